@@ -34,6 +34,23 @@ func main() {
 		os.Exit(1)
 	}
 
+	// reload configuration on sighup
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	go func() {
+		for {
+			select {
+			case <-hup:
+				if err := a.Reload(ctx); err != nil {
+					slog.Error("config reload failed, keeping previous configuration", "err", err)
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
 	slog.Info("agent starting")
 	if err := a.Run(ctx); err != nil && ctx.Err() == nil {
 		slog.Error("agent exited with error", "err", err)
@@ -1,9 +1,14 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"log/slog"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/reverseproxy/internal/relay"
 )
@@ -22,9 +27,45 @@ func main() {
 		os.Exit(1)
 	}
 
-	server := relay.NewServer(cfg)
-	if err := server.Run(); err != nil {
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	server, err := relay.NewServer(cfg)
+	if err != nil {
+		slog.Error("failed to create relay server", "err", err)
+		os.Exit(1)
+	}
+	runErr := make(chan error, 1)
+	go func() {
+		runErr <- server.Run()
+	}()
+
+	// reload configuration on sighup without dropping tunnels
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for running := true; running; {
+		select {
+		case err := <-runErr:
+			slog.Error("relay server exited with error", "err", err)
+			os.Exit(1)
+		case <-hup:
+			if _, err := server.Reload(); err != nil {
+				slog.Error("config reload failed, keeping previous configuration", "err", err)
+			}
+		case <-ctx.Done():
+			running = false
+		}
+	}
+
+	slog.Info("relay shutting down")
+	if err := server.Shutdown(context.Background()); err != nil {
+		slog.Warn("relay shutdown incomplete", "err", err)
+	}
+	if err := <-runErr; err != nil && !errors.Is(err, http.ErrServerClosed) {
 		slog.Error("relay server exited with error", "err", err)
 		os.Exit(1)
 	}
+	slog.Info("relay stopped")
 }
@@ -2,87 +2,229 @@ package agent
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"log/slog"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/reverseproxy/internal/relay"
 )
 
+// _instance identifies this agent process to the relay, which lets only
+// it move remote endpoints to a new tunnel while the old one is up.
+var _instance = _random_id()
+
+// _random_id returns a random hex identifier.
+func _random_id() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// errRelayDraining is returned by _run_tunnel when the relay asked the
+// tunnel to drain and a replacement should be connected straight away.
+var errRelayDraining = errors.New("relay is draining tunnel")
+
+// errReconfigured is returned by _run_tunnel when a config reload needs a
+// new tunnel. the old tunnel is handed back and kept serving until the
+// replacement is connected.
+var errReconfigured = errors.New("tunnel settings changed")
+
 // Agent manages the lifecycle of the tunnel connection to the relay,
 // including proxy verification and automatic reconnection.
 type Agent struct {
-	cfg    *Config
-	dialer *ProxyDialer
+	cfg     atomic.Pointer[Config]
+	dialer  atomic.Pointer[ProxyDialer]
+	handler *RequestHandler
+
+	// signalled when reloaded settings need a new tunnel
+	reconnect chan struct{}
+	reloadMu  sync.Mutex
+
+	// tunnels being drained, still finishing in-flight requests
+	retiring sync.WaitGroup
+
+	// endpoints the relay allocated to the latest tunnel
+	endpoints atomic.Pointer[[]relay.RemoteEndpoint]
+
+	// datagram counts of udp flows, across tunnels
+	udp *_udp_stats
+
+	// tcp, udp and tls passthrough settings, shared by every tunnel
+	streams atomic.Pointer[_stream_settings]
+}
+
+// _stream_settings is what tcp, udp and tls passthrough streams are
+// served with. reloads swap it without reconnecting; streams already
+// open keep the settings they started with.
+type _stream_settings struct {
+	tcp         TCPConfig
+	udp         UDPConfig
+	passthrough []_passthrough
+}
+
+// _new_stream_settings loads the stream settings of a configuration.
+func _new_stream_settings(cfg *Config) (*_stream_settings, error) {
+	passthrough, err := _load_passthrough(cfg.TLSPassthrough)
+	if err != nil {
+		return nil, err
+	}
+	return &_stream_settings{tcp: cfg.TCP, udp: cfg.UDP, passthrough: passthrough}, nil
 }
 
 // New creates a new agent from the given configuration.
 func New(cfg *Config) (*Agent, error) {
-	var dialer *ProxyDialer
-	if cfg.Proxy.URL != "" {
-		var err error
-		dialer, err = NewProxyDialer(cfg.Proxy.URL, cfg.Proxy.HealthTimeout)
-		if err != nil {
-			return nil, err
-		}
+	dialer, err := _new_dialer(cfg)
+	if err != nil {
+		return nil, err
+	}
+	streams, err := _new_stream_settings(cfg)
+	if err != nil {
+		return nil, err
+	}
+	handler, err := NewRequestHandler(cfg.Backend)
+	if err != nil {
+		return nil, err
+	}
+	a := &Agent{
+		handler:   handler,
+		reconnect: make(chan struct{}, 1),
+		udp:       &_udp_stats{},
 	}
-	return &Agent{cfg: cfg, dialer: dialer}, nil
+	a.cfg.Store(cfg)
+	a.dialer.Store(dialer)
+	a.streams.Store(streams)
+	return a, nil
+}
+
+// _new_dialer returns the proxy dialer for the configuration, or nil when
+// no proxy is configured.
+func _new_dialer(cfg *Config) (*ProxyDialer, error) {
+	if cfg.Proxy.URL == "" {
+		return nil, nil
+	}
+	return NewProxyDialer(cfg.Proxy.URL, cfg.Proxy.HealthTimeout)
 }
 
 // Run starts the agent. it verifies proxy routing, then enters the
 // reconnect loop. blocks until the context is cancelled.
 func (a *Agent) Run(ctx context.Context) error {
-	if a.dialer != nil && a.cfg.Proxy.VerifyRouting {
+	cfg := a._config()
+	if dialer := a.dialer.Load(); dialer != nil && cfg.Proxy.VerifyRouting {
 		slog.Info("verifying proxy routing before connecting")
-		if err := a._verify_proxy(ctx); err != nil {
+		if err := _verify_proxy(ctx, dialer, cfg); err != nil {
 			return err
 		}
 	}
 
-	return a._reconnect_loop(ctx)
+	if cfg.path != "" && cfg.Reload.WatchInterval > 0 {
+		go a._watch_config(ctx, cfg.path, cfg.Reload.WatchInterval)
+	}
+	if cfg.Metrics.Addr != "" {
+		go a._serve_metrics(ctx, cfg.Metrics.Addr)
+	}
+
+	err := a._reconnect_loop(ctx)
+	a.retiring.Wait()
+	a.handler.Close()
+	return err
+}
+
+// RemoteEndpoints returns the endpoints the relay allocated when the
+// current tunnel connected.
+func (a *Agent) RemoteEndpoints() []relay.RemoteEndpoint {
+	if endpoints := a.endpoints.Load(); endpoints != nil {
+		return *endpoints
+	}
+	return nil
+}
+
+// _config returns the configuration currently in effect.
+func (a *Agent) _config() *Config {
+	return a.cfg.Load()
 }
 
 // _verify_proxy checks that traffic is properly routed through the proxy.
-func (a *Agent) _verify_proxy(ctx context.Context) error {
-	verifier := NewVerifier(a.dialer, a.cfg.Proxy.HealthTimeout)
+func _verify_proxy(ctx context.Context, dialer *ProxyDialer, cfg *Config) error {
+	verifier := NewVerifier(dialer, cfg.Proxy.HealthTimeout)
 	return verifier.VerifyRouting(ctx)
 }
 
 // _reconnect_loop continuously attempts to connect and maintain the tunnel.
 func (a *Agent) _reconnect_loop(ctx context.Context) error {
-	delay := a.cfg.Tunnel.ReconnectDelay
+	delay := a._config().Tunnel.ReconnectDelay
+	// tunnel still serving while its replacement connects
+	var previous *Tunnel
 	for {
-		err := a._run_tunnel(ctx)
+		handoff, err := a._run_tunnel(ctx, previous)
+		previous = handoff
 		if ctx.Err() != nil {
+			if previous != nil {
+				a._drain_and_close(previous, "agent shutting down")
+			}
 			return ctx.Err()
 		}
+		if errors.Is(err, errRelayDraining) || errors.Is(err, errReconfigured) {
+			// overlap capacity: bring the replacement up while the old tunnel drains
+			slog.Info("connecting replacement tunnel", "reason", err)
+			delay = a._config().Tunnel.ReconnectDelay
+			continue
+		}
 
 		slog.Warn("tunnel disconnected, reconnecting", "err", err, "delay", delay)
 		select {
 		case <-time.After(delay):
 		case <-ctx.Done():
+			if previous != nil {
+				a._drain_and_close(previous, "agent shutting down")
+			}
 			return ctx.Err()
 		}
 
 		// exponential backoff
 		delay = delay * 2
-		if delay > a.cfg.Tunnel.MaxReconnectDelay {
-			delay = a.cfg.Tunnel.MaxReconnectDelay
+		if maxDelay := a._config().Tunnel.MaxReconnectDelay; delay > maxDelay {
+			delay = maxDelay
 		}
 	}
 }
 
 // _run_tunnel connects to the relay and processes frames until disconnection.
-func (a *Agent) _run_tunnel(ctx context.Context) error {
-	tunnel, err := ConnectTunnel(ctx, a.cfg, a.dialer)
+// once connected, previous (if any) is drained in the background. if the
+// connection fails, previous is handed back so it keeps serving.
+func (a *Agent) _run_tunnel(ctx context.Context, previous *Tunnel) (handoff *Tunnel, err error) {
+	// this connection already uses the latest settings
+	select {
+	case <-a.reconnect:
+	default:
+	}
+	cfg := a._config()
+	dialer := a.dialer.Load()
+	tunnel, err := ConnectTunnel(ctx, cfg, dialer, a.handler)
 	if err != nil {
-		return err
+		return previous, err
+	}
+	tunnel.udpStats = a.udp
+	tunnel.streams = &a.streams
+	endpoints := tunnel.RemoteEndpoints()
+	a.endpoints.Store(&endpoints)
+	if previous != nil {
+		a.retiring.Add(1)
+		go func() {
+			defer a.retiring.Done()
+			a._drain_and_close(previous, "agent reconnecting")
+		}()
 	}
-	defer tunnel.Close()
 
 	// start periodic proxy health checks if configured
 	var stopCheck func()
 	var checkFailed <-chan error
-	if a.dialer != nil && a.cfg.Proxy.RecheckInterval > 0 {
-		verifier := NewVerifier(a.dialer, a.cfg.Proxy.HealthTimeout)
-		stopCheck, checkFailed = StartPeriodicCheck(verifier, a.cfg.Proxy.RecheckInterval)
+	if dialer != nil && cfg.Proxy.RecheckInterval > 0 {
+		verifier := NewVerifier(dialer, cfg.Proxy.HealthTimeout)
+		stopCheck, checkFailed = StartPeriodicCheck(verifier, cfg.Proxy.RecheckInterval)
 		defer stopCheck()
 	}
 
@@ -92,16 +234,46 @@ func (a *Agent) _run_tunnel(ctx context.Context) error {
 		tunnelErr <- tunnel.Run()
 	}()
 
-	// wait for tunnel error, health check failure, or context cancellation
+	// wait for tunnel error, health check failure, relay drain, reload or context cancellation
 	select {
 	case err := <-tunnelErr:
-		return err
+		tunnel.Close()
+		return nil, err
+	case <-tunnel.RelayDraining():
+		a.retiring.Add(1)
+		go a._retire_tunnel(tunnel, tunnelErr)
+		return nil, errRelayDraining
+	case <-a.reconnect:
+		return tunnel, errReconfigured
 	case err := <-checkFailed:
 		slog.Error("proxy health check failed, closing tunnel", "err", err)
 		tunnel.Close()
-		return err
+		return nil, err
 	case <-ctx.Done():
-		tunnel.Close()
-		return ctx.Err()
+		a._drain_and_close(tunnel, "agent shutting down")
+		return nil, ctx.Err()
+	}
+}
+
+// _drain_and_close tells the relay to stop using a tunnel, waits for its
+// in-flight requests, then closes it.
+func (a *Agent) _drain_and_close(tunnel *Tunnel, reason string) {
+	if err := tunnel.Drain(reason, a._config().Tunnel.DrainTimeout); err != nil {
+		slog.Warn("agent tunnel did not drain cleanly", "err", err)
+	}
+	tunnel.Close()
+}
+
+// _retire_tunnel lets a tunnel the relay is draining finish its in-flight
+// requests, then closes it. the relay normally closes it first.
+func (a *Agent) _retire_tunnel(tunnel *Tunnel, tunnelErr <-chan error) {
+	defer a.retiring.Done()
+	timer := time.NewTimer(a._config().Tunnel.DrainTimeout)
+	defer timer.Stop()
+	select {
+	case <-tunnelErr:
+	case <-timer.C:
+		slog.Warn("relay did not close drained tunnel in time, closing it")
 	}
+	tunnel.Close()
 }
@@ -0,0 +1,134 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/reverseproxy/internal/relay"
+)
+
+// _err_no_backend is returned for requests no backend route matches.
+var _err_no_backend = errors.New("no backend route matches")
+
+// _picked is the backend target a request was sent to.
+type _picked struct {
+	pool   *_target_pool
+	target *_target
+}
+
+// _finish records the outcome of sending the request. on failure the
+// target is released; on success the caller releases it when done.
+func (p *_picked) _finish(ctx context.Context, err error) {
+	p.pool._result(ctx, p.target, err)
+	if err != nil {
+		p.target._release()
+	}
+}
+
+// _body releases the target once body is closed.
+func (p *_picked) _body(body io.ReadCloser) io.ReadCloser {
+	return &_released_body{ReadCloser: body, release: p.target._release}
+}
+
+// _backend_request builds the request to send to the backend serving req:
+// a target of the configured backend, or of the first matching route with
+// its path rewrite and header changes applied. the caller finishes the
+// returned target.
+func (h *RequestHandler) _backend_request(ctx context.Context, req *relay.TunnelledRequest, body io.Reader) (*http.Request, *_picked, error) {
+	backend := h.backend.Load()
+	pool, uri := backend.pool, req.URL
+	var route *BackendRouteConfig
+	if len(backend.cfg.Routes) > 0 {
+		u, err := url.ParseRequestURI(req.URL)
+		if err != nil {
+			return nil, nil, fmt.Errorf("parsing request url: %w", err)
+		}
+		i := _match_backend(backend.cfg.Routes, req.Method, req.Host, u.Path)
+		if i < 0 {
+			return nil, nil, fmt.Errorf("%w %s %s%s", _err_no_backend, req.Method, req.Host, u.Path)
+		}
+		route, pool = &backend.cfg.Routes[i], backend.routes[i]
+		if route.RewritePrefix != "" {
+			u.Path = _rewrite_prefix(u.Path, route.PathPrefix, route.RewritePrefix)
+			u.RawPath = ""
+			uri = u.RequestURI()
+		}
+	}
+	target, err := pool._pick()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, req.Method, target.url+uri, body)
+	if err != nil {
+		target._release()
+		return nil, nil, fmt.Errorf("creating backend request: %w", err)
+	}
+	for k, vs := range req.Headers {
+		for _, v := range vs {
+			httpReq.Header.Add(k, v)
+		}
+	}
+	if route != nil {
+		for _, k := range route.RemoveHeaders {
+			httpReq.Header.Del(k)
+		}
+		for k, v := range route.SetHeaders {
+			httpReq.Header.Set(k, v)
+		}
+	}
+	httpReq.Host = pool._host_header(httpReq.URL, req.Host)
+	return httpReq, &_picked{pool: pool, target: target}, nil
+}
+
+// _match_backend returns the index of the first route matching the
+// request, -1 if none does.
+func _match_backend(routes []BackendRouteConfig, method, host, path string) int {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	for i := range routes {
+		r := &routes[i]
+		if r.Host != "" && !relay.MatchHost(r.Host, host) {
+			continue
+		}
+		if r.PathPrefix != "" && !relay.HasPathPrefix(path, r.PathPrefix) {
+			continue
+		}
+		if len(r.Methods) > 0 && !slices.Contains(r.Methods, method) {
+			continue
+		}
+		return i
+	}
+	return -1
+}
+
+// _rewrite_prefix replaces prefix at the start of path with rewrite,
+// keeping the result an absolute path and the slash after the prefix.
+func _rewrite_prefix(path, prefix, rewrite string) string {
+	path = strings.TrimSuffix(rewrite, "/") + strings.TrimPrefix(path, strings.TrimSuffix(prefix, "/"))
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return path
+}
+
+// _backend_error returns the status and message a failed backend request
+// is answered with.
+func _backend_error(err error) (int, string) {
+	if errors.Is(err, _err_no_backend) {
+		return http.StatusNotFound, err.Error()
+	}
+	if errors.Is(err, _err_no_healthy_target) {
+		return http.StatusServiceUnavailable, err.Error()
+	}
+	return http.StatusBadGateway, "backend error: " + err.Error()
+}
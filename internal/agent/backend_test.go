@@ -0,0 +1,47 @@
+package agent
+
+import "testing"
+
+func Test_backend_path_prefix_matches_whole_segments(t *testing.T) {
+	routes := []BackendRouteConfig{
+		{PathPrefix: "/api"},
+		{PathPrefix: "/static/"},
+		{Host: "*.example.com", Methods: []string{"POST"}},
+	}
+	for _, tc := range []struct {
+		method, host, path string
+		want               int
+	}{
+		{"GET", "app.test", "/api", 0},
+		{"GET", "app.test", "/api/", 0},
+		{"GET", "app.test", "/api/users", 0},
+		{"GET", "app.test", "/apis", -1},
+		{"GET", "app.test", "/api-v2/users", -1},
+		{"GET", "app.test", "/static/app.js", 1},
+		{"GET", "app.test", "/static", -1},
+		{"GET", "app.test", "/staticfiles", -1},
+		{"POST", "www.example.com:8080", "/apis", 2},
+		{"GET", "www.example.com", "/apis", -1},
+	} {
+		if got := _match_backend(routes, tc.method, tc.host, tc.path); got != tc.want {
+			t.Errorf("%s %s%s: matched route %d, want %d", tc.method, tc.host, tc.path, got, tc.want)
+		}
+	}
+}
+
+func Test_backend_rewrite_prefix(t *testing.T) {
+	for _, tc := range []struct {
+		path, prefix, rewrite, want string
+	}{
+		{"/api", "/api", "/", "/"},
+		{"/api/users", "/api", "/", "/users"},
+		{"/api/users", "/api", "/v1", "/v1/users"},
+		{"/api/users", "/api/", "/v1/", "/v1/users"},
+		{"/api/", "/api/", "/", "/"},
+		{"/users", "/", "/v1", "/v1/users"},
+	} {
+		if got := _rewrite_prefix(tc.path, tc.prefix, tc.rewrite); got != tc.want {
+			t.Errorf("%s with %s -> %s: got %q, want %q", tc.path, tc.prefix, tc.rewrite, got, tc.want)
+		}
+	}
+}
@@ -2,9 +2,15 @@ package agent
 
 import (
 	"fmt"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
+	"golang.org/x/net/http/httpguts"
 	"gopkg.in/yaml.v3"
 )
 
@@ -15,11 +21,25 @@ type Config struct {
 	Backend BackendConfig `yaml:"backend"`
 	Auth    AuthConfig    `yaml:"auth"`
 	Tunnel  TunnelConfig  `yaml:"tunnel"`
+	Reload  ReloadConfig  `yaml:"reload"`
+	TCP     TCPConfig     `yaml:"tcp"`
+	UDP     UDPConfig     `yaml:"udp"`
+	Metrics MetricsConfig `yaml:"metrics"`
+
+	RemoteForwards []RemoteForwardConfig  `yaml:"remote_forwards"`
+	TLSPassthrough []TLSPassthroughConfig `yaml:"tls_passthrough"`
+
+	// file the configuration was loaded from, for reloads
+	path string
 }
 
-// RelayConfig specifies the relay server websocket endpoint.
+// RelayConfig specifies the relay server websocket endpoint and the
+// agent group this agent serves. name identifies the agent to the
+// relay's remote endpoint policy and defaults to the hostname.
 type RelayConfig struct {
-	URL string `yaml:"url"`
+	URL   string `yaml:"url"`
+	Group string `yaml:"group"`
+	Name  string `yaml:"name"`
 }
 
 // ProxyConfig controls the residential proxy settings.
@@ -30,9 +50,127 @@ type ProxyConfig struct {
 	RecheckInterval time.Duration `yaml:"recheck_interval"`
 }
 
-// BackendConfig specifies the local backend target.
+// BackendConfig specifies the local backend target. target_url and
+// targets may be unix:///path/to.sock for a service on a unix socket.
 type BackendConfig struct {
 	TargetURL string `yaml:"target_url"`
+	// serves requests in-process instead of target_url or targets, for
+	// programs embedding the agent. kept across reloads
+	Handler http.Handler `yaml:"-"`
+	// replicas to balance across instead of target_url
+	Targets     []string               `yaml:"targets"`
+	Balance     string                 `yaml:"balance"`
+	HealthCheck HealthCheckConfig      `yaml:"health_check"`
+	TLS         BackendTLSConfig       `yaml:"tls"`
+	HTTP2       string                 `yaml:"http2"`
+	Transport   BackendTransportConfig `yaml:"transport"`
+	HostHeader  string                 `yaml:"host_header"`
+	// longest gap between body reads of a streamed response, 0 for none
+	StreamIdleTimeout time.Duration `yaml:"stream_idle_timeout"`
+	// when set, requests go to the first matching route and target_url
+	// is unused; requests matching none are answered 404
+	Routes []BackendRouteConfig `yaml:"routes"`
+}
+
+// BackendRouteConfig sends matching requests to target_url, or balances
+// them across targets. empty match fields match anything, and a leading
+// "*." in host matches one extra label. rewrite_prefix replaces
+// path_prefix in the forwarded path; set_headers and remove_headers
+// adjust the forwarded headers.
+type BackendRouteConfig struct {
+	Host          string                 `yaml:"host"`
+	PathPrefix    string                 `yaml:"path_prefix"`
+	Methods       []string               `yaml:"methods"`
+	TargetURL     string                 `yaml:"target_url"`
+	Targets       []string               `yaml:"targets"`
+	Balance       string                 `yaml:"balance"`
+	HealthCheck   HealthCheckConfig      `yaml:"health_check"`
+	TLS           BackendTLSConfig       `yaml:"tls"`
+	HTTP2         string                 `yaml:"http2"`
+	Transport     BackendTransportConfig `yaml:"transport"`
+	HostHeader    string                 `yaml:"host_header"`
+	RewritePrefix string                 `yaml:"rewrite_prefix"`
+	SetHeaders    map[string]string      `yaml:"set_headers"`
+	RemoveHeaders []string               `yaml:"remove_headers"`
+}
+
+// BackendTLSConfig controls how https targets are reached: ca_file
+// replaces the system roots, client_cert and client_key are presented to
+// services requiring mutual tls, and server_name overrides the name sent
+// and verified. insecure_skip_verify turns verification off entirely.
+type BackendTLSConfig struct {
+	CAFile             string `yaml:"ca_file"`
+	ClientCert         string `yaml:"client_cert"`
+	ClientKey          string `yaml:"client_key"`
+	ServerName         string `yaml:"server_name"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+}
+
+// BackendTransportConfig tunes the connections to a backend's http and
+// https targets. zero values keep the defaults.
+type BackendTransportConfig struct {
+	DialTimeout           time.Duration `yaml:"dial_timeout"`
+	TLSHandshakeTimeout   time.Duration `yaml:"tls_handshake_timeout"`
+	ResponseHeaderTimeout time.Duration `yaml:"response_header_timeout"`
+	IdleConnTimeout       time.Duration `yaml:"idle_conn_timeout"`
+	RequestTimeout        time.Duration `yaml:"request_timeout"`
+	MaxIdleConns          int           `yaml:"max_idle_conns"`
+	MaxIdleConnsPerHost   int           `yaml:"max_idle_conns_per_host"`
+	MaxConnsPerHost       int           `yaml:"max_conns_per_host"`
+}
+
+// HealthCheckConfig decides which targets of a backend get requests.
+// with path set, each target is probed every interval and taken out after
+// unhealthy_threshold failed probes in a row, back after
+// healthy_threshold good ones; a probe is good if it answers
+// expected_status, or any 2xx when that is 0. with eject_after set, a
+// target whose requests fail to connect that many times in a row is
+// taken out for eject_for.
+type HealthCheckConfig struct {
+	Path               string        `yaml:"path"`
+	Interval           time.Duration `yaml:"interval"`
+	Timeout            time.Duration `yaml:"timeout"`
+	ExpectedStatus     int           `yaml:"expected_status"`
+	HealthyThreshold   int           `yaml:"healthy_threshold"`
+	UnhealthyThreshold int           `yaml:"unhealthy_threshold"`
+	EjectAfter         int           `yaml:"eject_after"`
+	EjectFor           time.Duration `yaml:"eject_for"`
+}
+
+// TCPConfig controls which targets the relay may open raw tcp streams
+// to. allow entries are host:port; the host may be a cidr and the port
+// "*". with no entries every tcp stream is refused.
+type TCPConfig struct {
+	Allow []string `yaml:"allow"`
+	// dial targets through the proxy rather than directly
+	ViaProxy bool `yaml:"via_proxy"`
+}
+
+// UDPConfig controls which targets the relay may open udp flows to,
+// matched like tcp.allow. a flow ends after idle_timeout without
+// datagrams either way.
+type UDPConfig struct {
+	Allow       []string      `yaml:"allow"`
+	IdleTimeout time.Duration `yaml:"idle_timeout"`
+}
+
+// RemoteForwardConfig asks the relay for a public endpoint when the
+// tunnel connects: a tcp port spliced to target, or a subdomain whose
+// requests go to the backend. port 0 or an empty subdomain lets the relay
+// choose.
+type RemoteForwardConfig struct {
+	Type      string `yaml:"type"`
+	Port      int    `yaml:"port"`
+	Subdomain string `yaml:"subdomain"`
+	Target    string `yaml:"target"`
+}
+
+// Request returns the endpoint request sent to the relay.
+func (f *RemoteForwardConfig) Request() string {
+	if f.Type == "tcp" {
+		return "tcp:" + strconv.Itoa(f.Port)
+	}
+	return "http:" + f.Subdomain
 }
 
 // AuthConfig holds the shared secret for hmac authentication.
@@ -40,11 +178,40 @@ type AuthConfig struct {
 	SharedSecret string `yaml:"shared_secret"`
 }
 
-// TunnelConfig controls reconnection and keepalive behaviour.
+// TunnelConfig controls reconnection, keepalive and shutdown behaviour.
 type TunnelConfig struct {
 	ReconnectDelay    time.Duration `yaml:"reconnect_delay"`
 	MaxReconnectDelay time.Duration `yaml:"max_reconnect_delay"`
 	PingInterval      time.Duration `yaml:"ping_interval"`
+	DrainTimeout      time.Duration `yaml:"drain_timeout"`
+	// concurrent streams advertised to the relay; extra streams are refused.
+	// 0 means no limit
+	MaxStreams int `yaml:"max_streams"`
+}
+
+// ReloadConfig controls how configuration changes are picked up. sighup
+// always triggers a reload.
+type ReloadConfig struct {
+	WatchInterval time.Duration `yaml:"watch_interval"`
+}
+
+// MetricsConfig serves prometheus metrics at /metrics on an optional
+// listener. a bearer token is required whenever it listens.
+type MetricsConfig struct {
+	Addr  string `yaml:"addr"`
+	Token string `yaml:"token"`
+}
+
+// TLSPassthroughConfig serves tls connections the relay passed through
+// undecrypted for server names matching host, where a leading "*."
+// matches one extra label. target gets the raw tls bytes, or the
+// plaintext if cert_file and key_file are set for the agent to terminate
+// tls itself.
+type TLSPassthroughConfig struct {
+	Host     string `yaml:"host"`
+	Target   string `yaml:"target"`
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
 }
 
 // LoadConfig reads and parses an agent configuration file.
@@ -54,7 +221,7 @@ func LoadConfig(path string) (*Config, error) {
 		return nil, fmt.Errorf("reading config file: %w", err)
 	}
 	cfg := &Config{
-		Backend: BackendConfig{TargetURL: "http://127.0.0.1:8080"},
+		Backend: BackendConfig{TargetURL: "http://127.0.0.1:8080", StreamIdleTimeout: 5 * time.Minute},
 		Proxy: ProxyConfig{
 			VerifyRouting:   true,
 			HealthTimeout:   10 * time.Second,
@@ -64,16 +231,133 @@ func LoadConfig(path string) (*Config, error) {
 			ReconnectDelay:    2 * time.Second,
 			MaxReconnectDelay: 60 * time.Second,
 			PingInterval:      15 * time.Second,
+			DrainTimeout:      30 * time.Second,
+			MaxStreams:        100,
 		},
+		Reload: ReloadConfig{WatchInterval: 10 * time.Second},
+		UDP:    UDPConfig{IdleTimeout: 60 * time.Second},
 	}
 	if err := yaml.Unmarshal(data, cfg); err != nil {
 		return nil, fmt.Errorf("parsing config: %w", err)
 	}
+	cfg.path = path
 	if cfg.Relay.URL == "" {
 		return nil, fmt.Errorf("relay.url is required")
 	}
 	if cfg.Auth.SharedSecret == "" {
 		return nil, fmt.Errorf("auth.shared_secret is required")
 	}
+	if cfg.Tunnel.MaxStreams < 0 {
+		return nil, fmt.Errorf("tunnel.max_streams must not be negative")
+	}
+	if cfg.Metrics.Addr != "" && cfg.Metrics.Token == "" {
+		return nil, fmt.Errorf("metrics.token is required when metrics.addr is set")
+	}
+	if cfg.Relay.Name == "" {
+		cfg.Relay.Name, _ = os.Hostname()
+	}
+	for i, f := range cfg.RemoteForwards {
+		switch f.Type {
+		case "tcp":
+			if _, _, err := net.SplitHostPort(f.Target); err != nil {
+				return nil, fmt.Errorf("remote_forwards[%d].target must be host:port", i)
+			}
+			if f.Port < 0 || f.Port > 65535 {
+				return nil, fmt.Errorf("remote_forwards[%d].port is out of range", i)
+			}
+		case "http":
+		default:
+			return nil, fmt.Errorf("remote_forwards[%d].type must be tcp or http", i)
+		}
+	}
+	for i, entry := range cfg.TCP.Allow {
+		if _, _, err := net.SplitHostPort(entry); err != nil {
+			return nil, fmt.Errorf("tcp.allow[%d] must be host:port: %w", i, err)
+		}
+	}
+	for i, entry := range cfg.UDP.Allow {
+		if _, _, err := net.SplitHostPort(entry); err != nil {
+			return nil, fmt.Errorf("udp.allow[%d] must be host:port: %w", i, err)
+		}
+	}
+	if err := _check_targets("backend", cfg.Backend.TargetURL, cfg.Backend.Targets, cfg.Backend.Balance); err != nil {
+		return nil, err
+	}
+	if err := _check_transport("backend", cfg.Backend.TLS, cfg.Backend.HTTP2, cfg.Backend.Transport, cfg.Backend.HostHeader); err != nil {
+		return nil, err
+	}
+	for i := range cfg.Backend.Routes {
+		r := &cfg.Backend.Routes[i]
+		name := fmt.Sprintf("backend.routes[%d]", i)
+		if err := _check_targets(name, r.TargetURL, r.Targets, r.Balance); err != nil {
+			return nil, err
+		}
+		if err := _check_transport(name, r.TLS, r.HTTP2, r.Transport, r.HostHeader); err != nil {
+			return nil, err
+		}
+		if r.RewritePrefix != "" && r.PathPrefix == "" {
+			return nil, fmt.Errorf("backend.routes[%d].rewrite_prefix needs path_prefix", i)
+		}
+		r.Host = strings.ToLower(r.Host)
+		for j, m := range r.Methods {
+			r.Methods[j] = strings.ToUpper(m)
+		}
+	}
+	for i, p := range cfg.TLSPassthrough {
+		if p.Host == "" {
+			return nil, fmt.Errorf("tls_passthrough[%d].host is required", i)
+		}
+		if _, _, err := net.SplitHostPort(p.Target); err != nil {
+			return nil, fmt.Errorf("tls_passthrough[%d].target must be host:port", i)
+		}
+		if (p.CertFile == "") != (p.KeyFile == "") {
+			return nil, fmt.Errorf("tls_passthrough[%d] needs both cert_file and key_file", i)
+		}
+	}
+	if cfg.UDP.IdleTimeout <= 0 {
+		return nil, fmt.Errorf("udp.idle_timeout must be positive")
+	}
 	return cfg, nil
 }
+
+// _check_targets validates the targets of a backend or backend route.
+func _check_targets(name, targetURL string, targets []string, balance string) error {
+	if len(targets) == 0 {
+		targets = []string{targetURL}
+	}
+	for _, target := range targets {
+		if _, ok := _unix_socket(target); ok {
+			continue
+		}
+		if u, err := url.Parse(target); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("%s: target %q must be an http, https or unix url", name, target)
+		}
+	}
+	if balance != "" && balance != _balance_round_robin && balance != _balance_least_conn {
+		return fmt.Errorf("%s.balance must be %s or %s", name, _balance_round_robin, _balance_least_conn)
+	}
+	return nil
+}
+
+// _check_transport validates how a backend or backend route is spoken
+// to. the tls files are loaded when the backend is applied.
+func _check_transport(name string, c BackendTLSConfig, http2 string, t BackendTransportConfig, hostHeader string) error {
+	if (c.ClientCert == "") != (c.ClientKey == "") {
+		return fmt.Errorf("%s.tls needs both client_cert and client_key", name)
+	}
+	switch http2 {
+	case "", _http2_auto, _http2_off, _http2_always:
+	default:
+		return fmt.Errorf("%s.http2 must be %s, %s or %s", name, _http2_auto, _http2_off, _http2_always)
+	}
+	if t.DialTimeout < 0 || t.TLSHandshakeTimeout < 0 || t.ResponseHeaderTimeout < 0 || t.IdleConnTimeout < 0 || t.RequestTimeout < 0 {
+		return fmt.Errorf("%s.transport timeouts must not be negative", name)
+	}
+	if t.MaxIdleConns < 0 || t.MaxIdleConnsPerHost < 0 || t.MaxConnsPerHost < 0 {
+		return fmt.Errorf("%s.transport connection limits must not be negative", name)
+	}
+	if !httpguts.ValidHostHeader(hostHeader) {
+		return fmt.Errorf("%s.host_header %q is not a valid host", name, hostHeader)
+	}
+	return nil
+}
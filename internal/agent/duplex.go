@@ -0,0 +1,88 @@
+package agent
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+
+	"github.com/reverseproxy/internal/protocol"
+	"github.com/reverseproxy/internal/relay"
+)
+
+// grpc status trailers, which a backend may send in the response head
+// when it fails before any message.
+var _grpc_status_headers = []string{"Grpc-Status", "Grpc-Message", "Grpc-Status-Details-Bin"}
+
+// _duplex_stream serves a request whose body arrives as stream data while
+// the response streams back, followed by its trailers. only the backend's
+// idle timeout applies.
+func (t *Tunnel) _duplex_stream(streamID uint32, req *relay.TunnelledRequest, in <-chan *protocol.Frame) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	body, pw := io.Pipe()
+	defer body.Close()
+	go _pipe_stream(ctx, in, pw, cancel)
+
+	resp, err := t.handler.DoDuplex(ctx, req, body)
+	if err != nil {
+		if ctx.Err() != nil {
+			t._send(&protocol.Frame{Type: protocol.TypeStreamReset, StreamID: streamID})
+			return
+		}
+		slog.Error("duplex request to backend failed", "stream", streamID, "err", err)
+		t._send_stream_error(streamID, err)
+		return
+	}
+	defer resp.Body.Close()
+
+	head := _response_head(resp)
+	// a trailers-only answer must still end in trailers for the client
+	trailers := make(http.Header)
+	for _, k := range _grpc_status_headers {
+		if vs := head.Headers.Values(k); len(vs) > 0 {
+			trailers[k] = vs
+			head.Headers.Del(k)
+		}
+	}
+	if !t._send_stream_head(streamID, head) {
+		return
+	}
+	r := _new_idle_reader(resp.Body, t.handler.Backend().StreamIdleTimeout, cancel)
+	defer r.Stop()
+	err = protocol.CopyToStream(r, streamID, t._send)
+	for k, vs := range resp.Trailer {
+		trailers[k] = append(trailers[k], vs...)
+	}
+	t._send_stream_end(streamID, err, trailers)
+}
+
+// _pipe_stream feeds a stream's data frames into a request body, which
+// ends when the relay half-closes the stream. a reset or a lost tunnel
+// abandons the request; it returns once ctx ends.
+func _pipe_stream(ctx context.Context, in <-chan *protocol.Frame, pw *io.PipeWriter, cancel context.CancelFunc) {
+	for {
+		select {
+		case f, ok := <-in:
+			if !ok {
+				pw.CloseWithError(protocol.ErrStreamLost)
+				cancel()
+				return
+			}
+			switch f.Type {
+			case protocol.TypeStreamData:
+				// a failed write means the backend stopped reading; keep draining
+				pw.Write(f.Payload)
+			case protocol.TypeStreamClose:
+				pw.Close()
+			case protocol.TypeStreamReset:
+				pw.CloseWithError(protocol.ErrStreamReset)
+				cancel()
+				return
+			}
+		case <-ctx.Done():
+			pw.CloseWithError(ctx.Err())
+			return
+		}
+	}
+}
@@ -1,12 +1,19 @@
 package agent
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log/slog"
+	"mime"
+	"net"
 	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/reverseproxy/internal/relay"
@@ -14,70 +21,208 @@ import (
 
 // RequestHandler processes tunnelled requests against the local backend.
 type RequestHandler struct {
-	targetURL string
-	client    *http.Client
+	backend atomic.Pointer[_backend_state]
+	// serialises backend changes
+	backendMu sync.Mutex
+
+	// closed and replaced whenever backend health may have changed
+	healthMu      sync.Mutex
+	healthChanged chan struct{}
+}
+
+// _backend_state is the backend settings in effect and the target pools
+// built from them: one for target_url or targets, or one per route.
+type _backend_state struct {
+	cfg    BackendConfig
+	pool   *_target_pool
+	routes []*_target_pool
+}
+
+// _pools returns every target pool in use.
+func (s *_backend_state) _pools() []*_target_pool {
+	if s.pool != nil {
+		return []*_target_pool{s.pool}
+	}
+	return s.routes
 }
 
-// NewRequestHandler creates a handler targeting the given backend url.
-func NewRequestHandler(targetURL string) *RequestHandler {
-	return &RequestHandler{
-		targetURL: targetURL,
-		client: &http.Client{
-			Timeout: 30 * time.Second,
-		},
+// NewRequestHandler creates a handler for the given backend.
+func NewRequestHandler(cfg BackendConfig) (*RequestHandler, error) {
+	h := &RequestHandler{healthChanged: make(chan struct{})}
+	if err := h.SetBackend(cfg); err != nil {
+		return nil, err
 	}
+	return h, nil
 }
 
-// HandleRequest deserialises a tunnelled request, executes it against
-// the backend, and returns the serialised response.
-func (h *RequestHandler) HandleRequest(data []byte) ([]byte, error) {
+// SetBackend changes the backend settings. requests already in flight
+// finish against the previous target; health checks start afresh. if
+// tls files cannot be loaded nothing changes.
+func (h *RequestHandler) SetBackend(cfg BackendConfig) error {
+	pools := []_pool_config{{
+		name: "backend", targetURL: cfg.TargetURL, targets: cfg.Targets, handler: cfg.Handler,
+		balance: cfg.Balance, check: cfg.HealthCheck, tlsFiles: cfg.TLS, http2: cfg.HTTP2,
+		transport: cfg.Transport, hostHeader: cfg.HostHeader,
+	}}
+	if len(cfg.Routes) > 0 {
+		pools = nil
+		for i, r := range cfg.Routes {
+			pools = append(pools, _pool_config{
+				name: fmt.Sprintf("backend.routes[%d]", i), targetURL: r.TargetURL, targets: r.Targets,
+				balance: r.Balance, check: r.HealthCheck, tlsFiles: r.TLS, http2: r.HTTP2,
+				transport: r.Transport, hostHeader: r.HostHeader,
+			})
+		}
+	}
+	for i := range pools {
+		var err error
+		if pools[i].tls, err = _load_backend_tls(pools[i].name, pools[i].tlsFiles); err != nil {
+			return err
+		}
+	}
+
+	h.backendMu.Lock()
+	defer h.backendMu.Unlock()
+	next := &_backend_state{cfg: cfg}
+	for _, c := range pools {
+		next.routes = append(next.routes, _new_target_pool(c, h._health_changed))
+	}
+	if len(cfg.Routes) == 0 {
+		next.pool, next.routes = next.routes[0], nil
+	}
+	if previous := h.backend.Swap(next); previous != nil {
+		for _, p := range previous._pools() {
+			p._close()
+		}
+	}
+	h._health_changed()
+	return nil
+}
+
+// Backend returns the backend settings in effect.
+func (h *RequestHandler) Backend() *BackendConfig {
+	return &h.backend.Load().cfg
+}
+
+// Close stops the backend health checks.
+func (h *RequestHandler) Close() {
+	h.backendMu.Lock()
+	defer h.backendMu.Unlock()
+	for _, p := range h.backend.Load()._pools() {
+		p._close()
+	}
+}
+
+// Healthy reports whether any backend has a target in rotation. changed
+// is closed the next time that may change.
+func (h *RequestHandler) Healthy() (healthy bool, changed <-chan struct{}) {
+	h.healthMu.Lock()
+	changed = h.healthChanged
+	h.healthMu.Unlock()
+	for _, p := range h.backend.Load()._pools() {
+		if p._healthy() {
+			return true, changed
+		}
+	}
+	return false, changed
+}
+
+// _health_changed wakes those waiting on Healthy.
+func (h *RequestHandler) _health_changed() {
+	h.healthMu.Lock()
+	close(h.healthChanged)
+	h.healthChanged = make(chan struct{})
+	h.healthMu.Unlock()
+}
+
+// Do deserialises a tunnelled request and executes it against the
+// backend, returning once the response head arrives. the caller reads and
+// closes the body; cancelling ctx abandons the request. start is called
+// with the request timeout of the backend picked before it is sent.
+func (h *RequestHandler) Do(ctx context.Context, data []byte, start func(timeout time.Duration)) (*http.Response, error) {
 	var req relay.TunnelledRequest
 	if err := json.Unmarshal(data, &req); err != nil {
 		return nil, fmt.Errorf("unmarshalling request: %w", err)
 	}
 
-	backendURL := h.targetURL + req.URL
-	slog.Debug("forwarding request to backend", "method", req.Method, "url", backendURL)
-
 	var bodyReader io.Reader
 	if len(req.Body) > 0 {
 		bodyReader = bytes.NewReader(req.Body)
 	}
+	httpReq, picked, err := h._backend_request(ctx, &req, bodyReader)
+	if err != nil {
+		return nil, err
+	}
+	slog.Debug("forwarding request to backend", "method", req.Method, "url", httpReq.URL)
 
-	httpReq, err := http.NewRequest(req.Method, backendURL, bodyReader)
+	start(picked.pool.requestTimeout)
+	resp, err := picked.pool._client(picked.target).Do(httpReq)
+	picked._finish(ctx, err)
 	if err != nil {
-		return nil, fmt.Errorf("creating backend request: %w", err)
+		return nil, fmt.Errorf("executing backend request: %w", err)
 	}
+	resp.Body = picked._body(resp.Body)
+	return resp, nil
+}
 
-	for k, v := range req.Headers {
-		httpReq.Header.Set(k, v)
+// DoDuplex executes a request over http/2 while its body is still being
+// written, as grpc needs, and returns once the response head arrives.
+// plain http backends are spoken to with h2c.
+func (h *RequestHandler) DoDuplex(ctx context.Context, req *relay.TunnelledRequest, body io.Reader) (*http.Response, error) {
+	httpReq, picked, err := h._backend_request(ctx, req, body)
+	if err != nil {
+		return nil, err
 	}
-	// override host to match the backend
-	httpReq.Host = httpReq.URL.Host
+	slog.Debug("streaming request to backend", "method", req.Method, "url", httpReq.URL)
 
-	resp, err := h.client.Do(httpReq)
+	resp, err := picked.pool._duplex_transport(picked.target, httpReq.URL.Scheme).RoundTrip(httpReq)
+	picked._finish(ctx, err)
 	if err != nil {
 		return nil, fmt.Errorf("executing backend request: %w", err)
 	}
-	defer resp.Body.Close()
+	resp.Body = picked._body(resp.Body)
+	return resp, nil
+}
+
+// _deadline cancels a request once its backend's request timeout passes,
+// from when it is started.
+type _deadline struct {
+	cancel  context.CancelFunc
+	timeout time.Duration
+	timer   *time.Timer
+}
+
+// _start arms the deadline.
+func (d *_deadline) _start(timeout time.Duration) {
+	d.timeout = timeout
+	d.timer = time.AfterFunc(timeout, d.cancel)
+}
+
+// _stop disarms the deadline, reporting false if it already fired.
+func (d *_deadline) _stop() bool {
+	return d.timer == nil || d.timer.Stop()
+}
 
+// _is_streamed reports whether a response should reach the client as it
+// arrives rather than once complete: event streams, and bodies of unknown
+// length such as chunked long polls.
+func _is_streamed(resp *http.Response) bool {
+	if resp.ContentLength < 0 {
+		return true
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return mediaType == "text/event-stream"
+}
+
+// _buffered_response reads a backend response in full and serialises it.
+func _buffered_response(resp *http.Response) ([]byte, error) {
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
 		return nil, fmt.Errorf("reading backend response: %w", err)
 	}
 
-	headers := make(map[string]string)
-	for k, v := range resp.Header {
-		if len(v) > 0 {
-			headers[k] = v[0]
-		}
-	}
-
-	tunnelledResp := relay.TunnelledResponse{
-		StatusCode: resp.StatusCode,
-		Headers:    headers,
-		Body:       body,
-	}
+	tunnelledResp := _response_head(resp)
+	tunnelledResp.Body = body
 
 	responseData, err := json.Marshal(tunnelledResp)
 	if err != nil {
@@ -86,11 +231,119 @@ func (h *RequestHandler) HandleRequest(data []byte) ([]byte, error) {
 	return responseData, nil
 }
 
+// _idle_reader cancels a streamed response that goes quiet for too long.
+type _idle_reader struct {
+	r     io.Reader
+	timer *time.Timer
+	idle  time.Duration
+}
+
+// _new_idle_reader wraps r so cancel runs after idle passes without a
+// read returning data. idle 0 leaves r unbounded.
+func _new_idle_reader(r io.Reader, idle time.Duration, cancel func()) *_idle_reader {
+	ir := &_idle_reader{r: r, idle: idle}
+	if idle > 0 {
+		ir.timer = time.AfterFunc(idle, cancel)
+	}
+	return ir
+}
+
+func (r *_idle_reader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 && r.timer != nil {
+		r.timer.Reset(r.idle)
+	}
+	return n, err
+}
+
+// Stop releases the idle timer.
+func (r *_idle_reader) Stop() {
+	if r.timer != nil {
+		r.timer.Stop()
+	}
+}
+
+// DialUpgrade sends an upgrade request to the backend over a connection
+// of its own and reads the answer. on success the caller owns conn; when
+// the backend switches protocols, br holds any bytes it sent after the
+// response head.
+func (h *RequestHandler) DialUpgrade(req *relay.TunnelledRequest) (net.Conn, *bufio.Reader, *http.Response, error) {
+	ctx := context.Background()
+	httpReq, picked, err := h._backend_request(ctx, req, bytes.NewReader(req.Body))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	slog.Debug("upgrading backend connection", "method", req.Method, "url", httpReq.URL)
+
+	conn, br, resp, err := picked.pool._dial_upgrade(httpReq, picked.target.dial)
+	picked._finish(ctx, err)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return &_released_conn{Conn: conn, release: picked.target._release}, br, resp, nil
+}
+
+// _dial_upgrade connects to the backend, through dial when set, and
+// exchanges the upgrade request and response.
+func (p *_target_pool) _dial_upgrade(httpReq *http.Request, dial func(ctx context.Context) (net.Conn, error)) (net.Conn, *bufio.Reader, *http.Response, error) {
+	addr := httpReq.URL.Host
+	if httpReq.URL.Port() == "" {
+		port := "80"
+		if httpReq.URL.Scheme == "https" {
+			port = "443"
+		}
+		addr = net.JoinHostPort(httpReq.URL.Hostname(), port)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), p.requestTimeout)
+	defer cancel()
+	var conn net.Conn
+	var err error
+	switch {
+	case dial != nil:
+		conn, err = dial(ctx)
+	case httpReq.URL.Scheme == "https":
+		cfg := &tls.Config{}
+		if p.tls != nil {
+			cfg = p.tls.Clone()
+		}
+		if cfg.ServerName == "" {
+			cfg.ServerName = httpReq.URL.Hostname()
+		}
+		conn, err = p._dial_tls(ctx, "tcp", addr, cfg)
+	default:
+		conn, err = p.dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("dialing backend: %w", err)
+	}
+
+	// bound the handshake; the upgraded connection has no deadline
+	conn.SetDeadline(time.Now().Add(p.requestTimeout))
+	if err := httpReq.Write(conn); err != nil {
+		conn.Close()
+		return nil, nil, nil, fmt.Errorf("writing backend request: %w", err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, httpReq)
+	if err != nil {
+		conn.Close()
+		return nil, nil, nil, fmt.Errorf("reading backend response: %w", err)
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, br, resp, nil
+}
+
+// _response_head converts a backend response's status and headers for
+// the relay, leaving the body to follow separately.
+func _response_head(resp *http.Response) *relay.TunnelledResponse {
+	return &relay.TunnelledResponse{StatusCode: resp.StatusCode, Headers: resp.Header.Clone()}
+}
+
 // _error_response creates a serialised error response with the given status and message.
 func _error_response(status int, message string) []byte {
 	resp := relay.TunnelledResponse{
 		StatusCode: status,
-		Headers:    map[string]string{"Content-Type": "text/plain"},
+		Headers:    http.Header{"Content-Type": {"text/plain"}},
 		Body:       []byte(message),
 	}
 	data, _ := json.Marshal(resp)
@@ -0,0 +1,126 @@
+package agent
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// _local_host is the host requests to unix socket and in-process targets
+// are addressed to.
+const _local_host = "localhost"
+
+// _new_target returns the target for a configured url. unix:// urls name
+// a socket the target is reached through.
+func _new_target(target string) *_target {
+	if path, ok := _unix_socket(target); ok {
+		t := &_target{url: "http://" + _local_host}
+		t._dial_with(func(ctx context.Context) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		})
+		return t
+	}
+	return &_target{url: strings.TrimSuffix(target, "/")}
+}
+
+// _unix_socket returns the socket path of a unix:// url.
+func _unix_socket(target string) (string, bool) {
+	u, err := url.Parse(target)
+	if err != nil || u.Scheme != "unix" || u.Path == "" {
+		return "", false
+	}
+	return u.Path, true
+}
+
+// _new_handler_target returns a target served by handler in this
+// process. requests reach it over in-memory connections, spoken as
+// http/1.1 or h2c like any plain http backend.
+func _new_handler_target(handler http.Handler) *_target {
+	ln := _new_pipe_listener()
+	t := &_target{url: "http://" + _local_host}
+	t.server = &http.Server{Handler: h2c.NewHandler(handler, &http2.Server{})}
+	go t.server.Serve(ln)
+	t._dial_with(ln._dial)
+	return t
+}
+
+// _dial_with makes t reach its backend through dial rather than by
+// address, with clients of its own.
+func (t *_target) _dial_with(dial func(ctx context.Context) (net.Conn, error)) {
+	t.dial = dial
+	t.client = &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dial(ctx)
+		},
+	}}
+	t.h2c = &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, _, _ string, _ *tls.Config) (net.Conn, error) {
+			return dial(ctx)
+		},
+	}
+}
+
+// _close drops t's idle connections and stops its in-process server once
+// requests in flight finish.
+func (t *_target) _close() {
+	if t.client != nil {
+		t.client.CloseIdleConnections()
+		t.h2c.CloseIdleConnections()
+	}
+	if t.server != nil {
+		go t.server.Shutdown(context.Background())
+	}
+}
+
+// _pipe_listener accepts in-memory connections made with _dial.
+type _pipe_listener struct {
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func _new_pipe_listener() *_pipe_listener {
+	return &_pipe_listener{conns: make(chan net.Conn), closed: make(chan struct{})}
+}
+
+func (l *_pipe_listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *_pipe_listener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *_pipe_listener) Addr() net.Addr { return _pipe_addr{} }
+
+// _dial connects to the listener's server.
+func (l *_pipe_listener) _dial(ctx context.Context) (net.Conn, error) {
+	client, server := net.Pipe()
+	var err error
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.closed:
+		err = net.ErrClosed
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	client.Close()
+	server.Close()
+	return nil, err
+}
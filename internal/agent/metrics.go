@@ -0,0 +1,90 @@
+package agent
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// reasons a datagram is dropped, as metric labels.
+const (
+	// the flow's queue from the relay was full
+	_udp_drop_queue = "queue_full"
+	// the target would not take it
+	_udp_drop_target = "target_error"
+)
+
+// _udp_stats counts the datagrams udp flows pass on, across tunnels.
+type _udp_stats struct {
+	// to and from targets
+	sent     atomic.Uint64
+	received atomic.Uint64
+	dropped  sync.Map // reason -> *atomic.Uint64
+}
+
+// _drop counts a dropped datagram.
+func (s *_udp_stats) _drop(reason string) {
+	counter, _ := s.dropped.LoadOrStore(reason, &atomic.Uint64{})
+	counter.(*atomic.Uint64).Add(1)
+}
+
+// _serve_metrics runs the metrics listener until ctx ends.
+func (a *Agent) _serve_metrics(ctx context.Context, addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", a._handle_metrics)
+	srv := &http.Server{Addr: addr, Handler: a._metrics_auth(mux)}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+	slog.Info("agent metrics listener starting", "addr", addr)
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		slog.Error("agent metrics listener failed", "err", err)
+	}
+}
+
+// _metrics_auth requires the configured bearer token. without one every
+// request is refused.
+func (a *Agent) _metrics_auth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := a._config().Metrics.Token
+		given, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token == "" || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			http.Error(w, "unauthorised", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// _handle_metrics serves agent metrics in the prometheus text format.
+func (a *Agent) _handle_metrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprint(w, "# HELP agent_udp_datagrams_total Datagrams sent to or received from udp targets.\n# TYPE agent_udp_datagrams_total counter\n")
+	fmt.Fprintf(w, "agent_udp_datagrams_total{direction=\"out\"} %d\n", a.udp.sent.Load())
+	fmt.Fprintf(w, "agent_udp_datagrams_total{direction=\"in\"} %d\n", a.udp.received.Load())
+
+	reasons := make(map[string]uint64)
+	a.udp.dropped.Range(func(reason, counter any) bool {
+		reasons[reason.(string)] = counter.(*atomic.Uint64).Load()
+		return true
+	})
+	keys := make([]string, 0, len(reasons))
+	for reason := range reasons {
+		keys = append(keys, reason)
+	}
+	slices.Sort(keys)
+	fmt.Fprint(w, "# HELP agent_udp_dropped_total Datagrams dropped by a udp flow.\n# TYPE agent_udp_dropped_total counter\n")
+	for _, reason := range keys {
+		fmt.Fprintf(w, "agent_udp_dropped_total{reason=%q} %d\n", reason, reasons[reason])
+	}
+}
@@ -0,0 +1,38 @@
+package agent
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_metrics_report_udp_drops(t *testing.T) {
+	a := &Agent{udp: &_udp_stats{}}
+	a.cfg.Store(&Config{Metrics: MetricsConfig{Addr: "127.0.0.1:0", Token: "secret"}})
+	a.udp.sent.Add(3)
+	a.udp._drop(_udp_drop_queue)
+	a.udp._drop(_udp_drop_queue)
+	a.udp._drop(_udp_drop_target)
+
+	handler := a._metrics_auth(http.HandlerFunc(a._handle_metrics))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("metrics without the token should be refused, got %d", w.Code)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	for _, want := range []string{
+		`agent_udp_datagrams_total{direction="out"} 3`,
+		`agent_udp_dropped_total{reason="queue_full"} 2`,
+		`agent_udp_dropped_total{reason="target_error"} 1`,
+	} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("metrics missing %q:\n%s", want, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package agent
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/reverseproxy/internal/protocol"
+	"github.com/reverseproxy/internal/relay"
+)
+
+// _passthrough is a tls_passthrough entry ready to serve. tls is set when
+// the agent terminates tls itself.
+type _passthrough struct {
+	host   string
+	target string
+	tls    *tls.Config
+}
+
+// _load_passthrough loads the certificates of the tls passthrough entries.
+func _load_passthrough(cfgs []TLSPassthroughConfig) ([]_passthrough, error) {
+	var entries []_passthrough
+	for _, c := range cfgs {
+		p := _passthrough{host: strings.ToLower(c.Host), target: c.Target}
+		if c.CertFile != "" {
+			cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+			if err != nil {
+				return nil, fmt.Errorf("tls_passthrough %s: %w", c.Host, err)
+			}
+			p.tls = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+		}
+		entries = append(entries, p)
+	}
+	return entries, nil
+}
+
+// _tls_stream serves a tls connection the relay passed through for server
+// name host: the raw bytes go to the entry's target, or the agent
+// terminates tls and the plaintext does. names without an entry are
+// refused.
+func (t *Tunnel) _tls_stream(streamID uint32, host string, in <-chan *protocol.Frame) {
+	p, ok := _match_passthrough(t.streams.Load().passthrough, host)
+	if !ok {
+		slog.Warn("tls server name not served", "stream", streamID, "server_name", host)
+		head := &relay.TunnelledResponse{StatusCode: 403, Body: []byte("tls server name " + host + " not served")}
+		if t._send_stream_head(streamID, head) {
+			t._send(&protocol.Frame{Type: protocol.TypeStreamClose, StreamID: streamID})
+		}
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), _connect_timeout)
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", p.target)
+	cancel()
+	if err != nil {
+		slog.Error("tls passthrough dial failed", "stream", streamID, "target", p.target, "err", err)
+		t._send_stream_error(streamID, err)
+		return
+	}
+	defer conn.Close()
+
+	if !t._send_stream_head(streamID, &relay.TunnelledResponse{StatusCode: 200}) {
+		return
+	}
+	if p.tls == nil {
+		if err := protocol.Splice(conn, conn, streamID, in, t._send); err != nil {
+			slog.Debug("tls passthrough stream ended", "stream", streamID, "server_name", host, "err", err)
+		}
+		return
+	}
+
+	local, remote := _pipe()
+	go func() {
+		if err := protocol.Splice(remote, remote, streamID, in, t._send); err != nil {
+			slog.Debug("tls passthrough stream ended", "stream", streamID, "server_name", host, "err", err)
+		}
+	}()
+	client := tls.Server(local, p.tls)
+	defer client.Close()
+	ctx, cancel = context.WithTimeout(context.Background(), _connect_timeout)
+	err = client.HandshakeContext(ctx)
+	cancel()
+	if err != nil {
+		slog.Warn("tls handshake failed", "stream", streamID, "server_name", host, "err", err)
+		return
+	}
+	_join(client, conn)
+}
+
+// _match_passthrough returns the entry serving server name host. a
+// leading "*." in an entry matches one extra label.
+func _match_passthrough(entries []_passthrough, host string) (_passthrough, bool) {
+	host = strings.ToLower(host)
+	for _, p := range entries {
+		if relay.MatchHost(p.host, host) {
+			return p, true
+		}
+	}
+	return _passthrough{}, false
+}
+
+// _join copies between a and b until both directions finish. end of
+// input is passed on as a half-close; an error ends both directions.
+func _join(a, b net.Conn) {
+	done := make(chan struct{})
+	copyHalf := func(dst, src net.Conn) {
+		if _, err := io.Copy(dst, src); err != nil {
+			a.Close()
+			b.Close()
+			return
+		}
+		if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		}
+	}
+	go func() {
+		copyHalf(b, a)
+		close(done)
+	}()
+	copyHalf(a, b)
+	<-done
+}
+
+// _pipe_conn is one end of an in-memory connection. unlike net.Pipe its
+// ends can be half-closed, as a stream can.
+type _pipe_conn struct {
+	r *io.PipeReader
+	w *io.PipeWriter
+}
+
+// _pipe returns the two ends of an in-memory connection.
+func _pipe() (*_pipe_conn, *_pipe_conn) {
+	ar, bw := io.Pipe()
+	br, aw := io.Pipe()
+	return &_pipe_conn{r: ar, w: aw}, &_pipe_conn{r: br, w: bw}
+}
+
+func (c *_pipe_conn) Read(p []byte) (int, error)  { return c.r.Read(p) }
+func (c *_pipe_conn) Write(p []byte) (int, error) { return c.w.Write(p) }
+func (c *_pipe_conn) CloseWrite() error           { return c.w.Close() }
+
+func (c *_pipe_conn) Close() error {
+	c.r.Close()
+	return c.w.Close()
+}
+
+func (c *_pipe_conn) LocalAddr() net.Addr              { return _pipe_addr{} }
+func (c *_pipe_conn) RemoteAddr() net.Addr             { return _pipe_addr{} }
+func (c *_pipe_conn) SetDeadline(time.Time) error      { return nil }
+func (c *_pipe_conn) SetReadDeadline(time.Time) error  { return nil }
+func (c *_pipe_conn) SetWriteDeadline(time.Time) error { return nil }
+
+type _pipe_addr struct{}
+
+func (_pipe_addr) Network() string { return "pipe" }
+func (_pipe_addr) String() string  { return "pipe" }
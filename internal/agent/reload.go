@@ -0,0 +1,163 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+)
+
+// settings the tunnel is dialled with, whose changes need a new tunnel.
+var _reconnect_settings = []string{"relay", "auth", "proxy.url", "proxy.health_timeout", "remote_forwards"}
+
+// settings streams are served with, swapped in place.
+var _stream_sections = []string{"tcp", "udp", "tls_passthrough"}
+
+// Reload re-reads the configuration file. backend, tcp, udp and
+// tls_passthrough changes apply in place; relay, auth, proxy dialling and
+// remote_forwards changes bring up a new tunnel before the old one is
+// drained. if the new file is invalid nothing changes.
+func (a *Agent) Reload(ctx context.Context) error {
+	a.reloadMu.Lock()
+	defer a.reloadMu.Unlock()
+
+	current := a._config()
+	if current.path == "" {
+		return fmt.Errorf("configuration was not loaded from a file")
+	}
+	next, err := LoadConfig(current.path)
+	if err != nil {
+		return fmt.Errorf("reload refused: %w", err)
+	}
+	// set in code rather than in the file
+	next.Backend.Handler = current.Backend.Handler
+	return a._apply_config(ctx, current, next)
+}
+
+// _apply_config swaps in next. a new proxy dialer is built and, if routing
+// verification is on, checked before anything is applied.
+func (a *Agent) _apply_config(ctx context.Context, current, next *Config) error {
+	changed := _changed_settings(current, next)
+	if len(changed) == 0 {
+		slog.Info("agent configuration unchanged")
+		return nil
+	}
+	reconnect := _any_under(changed, _reconnect_settings)
+
+	dialer := a.dialer.Load()
+	if _any_under(changed, []string{"proxy.url", "proxy.health_timeout"}) {
+		var err error
+		dialer, err = _new_dialer(next)
+		if err != nil {
+			return fmt.Errorf("reload refused: %w", err)
+		}
+		if dialer != nil && next.Proxy.VerifyRouting {
+			verifyCtx, cancel := context.WithTimeout(ctx, 2*next.Proxy.HealthTimeout)
+			err := _verify_proxy(verifyCtx, dialer, next)
+			cancel()
+			if err != nil {
+				return fmt.Errorf("reload refused, new proxy failed verification: %w", err)
+			}
+		}
+	}
+
+	streams := a.streams.Load()
+	if _any_under(changed, _stream_sections) {
+		var err error
+		if streams, err = _new_stream_settings(next); err != nil {
+			return fmt.Errorf("reload refused: %w", err)
+		}
+	}
+	if _any_under(changed, []string{"backend"}) {
+		if err := a.handler.SetBackend(next.Backend); err != nil {
+			return fmt.Errorf("reload refused: %w", err)
+		}
+	}
+	a.dialer.Store(dialer)
+	a.streams.Store(streams)
+	a.cfg.Store(next)
+	slog.Info("agent configuration reloaded", "changed", changed, "reconnect", reconnect)
+
+	if reconnect {
+		select {
+		case a.reconnect <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// _watch_config reloads the configuration whenever its file changes.
+// returns when the context ends.
+func (a *Agent) _watch_config(ctx context.Context, path string, interval time.Duration) {
+	lastMod := _mod_time(path)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			mod := _mod_time(path)
+			if mod.IsZero() || mod.Equal(lastMod) {
+				continue
+			}
+			lastMod = mod
+			slog.Info("agent config file changed, reloading", "path", path)
+			if err := a.Reload(ctx); err != nil {
+				slog.Error("config reload failed, keeping previous configuration", "err", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// _mod_time returns the file's modification time, or zero if unreadable.
+func _mod_time(path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+// _changed_settings returns the settings that differ, as dotted yaml
+// paths. lists are compared as a whole; the backend handler is not
+// compared, reloads keep it.
+func _changed_settings(a, b *Config) []string {
+	var changed []string
+	_diff_settings("", reflect.ValueOf(a).Elem(), reflect.ValueOf(b).Elem(), &changed)
+	return changed
+}
+
+// _diff_settings walks struct fields by yaml tag, recording differing leaves.
+func _diff_settings(path string, a, b reflect.Value, changed *[]string) {
+	if a.Kind() != reflect.Struct {
+		if !reflect.DeepEqual(a.Interface(), b.Interface()) {
+			*changed = append(*changed, path)
+		}
+		return
+	}
+	for i := 0; i < a.NumField(); i++ {
+		name, _, _ := strings.Cut(a.Type().Field(i).Tag.Get("yaml"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		if path != "" {
+			name = path + "." + name
+		}
+		_diff_settings(name, a.Field(i), b.Field(i), changed)
+	}
+}
+
+// _any_under reports whether any of paths is one of settings or inside it.
+func _any_under(paths, settings []string) bool {
+	return slices.ContainsFunc(paths, func(path string) bool {
+		return slices.ContainsFunc(settings, func(setting string) bool {
+			return path == setting || strings.HasPrefix(path, setting+".")
+		})
+	})
+}
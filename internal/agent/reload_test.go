@@ -0,0 +1,100 @@
+package agent
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const _reload_base_config = `
+relay:
+  url: "ws://relay.example.com/_tunnel"
+backend:
+  target_url: "http://127.0.0.1:8080"
+auth:
+  shared_secret: "secret"
+tcp:
+  allow:
+    - "127.0.0.1:5432"
+`
+
+// _reload_agent creates an agent from base and returns it with a function
+// reloading it from the given config.
+func _reload_agent(t *testing.T, base string) (*Agent, func(config string) bool) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "agent.yaml")
+	if err := os.WriteFile(path, []byte(base), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(a.handler.Close)
+	return a, func(config string) bool {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := a.Reload(context.Background()); err != nil {
+			t.Fatalf("reload: %v", err)
+		}
+		select {
+		case <-a.reconnect:
+			return true
+		default:
+			return false
+		}
+	}
+}
+
+func Test_reload_reconnects_only_for_dial_settings(t *testing.T) {
+	a, reload := _reload_agent(t, _reload_base_config)
+	streams := a.streams.Load()
+
+	config := strings.Replace(_reload_base_config, `"127.0.0.1:5432"`, `"127.0.0.1:5433"`, 1) + `
+udp:
+  allow:
+    - "127.0.0.1:53"
+proxy:
+  recheck_interval: 1m
+`
+	if reload(config) {
+		t.Error("tcp, udp and proxy health check changes should not reconnect")
+	}
+	if a.streams.Load() == streams || !_target_allowed(a.streams.Load().tcp.Allow, "127.0.0.1:5433") || !_target_allowed(a.streams.Load().udp.Allow, "127.0.0.1:53") {
+		t.Error("stream settings were not swapped in")
+	}
+
+	for name, changed := range map[string]string{
+		"relay.url":          strings.Replace(config, "relay.example.com", "relay2.example.com", 1),
+		"auth.shared_secret": strings.Replace(config, `"secret"`, `"other"`, 1),
+		"remote_forwards":    config + "remote_forwards:\n  - type: http\n    subdomain: app\n",
+	} {
+		if !reload(changed) {
+			t.Errorf("%s: a change to how the tunnel is dialled should reconnect", name)
+		}
+		reload(config)
+	}
+}
+
+func Test_changed_settings_are_field_paths(t *testing.T) {
+	a := &Config{TCP: TCPConfig{Allow: []string{"127.0.0.1:1"}}, Proxy: ProxyConfig{URL: "socks5://p:1080"}}
+	b := &Config{TCP: TCPConfig{Allow: []string{"127.0.0.1:1"}, ViaProxy: true}, Proxy: ProxyConfig{URL: "socks5://p:1080", RecheckInterval: 1}}
+	changed := _changed_settings(a, b)
+	if strings.Join(changed, ",") != "proxy.recheck_interval,tcp.via_proxy" {
+		t.Errorf("unexpected changes %v", changed)
+	}
+	if _any_under(changed, _reconnect_settings) {
+		t.Error("proxy.recheck_interval and tcp.via_proxy should not need a new tunnel")
+	}
+	if !_any_under([]string{"relay.group"}, _reconnect_settings) {
+		t.Error("relay.group should need a new tunnel")
+	}
+}
@@ -0,0 +1,54 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/reverseproxy/internal/protocol"
+	"github.com/reverseproxy/internal/relay"
+)
+
+// _remote_endpoints reads and logs the endpoints the relay allocated on
+// the tunnel's upgrade response.
+func _remote_endpoints(resp *http.Response) []relay.RemoteEndpoint {
+	if resp == nil {
+		return nil
+	}
+	data := resp.Header.Get(relay.RemoteEndpointsHeader)
+	if data == "" {
+		return nil
+	}
+	var endpoints []relay.RemoteEndpoint
+	if err := json.Unmarshal([]byte(data), &endpoints); err != nil {
+		slog.Error("invalid remote endpoints from relay", "err", err)
+		return nil
+	}
+	for _, e := range endpoints {
+		if e.Error != "" {
+			slog.Warn("relay refused remote endpoint", "request", e.Request, "err", e.Error)
+			continue
+		}
+		slog.Info("remote endpoint ready", "request", e.Request, "port", e.Port, "host", e.Host)
+	}
+	return endpoints
+}
+
+// RemoteEndpoints returns the relay's answers to the endpoints this
+// tunnel asked for.
+func (t *Tunnel) RemoteEndpoints() []relay.RemoteEndpoint {
+	return t.endpoints
+}
+
+// _remote_stream splices a connection to a tcp endpoint the agent asked
+// for to the forward's target.
+func (t *Tunnel) _remote_stream(streamID uint32, request string, in <-chan *protocol.Frame) {
+	target, ok := t.forwards[request]
+	if !ok || target == "" {
+		slog.Warn("stream for unknown remote endpoint", "stream", streamID, "request", request)
+		t._send_stream_error(streamID, fmt.Errorf("no remote forward for %s", request))
+		return
+	}
+	t._splice_target(streamID, target, in)
+}
@@ -0,0 +1,337 @@
+package agent
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/reverseproxy/internal/protocol"
+	"golang.org/x/net/http2"
+)
+
+// target selection policies.
+const (
+	_balance_round_robin = "round_robin"
+	_balance_least_conn  = "least_conn"
+)
+
+// health check defaults, for settings left at 0.
+const (
+	_default_check_interval      = 10 * time.Second
+	_default_check_timeout       = 2 * time.Second
+	_default_healthy_threshold   = 2
+	_default_unhealthy_threshold = 3
+	_default_eject_for           = 30 * time.Second
+)
+
+// _err_no_healthy_target is returned when every target of a backend is
+// out of rotation.
+var _err_no_healthy_target = errors.New("no healthy backend target")
+
+// _target_pool is the set of targets one backend balances across, and
+// the clients they are reached with.
+type _target_pool struct {
+	targets []*_target
+	balance string
+	check   HealthCheckConfig
+	counter atomic.Uint64
+	// told when a target enters or leaves rotation
+	changed func()
+	stop    chan struct{}
+
+	tls              *tls.Config
+	dialer           *net.Dialer
+	handshakeTimeout time.Duration
+	// for requests read in full and upgrade handshakes
+	requestTimeout time.Duration
+	client         *http.Client
+	// http/2 for duplex requests, over tls or in the clear
+	h2         *http2.Transport
+	h2c        *http2.Transport
+	hostHeader string
+}
+
+// _pool_config is what a backend or backend route says about its
+// targets. handler, then targets, replace targetURL when set; tls is
+// loaded from tlsFiles.
+type _pool_config struct {
+	name       string
+	targetURL  string
+	targets    []string
+	handler    http.Handler
+	balance    string
+	check      HealthCheckConfig
+	tlsFiles   BackendTLSConfig
+	tls        *tls.Config
+	http2      string
+	transport  BackendTransportConfig
+	hostHeader string
+}
+
+// _target is one replica of a backend.
+type _target struct {
+	url    string
+	active atomic.Int64
+	// set for unix socket and in-process targets, which are not dialled
+	// by address
+	dial   func(ctx context.Context) (net.Conn, error)
+	client *http.Client
+	h2c    *http2.Transport
+	server *http.Server
+
+	mu sync.Mutex
+	// active check state: failing once unhealthy_threshold probes failed
+	failing bool
+	streak  int
+	// passive state: consecutive connection errors and ejection
+	errors       int
+	ejectedUntil time.Time
+}
+
+// _new_target_pool starts health checks, if configured, for the targets
+// of a backend.
+func _new_target_pool(c _pool_config, changed func()) *_target_pool {
+	targets, check := c.targets, c.check
+	if len(targets) == 0 {
+		targets = []string{c.targetURL}
+	}
+	if check.Interval <= 0 {
+		check.Interval = _default_check_interval
+	}
+	if check.Timeout <= 0 {
+		check.Timeout = _default_check_timeout
+	}
+	if check.HealthyThreshold <= 0 {
+		check.HealthyThreshold = _default_healthy_threshold
+	}
+	if check.UnhealthyThreshold <= 0 {
+		check.UnhealthyThreshold = _default_unhealthy_threshold
+	}
+	if check.EjectFor <= 0 {
+		check.EjectFor = _default_eject_for
+	}
+	p := &_target_pool{balance: c.balance, check: check, changed: changed, stop: make(chan struct{})}
+	p.hostHeader = c.hostHeader
+	p._transports(c.tls, c.http2, c.transport)
+	if c.handler != nil {
+		p.targets = []*_target{_new_handler_target(c.handler)}
+	} else {
+		for _, u := range targets {
+			p.targets = append(p.targets, _new_target(u))
+		}
+	}
+	if check.Path != "" {
+		for _, t := range p.targets {
+			client := &http.Client{Transport: p._client(t).Transport, Timeout: check.Timeout}
+			go p._check_loop(client, t)
+		}
+	}
+	return p
+}
+
+// _close stops the pool's health checks and lets go of its targets.
+func (p *_target_pool) _close() {
+	close(p.stop)
+	p.client.CloseIdleConnections()
+	p.h2.CloseIdleConnections()
+	p.h2c.CloseIdleConnections()
+	for _, t := range p.targets {
+		t._close()
+	}
+}
+
+// _pick returns a target in rotation and counts a request against it;
+// the caller releases it when done.
+func (p *_target_pool) _pick() (*_target, error) {
+	n := uint64(len(p.targets))
+	start := p.counter.Add(1)
+	now := time.Now()
+	var best *_target
+	for i := uint64(0); i < n; i++ {
+		t := p.targets[(start+i)%n]
+		if !t._available(now) {
+			continue
+		}
+		if p.balance != _balance_least_conn {
+			best = t
+			break
+		}
+		if best == nil || t.active.Load() < best.active.Load() {
+			best = t
+		}
+	}
+	if best == nil {
+		return nil, _err_no_healthy_target
+	}
+	best.active.Add(1)
+	return best, nil
+}
+
+// _healthy reports whether any target is in rotation.
+func (p *_target_pool) _healthy() bool {
+	now := time.Now()
+	for _, t := range p.targets {
+		if t._available(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// _available reports whether t passes its checks and is not ejected.
+func (t *_target) _available(now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return !t.failing && !now.Before(t.ejectedUntil)
+}
+
+// _release ends a request counted by _pick.
+func (t *_target) _release() {
+	t.active.Add(-1)
+}
+
+// _result records how a request to t went. only failures to reach the
+// target count towards ejection; a request its caller gave up on does
+// not count at all.
+func (p *_target_pool) _result(ctx context.Context, t *_target, err error) {
+	if p.check.EjectAfter <= 0 || ctx.Err() != nil {
+		return
+	}
+	t.mu.Lock()
+	if err == nil {
+		t.errors = 0
+		t.mu.Unlock()
+		return
+	}
+	t.errors++
+	if t.errors < p.check.EjectAfter {
+		t.mu.Unlock()
+		return
+	}
+	t.errors = 0
+	t.ejectedUntil = time.Now().Add(p.check.EjectFor)
+	t.mu.Unlock()
+
+	slog.Warn("backend target ejected", "target", t.url, "for", p.check.EjectFor, "err", err)
+	p.changed()
+	time.AfterFunc(p.check.EjectFor, p.changed)
+}
+
+// _check_loop probes t every interval until the pool closes.
+func (p *_target_pool) _check_loop(client *http.Client, t *_target) {
+	ticker := time.NewTicker(p.check.Interval)
+	defer ticker.Stop()
+	for {
+		p._probe(client, t)
+		select {
+		case <-ticker.C:
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+// _probe runs one health check against t and moves it in or out of
+// rotation once a threshold is reached.
+func (p *_target_pool) _probe(client *http.Client, t *_target) {
+	good := false
+	resp, err := client.Get(t.url + p.check.Path)
+	if err == nil {
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if p.check.ExpectedStatus != 0 {
+			good = resp.StatusCode == p.check.ExpectedStatus
+		} else {
+			good = resp.StatusCode >= 200 && resp.StatusCode < 300
+		}
+	}
+
+	t.mu.Lock()
+	if good == t.failing {
+		t.streak++
+	} else {
+		t.streak = 0
+	}
+	threshold := p.check.UnhealthyThreshold
+	if t.failing {
+		threshold = p.check.HealthyThreshold
+	}
+	flip := t.streak >= threshold
+	if flip {
+		t.failing = !t.failing
+		t.streak = 0
+	}
+	failing := t.failing
+	t.mu.Unlock()
+
+	if flip {
+		slog.Warn("backend target health changed", "target", t.url, "healthy", !failing, "err", err)
+		p.changed()
+	}
+}
+
+// _health_loop tells the relay whenever the backend's health changes. the
+// relay takes a new tunnel to be healthy, so only bad news is sent first.
+func (t *Tunnel) _health_loop() {
+	reported := true
+	for {
+		healthy, changed := t.handler.Healthy()
+		if healthy != reported {
+			payload := []byte{0}
+			if healthy {
+				payload[0] = 1
+			}
+			if err := t.codec.WriteFrame(&protocol.Frame{Type: protocol.TypeHealth, Payload: payload}); err != nil {
+				return
+			}
+			slog.Info("reported backend health to relay", "healthy", healthy)
+			reported = healthy
+		}
+		select {
+		case <-changed:
+		case <-t.done:
+			return
+		}
+	}
+}
+
+// _released_body releases a target once the response body is closed.
+type _released_body struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *_released_body) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
+
+// _released_conn releases a target once the connection is closed.
+type _released_conn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *_released_conn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
+
+// CloseWrite half-closes the connection, or closes it if it cannot.
+func (c *_released_conn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Close()
+}
@@ -0,0 +1,161 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func _test_pool(balance string, check HealthCheckConfig, urls ...string) *_target_pool {
+	p := &_target_pool{balance: balance, check: check, changed: func() {}, stop: make(chan struct{})}
+	for _, u := range urls {
+		p.targets = append(p.targets, _new_target(u))
+	}
+	return p
+}
+
+func Test_pick_balances_across_available_targets(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		balance string
+		active  []int64
+		out     []bool
+		want    []string
+	}{
+		{"round robin cycles", _balance_round_robin, []int64{0, 0, 0}, []bool{false, false, false}, []string{"http://b", "http://c", "http://a", "http://b"}},
+		{"round robin skips unavailable", _balance_round_robin, []int64{0, 0, 0}, []bool{false, true, false}, []string{"http://c", "http://c", "http://a", "http://c"}},
+		{"least conn takes fewest active", _balance_least_conn, []int64{3, 1, 2}, []bool{false, false, false}, []string{"http://b", "http://c", "http://b", "http://b"}},
+		{"least conn skips unavailable", _balance_least_conn, []int64{3, 0, 2}, []bool{false, true, false}, []string{"http://c", "http://c", "http://a", "http://c"}},
+		{"nothing available", _balance_least_conn, []int64{0, 0, 0}, []bool{true, true, true}, nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p := _test_pool(tc.balance, HealthCheckConfig{}, "http://a", "http://b", "http://c")
+			for i, target := range p.targets {
+				target.active.Store(tc.active[i])
+				target.failing = tc.out[i]
+			}
+			if tc.want == nil {
+				if _, err := p._pick(); !errors.Is(err, _err_no_healthy_target) {
+					t.Fatalf("pick: got %v, want %v", err, _err_no_healthy_target)
+				}
+				return
+			}
+			for i, want := range tc.want {
+				got, err := p._pick()
+				if err != nil {
+					t.Fatalf("pick %d: %v", i, err)
+				}
+				if got.url != want {
+					t.Errorf("pick %d: got %s, want %s", i, got.url, want)
+				}
+			}
+		})
+	}
+}
+
+func Test_release_returns_the_target_to_least_conn(t *testing.T) {
+	p := _test_pool(_balance_least_conn, HealthCheckConfig{}, "http://a", "http://b")
+	first, _ := p._pick()
+	second, _ := p._pick()
+	if first == second {
+		t.Fatalf("both picks went to %s", first.url)
+	}
+	first._release()
+	if got, _ := p._pick(); got != first {
+		t.Errorf("pick after release: got %s, want %s", got.url, first.url)
+	}
+}
+
+func Test_probe_flips_health_at_thresholds(t *testing.T) {
+	var status atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(int(status.Load()))
+	}))
+	defer srv.Close()
+
+	for _, tc := range []struct {
+		name   string
+		check  HealthCheckConfig
+		probes []int
+		want   []bool
+	}{
+		{
+			"goes out after unhealthy threshold",
+			HealthCheckConfig{Path: "/health", HealthyThreshold: 2, UnhealthyThreshold: 3},
+			[]int{500, 500, 500, 200},
+			[]bool{false, false, true, true},
+		},
+		{
+			"comes back after healthy threshold",
+			HealthCheckConfig{Path: "/health", HealthyThreshold: 2, UnhealthyThreshold: 1},
+			[]int{503, 200, 200, 200},
+			[]bool{true, true, false, false},
+		},
+		{
+			"a good probe resets the streak",
+			HealthCheckConfig{Path: "/health", HealthyThreshold: 2, UnhealthyThreshold: 2},
+			[]int{500, 200, 500, 200, 500, 500},
+			[]bool{false, false, false, false, false, true},
+		},
+		{
+			"expected status is the only good one",
+			HealthCheckConfig{Path: "/health", ExpectedStatus: 204, HealthyThreshold: 1, UnhealthyThreshold: 1},
+			[]int{200, 204, 418},
+			[]bool{true, false, true},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p := _test_pool(_balance_round_robin, tc.check, srv.URL)
+			target := p.targets[0]
+			for i, code := range tc.probes {
+				status.Store(int64(code))
+				p._probe(srv.Client(), target)
+				if got := target.failing; got != tc.want[i] {
+					t.Errorf("probe %d (%d): failing %v, want %v", i, code, got, tc.want[i])
+				}
+			}
+		})
+	}
+}
+
+func Test_result_ejects_until_eject_for_passes(t *testing.T) {
+	errDial := errors.New("connection refused")
+	for _, tc := range []struct {
+		name    string
+		results []error
+		ejected bool
+	}{
+		{"ejected after eject_after errors", []error{errDial, errDial, errDial}, true},
+		{"one short of eject_after", []error{errDial, errDial}, false},
+		{"a success resets the count", []error{errDial, errDial, nil, errDial, errDial}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p := _test_pool(_balance_round_robin, HealthCheckConfig{EjectAfter: 3, EjectFor: time.Minute}, "http://a")
+			target := p.targets[0]
+			before := time.Now()
+			for _, err := range tc.results {
+				p._result(context.Background(), target, err)
+			}
+			if got := !target._available(before.Add(time.Second)); got != tc.ejected {
+				t.Fatalf("ejected %v, want %v", got, tc.ejected)
+			}
+			if !target._available(before.Add(time.Minute + time.Second)) {
+				t.Errorf("still out after eject_for")
+			}
+		})
+	}
+}
+
+func Test_result_ignores_cancelled_requests(t *testing.T) {
+	p := _test_pool(_balance_round_robin, HealthCheckConfig{EjectAfter: 1, EjectFor: time.Minute}, "http://a")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	p._result(ctx, p.targets[0], errors.New("context canceled"))
+	if !p.targets[0]._available(time.Now()) {
+		t.Errorf("ejected for a request its caller gave up on")
+	}
+}
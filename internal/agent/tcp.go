@@ -0,0 +1,86 @@
+package agent
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/reverseproxy/internal/protocol"
+	"github.com/reverseproxy/internal/relay"
+)
+
+// tcp and tls passthrough targets must be connected, and passthrough
+// handshakes finished, within this time.
+const _connect_timeout = 30 * time.Second
+
+// _tcp_stream dials target for the relay and splices the connection to
+// the stream until both sides finish. targets off the allow list are
+// answered with an error and never dialled.
+func (t *Tunnel) _tcp_stream(streamID uint32, target string, in <-chan *protocol.Frame) {
+	if !_target_allowed(t.streams.Load().tcp.Allow, target) {
+		slog.Warn("tcp target not allowed", "stream", streamID, "target", target)
+		head := &relay.TunnelledResponse{StatusCode: 403, Body: []byte("tcp target " + target + " not allowed")}
+		if t._send_stream_head(streamID, head) {
+			t._send(&protocol.Frame{Type: protocol.TypeStreamClose, StreamID: streamID})
+		}
+		return
+	}
+	t._splice_target(streamID, target, in)
+}
+
+// _splice_target dials target, through the proxy if tcp.via_proxy is set,
+// and splices the connection to the stream.
+func (t *Tunnel) _splice_target(streamID uint32, target string, in <-chan *protocol.Frame) {
+	ctx, cancel := context.WithTimeout(context.Background(), _connect_timeout)
+	dial := (&net.Dialer{}).DialContext
+	if t.streams.Load().tcp.ViaProxy && t.dialer != nil {
+		dial = t.dialer.DialContext
+	}
+	conn, err := dial(ctx, "tcp", target)
+	cancel()
+	if err != nil {
+		slog.Error("tcp dial failed", "stream", streamID, "target", target, "err", err)
+		t._send_stream_error(streamID, err)
+		return
+	}
+	defer conn.Close()
+
+	if !t._send_stream_head(streamID, &relay.TunnelledResponse{StatusCode: 200}) {
+		return
+	}
+	if err := protocol.Splice(conn, conn, streamID, in, t._send); err != nil {
+		slog.Debug("tcp stream ended", "stream", streamID, "target", target, "err", err)
+	}
+}
+
+// _target_allowed reports whether target matches an allow entry. hosts
+// compare as written, so a cidr entry only matches address targets.
+func _target_allowed(allow []string, target string) bool {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return false
+	}
+	addr, addrErr := netip.ParseAddr(host)
+	for _, entry := range allow {
+		entryHost, entryPort, err := net.SplitHostPort(entry)
+		if err != nil || (entryPort != "*" && entryPort != port) {
+			continue
+		}
+		if strings.EqualFold(entryHost, host) {
+			return true
+		}
+		if addrErr != nil {
+			continue
+		}
+		if prefix, err := netip.ParsePrefix(entryHost); err == nil && prefix.Contains(addr.Unmap()) {
+			return true
+		}
+		if entryAddr, err := netip.ParseAddr(entryHost); err == nil && entryAddr.Unmap() == addr.Unmap() {
+			return true
+		}
+	}
+	return false
+}
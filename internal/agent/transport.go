@@ -0,0 +1,221 @@
+package agent
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// backend http/2 modes.
+const (
+	// http/2 where tls negotiates it; duplex requests always use it
+	_http2_auto = "auto"
+	// http/1.1 only, except for duplex requests
+	_http2_off = "off"
+	// http/2 for every request, h2c for plain http backends
+	_http2_always = "always"
+)
+
+// backend host header policies; any other value is sent as the host.
+const (
+	// the target's host, the default
+	_host_header_backend = "backend"
+	// the host the client asked the relay for
+	_host_header_preserve = "preserve"
+)
+
+// transport defaults, for settings left at 0.
+const (
+	_default_dial_timeout          = 30 * time.Second
+	_default_tls_handshake_timeout = 10 * time.Second
+	_default_idle_conn_timeout     = 90 * time.Second
+	_default_request_timeout       = 30 * time.Second
+)
+
+// _load_backend_tls builds the tls settings https targets of a backend are
+// reached with. nil means the defaults.
+func _load_backend_tls(name string, c BackendTLSConfig) (*tls.Config, error) {
+	if c == (BackendTLSConfig{}) {
+		return nil, nil
+	}
+	cfg := &tls.Config{ServerName: c.ServerName, InsecureSkipVerify: c.InsecureSkipVerify}
+	if c.CAFile != "" {
+		pem, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("%s.tls.ca_file: %w", name, err)
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s.tls.ca_file: no certificates in %s", name, c.CAFile)
+		}
+	}
+	if c.ClientCert != "" {
+		cert, err := tls.LoadX509KeyPair(c.ClientCert, c.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("%s.tls.client_cert: %w", name, err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	if c.InsecureSkipVerify {
+		slog.Warn("BACKEND TLS VERIFICATION DISABLED: certificates of https targets are not checked, anyone on the path can impersonate them", "backend", name)
+	}
+	return cfg, nil
+}
+
+// _transports builds the clients the pool's targets are reached with.
+// the response header timeout and connection limits do not apply to
+// duplex requests.
+func (p *_target_pool) _transports(tlsCfg *tls.Config, mode string, c BackendTransportConfig) {
+	p.tls = tlsCfg
+	p.dialer = &net.Dialer{Timeout: _or(c.DialTimeout, _default_dial_timeout), KeepAlive: 30 * time.Second}
+	p.handshakeTimeout = _or(c.TLSHandshakeTimeout, _default_tls_handshake_timeout)
+	p.requestTimeout = _or(c.RequestTimeout, _default_request_timeout)
+	idle := _or(c.IdleConnTimeout, _default_idle_conn_timeout)
+	p.h2 = &http2.Transport{TLSClientConfig: tlsCfg, DialTLSContext: p._dial_tls, IdleConnTimeout: idle}
+	p.h2c = &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			return p.dialer.DialContext(ctx, network, addr)
+		},
+		IdleConnTimeout: idle,
+	}
+	if mode == _http2_always {
+		p.client = &http.Client{Transport: _h2_transport{p: p, timeout: c.ResponseHeaderTimeout}}
+		return
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = p.dialer.DialContext
+	transport.TLSClientConfig = tlsCfg
+	transport.TLSHandshakeTimeout = p.handshakeTimeout
+	transport.ResponseHeaderTimeout = c.ResponseHeaderTimeout
+	transport.IdleConnTimeout = idle
+	if c.MaxIdleConns > 0 {
+		transport.MaxIdleConns = c.MaxIdleConns
+	}
+	if c.MaxIdleConnsPerHost > 0 {
+		transport.MaxIdleConnsPerHost = c.MaxIdleConnsPerHost
+	}
+	transport.MaxConnsPerHost = c.MaxConnsPerHost
+	if mode == _http2_off {
+		transport.ForceAttemptHTTP2 = false
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	p.client = &http.Client{Transport: transport}
+}
+
+// _client returns the client requests to t are sent with.
+func (p *_target_pool) _client(t *_target) *http.Client {
+	if t.client != nil {
+		return t.client
+	}
+	return p.client
+}
+
+// _duplex_transport returns the http/2 transport duplex requests to t
+// are sent with: h2c for plain http, h2 over tls.
+func (p *_target_pool) _duplex_transport(t *_target, scheme string) *http2.Transport {
+	switch {
+	case t.h2c != nil:
+		return t.h2c
+	case scheme == "http":
+		return p.h2c
+	default:
+		return p.h2
+	}
+}
+
+// _dial_tls connects to addr and completes the tls handshake within the
+// pool's timeouts.
+func (p *_target_pool) _dial_tls(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+	conn, err := p.dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, p.handshakeTimeout)
+	defer cancel()
+	tlsConn := tls.Client(conn, cfg)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// _host_header returns the host a request for host is sent to target
+// with.
+func (p *_target_pool) _host_header(target *url.URL, host string) string {
+	switch p.hostHeader {
+	case "", _host_header_backend:
+		return target.Host
+	case _host_header_preserve:
+		if host != "" {
+			return host
+		}
+		return target.Host
+	default:
+		return p.hostHeader
+	}
+}
+
+// _h2_transport sends every request over http/2, giving up on those
+// whose response head takes longer than timeout.
+type _h2_transport struct {
+	p       *_target_pool
+	timeout time.Duration
+}
+
+func (tr _h2_transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	transport := tr.p.h2
+	if req.URL.Scheme == "http" {
+		transport = tr.p.h2c
+	}
+	if tr.timeout <= 0 {
+		return transport.RoundTrip(req)
+	}
+	ctx, cancel := context.WithCancel(req.Context())
+	timer := time.AfterFunc(tr.timeout, cancel)
+	resp, err := transport.RoundTrip(req.WithContext(ctx))
+	if !timer.Stop() {
+		if err == nil {
+			resp.Body.Close()
+		}
+		cancel()
+		return nil, fmt.Errorf("timeout awaiting response headers after %s", tr.timeout)
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &_cancel_body{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// _cancel_body releases a request's context once its body is closed.
+type _cancel_body struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *_cancel_body) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// _or returns d, or def when d is 0.
+func _or(d, def time.Duration) time.Duration {
+	if d > 0 {
+		return d
+	}
+	return def
+}
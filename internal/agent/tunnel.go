@@ -2,9 +2,15 @@ package agent
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"log/slog"
+	"net/http"
+	neturl "net/url"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -20,38 +26,125 @@ type Tunnel struct {
 	closeOnce sync.Once
 	handler   *RequestHandler
 	pingInterval time.Duration
+	maxStreams   int
+
+	// what tcp, udp and tls passthrough streams are served with; tcp
+	// targets are dialled through dialer if set
+	streams *atomic.Pointer[_stream_settings]
+	dialer  *ProxyDialer
+	// where udp flows count their datagrams
+	udpStats *_udp_stats
+
+	// tcp targets of remote endpoints by request, and what the relay allocated
+	forwards  map[string]string
+	endpoints []relay.RemoteEndpoint
+
+	// in-flight request tracking for graceful shutdown
+	inflightMu sync.Mutex
+	inflight   int
+	idle       chan struct{}
+
+	// stream acceptance, frozen once this side starts draining
+	acceptMu     sync.Mutex
+	lastStreamID uint32
+	draining     bool
+	// closed once this side starts draining
+	drainStart chan struct{}
+
+	// closed when the relay asks this tunnel to drain
+	relayDrain     chan struct{}
+	relayDrainOnce sync.Once
+
+	// open bidirectional streams, fed by the read loop
+	rawMu sync.Mutex
+	raw   map[uint32]*_raw_stream
+
+	// whether both sides return credit with TypeWindowUpdate, and the
+	// credit of streams this side has not finished sending on
+	flowControl bool
+	windowMu    sync.Mutex
+	windows     map[uint32]*protocol.Window
+
+	// requests being served, cancelled if the relay resets them
+	cancelMu sync.Mutex
+	cancels  map[uint32]context.CancelFunc
+}
+
+// _raw_stream is an open bidirectional stream. the read loop delivers to
+// inbox, which closes once the relay resets the stream or its handler
+// returns; done closes when the handler returns.
+type _raw_stream struct {
+	inbox *protocol.Inbox
+	done  chan struct{}
 }
 
 // ConnectTunnel establishes a websocket connection to the relay,
-// optionally routing through a proxy.
-func ConnectTunnel(ctx context.Context, cfg *Config, dialer *ProxyDialer) (*Tunnel, error) {
+// optionally routing through a proxy. requests are served by handler.
+func ConnectTunnel(ctx context.Context, cfg *Config, dialer *ProxyDialer, handler *RequestHandler) (*Tunnel, error) {
 	wsDialer := websocket.Dialer{}
 	if dialer != nil {
 		wsDialer.NetDialContext = dialer.DialContext
 	}
 
-	token := relay.GenerateToken(cfg.Auth.SharedSecret)
-	url := cfg.Relay.URL + "?token=" + token
+	query := neturl.Values{}
+	query.Set("token", relay.GenerateAgentToken(cfg.Auth.SharedSecret, cfg.Relay.Name))
+	query.Set("instance", _instance)
+	query.Set("flow_control", "1")
+	if cfg.Relay.Group != "" {
+		query.Set("group", cfg.Relay.Group)
+	}
+	if cfg.Tunnel.MaxStreams > 0 {
+		query.Set("max_streams", strconv.Itoa(cfg.Tunnel.MaxStreams))
+	}
+	if cfg.Relay.Name != "" {
+		query.Set("name", cfg.Relay.Name)
+	}
+	forwards := make(map[string]string)
+	for _, f := range cfg.RemoteForwards {
+		query.Add("forward", f.Request())
+		forwards[f.Request()] = f.Target
+	}
+	url := cfg.Relay.URL + "?" + query.Encode()
+	settings, err := _new_stream_settings(cfg)
+	if err != nil {
+		return nil, err
+	}
+	streams := &atomic.Pointer[_stream_settings]{}
+	streams.Store(settings)
 
-	slog.Info("connecting to relay", "url", cfg.Relay.URL)
-	conn, _, err := wsDialer.DialContext(ctx, url, nil)
+	slog.Info("connecting to relay", "url", cfg.Relay.URL, "group", cfg.Relay.Group)
+	conn, resp, err := wsDialer.DialContext(ctx, url, nil)
 	if err != nil {
 		return nil, fmt.Errorf("dialling relay: %w", err)
 	}
 
 	slog.Info("connected to relay")
+	endpoints := _remote_endpoints(resp)
 	return &Tunnel{
 		codec:        protocol.NewCodec(conn),
 		conn:         conn,
 		done:         make(chan struct{}),
-		handler:      NewRequestHandler(cfg.Backend.TargetURL),
+		relayDrain:   make(chan struct{}),
+		drainStart:   make(chan struct{}),
+		raw:          make(map[uint32]*_raw_stream),
+		flowControl:  resp.Header.Get(relay.FlowControlHeader) == "1",
+		windows:      make(map[uint32]*protocol.Window),
+		cancels:      make(map[uint32]context.CancelFunc),
+		handler:      handler,
 		pingInterval: cfg.Tunnel.PingInterval,
+		maxStreams:   cfg.Tunnel.MaxStreams,
+		streams:      streams,
+		dialer:       dialer,
+		udpStats:     &_udp_stats{},
+		forwards:     forwards,
+		endpoints:    endpoints,
 	}, nil
 }
 
 // Run starts processing frames from the relay. blocks until the tunnel closes.
 func (t *Tunnel) Run() error {
 	go t._ping_loop()
+	go t._health_loop()
 	return t._read_loop()
 }
 
@@ -64,6 +157,51 @@ func (t *Tunnel) Close() {
 	})
 }
 
+// Drain tells the relay to stop routing new streams to this tunnel, then
+// waits for in-flight requests to finish or the timeout to elapse. udp
+// flows are closed rather than waited for; the relay opens new ones
+// elsewhere.
+// streams the relay opened after the last accepted one are dropped so the
+// relay can retry them elsewhere. the tunnel is left open; callers close
+// it once Drain returns.
+func (t *Tunnel) Drain(reason string, timeout time.Duration) error {
+	lastStreamID := t._stop_accepting()
+	payload := protocol.MarshalDrain(&protocol.Drain{LastStreamID: lastStreamID, Reason: reason})
+	if err := t.codec.WriteFrame(&protocol.Frame{Type: protocol.TypeDrain, Payload: payload}); err != nil {
+		return fmt.Errorf("sending drain: %w", err)
+	}
+	slog.Info("draining agent tunnel", "last_stream", lastStreamID, "inflight", t._inflight_count(), "timeout", timeout)
+
+	return t._wait_idle(timeout)
+}
+
+// RelayDraining returns a channel that closes when the relay asks this
+// tunnel to drain. in-flight requests still complete on it.
+func (t *Tunnel) RelayDraining() <-chan struct{} {
+	return t.relayDrain
+}
+
+// _wait_idle blocks until no requests are in flight, the tunnel closes,
+// or the timeout elapses.
+func (t *Tunnel) _wait_idle(timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		idle := t._idle_chan()
+		if idle == nil {
+			slog.Info("agent tunnel drained")
+			return nil
+		}
+		select {
+		case <-idle:
+		case <-t.done:
+			return fmt.Errorf("tunnel closed while draining")
+		case <-timer.C:
+			return fmt.Errorf("drain timed out with %d requests in flight", t._inflight_count())
+		}
+	}
+}
+
 // Done returns a channel that closes when the tunnel shuts down.
 func (t *Tunnel) Done() <-chan struct{} {
 	return t.done
@@ -72,8 +210,15 @@ func (t *Tunnel) Done() <-chan struct{} {
 // _read_loop reads frames from the relay and processes them.
 func (t *Tunnel) _read_loop() error {
 	defer t.Close()
-	// collect partial request data per stream
+	defer t._close_raw_streams()
+	// collect partial request data per stream, and the body chunks not yet credited
 	streams := make(map[uint32][]byte)
+	uncredited := make(map[uint32]uint32)
+	defer func() {
+		for range streams {
+			t._end_request()
+		}
+	}()
 
 	for {
 		frame, err := t.codec.ReadFrame()
@@ -92,17 +237,100 @@ func (t *Tunnel) _read_loop() error {
 				return fmt.Errorf("sending pong: %w", err)
 			}
 
+		case protocol.TypeDrain:
+			d, err := protocol.UnmarshalDrain(frame.Payload)
+			if err != nil {
+				slog.Warn("invalid drain frame from relay", "err", err)
+				continue
+			}
+			t.relayDrainOnce.Do(func() {
+				slog.Info("relay asked tunnel to drain", "reason", d.Reason)
+				close(t.relayDrain)
+			})
+
 		case protocol.TypeHTTPRequest:
+			if _, ok := streams[frame.StreamID]; !ok {
+				if !t._admit_stream(frame.StreamID) {
+					continue
+				}
+				// in flight from here, so a drain waits for the rest of it
+				t._begin_request()
+				t._open_window(frame.StreamID)
+			}
 			streams[frame.StreamID] = append(streams[frame.StreamID], frame.Payload...)
 
+		case protocol.TypeStreamOpen:
+			if !t._admit_stream(frame.StreamID) {
+				continue
+			}
+			s := &_raw_stream{done: make(chan struct{})}
+			s.inbox = protocol.NewInbox(t._ack(frame.StreamID), s.done)
+			t.rawMu.Lock()
+			t.raw[frame.StreamID] = s
+			t.rawMu.Unlock()
+			t._open_window(frame.StreamID)
+			t._begin_request()
+			go func() {
+				defer t._end_request()
+				defer t._forget_window(frame.StreamID)
+				defer t._forget_raw_stream(frame.StreamID, s)
+				t._handle_stream(frame.StreamID, frame.Payload, s.inbox.Frames())
+			}()
+
+		case protocol.TypeStreamData, protocol.TypeDatagram:
+			t._deliver_raw(frame)
+
+		case protocol.TypeStreamReset:
+			t._forget_window(frame.StreamID)
+			if t._deliver_raw(frame) {
+				continue
+			}
+			if _, ok := streams[frame.StreamID]; ok {
+				delete(streams, frame.StreamID)
+				delete(uncredited, frame.StreamID)
+				t._end_request()
+				continue
+			}
+			t._cancel_request(frame.StreamID)
+
 		case protocol.TypeBodyChunk:
-			streams[frame.StreamID] = append(streams[frame.StreamID], frame.Payload...)
+			if _, ok := streams[frame.StreamID]; ok {
+				streams[frame.StreamID] = append(streams[frame.StreamID], frame.Payload...)
+				// request bodies are buffered here, so credit is returned as they arrive
+				if ack := t._ack(frame.StreamID); ack != nil {
+					if uncredited[frame.StreamID]++; uncredited[frame.StreamID] >= protocol.StreamWindow/2 {
+						ack(uncredited[frame.StreamID])
+						delete(uncredited, frame.StreamID)
+					}
+				}
+			}
+
+		case protocol.TypeWindowUpdate:
+			n, err := protocol.UnmarshalWindowUpdate(frame.Payload)
+			if err != nil {
+				slog.Warn("invalid window update from relay", "err", err)
+				continue
+			}
+			t.windowMu.Lock()
+			w := t.windows[frame.StreamID]
+			t.windowMu.Unlock()
+			if w != nil {
+				w.Add(int(n))
+			}
 
 		case protocol.TypeStreamClose:
+			if t._deliver_raw(frame) {
+				continue
+			}
 			data, ok := streams[frame.StreamID]
 			if ok {
 				delete(streams, frame.StreamID)
-				go t._handle_request(frame.StreamID, data)
+				delete(uncredited, frame.StreamID)
+				go func() {
+					defer t._end_request()
+					defer t._forget_window(frame.StreamID)
+					t._handle_request(frame.StreamID, data)
+				}()
 			}
 
 		default:
@@ -111,24 +339,364 @@ func (t *Tunnel) _read_loop() error {
 	}
 }
 
-// _handle_request processes a complete request and sends the response back.
+// _admit_stream decides whether to take a new stream from the relay.
+// streams still buffering their request count as in flight.
+func (t *Tunnel) _admit_stream(streamID uint32) bool {
+	if t.maxStreams > 0 && t._inflight_count() >= t.maxStreams {
+		t._refuse_stream(streamID)
+		return false
+	}
+	if !t._accept_stream(streamID) {
+		slog.Debug("dropping stream opened after drain", "stream", streamID)
+		return false
+	}
+	return true
+}
+
+// _deliver_raw passes a frame to an open bidirectional stream, reporting
+// whether the stream exists. a reset ends the stream; after a close it
+// stays open for the other direction and a possible reset. a stream whose
+// buffer the relay overran is reset. the lock is only held for the
+// lookup: an inbox drops frames once closed, so delivery needs no lock.
+func (t *Tunnel) _deliver_raw(frame *protocol.Frame) bool {
+	t.rawMu.Lock()
+	s, ok := t.raw[frame.StreamID]
+	t.rawMu.Unlock()
+	if !ok {
+		return false
+	}
+	if frame.Type == protocol.TypeDatagram {
+		// best effort: never wait for a flow that is behind
+		if !s.inbox.Offer(frame) {
+			t.udpStats._drop(_udp_drop_queue)
+		}
+		return true
+	}
+	if !s.inbox.Deliver(frame, t.done) {
+		slog.Warn("stream receive buffer full, resetting", "stream", frame.StreamID)
+		t._send(&protocol.Frame{Type: protocol.TypeStreamReset, StreamID: frame.StreamID})
+		t._end_raw_stream(frame.StreamID, s)
+		return true
+	}
+	if frame.Type == protocol.TypeStreamReset {
+		t._end_raw_stream(frame.StreamID, s)
+	}
+	return true
+}
+
+// _end_raw_stream forgets s and closes its inbox, unless its handler
+// already has.
+func (t *Tunnel) _end_raw_stream(streamID uint32, s *_raw_stream) {
+	t.rawMu.Lock()
+	if t.raw[streamID] == s {
+		delete(t.raw, streamID)
+	}
+	t.rawMu.Unlock()
+	s.inbox.Close()
+}
+
+// _forget_raw_stream drops a stream whose handler has returned.
+func (t *Tunnel) _forget_raw_stream(streamID uint32, s *_raw_stream) {
+	// stops handing frames to the handler, and unblocks a delivery
+	close(s.done)
+	t._end_raw_stream(streamID, s)
+}
+
+// _close_raw_streams ends every open stream when the tunnel goes away.
+func (t *Tunnel) _close_raw_streams() {
+	t.rawMu.Lock()
+	defer t.rawMu.Unlock()
+	for id, s := range t.raw {
+		delete(t.raw, id)
+		s.inbox.Close()
+	}
+}
+
+// _send writes a frame for a stream. under flow control, data frames wait
+// for the relay to have room for them, and are dropped once the relay has
+// reset the stream.
+func (t *Tunnel) _send(f *protocol.Frame) error {
+	if protocol.FlowControlled(f.Type) {
+		t.windowMu.Lock()
+		w := t.windows[f.StreamID]
+		t.windowMu.Unlock()
+		if w != nil {
+			switch err := w.Take(t.done); err {
+			case protocol.ErrStreamReset:
+				return nil
+			case protocol.ErrStreamLost:
+				return err
+			}
+		}
+	}
+	if err := t.codec.WriteFrame(f); err != nil {
+		return err
+	}
+	if f.Type == protocol.TypeStreamClose || f.Type == protocol.TypeStreamReset {
+		// nothing more is sent on the stream
+		t._forget_window(f.StreamID)
+	}
+	return nil
+}
+
+// _ack returns how credit is returned on a stream, nil without flow
+// control.
+func (t *Tunnel) _ack(streamID uint32) func(uint32) {
+	if !t.flowControl {
+		return nil
+	}
+	return func(n uint32) {
+		t.codec.WriteFrame(&protocol.Frame{Type: protocol.TypeWindowUpdate, StreamID: streamID, Payload: protocol.MarshalWindowUpdate(n)})
+	}
+}
+
+// _open_window gives a new stream its send credit.
+func (t *Tunnel) _open_window(streamID uint32) {
+	if !t.flowControl {
+		return
+	}
+	t.windowMu.Lock()
+	t.windows[streamID] = protocol.NewWindow()
+	t.windowMu.Unlock()
+}
+
+// _forget_window drops a stream's send credit, failing senders waiting
+// on it.
+func (t *Tunnel) _forget_window(streamID uint32) {
+	t.windowMu.Lock()
+	if w, ok := t.windows[streamID]; ok {
+		w.Close()
+		delete(t.windows, streamID)
+	}
+	t.windowMu.Unlock()
+}
+
+// _handle_stream serves a bidirectional stream opened by the relay.
+func (t *Tunnel) _handle_stream(streamID uint32, payload []byte, in <-chan *protocol.Frame) {
+	var open relay.StreamOpen
+	if err := json.Unmarshal(payload, &open); err == nil {
+		switch {
+		case open.Kind == relay.StreamKindUpgrade && open.Request != nil:
+			t._upgrade_stream(streamID, open.Request, in)
+			return
+		case open.Kind == relay.StreamKindDuplex && open.Request != nil:
+			t._duplex_stream(streamID, open.Request, in)
+			return
+		case open.Kind == relay.StreamKindTCP:
+			t._tcp_stream(streamID, open.Target, in)
+			return
+		case open.Kind == relay.StreamKindUDP:
+			t._udp_stream(streamID, open.Target, in)
+			return
+		case open.Kind == relay.StreamKindRemote:
+			t._remote_stream(streamID, open.Target, in)
+			return
+		case open.Kind == relay.StreamKindTLS:
+			t._tls_stream(streamID, open.Target, in)
+			return
+		}
+	}
+	slog.Warn("unsupported stream from relay", "stream", streamID, "kind", open.Kind)
+	t._send(&protocol.Frame{Type: protocol.TypeStreamReset, StreamID: streamID})
+}
+
+// _upgrade_stream passes an upgrade request to the backend and, once it
+// switches protocols, splices the connection to the stream.
+func (t *Tunnel) _upgrade_stream(streamID uint32, req *relay.TunnelledRequest, in <-chan *protocol.Frame) {
+	conn, br, resp, err := t.handler.DialUpgrade(req)
+	if err != nil {
+		slog.Error("upgrade to backend failed", "stream", streamID, "err", err)
+		t._send_stream_error(streamID, err)
+		return
+	}
+	defer conn.Close()
+
+	if !t._send_stream_head(streamID, _response_head(resp)) {
+		return
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		// the backend declined the upgrade; pass its answer on as is
+		t._send_stream_body(streamID, resp.Body)
+		return
+	}
+	if err := protocol.Splice(conn, br, streamID, in, t._send); err != nil {
+		slog.Debug("upgraded stream ended", "stream", streamID, "err", err)
+	}
+}
+
+// _send_stream_error answers a stream with a 502 carrying err, or a 404
+// if no backend route matched.
+func (t *Tunnel) _send_stream_error(streamID uint32, err error) {
+	status, message := _backend_error(err)
+	head := &relay.TunnelledResponse{
+		StatusCode: status,
+		Headers:    http.Header{"Content-Type": {"text/plain"}},
+		Body:       []byte(message),
+	}
+	if t._send_stream_head(streamID, head) {
+		t._send(&protocol.Frame{Type: protocol.TypeStreamClose, StreamID: streamID})
+	}
+}
+
+// _send_stream_head sends the response head of a bidirectional stream.
+func (t *Tunnel) _send_stream_head(streamID uint32, head *relay.TunnelledResponse) bool {
+	data, err := json.Marshal(head)
+	if err == nil && len(data) > protocol.MaxPayloadSize {
+		err = fmt.Errorf("response head of %d bytes exceeds frame size", len(data))
+	}
+	if err == nil {
+		err = t._send(&protocol.Frame{Type: protocol.TypeStreamHead, StreamID: streamID, Payload: data})
+	}
+	if err != nil {
+		slog.Error("failed to send stream response", "stream", streamID, "err", err)
+		t._send(&protocol.Frame{Type: protocol.TypeStreamReset, StreamID: streamID})
+		return false
+	}
+	return true
+}
+
+// _send_stream_body sends r as stream data followed by a close, or a
+// reset if reading fails.
+func (t *Tunnel) _send_stream_body(streamID uint32, r io.Reader) {
+	t._send_stream_end(streamID, protocol.CopyToStream(r, streamID, t._send), nil)
+}
+
+// _send_stream_end finishes a streamed response: trailers, if any, and a
+// close once the body was sent in full, or a reset after err.
+func (t *Tunnel) _send_stream_end(streamID uint32, err error, trailers http.Header) {
+	if err == nil && len(trailers) > 0 {
+		var data []byte
+		data, err = json.Marshal(trailers)
+		if err == nil {
+			err = t._send(&protocol.Frame{Type: protocol.TypeStreamTrailers, StreamID: streamID, Payload: data})
+		}
+	}
+	if err != nil {
+		slog.Debug("streamed response cut short", "stream", streamID, "err", err)
+		t._send(&protocol.Frame{Type: protocol.TypeStreamReset, StreamID: streamID})
+		return
+	}
+	t._send(&protocol.Frame{Type: protocol.TypeStreamClose, StreamID: streamID})
+}
+
+// _refuse_stream tells the relay a stream will not be processed, so it
+// can retry the request on another tunnel.
+func (t *Tunnel) _refuse_stream(streamID uint32) {
+	slog.Debug("refusing stream, tunnel at capacity", "stream", streamID, "max_streams", t.maxStreams)
+	if err := t._send(&protocol.Frame{Type: protocol.TypeRefuseStream, StreamID: streamID}); err != nil {
+		slog.Error("failed to refuse stream", "stream", streamID, "err", err)
+	}
+}
+
+// _accept_stream records a new stream from the relay. once draining, only
+// streams at or below the advertised last stream id are accepted.
+func (t *Tunnel) _accept_stream(streamID uint32) bool {
+	t.acceptMu.Lock()
+	defer t.acceptMu.Unlock()
+	if t.draining {
+		return streamID <= t.lastStreamID
+	}
+	if streamID > t.lastStreamID {
+		t.lastStreamID = streamID
+	}
+	return true
+}
+
+// _stop_accepting freezes stream acceptance and returns the last accepted stream id.
+func (t *Tunnel) _stop_accepting() uint32 {
+	t.acceptMu.Lock()
+	defer t.acceptMu.Unlock()
+	if !t.draining {
+		t.draining = true
+		close(t.drainStart)
+	}
+	return t.lastStreamID
+}
+
+// _begin_request records a new in-flight request.
+func (t *Tunnel) _begin_request() {
+	t.inflightMu.Lock()
+	if t.inflight == 0 {
+		t.idle = make(chan struct{})
+	}
+	t.inflight++
+	t.inflightMu.Unlock()
+}
+
+// _end_request marks an in-flight request as finished, waking any drain
+// waiting for the tunnel to go idle.
+func (t *Tunnel) _end_request() {
+	t.inflightMu.Lock()
+	t.inflight--
+	if t.inflight == 0 {
+		close(t.idle)
+		t.idle = nil
+	}
+	t.inflightMu.Unlock()
+}
+
+// _idle_chan returns a channel that closes when the current in-flight
+// requests finish, or nil if there are none.
+func (t *Tunnel) _idle_chan() <-chan struct{} {
+	t.inflightMu.Lock()
+	defer t.inflightMu.Unlock()
+	if t.inflight == 0 {
+		return nil
+	}
+	return t.idle
+}
+
+// _inflight_count returns the number of requests currently being handled.
+func (t *Tunnel) _inflight_count() int {
+	t.inflightMu.Lock()
+	defer t.inflightMu.Unlock()
+	return t.inflight
+}
+
+// _handle_request processes a complete request and sends the response
+// back. responses that should arrive incrementally are streamed and only
+// bound by the backend's idle timeout; others are read in full within
+// the backend's request timeout.
 func (t *Tunnel) _handle_request(streamID uint32, requestData []byte) {
-	responseData, err := t.handler.HandleRequest(requestData)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	t._track_request(streamID, cancel)
+	defer t._untrack_request(streamID)
+	deadline := &_deadline{cancel: cancel}
+	defer deadline._stop()
+
+	var responseData []byte
+	resp, err := t.handler.Do(ctx, requestData, deadline._start)
+	if err == nil {
+		defer resp.Body.Close()
+		if _is_streamed(resp) && deadline._stop() {
+			t._stream_response(streamID, resp, cancel)
+			return
+		}
+		responseData, err = _buffered_response(resp)
+	}
 	if err != nil {
+		if ctx.Err() == context.Canceled && !deadline._stop() {
+			err = fmt.Errorf("backend did not respond within %s", deadline.timeout)
+		} else if ctx.Err() != nil {
+			// the relay gave up on the request; answer its reset
+			t._send(&protocol.Frame{Type: protocol.TypeStreamReset, StreamID: streamID})
+			return
+		}
 		slog.Error("failed to handle request", "stream", streamID, "err", err)
-		responseData = _error_response(502, "backend error: "+err.Error())
+		responseData = _error_response(_backend_error(err))
 	}
 
 	frames := _response_frames(streamID, responseData)
 	for _, f := range frames {
-		if err := t.codec.WriteFrame(f); err != nil {
+		if err := t._send(f); err != nil {
 			slog.Error("failed to send response frame", "stream", streamID, "err", err)
 			return
 		}
 	}
 
 	// send stream close
-	if err := t.codec.WriteFrame(&protocol.Frame{
+	if err := t._send(&protocol.Frame{
 		Type:     protocol.TypeStreamClose,
 		StreamID: streamID,
 	}); err != nil {
@@ -136,6 +704,41 @@ func (t *Tunnel) _handle_request(streamID uint32, requestData []byte) {
 	}
 }
 
+// _stream_response sends a response head straight away and the body as
+// the backend produces it.
+func (t *Tunnel) _stream_response(streamID uint32, resp *http.Response, cancel func()) {
+	if !t._send_stream_head(streamID, _response_head(resp)) {
+		return
+	}
+	body := _new_idle_reader(resp.Body, t.handler.Backend().StreamIdleTimeout, cancel)
+	defer body.Stop()
+	t._send_stream_body(streamID, body)
+}
+
+// _track_request remembers how to cancel a request being served.
+func (t *Tunnel) _track_request(streamID uint32, cancel context.CancelFunc) {
+	t.cancelMu.Lock()
+	t.cancels[streamID] = cancel
+	t.cancelMu.Unlock()
+}
+
+// _untrack_request forgets a finished request.
+func (t *Tunnel) _untrack_request(streamID uint32) {
+	t.cancelMu.Lock()
+	delete(t.cancels, streamID)
+	t.cancelMu.Unlock()
+}
+
+// _cancel_request abandons a request the relay reset.
+func (t *Tunnel) _cancel_request(streamID uint32) {
+	t.cancelMu.Lock()
+	cancel, ok := t.cancels[streamID]
+	t.cancelMu.Unlock()
+	if ok {
+		cancel()
+	}
+}
+
 // _response_frames splits response data into appropriately sized frames.
 func _response_frames(streamID uint32, data []byte) []*protocol.Frame {
 	if len(data) <= protocol.MaxPayloadSize {
@@ -0,0 +1,156 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/reverseproxy/internal/protocol"
+	"github.com/reverseproxy/internal/relay"
+)
+
+// _fake_relay connects an agent tunnel for backend to a scripted relay,
+// returning the tunnel and the codec of the relay end. extra is appended
+// to the agent's config.
+func _fake_relay(t *testing.T, backend, extra string) (*Tunnel, *protocol.Codec) {
+	t.Helper()
+	conns := make(chan *websocket.Conn, 1)
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("upgrade: %v", err)
+			return
+		}
+		conns <- conn
+	}))
+	t.Cleanup(srv.Close)
+
+	path := filepath.Join(t.TempDir(), "agent.yaml")
+	config := "relay:\n  url: \"ws" + strings.TrimPrefix(srv.URL, "http") + "\"\nbackend:\n  target_url: \"" + backend + "\"\nauth:\n  shared_secret: \"secret\"\n" + extra
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(a.handler.Close)
+	tunnel, err := ConnectTunnel(context.Background(), cfg, nil, a.handler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(tunnel.Close)
+	go tunnel.Run()
+
+	codec := protocol.NewCodec(<-conns)
+	t.Cleanup(func() { codec.Close() })
+	return tunnel, codec
+}
+
+// _read_until returns the next frame of the given type from the agent.
+func _read_until(t *testing.T, codec *protocol.Codec, frameType uint8) *protocol.Frame {
+	t.Helper()
+	for {
+		frame, err := codec.ReadFrame()
+		if err != nil {
+			t.Fatalf("reading from agent: %v", err)
+		}
+		if frame.Type == frameType {
+			return frame
+		}
+	}
+}
+
+func Test_drain_waits_for_a_request_still_arriving(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	}))
+	defer backend.Close()
+	tunnel, codec := _fake_relay(t, backend.URL, "")
+
+	payload, _ := json.Marshal(&relay.TunnelledRequest{Method: "POST", URL: "/echo", Headers: http.Header{}, Body: []byte("hello")})
+	half := len(payload) / 2
+	codec.WriteFrame(&protocol.Frame{Type: protocol.TypeHTTPRequest, StreamID: 1, Payload: payload[:half]})
+	// the pong tells the first half has been read
+	codec.WriteFrame(&protocol.Frame{Type: protocol.TypePing})
+	_read_until(t, codec, protocol.TypePong)
+
+	drained := make(chan error, 1)
+	go func() { drained <- tunnel.Drain("test", 5*time.Second) }()
+	d, err := protocol.UnmarshalDrain(_read_until(t, codec, protocol.TypeDrain).Payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.LastStreamID != 1 {
+		t.Fatalf("drain advertised last stream %d, want 1", d.LastStreamID)
+	}
+	select {
+	case err := <-drained:
+		t.Fatalf("drain finished with a request half sent: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	codec.WriteFrame(&protocol.Frame{Type: protocol.TypeHTTPRequest, StreamID: 1, Payload: payload[half:]})
+	codec.WriteFrame(&protocol.Frame{Type: protocol.TypeStreamClose, StreamID: 1})
+	var resp relay.TunnelledResponse
+	if err := json.Unmarshal(_read_until(t, codec, protocol.TypeHTTPResponse).Payload, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || string(resp.Body) != "hello" {
+		t.Errorf("got %d %q, want 200 \"hello\"", resp.StatusCode, resp.Body)
+	}
+	select {
+	case err := <-drained:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("drain did not finish once the request was served")
+	}
+}
+
+func Test_drain_closes_udp_flows(t *testing.T) {
+	target, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	tunnel, codec := _fake_relay(t, "http://127.0.0.1:8080", "udp:\n  allow:\n    - \""+target.LocalAddr().String()+"\"\n")
+
+	open, _ := json.Marshal(&relay.StreamOpen{Kind: relay.StreamKindUDP, Target: target.LocalAddr().String()})
+	codec.WriteFrame(&protocol.Frame{Type: protocol.TypeStreamOpen, StreamID: 1, Payload: open})
+	codec.WriteFrame(&protocol.Frame{Type: protocol.TypeDatagram, StreamID: 1, Payload: []byte("query")})
+	buf := make([]byte, 16)
+	target.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, _, err := target.ReadFrom(buf); err != nil {
+		t.Fatalf("datagram did not reach the target: %v", err)
+	}
+
+	drained := make(chan error, 1)
+	go func() { drained <- tunnel.Drain("test", 5*time.Second) }()
+	if f := _read_until(t, codec, protocol.TypeStreamClose); f.StreamID != 1 {
+		t.Fatalf("expected the flow closed, got a close for stream %d", f.StreamID)
+	}
+	select {
+	case err := <-drained:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("drain waited on a udp flow")
+	}
+}
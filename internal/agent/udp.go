@@ -0,0 +1,90 @@
+package agent
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"time"
+
+	"github.com/reverseproxy/internal/protocol"
+)
+
+// _udp_stream passes datagrams between the relay and target until either
+// side closes the flow, it idles out or the tunnel drains. delivery is best effort: datagrams
+// the target will not take are dropped and counted in the agent's metrics.
+func (t *Tunnel) _udp_stream(streamID uint32, target string, in <-chan *protocol.Frame) {
+	settings := t.streams.Load().udp
+	if !_target_allowed(settings.Allow, target) {
+		slog.Warn("udp target not allowed", "stream", streamID, "target", target)
+		t._send(&protocol.Frame{Type: protocol.TypeStreamReset, StreamID: streamID})
+		return
+	}
+	conn, err := net.Dial("udp", target)
+	if err != nil {
+		slog.Error("udp dial failed", "stream", streamID, "target", target, "err", err)
+		t._send(&protocol.Frame{Type: protocol.TypeStreamReset, StreamID: streamID})
+		return
+	}
+	defer conn.Close()
+
+	// datagrams from the target; read errors such as icmp unreachable are transient
+	activity := make(chan struct{}, 1)
+	go func() {
+		buf := make([]byte, protocol.MaxPayloadSize)
+		for {
+			n, err := conn.Read(buf)
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if err != nil {
+				continue
+			}
+			select {
+			case activity <- struct{}{}:
+			default:
+			}
+			t.udpStats.received.Add(1)
+			payload := append([]byte(nil), buf[:n]...)
+			if t._send(&protocol.Frame{Type: protocol.TypeDatagram, StreamID: streamID, Payload: payload}) != nil {
+				return
+			}
+		}
+	}()
+
+	idle := time.NewTimer(settings.IdleTimeout)
+	defer func() {
+		idle.Stop()
+		slog.Debug("udp flow closed", "stream", streamID, "target", target)
+	}()
+	for {
+		select {
+		case frame, ok := <-in:
+			if !ok {
+				return
+			}
+			switch frame.Type {
+			case protocol.TypeDatagram:
+				if _, err := conn.Write(frame.Payload); err != nil {
+					t.udpStats._drop(_udp_drop_target)
+				} else {
+					t.udpStats.sent.Add(1)
+				}
+				idle.Reset(settings.IdleTimeout)
+			case protocol.TypeStreamClose:
+				t._send(&protocol.Frame{Type: protocol.TypeStreamClose, StreamID: streamID})
+				return
+			case protocol.TypeStreamReset:
+				return
+			}
+		case <-activity:
+			idle.Reset(settings.IdleTimeout)
+		case <-idle.C:
+			t._send(&protocol.Frame{Type: protocol.TypeStreamClose, StreamID: streamID})
+			return
+		case <-t.drainStart:
+			// a flow has no end to wait for
+			t._send(&protocol.Frame{Type: protocol.TypeStreamClose, StreamID: streamID})
+			return
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+)
+
+// StreamWindow is how many flow-controlled frames a sender may have on a
+// stream that the receiver has not yet consumed.
+const StreamWindow = 32
+
+// StreamBuffer is how many frames a receiver queues per stream: a full
+// window and the few frames outside flow control, such as a head,
+// trailers, close and reset.
+const StreamBuffer = StreamWindow + 8
+
+// FlowControlled reports whether frames of type t count against a
+// stream's window.
+func FlowControlled(t uint8) bool {
+	return t == TypeStreamData || t == TypeBodyChunk
+}
+
+// MarshalWindowUpdate encodes the credit of a TypeWindowUpdate frame.
+func MarshalWindowUpdate(n uint32) []byte {
+	return binary.BigEndian.AppendUint32(nil, n)
+}
+
+// UnmarshalWindowUpdate decodes the credit of a TypeWindowUpdate frame.
+func UnmarshalWindowUpdate(payload []byte) (uint32, error) {
+	if len(payload) != 4 {
+		return 0, fmt.Errorf("window update payload of %d bytes", len(payload))
+	}
+	return binary.BigEndian.Uint32(payload), nil
+}
+
+// Window is the credit a sender has left on a stream.
+type Window struct {
+	mu     sync.Mutex
+	credit int
+	// closed and replaced whenever credit is added
+	wake   chan struct{}
+	closed bool
+}
+
+// NewWindow returns a window with a full StreamWindow of credit.
+func NewWindow() *Window {
+	return &Window{credit: StreamWindow, wake: make(chan struct{})}
+}
+
+// Take uses a frame of credit, waiting for the receiver to return some
+// if none is left. it returns ErrStreamReset once the window is closed,
+// after which frames are not worth sending, and ErrStreamLost if done
+// closes first.
+func (w *Window) Take(done <-chan struct{}) error {
+	for {
+		w.mu.Lock()
+		if w.closed {
+			w.mu.Unlock()
+			return ErrStreamReset
+		}
+		if w.credit > 0 {
+			w.credit--
+			w.mu.Unlock()
+			return nil
+		}
+		wake := w.wake
+		w.mu.Unlock()
+		select {
+		case <-wake:
+		case <-done:
+			return ErrStreamLost
+		}
+	}
+}
+
+// Add returns n frames of credit.
+func (w *Window) Add(n int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return
+	}
+	w.credit += n
+	close(w.wake)
+	w.wake = make(chan struct{})
+}
+
+// Close fails senders waiting for credit and any that come later.
+func (w *Window) Close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.closed {
+		w.closed = true
+		close(w.wake)
+	}
+}
+
+// Inbox hands a stream's frames from a tunnel's read loop to whoever
+// serves the stream, so one slow stream never holds up the others. with
+// flow control it returns credit as data frames are consumed.
+type Inbox struct {
+	queue    chan *Frame
+	out      chan *Frame
+	stop     chan struct{}
+	stopOnce sync.Once
+	// handed over after the queued frames once stopped, if set
+	last *Frame
+	// nil without flow control
+	ack func(n uint32)
+}
+
+// NewInbox starts an inbox. ack returns credit to the sender; with a nil
+// ack the sender is not flow controlled and Deliver waits for room.
+// frames are no longer handed over once gone closes.
+func NewInbox(ack func(n uint32), gone <-chan struct{}) *Inbox {
+	b := &Inbox{
+		queue: make(chan *Frame, StreamBuffer),
+		out:   make(chan *Frame),
+		stop:  make(chan struct{}),
+		ack:   ack,
+	}
+	go b._forward(gone)
+	return b
+}
+
+// Frames returns the channel the stream's frames are read from. it is
+// closed once the inbox is closed and everything queued has been read.
+func (b *Inbox) Frames() chan *Frame {
+	return b.out
+}
+
+// Deliver queues a frame for the stream. under flow control it never
+// waits, and reports false if the queue is full, meaning the sender
+// overran its window. without it, it waits for room until done closes.
+func (b *Inbox) Deliver(f *Frame, done <-chan struct{}) bool {
+	if b.ack != nil {
+		return b.Offer(f)
+	}
+	select {
+	case b.queue <- f:
+	case <-b.stop:
+	case <-done:
+	}
+	return true
+}
+
+// Offer queues a frame if there is room, reporting whether there was.
+// frames offered after Close are dropped.
+func (b *Inbox) Offer(f *Frame) bool {
+	select {
+	case <-b.stop:
+		return true
+	default:
+	}
+	select {
+	case b.queue <- f:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close ends the stream once the frames already queued are read.
+func (b *Inbox) Close() {
+	b.stopOnce.Do(func() { close(b.stop) })
+}
+
+// CloseWith ends the stream like Close, with last handed over after the
+// queued frames however full the queue is. it does nothing once closed.
+func (b *Inbox) CloseWith(last *Frame) {
+	b.stopOnce.Do(func() {
+		b.last = last
+		close(b.stop)
+	})
+}
+
+// _forward hands queued frames over in order, returning credit for the
+// flow-controlled ones half a window at a time.
+func (b *Inbox) _forward(gone <-chan struct{}) {
+	defer close(b.out)
+	var consumed uint32
+	hand := func(f *Frame) bool {
+		select {
+		case b.out <- f:
+		case <-gone:
+			return false
+		}
+		if b.ack != nil && FlowControlled(f.Type) {
+			if consumed++; consumed >= StreamWindow/2 {
+				b.ack(consumed)
+				consumed = 0
+			}
+		}
+		return true
+	}
+	for {
+		select {
+		case f := <-b.queue:
+			if !hand(f) {
+				return
+			}
+		case <-b.stop:
+			for {
+				select {
+				case f := <-b.queue:
+					if !hand(f) {
+						return
+					}
+				default:
+					if b.last != nil {
+						hand(b.last)
+					}
+					return
+				}
+			}
+		}
+	}
+}
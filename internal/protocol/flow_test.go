@@ -0,0 +1,121 @@
+package protocol
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_window_waits_for_credit(t *testing.T) {
+	w := NewWindow()
+	for i := 0; i < StreamWindow; i++ {
+		if err := w.Take(nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	taken := make(chan error, 1)
+	go func() { taken <- w.Take(nil) }()
+	select {
+	case <-taken:
+		t.Fatal("take should wait once the window is used up")
+	case <-time.After(50 * time.Millisecond):
+	}
+	w.Add(1)
+	if err := <-taken; err != nil {
+		t.Fatalf("take after credit returned %v", err)
+	}
+
+	go func() { taken <- w.Take(nil) }()
+	w.Close()
+	if err := <-taken; err != ErrStreamReset {
+		t.Errorf("take on a closed window returned %v, want ErrStreamReset", err)
+	}
+	done := make(chan struct{})
+	close(done)
+	if err := NewWindow().Take(done); err != nil {
+		t.Errorf("credit should be used before done is checked, got %v", err)
+	}
+}
+
+func Test_inbox_acks_consumed_data(t *testing.T) {
+	acks := make(chan uint32, 8)
+	b := NewInbox(func(n uint32) { acks <- n }, nil)
+
+	for i := 0; i < StreamWindow; i++ {
+		if !b.Deliver(&Frame{Type: TypeStreamData}, nil) {
+			t.Fatalf("frame %d within the window refused", i)
+		}
+	}
+	b.Deliver(&Frame{Type: TypeStreamClose}, nil)
+	select {
+	case n := <-acks:
+		t.Fatalf("credit %d returned before anything was consumed", n)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	frames := b.Frames()
+	for i := 0; i < StreamWindow/2; i++ {
+		<-frames
+	}
+	select {
+	case n := <-acks:
+		if n != StreamWindow/2 {
+			t.Errorf("credit %d, want %d", n, StreamWindow/2)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no credit returned after half a window was consumed")
+	}
+
+	b.Close()
+	n := 0
+	for f := range frames {
+		n++
+		if f.Type == TypeStreamClose && n != StreamWindow/2+1 {
+			t.Errorf("close handed over out of order, at %d", n)
+		}
+	}
+	if n != StreamWindow/2+1 {
+		t.Errorf("%d frames read after close, want %d", n, StreamWindow/2+1)
+	}
+}
+
+func Test_inbox_overrun_is_refused(t *testing.T) {
+	b := NewInbox(func(uint32) {}, nil)
+	defer b.Close()
+	refused := false
+	for i := 0; i < StreamBuffer+2; i++ {
+		if !b.Deliver(&Frame{Type: TypeStreamData}, nil) {
+			refused = true
+			break
+		}
+	}
+	if !refused {
+		t.Fatal("a sender overrunning its window should be refused, not waited for")
+	}
+}
+
+func Test_inbox_close_unblocks_delivery(t *testing.T) {
+	// without flow control a full inbox makes Deliver wait
+	b := NewInbox(nil, nil)
+	delivered := make(chan bool)
+	go func() {
+		for i := 0; i < StreamBuffer+2; i++ {
+			b.Deliver(&Frame{Type: TypeStreamData}, nil)
+		}
+		delivered <- true
+	}()
+	select {
+	case <-delivered:
+		t.Fatal("delivery to a full inbox should wait")
+	case <-time.After(50 * time.Millisecond):
+	}
+	b.Close()
+	select {
+	case <-delivered:
+	case <-time.After(time.Second):
+		t.Fatal("close should release a waiting delivery")
+	}
+	if !b.Deliver(&Frame{Type: TypeStreamData}, nil) || !b.Offer(&Frame{Type: TypeStreamData}) {
+		t.Error("frames for a closed inbox should be dropped, not refused")
+	}
+}
@@ -16,6 +16,34 @@ const (
 	TypePong           uint8 = 6
 	TypeAuthChallenge  uint8 = 7
 	TypeAuthResponse   uint8 = 8
+	TypeDrain          uint8 = 9
+	// TypeRefuseStream rejects a single stream the agent has no capacity
+	// for. the stream was not processed and may be retried elsewhere.
+	TypeRefuseStream uint8 = 10
+	// TypeStreamOpen starts a bidirectional byte stream. TypeStreamData
+	// carries its bytes either way, TypeStreamClose ends one direction and
+	// TypeStreamReset aborts both.
+	TypeStreamOpen  uint8 = 11
+	TypeStreamData  uint8 = 12
+	TypeStreamReset uint8 = 13
+	// TypeStreamHead carries the whole head of a response whose body
+	// follows as TypeStreamData frames, delivered as it arrives.
+	TypeStreamHead uint8 = 14
+	// TypeStreamTrailers carries a streamed response's trailers after its
+	// last data frame.
+	TypeStreamTrailers uint8 = 15
+	// TypeDatagram carries one udp datagram of a flow opened with
+	// TypeStreamOpen. delivery is best effort; a flow ends with a
+	// TypeStreamClose from either side, which the other answers.
+	TypeDatagram uint8 = 16
+	// TypeHealth tells the relay whether the agent has a healthy backend:
+	// a one-byte payload, 1 if it has and 0 if not. a tunnel counts as
+	// healthy until told otherwise.
+	TypeHealth uint8 = 17
+	// TypeWindowUpdate returns flow control credit on a stream: a 4-byte
+	// count of TypeStreamData and TypeBodyChunk frames the receiver has
+	// consumed. only sent on tunnels that negotiated flow control.
+	TypeWindowUpdate uint8 = 18
 )
 
 // header size: 1 byte type + 4 byte stream id + 4 byte payload length.
@@ -60,6 +88,33 @@ func _decode_header(buf []byte) (msgType uint8, streamID uint32, payloadLen uint
 	return msgType, streamID, payloadLen, nil
 }
 
+// Drain is the payload of a TypeDrain frame. the sender will not accept
+// streams above LastStreamID; streams up to it are still completed.
+type Drain struct {
+	LastStreamID uint32
+	Reason       string
+}
+
+// MarshalDrain encodes a drain payload as a 4-byte last stream id
+// followed by the reason text.
+func MarshalDrain(d *Drain) []byte {
+	buf := make([]byte, 4+len(d.Reason))
+	binary.BigEndian.PutUint32(buf[0:4], d.LastStreamID)
+	copy(buf[4:], d.Reason)
+	return buf
+}
+
+// UnmarshalDrain decodes a drain payload.
+func UnmarshalDrain(payload []byte) (*Drain, error) {
+	if len(payload) < 4 {
+		return nil, fmt.Errorf("drain payload too short: %d bytes", len(payload))
+	}
+	return &Drain{
+		LastStreamID: binary.BigEndian.Uint32(payload[0:4]),
+		Reason:       string(payload[4:]),
+	}, nil
+}
+
 // MarshalFrame serialises a frame into bytes (header + payload).
 func MarshalFrame(f *Frame) ([]byte, error) {
 	if len(f.Payload) > MaxPayloadSize {
@@ -86,7 +86,9 @@ func Test_all_message_types_round_trip(t *testing.T) {
 	types := []uint8{
 		TypeHTTPRequest, TypeHTTPResponse, TypeBodyChunk,
 		TypeStreamClose, TypePing, TypePong,
-		TypeAuthChallenge, TypeAuthResponse,
+		TypeAuthChallenge, TypeAuthResponse, TypeDrain, TypeRefuseStream,
+		TypeStreamOpen, TypeStreamData, TypeStreamReset, TypeStreamHead,
+		TypeStreamTrailers, TypeDatagram,
 	}
 
 	for _, msgType := range types {
@@ -122,3 +124,22 @@ func Test_next_stream_id_is_unique(t *testing.T) {
 		t.Errorf("expected monotonically increasing ids, got %d then %d", id1, id2)
 	}
 }
+
+func Test_drain_round_trip(t *testing.T) {
+	original := &Drain{LastStreamID: 77, Reason: "shutting down"}
+
+	decoded, err := UnmarshalDrain(MarshalDrain(original))
+	if err != nil {
+		t.Fatalf("unmarshal failed: %v", err)
+	}
+	if *decoded != *original {
+		t.Errorf("drain mismatch: got %+v, want %+v", decoded, original)
+	}
+}
+
+func Test_unmarshal_drain_rejects_short_payload(t *testing.T) {
+	_, err := UnmarshalDrain([]byte{0x00, 0x01})
+	if err == nil {
+		t.Fatal("expected error for short drain payload")
+	}
+}
@@ -0,0 +1,126 @@
+package protocol
+
+import (
+	"errors"
+	"io"
+	"net"
+)
+
+// ErrStreamReset is returned by Splice when the peer aborted the stream.
+var ErrStreamReset = errors.New("stream reset by peer")
+
+// ErrStreamLost is returned by Splice when the tunnel went away before the
+// peer finished the stream.
+var ErrStreamLost = errors.New("tunnel closed during stream")
+
+// Splice copies bytes between a local connection and a tunnel stream until
+// both directions finish. r reads from conn and may hold bytes already
+// buffered from it. in delivers the peer's frames for the stream and is
+// closed when the stream is forgotten; send writes frames to the peer.
+// end of input on either side is passed on as a half-close, errors as a
+// reset. a reset from the peer is answered with one so both ends forget
+// the stream. conn is closed on return.
+func Splice(conn net.Conn, r io.Reader, streamID uint32, in <-chan *Frame, send func(*Frame) error) error {
+	outDone := make(chan error, 1)
+	go func() {
+		err := CopyToStream(r, streamID, send)
+		if err == nil {
+			err = send(&Frame{Type: TypeStreamClose, StreamID: streamID})
+		}
+		outDone <- err
+	}()
+
+	var result error
+	resetSent := false
+	abort := func(err error, notify bool) {
+		if result == nil {
+			result = err
+		}
+		if notify && !resetSent {
+			resetSent = true
+			send(&Frame{Type: TypeStreamReset, StreamID: streamID})
+		}
+		conn.Close()
+	}
+
+	inDone, outFinished := false, false
+	for !inDone || !outFinished {
+		select {
+		case f, ok := <-in:
+			if !ok {
+				in = nil
+				if !inDone {
+					inDone = true
+					abort(ErrStreamLost, false)
+				}
+				continue
+			}
+			switch f.Type {
+			case TypeStreamData:
+				if inDone {
+					continue
+				}
+				if _, err := conn.Write(f.Payload); err != nil {
+					inDone = true
+					abort(err, true)
+				}
+			case TypeStreamClose:
+				if !inDone {
+					inDone = true
+					_close_write(conn)
+				}
+			case TypeStreamReset:
+				// also ends the other direction after a half-close
+				inDone = true
+				abort(ErrStreamReset, true)
+			}
+		case err := <-outDone:
+			outFinished = true
+			if err != nil && !inDone {
+				inDone = true
+				abort(err, true)
+			}
+		}
+	}
+	conn.Close()
+
+	// frames may still arrive until the peer sees the close; never leave
+	// the tunnel's read loop blocked on them
+	if in != nil {
+		go func() {
+			for range in {
+			}
+		}()
+	}
+	return result
+}
+
+// CopyToStream sends everything read from r as stream data frames. it
+// returns nil at end of input, leaving the caller to end the stream.
+func CopyToStream(r io.Reader, streamID uint32, send func(*Frame) error) error {
+	buf := make([]byte, MaxPayloadSize)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if err := send(&Frame{Type: TypeStreamData, StreamID: streamID, Payload: buf[:n]}); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// _close_write shuts the write side of conn, or all of it if it cannot
+// be half-closed.
+func _close_write(conn net.Conn) {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+		return
+	}
+	conn.Close()
+}
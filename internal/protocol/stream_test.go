@@ -0,0 +1,108 @@
+package protocol
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// _tcp_pair returns two ends of a loopback tcp connection.
+func _tcp_pair(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, _ := ln.Accept()
+		accepted <- c
+	}()
+	a, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := <-accepted
+	t.Cleanup(func() { a.Close(); b.Close() })
+	return a, b
+}
+
+// _spliced connects two local connections through a pair of spliced
+// streams, as the relay and agent would, and returns the splice results.
+func _spliced(t *testing.T, left, right net.Conn) (<-chan error, <-chan error) {
+	t.Helper()
+	toRight := make(chan *Frame, 64)
+	toLeft := make(chan *Frame, 64)
+	// a tunnel read loop: forward frames and forget the stream once closed
+	forward := func(ch chan *Frame) func(*Frame) error {
+		closed := false
+		return func(f *Frame) error {
+			if closed {
+				return nil
+			}
+			payload := append([]byte(nil), f.Payload...)
+			ch <- &Frame{Type: f.Type, StreamID: f.StreamID, Payload: payload}
+			if f.Type == TypeStreamClose || f.Type == TypeStreamReset {
+				closed = true
+				close(ch)
+			}
+			return nil
+		}
+	}
+	leftDone := make(chan error, 1)
+	rightDone := make(chan error, 1)
+	go func() { leftDone <- Splice(left, left, 1, toLeft, forward(toRight)) }()
+	go func() { rightDone <- Splice(right, right, 1, toRight, forward(toLeft)) }()
+	return leftDone, rightDone
+}
+
+func Test_splice_copies_both_ways_with_half_close(t *testing.T) {
+	client, left := _tcp_pair(t)
+	right, server := _tcp_pair(t)
+	leftDone, rightDone := _spliced(t, left, right)
+
+	client.Write([]byte("hello"))
+	client.(*net.TCPConn).CloseWrite()
+
+	got, err := io.ReadAll(server)
+	if err != nil || string(got) != "hello" {
+		t.Fatalf("server read %q, %v", got, err)
+	}
+	// the server can still answer after the client finished sending
+	server.Write([]byte("world"))
+	server.Close()
+
+	got, err = io.ReadAll(client)
+	if err != nil || string(got) != "world" {
+		t.Fatalf("client read %q, %v", got, err)
+	}
+	for _, done := range []<-chan error{leftDone, rightDone} {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Errorf("splice returned %v", err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("splice did not finish")
+		}
+	}
+}
+
+func Test_splice_reports_lost_tunnel(t *testing.T) {
+	_, conn := _tcp_pair(t)
+	in := make(chan *Frame)
+	done := make(chan error, 1)
+	go func() { done <- Splice(conn, conn, 1, in, func(*Frame) error { return nil }) }()
+	close(in)
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrStreamLost) {
+			t.Errorf("expected ErrStreamLost, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("splice did not finish")
+	}
+}
@@ -0,0 +1,161 @@
+package relay
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// IPFilter admits or rejects client addresses by cidr.
+type IPFilter struct {
+	allow []netip.Prefix
+	deny  []netip.Prefix
+}
+
+// NewIPFilter parses allow and deny lists. bare addresses are treated as
+// single-host prefixes.
+func NewIPFilter(cfg *IPFilterConfig) (*IPFilter, error) {
+	allow, err := _parse_prefixes(cfg.Allow)
+	if err != nil {
+		return nil, fmt.Errorf("allow: %w", err)
+	}
+	deny, err := _parse_prefixes(cfg.Deny)
+	if err != nil {
+		return nil, fmt.Errorf("deny: %w", err)
+	}
+	return &IPFilter{allow: allow, deny: deny}, nil
+}
+
+// Allows reports whether addr passes the filter. a nil filter allows all.
+func (f *IPFilter) Allows(addr netip.Addr) bool {
+	if f == nil {
+		return true
+	}
+	if _prefixes_contain(f.deny, addr) {
+		return false
+	}
+	return len(f.allow) == 0 || _prefixes_contain(f.allow, addr)
+}
+
+// AccessPolicy holds the global and per-group filters and works out the
+// client address of a request.
+type AccessPolicy struct {
+	global       *IPFilter
+	groups       map[string]*IPFilter
+	trusted      []netip.Prefix
+	forwardedFor bool
+}
+
+// NewAccessPolicy builds the access policy from configuration.
+func NewAccessPolicy(cfg *AccessConfig) (*AccessPolicy, error) {
+	global, err := NewIPFilter(&cfg.IPFilterConfig)
+	if err != nil {
+		return nil, fmt.Errorf("access: %w", err)
+	}
+	trusted, err := _parse_prefixes(cfg.TrustedProxies)
+	if err != nil {
+		return nil, fmt.Errorf("access.trusted_proxies: %w", err)
+	}
+	p := &AccessPolicy{
+		global:       global,
+		groups:       make(map[string]*IPFilter),
+		trusted:      trusted,
+		forwardedFor: cfg.ForwardedFor,
+	}
+	for group, gc := range cfg.Groups {
+		f, err := NewIPFilter(&gc)
+		if err != nil {
+			return nil, fmt.Errorf("access.groups.%s: %w", group, err)
+		}
+		p.groups[group] = f
+	}
+	return p, nil
+}
+
+// Global returns the filter applied to every request.
+func (p *AccessPolicy) Global() *IPFilter {
+	return p.global
+}
+
+// Group returns the filter for an agent group, or nil if it has none.
+func (p *AccessPolicy) Group(group string) *IPFilter {
+	return p.groups[_group_name(group)]
+}
+
+// Trusted reports whether addr is a trusted proxy.
+func (p *AccessPolicy) Trusted(addr netip.Addr) bool {
+	return _prefixes_contain(p.trusted, addr)
+}
+
+// ClientAddr returns the address of the client behind a request. when
+// forwarded_for is on and the peer is trusted, x-forwarded-for is read
+// right to left and the first untrusted hop is the client.
+func (p *AccessPolicy) ClientAddr(r *http.Request) (netip.Addr, bool) {
+	peer, ok := _remote_addr(r.RemoteAddr)
+	if !ok || !p.forwardedFor || !p.Trusted(peer) {
+		return peer, ok
+	}
+
+	var hops []string
+	for _, v := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(v, ",")...)
+	}
+	client := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		client = addr.Unmap()
+		if !p.Trusted(client) {
+			break
+		}
+	}
+	return client, true
+}
+
+// _remote_addr parses an http.Request RemoteAddr.
+func _remote_addr(remote string) (netip.Addr, bool) {
+	host, _, err := net.SplitHostPort(remote)
+	if err != nil {
+		host = remote
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
+
+// _parse_prefixes parses cidrs and bare addresses.
+func _parse_prefixes(entries []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, e := range entries {
+		if strings.Contains(e, "/") {
+			prefix, err := netip.ParsePrefix(e)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(e)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+	}
+	return prefixes, nil
+}
+
+// _prefixes_contain reports whether any prefix contains addr.
+func _prefixes_contain(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, p := range prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
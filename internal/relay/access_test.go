@@ -0,0 +1,111 @@
+package relay
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func Test_ip_filter_deny_wins_over_allow(t *testing.T) {
+	f, err := NewIPFilter(&IPFilterConfig{
+		Allow: []string{"10.0.0.0/8", "2001:db8::/32", "192.0.2.7"},
+		Deny:  []string{"10.1.0.0/16"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for addr, want := range map[string]bool{
+		"10.2.3.4":        true,
+		"10.1.2.3":        false,
+		"2001:db8::1":     true,
+		"192.0.2.7":       true,
+		"192.0.2.8":       false,
+		"::ffff:10.2.3.4": true,
+		"198.51.100.1":    false,
+	} {
+		if got := f.Allows(netip.MustParseAddr(addr).Unmap()); got != want {
+			t.Errorf("%s: allowed=%v, want %v", addr, got, want)
+		}
+	}
+
+	if _, err := NewIPFilter(&IPFilterConfig{Allow: []string{"10.0.0.0/33"}}); err == nil {
+		t.Error("expected invalid cidr to be rejected")
+	}
+}
+
+func Test_access_client_addr_from_trusted_proxies(t *testing.T) {
+	p, err := NewAccessPolicy(&AccessConfig{
+		TrustedProxies: []string{"10.0.0.0/8"},
+		ForwardedFor:   true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		remote string
+		xff    string
+		want   string
+	}{
+		// untrusted peers cannot set their address
+		{"198.51.100.1:1234", "192.0.2.1", "198.51.100.1"},
+		// first untrusted hop from the right is the client
+		{"10.0.0.1:1234", "203.0.113.9, 192.0.2.1, 10.0.0.2", "192.0.2.1"},
+		{"10.0.0.1:1234", "", "10.0.0.1"},
+		// garbage stops the walk at the last good hop
+		{"10.0.0.1:1234", "192.0.2.1, bogus, 10.0.0.2", "10.0.0.2"},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "http://app.example.com/", nil)
+		r.RemoteAddr = c.remote
+		if c.xff != "" {
+			r.Header.Set("X-Forwarded-For", c.xff)
+		}
+		got, ok := p.ClientAddr(r)
+		if !ok || got != netip.MustParseAddr(c.want) {
+			t.Errorf("%s / %q: client %v, want %s", c.remote, c.xff, got, c.want)
+		}
+	}
+}
+
+func Test_handler_applies_access_lists(t *testing.T) {
+	router, err := NewRouter([]RouteConfig{
+		{Host: "tools.example.com", Group: "tools", Access: &IPFilterConfig{Allow: []string{"10.0.0.0/8"}}},
+		{Host: "app.example.com", Group: "app"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	access, err := NewAccessPolicy(&AccessConfig{
+		IPFilterConfig: IPFilterConfig{Deny: []string{"203.0.113.0/24"}},
+		Groups:         map[string]IPFilterConfig{"app": {Deny: []string{"10.9.0.0/16"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewHandler(NewPool(), router, access, &Limits{}, time.Second, 0)
+
+	cases := []struct {
+		url    string
+		remote string
+		status int
+	}{
+		{"http://app.example.com/", "203.0.113.5:1", http.StatusForbidden},
+		{"http://tools.example.com/", "192.0.2.1:1", http.StatusForbidden},
+		{"http://app.example.com/", "10.9.1.1:1", http.StatusForbidden},
+		// allowed through to tunnel selection, which has no agents
+		{"http://tools.example.com/", "10.1.1.1:1", http.StatusBadGateway},
+		{"http://app.example.com/", "192.0.2.1:1", http.StatusBadGateway},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", c.url, nil)
+		r.RemoteAddr = c.remote
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != c.status {
+			t.Errorf("%s from %s: status %d, want %d", c.url, c.remote, w.Code, c.status)
+		}
+	}
+}
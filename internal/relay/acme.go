@@ -0,0 +1,81 @@
+package relay
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// _new_acme_manager creates an autocert manager that issues certificates
+// on demand via tls-alpn-01 or http-01, stores them in the cache dir and
+// renews them before expiry. allowed decides which hostnames may be issued.
+func _new_acme_manager(cfg *ACMEConfig, allowed func(host string) bool) (*autocert.Manager, error) {
+	client := &acme.Client{DirectoryURL: cfg.DirectoryURL}
+	if cfg.CAFile != "" {
+		// e.g. a local pebble instance with its own root
+		httpClient, err := _acme_http_client(cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		client.HTTPClient = httpClient
+	}
+
+	return &autocert.Manager{
+		Prompt:      autocert.AcceptTOS,
+		Cache:       autocert.DirCache(cfg.CacheDir),
+		Email:       cfg.Email,
+		RenewBefore: cfg.RenewBefore,
+		Client:      client,
+		HostPolicy: func(_ context.Context, host string) error {
+			if allowed(host) {
+				return nil
+			}
+			return fmt.Errorf("acme: host %q is not in the routing table", host)
+		},
+	}, nil
+}
+
+// _acme_http_client returns an http client that trusts the given ca bundle
+// when talking to the acme directory.
+func _acme_http_client(caFile string) (*http.Client, error) {
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading acme ca file: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in acme ca file %s", caFile)
+	}
+	return &http.Client{
+		Timeout: 30 * time.Second,
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{RootCAs: pool},
+		},
+	}, nil
+}
+
+// _acme_host_allowed reports whether a certificate may be issued for host.
+// wildcard routes do not count: any label under them would place an
+// order, so they need a static certificate.
+func (s *Server) _acme_host_allowed(host string) bool {
+	for _, h := range s._config().TLS.ACME.Hosts {
+		if strings.EqualFold(h, host) {
+			return true
+		}
+	}
+	for _, rt := range s.handler.Router().Routes() {
+		if rt.Host != "" && !strings.HasPrefix(rt.Host, "*.") && strings.EqualFold(rt.Host, host) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,361 @@
+package relay
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+// _acme_config returns a relay config issuing certificates from
+// directoryURL for its routes plus extra.example.com, cached in dir.
+func _acme_config(dir, directoryURL, caFile, routes string) string {
+	return fmt.Sprintf(`
+listen:
+  addr: "127.0.0.1:0"
+auth:
+  shared_secret: "secret"
+tls:
+  enabled: true
+  acme:
+    enabled: true
+    directory_url: %q
+    ca_file: %q
+    cache_dir: %q
+    http_addr: "127.0.0.1:0"
+    hosts:
+      - "extra.example.com"
+routes:
+%s`, directoryURL, caFile, filepath.Join(dir, "certs"), routes)
+}
+
+// _acme_server creates a relay from a config written to dir, returning
+// it and the config's path.
+func _acme_server(t *testing.T, dir, config string) (*Server, string) {
+	t.Helper()
+	path := filepath.Join(dir, "relay.yaml")
+	_write_config(t, path, config)
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("loading config: %v", err)
+	}
+	s, err := NewServer(cfg)
+	if err != nil {
+		t.Fatalf("creating server: %v", err)
+	}
+	return s, path
+}
+
+func Test_acme_host_allowed(t *testing.T) {
+	routes := `  - host: "app.example.com"
+  - host: "*.wild.example.com"
+  - path_prefix: "/"
+`
+	dir := t.TempDir()
+	s, path := _acme_server(t, dir, _acme_config(dir, "https://acme.invalid/directory", "", routes))
+
+	for host, want := range map[string]bool{
+		"app.example.com":      true,
+		"App.Example.COM":      true,
+		"extra.example.com":    true,
+		"EXTRA.example.com":    true,
+		"a.wild.example.com":   false,
+		"a.b.wild.example.com": false,
+		"wild.example.com":     false,
+		"other.example.com":    false,
+		"":                     false,
+	} {
+		if got := s._acme_host_allowed(host); got != want {
+			t.Errorf("%q: allowed %v, want %v", host, got, want)
+		}
+	}
+
+	// the policy follows the routing table across reloads
+	_write_config(t, path, _acme_config(dir, "https://acme.invalid/directory", "", `  - host: "new.example.com"
+`))
+	if _, err := s.Reload(); err != nil {
+		t.Fatalf("reload failed: %v", err)
+	}
+	if !s._acme_host_allowed("new.example.com") || s._acme_host_allowed("app.example.com") {
+		t.Error("acme host policy did not follow the reloaded routes")
+	}
+}
+
+func Test_acme_http_client(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := _acme_http_client(filepath.Join(dir, "missing.pem")); err == nil {
+		t.Error("expected an error for a missing ca file")
+	}
+	empty := filepath.Join(dir, "empty.pem")
+	_write_config(t, empty, "not a certificate")
+	if _, err := _acme_http_client(empty); err == nil {
+		t.Error("expected an error for a ca file without certificates")
+	}
+
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "directory")
+	}))
+	defer srv.Close()
+	caFile := filepath.Join(dir, "ca.pem")
+	_write_config(t, caFile, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})))
+	client, err := _acme_http_client(caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("client should trust the ca file: %v", err)
+	}
+	resp.Body.Close()
+	if _, err := http.Get(srv.URL); err == nil {
+		t.Error("the default client should not trust the test ca")
+	}
+}
+
+// _fake_acme is a minimal rfc 8555 directory for one order at a time. it
+// validates http-01 challenges by fetching them from challengeAddr and
+// signs any csr with a ca of its own.
+type _fake_acme struct {
+	srv    *httptest.Server
+	caFile string
+	caKey  *ecdsa.PrivateKey
+	ca     *x509.Certificate
+
+	mu            sync.Mutex
+	nonce         int
+	challengeAddr string
+	accountKey    crypto.PublicKey
+	orders        int
+	domain        string
+	token         string
+	authz         string
+	order         string
+	chain         []byte
+}
+
+func _start_fake_acme(t *testing.T) *_fake_acme {
+	t.Helper()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "fake acme ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _ := x509.ParseCertificate(der)
+
+	f := &_fake_acme{caKey: caKey, ca: ca}
+	f.srv = httptest.NewTLSServer(http.HandlerFunc(f._serve))
+	t.Cleanup(f.srv.Close)
+	f.caFile = filepath.Join(t.TempDir(), "acme-ca.pem")
+	_write_config(t, f.caFile, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: f.srv.Certificate().Raw})))
+	return f
+}
+
+func (f *_fake_acme) _serve(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.nonce++
+	w.Header().Set("Replay-Nonce", fmt.Sprintf("nonce-%d", f.nonce))
+	base := f.srv.URL
+	if r.URL.Path == "/directory" {
+		json.NewEncoder(w).Encode(map[string]string{
+			"newNonce":   base + "/new-nonce",
+			"newAccount": base + "/new-account",
+			"newOrder":   base + "/new-order",
+			"revokeCert": base + "/revoke-cert",
+			"keyChange":  base + "/key-change",
+		})
+		return
+	}
+	if r.Method != http.MethodPost {
+		return
+	}
+
+	var jws struct{ Protected, Payload string }
+	var protected struct{ JWK *_jwk }
+	if err := json.NewDecoder(r.Body).Decode(&jws); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	header, _ := base64.RawURLEncoding.DecodeString(jws.Protected)
+	json.Unmarshal(header, &protected)
+	payload, _ := base64.RawURLEncoding.DecodeString(jws.Payload)
+
+	switch r.URL.Path {
+	case "/new-account":
+		f.accountKey, _ = protected.JWK._public_key()
+		w.Header().Set("Location", base+"/account")
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, `{"status":"valid"}`)
+	case "/new-order":
+		var req struct{ Identifiers []struct{ Value string } }
+		json.Unmarshal(payload, &req)
+		f.orders++
+		f.domain = req.Identifiers[0].Value
+		f.token = fmt.Sprintf("token-%d", f.orders)
+		f.authz, f.order, f.chain = "pending", "pending", nil
+		w.Header().Set("Location", base+"/order")
+		w.WriteHeader(http.StatusCreated)
+		f._write_order(w)
+	case "/order":
+		f._write_order(w)
+	case "/authz":
+		f._write_authz(w)
+	case "/challenge":
+		f._validate()
+		json.NewEncoder(w).Encode(f._challenge())
+	case "/finalize":
+		var req struct{ CSR string }
+		json.Unmarshal(payload, &req)
+		csrDER, _ := base64.RawURLEncoding.DecodeString(req.CSR)
+		if err := f._issue(csrDER); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Location", base+"/order")
+		f._write_order(w)
+	case "/certificate":
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		w.Write(f.chain)
+	}
+}
+
+// _validate fetches the http-01 response the way a ca would.
+func (f *_fake_acme) _validate() {
+	thumbprint, _ := acme.JWKThumbprint(f.accountKey)
+	req, _ := http.NewRequest("GET", "http://"+f.challengeAddr+"/.well-known/acme-challenge/"+f.token, nil)
+	req.Host = f.domain
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		f.authz = "invalid"
+		return
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != f.token+"."+thumbprint {
+		f.authz = "invalid"
+		return
+	}
+	f.authz, f.order = "valid", "ready"
+}
+
+// _issue signs a certificate for the order's csr.
+func (f *_fake_acme) _issue(csrDER []byte) error {
+	csr, err := x509.ParseCertificateRequest(csrDER)
+	if err != nil {
+		return err
+	}
+	if f.order != "ready" || len(csr.DNSNames) != 1 || csr.DNSNames[0] != f.domain {
+		return fmt.Errorf("order not ready for %v", csr.DNSNames)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(int64(f.orders + 1)),
+		Subject:      pkix.Name{CommonName: f.domain},
+		DNSNames:     csr.DNSNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, f.ca, csr.PublicKey, f.caKey)
+	if err != nil {
+		return err
+	}
+	f.chain = append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: f.ca.Raw})...)
+	f.order = "valid"
+	return nil
+}
+
+func (f *_fake_acme) _write_order(w http.ResponseWriter) {
+	order := map[string]any{
+		"status":         f.order,
+		"identifiers":    []map[string]string{{"type": "dns", "value": f.domain}},
+		"authorizations": []string{f.srv.URL + "/authz"},
+		"finalize":       f.srv.URL + "/finalize",
+	}
+	if f.order == "valid" {
+		order["certificate"] = f.srv.URL + "/certificate"
+	}
+	json.NewEncoder(w).Encode(order)
+}
+
+func (f *_fake_acme) _write_authz(w http.ResponseWriter) {
+	json.NewEncoder(w).Encode(map[string]any{
+		"status":     f.authz,
+		"identifier": map[string]string{"type": "dns", "value": f.domain},
+		"challenges": []any{f._challenge()},
+	})
+}
+
+func (f *_fake_acme) _challenge() map[string]string {
+	return map[string]string{"type": "http-01", "url": f.srv.URL + "/challenge", "token": f.token, "status": f.authz}
+}
+
+func Test_acme_issues_certificates_for_routed_hosts(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping acme issuance in short mode")
+	}
+	ca := _start_fake_acme(t)
+	dir := t.TempDir()
+	s, _ := _acme_server(t, dir, _acme_config(dir, ca.srv.URL+"/directory", ca.caFile, `  - host: "app.example.com"
+`))
+	challenges := httptest.NewServer(s.acmeHTTP.Handler)
+	defer challenges.Close()
+	ca.mu.Lock()
+	ca.challengeAddr = strings.TrimPrefix(challenges.URL, "http://")
+	ca.mu.Unlock()
+
+	cert, err := s._get_certificate(&tls.ClientHelloInfo{ServerName: "app.example.com"})
+	if err != nil {
+		t.Fatalf("issuing a certificate: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := leaf.VerifyHostname("app.example.com"); err != nil || leaf.Issuer.CommonName != "fake acme ca" {
+		t.Errorf("unexpected certificate for %v from %q: %v", leaf.DNSNames, leaf.Issuer.CommonName, err)
+	}
+
+	// issued once, then served from the cache
+	if _, err := s._get_certificate(&tls.ClientHelloInfo{ServerName: "app.example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s._get_certificate(&tls.ClientHelloInfo{ServerName: "other.example.com"}); err == nil {
+		t.Error("a host outside the routing table should not get a certificate")
+	}
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	if ca.orders != 1 {
+		t.Errorf("expected one order, got %d", ca.orders)
+	}
+}
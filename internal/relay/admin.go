@@ -0,0 +1,56 @@
+package relay
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// _admin_handler builds the admin api routes.
+func (s *Server) _admin_handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/reload", s._handle_reload)
+	mux.HandleFunc("/metrics", s._handle_metrics)
+	return s._admin_auth(mux)
+}
+
+// _serve_admin runs the admin api listener.
+func (s *Server) _serve_admin() {
+	slog.Info("admin api starting", "addr", s.admin.Addr)
+	if err := s.admin.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		slog.Error("admin api failed", "err", err)
+	}
+}
+
+// _admin_auth requires the configured bearer token. without one every
+// request is refused.
+func (s *Server) _admin_auth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := s._config().Admin.Token
+		given, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token == "" || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			http.Error(w, "unauthorised", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// _handle_reload reloads the configuration file and reports what changed.
+func (s *Server) _handle_reload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	result, err := s.Reload()
+	if err != nil {
+		slog.Error("config reload via admin api failed", "err", err)
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
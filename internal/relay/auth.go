@@ -16,13 +16,24 @@ const _token_validity = 5 * time.Minute
 
 // GenerateToken creates an hmac-sha256 auth token in the format "hmac:timestamp".
 func GenerateToken(secret string) string {
+	return GenerateAgentToken(secret, "")
+}
+
+// GenerateAgentToken creates a token for the agent called name. the hmac
+// covers the name too, so the token is refused for any other name.
+func GenerateAgentToken(secret, name string) string {
 	ts := strconv.FormatInt(time.Now().Unix(), 10)
-	mac := _compute_hmac(secret, ts)
+	mac := _compute_hmac(secret, _token_message(name, ts))
 	return mac + ":" + ts
 }
 
 // ValidateToken checks an hmac-sha256 auth token against the shared secret.
 func ValidateToken(secret, token string) error {
+	return ValidateAgentToken(secret, "", token)
+}
+
+// ValidateAgentToken checks a token made by GenerateAgentToken for name.
+func ValidateAgentToken(secret, name, token string) error {
 	parts := strings.SplitN(token, ":", 2)
 	if len(parts) != 2 {
 		return fmt.Errorf("malformed token: expected hmac:timestamp")
@@ -39,13 +50,21 @@ func ValidateToken(secret, token string) error {
 		return fmt.Errorf("token expired: age %v exceeds %v", diff, _token_validity)
 	}
 
-	expected := _compute_hmac(secret, tsStr)
+	expected := _compute_hmac(secret, _token_message(name, tsStr))
 	if !hmac.Equal([]byte(mac), []byte(expected)) {
 		return fmt.Errorf("invalid hmac signature")
 	}
 	return nil
 }
 
+// _token_message is what a token's hmac is computed over.
+func _token_message(name, ts string) string {
+	if name == "" {
+		return ts
+	}
+	return name + "\x00" + ts
+}
+
 // _compute_hmac generates a hex-encoded hmac-sha256 of the given message.
 func _compute_hmac(secret, message string) string {
 	h := hmac.New(sha256.New, []byte(secret))
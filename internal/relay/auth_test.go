@@ -52,3 +52,16 @@ func Test_token_format(t *testing.T) {
 		t.Errorf("expected exactly one colon in token, got %d: %q", colonCount, token)
 	}
 }
+
+func Test_agent_token_is_bound_to_name(t *testing.T) {
+	token := GenerateAgentToken("secret", "laptop")
+	if err := ValidateAgentToken("secret", "laptop", token); err != nil {
+		t.Fatalf("valid agent token rejected: %v", err)
+	}
+	if err := ValidateAgentToken("secret", "desktop", token); err == nil {
+		t.Error("expected token to be refused for another name")
+	}
+	if err := ValidateToken("secret", token); err == nil {
+		t.Error("expected named token to be refused without its name")
+	}
+}
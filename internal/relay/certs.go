@@ -0,0 +1,203 @@
+package relay
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+// CertStore serves tls certificates chosen by sni from a set of cert/key
+// file pairs. the set is swapped atomically on reload, so handshakes in
+// progress keep the certificate they started with.
+type CertStore struct {
+	pairs    []CertPairConfig
+	current  atomic.Pointer[_cert_set]
+	reloadMu sync.Mutex
+	mtimes   map[string]time.Time
+}
+
+// _cert_set is an immutable snapshot of loaded certificates.
+type _cert_set struct {
+	byName   map[string]*tls.Certificate
+	fallback *tls.Certificate
+}
+
+// NewCertStore loads the given certificate pairs. the first pair is served
+// when no certificate matches the requested server name.
+func NewCertStore(pairs []CertPairConfig) (*CertStore, error) {
+	s := &CertStore{pairs: pairs}
+	set, mtimes, err := _load_cert_set(pairs)
+	if err != nil {
+		return nil, err
+	}
+	s.current.Store(set)
+	s.mtimes = mtimes
+	return s, nil
+}
+
+// Reload re-reads every certificate pair. on any error the previous
+// certificates stay in use.
+func (s *CertStore) Reload() error {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+	set, mtimes, err := _load_cert_set(s.pairs)
+	if err != nil {
+		return err
+	}
+	s.current.Store(set)
+	s.mtimes = mtimes
+	slog.Info("tls certificates reloaded", "pairs", len(s.pairs), "names", len(set.byName))
+	return nil
+}
+
+// SetPairs replaces the configured certificate pairs and loads them. on
+// any error the previous pairs and certificates stay in use.
+func (s *CertStore) SetPairs(pairs []CertPairConfig) error {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+	set, mtimes, err := _load_cert_set(pairs)
+	if err != nil {
+		return err
+	}
+	s.pairs = pairs
+	s.current.Store(set)
+	s.mtimes = mtimes
+	return nil
+}
+
+// Lookup returns the certificate for a server name, or nil if none match.
+func (s *CertStore) Lookup(serverName string) *tls.Certificate {
+	set := s.current.Load()
+	name := strings.ToLower(strings.TrimSuffix(serverName, "."))
+	if cert, ok := set.byName[name]; ok {
+		return cert
+	}
+	if _, rest, ok := strings.Cut(name, "."); ok {
+		if cert, ok := set.byName["*."+rest]; ok {
+			return cert
+		}
+	}
+	return nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (s *CertStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if cert := s.Lookup(hello.ServerName); cert != nil {
+		return cert, nil
+	}
+	return s.current.Load().fallback, nil
+}
+
+// Watch polls the certificate files and reloads when any of them change.
+// returns a function that stops watching.
+func (s *CertStore) Watch(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if !s._changed() {
+					continue
+				}
+				if err := s.Reload(); err != nil {
+					slog.Error("tls certificate reload failed, keeping previous certificates", "err", err)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// _changed reports whether any certificate file has a different mtime
+// from when it was last loaded.
+func (s *CertStore) _changed() bool {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+	for path, mtime := range s.mtimes {
+		info, err := os.Stat(path)
+		if err != nil {
+			// mid-rotation; try again next tick
+			continue
+		}
+		if !info.ModTime().Equal(mtime) {
+			return true
+		}
+	}
+	return false
+}
+
+// _load_cert_set loads all pairs and indexes them by the dns names in
+// their leaf certificates. it also returns the file mtimes it saw.
+func _load_cert_set(pairs []CertPairConfig) (*_cert_set, map[string]time.Time, error) {
+	set := &_cert_set{byName: make(map[string]*tls.Certificate)}
+	mtimes := make(map[string]time.Time)
+	for _, p := range pairs {
+		for _, path := range []string{p.CertFile, p.KeyFile} {
+			info, err := os.Stat(path)
+			if err != nil {
+				return nil, nil, fmt.Errorf("reading certificate file: %w", err)
+			}
+			mtimes[path] = info.ModTime()
+		}
+
+		cert, err := tls.LoadX509KeyPair(p.CertFile, p.KeyFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("loading certificate %s: %w", p.CertFile, err)
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return nil, nil, fmt.Errorf("parsing certificate %s: %w", p.CertFile, err)
+		}
+		cert.Leaf = leaf
+
+		if set.fallback == nil {
+			set.fallback = &cert
+		}
+		names := leaf.DNSNames
+		if len(names) == 0 && leaf.Subject.CommonName != "" {
+			names = []string{leaf.Subject.CommonName}
+		}
+		for _, name := range names {
+			name = strings.ToLower(name)
+			// earlier pairs win for overlapping names
+			if _, ok := set.byName[name]; !ok {
+				set.byName[name] = &cert
+			}
+		}
+	}
+	if set.fallback == nil {
+		return nil, nil, fmt.Errorf("no tls certificates configured")
+	}
+	return set, mtimes, nil
+}
+
+// _get_certificate picks the certificate for a handshake: acme challenges
+// first, then static certificates by sni, then acme issuance for routed
+// hosts, then the default static certificate.
+func (s *Server) _get_certificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if s.acme != nil && slices.Contains(hello.SupportedProtos, acme.ALPNProto) {
+		return s.acme.GetCertificate(hello)
+	}
+	if s.certs != nil {
+		if cert := s.certs.Lookup(hello.ServerName); cert != nil {
+			return cert, nil
+		}
+	}
+	if s.acme != nil && (s.certs == nil || s._acme_host_allowed(hello.ServerName)) {
+		return s.acme.GetCertificate(hello)
+	}
+	return s.certs.GetCertificate(hello)
+}
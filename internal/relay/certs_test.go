@@ -0,0 +1,129 @@
+package relay
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// _write_test_cert writes a self-signed certificate for the given names
+// and returns its cert/key pair.
+func _write_test_cert(t *testing.T, dir, prefix string, names ...string) CertPairConfig {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("creating certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("marshalling key: %v", err)
+	}
+
+	pair := CertPairConfig{
+		CertFile: filepath.Join(dir, prefix+".crt"),
+		KeyFile:  filepath.Join(dir, prefix+".key"),
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(pair.CertFile, certPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(pair.KeyFile, keyPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return pair
+}
+
+func Test_cert_store_selects_by_sni(t *testing.T) {
+	dir := t.TempDir()
+	a := _write_test_cert(t, dir, "a", "a.example.com")
+	b := _write_test_cert(t, dir, "b", "*.b.example.com")
+
+	store, err := NewCertStore([]CertPairConfig{a, b})
+	if err != nil {
+		t.Fatalf("loading store: %v", err)
+	}
+
+	cases := map[string]string{
+		"a.example.com":   "a.example.com",
+		"x.b.example.com": "*.b.example.com",
+		"unknown.example": "a.example.com",
+		"":                "a.example.com",
+	}
+	for sni, want := range cases {
+		cert, err := store.GetCertificate(&tls.ClientHelloInfo{ServerName: sni})
+		if err != nil {
+			t.Fatalf("%q: %v", sni, err)
+		}
+		if got := cert.Leaf.DNSNames[0]; got != want {
+			t.Errorf("%q: served %q, want %q", sni, got, want)
+		}
+	}
+}
+
+func Test_cert_store_reload_swaps_certificates(t *testing.T) {
+	dir := t.TempDir()
+	pair := _write_test_cert(t, dir, "site", "old.example.com")
+
+	store, err := NewCertStore([]CertPairConfig{pair})
+	if err != nil {
+		t.Fatalf("loading store: %v", err)
+	}
+
+	// rotate on disk, push the mtime forward so the watcher notices
+	_write_test_cert(t, dir, "site", "new.example.com")
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(pair.CertFile, later, later)
+
+	if !store._changed() {
+		t.Fatal("expected rotated files to be detected")
+	}
+	if err := store.Reload(); err != nil {
+		t.Fatalf("reload failed: %v", err)
+	}
+	if store.Lookup("new.example.com") == nil {
+		t.Error("expected new certificate after reload")
+	}
+	if store.Lookup("old.example.com") != nil {
+		t.Error("expected old certificate to be gone after reload")
+	}
+}
+
+func Test_cert_store_keeps_previous_on_bad_reload(t *testing.T) {
+	dir := t.TempDir()
+	pair := _write_test_cert(t, dir, "site", "keep.example.com")
+
+	store, err := NewCertStore([]CertPairConfig{pair})
+	if err != nil {
+		t.Fatalf("loading store: %v", err)
+	}
+
+	os.WriteFile(pair.KeyFile, []byte("not a key"), 0o600)
+	if err := store.Reload(); err == nil {
+		t.Fatal("expected reload of a broken key to fail")
+	}
+	if store.Lookup("keep.example.com") == nil {
+		t.Error("expected previous certificate to stay in use")
+	}
+}
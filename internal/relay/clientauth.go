@@ -0,0 +1,190 @@
+package relay
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// default header carrying the authenticated user to the agent.
+const _default_user_header = "X-Auth-User"
+
+// ClientAuth authenticates public clients for a route with http basic
+// (htpasswd), static bearer tokens or jwts.
+type ClientAuth struct {
+	realm        string
+	users        map[string]string
+	tokens       map[string]string
+	jwt          *JWTVerifier
+	userClaim    string
+	userHeader   string
+	claimHeaders map[string]string
+}
+
+// NewClientAuth builds an authenticator, loading the htpasswd and jwks
+// files so that bad files fail at load time rather than per request.
+func NewClientAuth(cfg *ClientAuthConfig) (*ClientAuth, error) {
+	a := &ClientAuth{
+		realm:        cfg.Realm,
+		userHeader:   cfg.UserHeader,
+		claimHeaders: cfg.ClaimHeaders,
+	}
+	if a.realm == "" {
+		a.realm = "relay"
+	}
+	if a.userHeader == "" {
+		a.userHeader = _default_user_header
+	}
+
+	if cfg.HtpasswdFile != "" {
+		users, err := _load_htpasswd(cfg.HtpasswdFile)
+		if err != nil {
+			return nil, err
+		}
+		a.users = users
+	}
+	if len(cfg.BearerTokens) > 0 {
+		a.tokens = make(map[string]string)
+		for _, t := range cfg.BearerTokens {
+			a.tokens[t.Token] = t.User
+		}
+	}
+	if cfg.JWT != nil {
+		v, err := NewJWTVerifier(*cfg.JWT)
+		if err != nil {
+			return nil, err
+		}
+		a.jwt = v
+		a.userClaim = cfg.JWT.UserClaim
+		if a.userClaim == "" {
+			a.userClaim = "sub"
+		}
+	}
+	return a, nil
+}
+
+// Authenticate checks the request credentials. on success the identity
+// headers are set on the request; client-supplied copies are always removed
+// first so they cannot be spoofed.
+func (a *ClientAuth) Authenticate(r *http.Request) error {
+	r.Header.Del(a.userHeader)
+	for _, header := range a.claimHeaders {
+		r.Header.Del(header)
+	}
+
+	scheme, credentials, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	switch {
+	case strings.EqualFold(scheme, "Basic") && a.users != nil:
+		user, password, ok := r.BasicAuth()
+		if !ok || !a._check_password(user, password) {
+			return fmt.Errorf("invalid basic credentials")
+		}
+		r.Header.Set(a.userHeader, user)
+	case strings.EqualFold(scheme, "Bearer") && (a.tokens != nil || a.jwt != nil):
+		if user, ok := a._check_token(credentials); ok {
+			r.Header.Set(a.userHeader, user)
+			break
+		}
+		if a.jwt == nil {
+			return fmt.Errorf("invalid bearer token")
+		}
+		claims, err := a.jwt.Verify(credentials)
+		if err != nil {
+			return err
+		}
+		if user, ok := claims[a.userClaim]; ok {
+			r.Header.Set(a.userHeader, _claim_string(user))
+		}
+		for claim, header := range a.claimHeaders {
+			if value, ok := claims[claim]; ok {
+				r.Header.Set(header, _claim_string(value))
+			}
+		}
+	default:
+		return fmt.Errorf("no supported credentials")
+	}
+
+	// the agent only sees the verified identity, never the credentials
+	r.Header.Del("Authorization")
+	return nil
+}
+
+// Challenge writes a 401 response advertising the configured methods.
+func (a *ClientAuth) Challenge(w http.ResponseWriter) {
+	if a.users != nil {
+		w.Header().Add("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", a.realm))
+	}
+	if a.tokens != nil || a.jwt != nil {
+		w.Header().Add("WWW-Authenticate", fmt.Sprintf("Bearer realm=%q", a.realm))
+	}
+	http.Error(w, "unauthorised", http.StatusUnauthorized)
+}
+
+// _check_password verifies a password against the htpasswd entry.
+func (a *ClientAuth) _check_password(user, password string) bool {
+	return _htpasswd_match(a.users, user, password)
+}
+
+// _htpasswd_match verifies a password against a user's entry from
+// _load_htpasswd.
+func _htpasswd_match(users map[string]string, user, password string) bool {
+	hash, ok := users[user]
+	if !ok {
+		return false
+	}
+	if sha, ok := strings.CutPrefix(hash, "{SHA}"); ok {
+		sum := sha1.Sum([]byte(password))
+		want := base64.StdEncoding.EncodeToString(sum[:])
+		return subtle.ConstantTimeCompare([]byte(sha), []byte(want)) == 1
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// _check_token looks up a static bearer token in constant time per entry.
+func (a *ClientAuth) _check_token(token string) (user string, ok bool) {
+	for t, u := range a.tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			user, ok = u, true
+		}
+	}
+	return user, ok
+}
+
+// _load_htpasswd reads an htpasswd file. only bcrypt and {SHA} hashes are
+// accepted; md5-crypt and plain crypt are rejected.
+func _load_htpasswd(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading htpasswd file: %w", err)
+	}
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("htpasswd %s line %d: malformed entry", path, n)
+		}
+		switch {
+		case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		case strings.HasPrefix(hash, "{SHA}"):
+			slog.Warn("htpasswd entry uses weak sha1 hash", "file", path, "user", user)
+		default:
+			return nil, fmt.Errorf("htpasswd %s line %d: unsupported hash for %q, use bcrypt", path, n, user)
+		}
+		users[user] = hash
+	}
+	return users, nil
+}
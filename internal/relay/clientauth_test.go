@@ -0,0 +1,287 @@
+package relay
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func _new_auth(t *testing.T, cfg *ClientAuthConfig) *ClientAuth {
+	t.Helper()
+	a, err := NewClientAuth(cfg)
+	if err != nil {
+		t.Fatalf("creating auth: %v", err)
+	}
+	return a
+}
+
+func Test_client_auth_basic_htpasswd(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	_write_config(t, path, "# users\nalice:"+string(hash)+"\nbob:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n")
+	a := _new_auth(t, &ClientAuthConfig{HtpasswdFile: path})
+
+	req := httptest.NewRequest("GET", "http://app.example.com/", nil)
+	req.SetBasicAuth("alice", "hunter2")
+	req.Header.Set("X-Auth-User", "mallory")
+	if err := a.Authenticate(req); err != nil {
+		t.Fatalf("expected alice to authenticate: %v", err)
+	}
+	if got := req.Header.Get("X-Auth-User"); got != "alice" {
+		t.Errorf("user header %q, want alice", got)
+	}
+	if req.Header.Get("Authorization") != "" {
+		t.Error("credentials should not be forwarded")
+	}
+
+	req = httptest.NewRequest("GET", "http://app.example.com/", nil)
+	req.SetBasicAuth("bob", "password")
+	if err := a.Authenticate(req); err != nil {
+		t.Errorf("expected sha entry to authenticate: %v", err)
+	}
+
+	req = httptest.NewRequest("GET", "http://app.example.com/", nil)
+	req.SetBasicAuth("alice", "wrong")
+	req.Header.Set("X-Auth-User", "mallory")
+	if err := a.Authenticate(req); err == nil {
+		t.Error("expected wrong password to be rejected")
+	}
+	if req.Header.Get("X-Auth-User") != "" {
+		t.Error("spoofed identity header should be stripped")
+	}
+}
+
+func Test_client_auth_rejects_unsupported_htpasswd_hash(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	_write_config(t, path, "alice:$apr1$abc$def\n")
+	if _, err := NewClientAuth(&ClientAuthConfig{HtpasswdFile: path}); err == nil {
+		t.Fatal("expected md5 hash to be rejected")
+	}
+}
+
+func Test_client_auth_static_bearer_token(t *testing.T) {
+	a := _new_auth(t, &ClientAuthConfig{
+		BearerTokens: []BearerTokenConfig{{User: "ci", Token: "s3cret"}},
+		UserHeader:   "X-User",
+	})
+
+	req := httptest.NewRequest("GET", "http://app.example.com/", nil)
+	req.Header.Set("Authorization", "Bearer s3cret")
+	if err := a.Authenticate(req); err != nil {
+		t.Fatalf("expected token to authenticate: %v", err)
+	}
+	if got := req.Header.Get("X-User"); got != "ci" {
+		t.Errorf("user header %q, want ci", got)
+	}
+
+	req = httptest.NewRequest("GET", "http://app.example.com/", nil)
+	req.Header.Set("Authorization", "Bearer other")
+	if err := a.Authenticate(req); err == nil {
+		t.Error("expected unknown token to be rejected")
+	}
+
+	w := httptest.NewRecorder()
+	a.Challenge(w)
+	if w.Code != 401 || !strings.HasPrefix(w.Header().Get("WWW-Authenticate"), "Bearer") {
+		t.Errorf("unexpected challenge: %d %q", w.Code, w.Header().Get("WWW-Authenticate"))
+	}
+}
+
+// _sign_jwt creates an rs256 token for claims.
+func _sign_jwt(t *testing.T, key *rsa.PrivateKey, kid string, claims map[string]any) string {
+	t.Helper()
+	enc := func(v any) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	signed := enc(map[string]string{"alg": "RS256", "kid": kid}) + "." + enc(claims)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// _jwks returns a jwks document with the public halves of keys.
+func _jwks(keys map[string]*rsa.PrivateKey) []byte {
+	var doc []map[string]string
+	for kid, key := range keys {
+		doc = append(doc, map[string]string{
+			"kty": "RSA",
+			"kid": kid,
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		})
+	}
+	data, _ := json.Marshal(map[string]any{"keys": doc})
+	return data
+}
+
+func Test_client_auth_jwt(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwks := _jwks(map[string]*rsa.PrivateKey{"k1": key})
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, jwks, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	a := _new_auth(t, &ClientAuthConfig{
+		JWT: &JWTConfig{
+			JWKSFile: path,
+			Issuer:   "https://idp.example.com",
+			Audience: "relay",
+			Claims:   map[string]string{"groups": "admins"},
+		},
+		ClaimHeaders: map[string]string{"email": "X-Auth-Email"},
+	})
+
+	valid := func() map[string]any {
+		return map[string]any{
+			"sub":    "user-42",
+			"email":  "u42@example.com",
+			"iss":    "https://idp.example.com",
+			"aud":    []string{"relay", "other"},
+			"groups": []string{"staff", "admins"},
+			"exp":    time.Now().Add(time.Hour).Unix(),
+		}
+	}
+
+	req := httptest.NewRequest("GET", "http://app.example.com/", nil)
+	req.Header.Set("Authorization", "Bearer "+_sign_jwt(t, key, "k1", valid()))
+	if err := a.Authenticate(req); err != nil {
+		t.Fatalf("expected valid jwt to authenticate: %v", err)
+	}
+	if req.Header.Get("X-Auth-User") != "user-42" || req.Header.Get("X-Auth-Email") != "u42@example.com" {
+		t.Errorf("identity headers not forwarded: %v", req.Header)
+	}
+
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, token := range map[string]string{
+		"expired":     _sign_jwt(t, key, "k1", _with_claim(valid(), "exp", time.Now().Add(-time.Hour).Unix())),
+		"issuer":      _sign_jwt(t, key, "k1", _with_claim(valid(), "iss", "https://evil.example.com")),
+		"audience":    _sign_jwt(t, key, "k1", _with_claim(valid(), "aud", "other")),
+		"claim":       _sign_jwt(t, key, "k1", _with_claim(valid(), "groups", []string{"staff"})),
+		"signature":   _sign_jwt(t, other, "k1", valid()),
+		"unknown kid": _sign_jwt(t, key, "k2", valid()),
+		"not a jwt":   "abc",
+		"missing exp": _sign_jwt(t, key, "k1", _with_claim(valid(), "exp", nil)),
+	} {
+		req := httptest.NewRequest("GET", "http://app.example.com/", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("X-Auth-Email", "spoofed@example.com")
+		if err := a.Authenticate(req); err == nil {
+			t.Errorf("%s: expected jwt to be rejected", name)
+		}
+		if req.Header.Get("X-Auth-Email") != "" {
+			t.Errorf("%s: spoofed claim header should be stripped", name)
+		}
+	}
+}
+
+// _with_claim sets a claim, deleting it when value is nil.
+func _with_claim(claims map[string]any, name string, value any) map[string]any {
+	if value == nil {
+		delete(claims, name)
+	} else {
+		claims[name] = value
+	}
+	return claims
+}
+
+func Test_jwks_fetch_does_not_block_known_keys(t *testing.T) {
+	k1, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k2, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fetches atomic.Int32
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fetches.Add(1) == 1 {
+			w.Write(_jwks(map[string]*rsa.PrivateKey{"k1": k1}))
+			return
+		}
+		<-release
+		w.Write(_jwks(map[string]*rsa.PrivateKey{"k1": k1, "k2": k2}))
+	}))
+	defer srv.Close()
+
+	v, err := NewJWTVerifier(JWTConfig{JWKSURL: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := map[string]any{"sub": "user-42", "exp": time.Now().Add(time.Hour).Unix()}
+	if _, err := v.Verify(_sign_jwt(t, k1, "k1", claims)); err != nil {
+		t.Fatal(err)
+	}
+
+	// a rotated key is fetched once, however many tokens ask for it
+	v.mu.Lock()
+	v.fetchedAt = time.Now().Add(-time.Minute)
+	v.mu.Unlock()
+	rotated := _sign_jwt(t, k2, "k2", claims)
+	results := make(chan error, 5)
+	for range 5 {
+		go func() {
+			_, err := v.Verify(rotated)
+			results <- err
+		}()
+	}
+	for fetches.Load() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	verified := make(chan error, 1)
+	go func() {
+		_, err := v.Verify(_sign_jwt(t, k1, "k1", claims))
+		verified <- err
+	}()
+	select {
+	case err := <-verified:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("a known key waited for a jwks fetch")
+	}
+
+	close(release)
+	for range 5 {
+		if err := <-results; err != nil {
+			t.Errorf("rotated key: %v", err)
+		}
+	}
+	if n := fetches.Load(); n != 2 {
+		t.Errorf("expected one fetch for the rotated key, got %d", n-1)
+	}
+}
@@ -2,7 +2,9 @@ package relay
 
 import (
 	"fmt"
+	"net"
 	"os"
+	"strings"
 	"time"
 
 	"gopkg.in/yaml.v3"
@@ -10,10 +12,26 @@ import (
 
 // Config holds the relay server configuration.
 type Config struct {
-	Listen ListenConfig `yaml:"listen"`
-	TLS    TLSConfig    `yaml:"tls"`
-	Auth   AuthConfig   `yaml:"auth"`
-	Tunnel TunnelConfig `yaml:"tunnel"`
+	Listen ListenConfig  `yaml:"listen"`
+	TLS    TLSConfig     `yaml:"tls"`
+	Auth   AuthConfig    `yaml:"auth"`
+	Tunnel TunnelConfig  `yaml:"tunnel"`
+	Routes []RouteConfig `yaml:"routes"`
+	Admin  AdminConfig   `yaml:"admin"`
+	Access AccessConfig  `yaml:"access"`
+
+	RateLimits []RateLimitConfig      `yaml:"rate_limits"`
+	Groups     map[string]GroupConfig `yaml:"groups"`
+	TCP        []TCPForwardConfig     `yaml:"tcp"`
+	UDP        []UDPForwardConfig     `yaml:"udp"`
+	SOCKS      SOCKSConfig            `yaml:"socks"`
+	HTTPProxy  HTTPProxyConfig        `yaml:"http_proxy"`
+	Remote     RemoteConfig           `yaml:"remote"`
+
+	TLSPassthrough TLSPassthroughConfig `yaml:"tls_passthrough"`
+
+	// file the configuration was loaded from, for reloads
+	path string
 }
 
 // ListenConfig specifies the address to bind on.
@@ -21,16 +39,134 @@ type ListenConfig struct {
 	Addr string `yaml:"addr"`
 }
 
-// TLSConfig controls tls certificate settings.
+// TLSConfig controls tls certificate settings. cert_file/key_file and the
+// certificates list may be combined; the certificate is chosen by sni.
 type TLSConfig struct {
-	Enabled  bool   `yaml:"enabled"`
+	Enabled       bool             `yaml:"enabled"`
+	CertFile      string           `yaml:"cert_file"`
+	KeyFile       string           `yaml:"key_file"`
+	Certificates  []CertPairConfig `yaml:"certificates"`
+	WatchInterval time.Duration    `yaml:"watch_interval"`
+	ACME          ACMEConfig       `yaml:"acme"`
+}
+
+// CertPairConfig is a certificate chain and its private key.
+type CertPairConfig struct {
 	CertFile string `yaml:"cert_file"`
 	KeyFile  string `yaml:"key_file"`
 }
 
-// AuthConfig holds the shared secret for hmac authentication.
+// CertPairs returns every configured certificate pair, the top-level
+// cert_file/key_file first.
+func (c *TLSConfig) CertPairs() []CertPairConfig {
+	var pairs []CertPairConfig
+	if c.CertFile != "" || c.KeyFile != "" {
+		pairs = append(pairs, CertPairConfig{CertFile: c.CertFile, KeyFile: c.KeyFile})
+	}
+	return append(pairs, c.Certificates...)
+}
+
+// ACMEConfig controls automatic certificate issuance. certificates are
+// issued on demand for hostnames in the routing table plus any extra hosts.
+type ACMEConfig struct {
+	Enabled      bool          `yaml:"enabled"`
+	DirectoryURL string        `yaml:"directory_url"`
+	Email        string        `yaml:"email"`
+	CacheDir     string        `yaml:"cache_dir"`
+	RenewBefore  time.Duration `yaml:"renew_before"`
+	HTTPAddr     string        `yaml:"http_addr"`
+	CAFile       string        `yaml:"ca_file"`
+	Hosts        []string      `yaml:"hosts"`
+}
+
+// TCPForwardConfig exposes a tcp service behind an agent group on a relay
+// port. the agent dials target, which must be on its tcp allow list.
+type TCPForwardConfig struct {
+	Listen string `yaml:"listen"`
+	Group  string `yaml:"group"`
+	Target string `yaml:"target"`
+}
+
+// UDPForwardConfig forwards udp datagrams on a relay port to target
+// behind an agent group. each client address is a flow of its own, ended
+// after idle_timeout without datagrams either way.
+type UDPForwardConfig struct {
+	Listen      string        `yaml:"listen"`
+	Group       string        `yaml:"group"`
+	Target      string        `yaml:"target"`
+	IdleTimeout time.Duration `yaml:"idle_timeout"`
+}
+
+// SOCKSConfig runs a socks5 server whose connections exit through
+// agents. users authenticate against htpasswd_file and each is mapped to
+// the agent group that carries their connections.
+type SOCKSConfig struct {
+	Listen       string            `yaml:"listen"`
+	HtpasswdFile string            `yaml:"htpasswd_file"`
+	Users        map[string]string `yaml:"users"`
+}
+
+// HTTPProxyConfig runs an http forward proxy whose connections exit
+// through agents. users authenticate with Proxy-Authorization against
+// htpasswd_file and may exit through the groups listed for them, the
+// first unless group_header names another.
+type HTTPProxyConfig struct {
+	Listen       string              `yaml:"listen"`
+	HtpasswdFile string              `yaml:"htpasswd_file"`
+	Users        map[string][]string `yaml:"users"`
+	GroupHeader  string              `yaml:"group_header"`
+}
+
+// TLSPassthroughConfig accepts tls connections on listen without
+// decrypting them. each goes as raw bytes to an agent of the group of the
+// first route matching the client hello's server name.
+type TLSPassthroughConfig struct {
+	Listen string                   `yaml:"listen"`
+	Routes []PassthroughRouteConfig `yaml:"routes"`
+}
+
+// PassthroughRouteConfig sends tls connections for host to group. a
+// leading "*." in host matches one extra label.
+type PassthroughRouteConfig struct {
+	Host  string `yaml:"host"`
+	Group string `yaml:"group"`
+}
+
+// RemoteConfig lets agents ask for public endpoints of their own when
+// they connect: tcp ports from port_range, or subdomains of domain.
+type RemoteConfig struct {
+	PortRange string `yaml:"port_range"`
+	// address the allocated ports are bound on, all interfaces if empty
+	BindHost string `yaml:"bind_host"`
+	Domain   string `yaml:"domain"`
+	// how long an endpoint is kept for its agent after the tunnel closes
+	GracePeriod time.Duration `yaml:"grace_period"`
+	// policies by agent name; "*" applies to agents not listed
+	Agents map[string]RemoteAgentPolicy `yaml:"agents"`
+}
+
+// RemoteAgentPolicy limits the endpoints an agent may hold. ports are
+// single ports or ranges within port_range; subdomains are labels or
+// patterns such as "ci-*", where "*" also allows a generated label.
+type RemoteAgentPolicy struct {
+	Ports      []string `yaml:"ports"`
+	Subdomains []string `yaml:"subdomains"`
+}
+
+// AuthConfig holds the shared secret for hmac authentication. agents
+// listed in agents must sign with their own secret instead, so no other
+// agent can connect under their name.
 type AuthConfig struct {
-	SharedSecret string `yaml:"shared_secret"`
+	SharedSecret string            `yaml:"shared_secret" secret:"true"`
+	Agents       map[string]string `yaml:"agents" secret:"true"`
+}
+
+// AgentSecret returns the secret the agent called name signs with.
+func (c *AuthConfig) AgentSecret(name string) string {
+	if secret, ok := c.Agents[name]; ok {
+		return secret
+	}
+	return c.SharedSecret
 }
 
 // TunnelConfig controls tunnel behaviour.
@@ -38,6 +174,102 @@ type TunnelConfig struct {
 	Path           string        `yaml:"path"`
 	PingInterval   time.Duration `yaml:"ping_interval"`
 	RequestTimeout time.Duration `yaml:"request_timeout"`
+	DrainTimeout   time.Duration `yaml:"drain_timeout"`
+	// longest gap between body chunks of a streamed response, 0 for none
+	StreamIdleTimeout time.Duration `yaml:"stream_idle_timeout"`
+}
+
+// AdminConfig controls the optional admin api listener. a token is
+// required whenever it listens.
+type AdminConfig struct {
+	Addr  string `yaml:"addr"`
+	Token string `yaml:"token" secret:"true"`
+}
+
+// RouteConfig maps public requests to an agent group. empty host or path
+// prefix match anything; a host of "*.example.com" matches one subdomain level.
+type RouteConfig struct {
+	Host        string             `yaml:"host"`
+	PathPrefix  string             `yaml:"path_prefix"`
+	Group       string             `yaml:"group"`
+	Auth        *ClientAuthConfig  `yaml:"auth"`
+	ForwardAuth *ForwardAuthConfig `yaml:"forward_auth"`
+	Access      *IPFilterConfig    `yaml:"access"`
+	RateLimits  []RateLimitConfig  `yaml:"rate_limits"`
+}
+
+// RateLimitConfig is a token bucket refilled at rate requests per second
+// up to burst. key selects the bucket: "client_ip", "header:<name>" or
+// "route". requests without the keyed header are not limited.
+type RateLimitConfig struct {
+	Name  string  `yaml:"name"`
+	Key   string  `yaml:"key"`
+	Rate  float64 `yaml:"rate"`
+	Burst int     `yaml:"burst"`
+}
+
+// GroupConfig holds per agent group limits.
+type GroupConfig struct {
+	MaxStreams int `yaml:"max_streams"`
+}
+
+// AccessConfig restricts which client addresses may use the relay. the
+// global lists apply to every request, group lists to requests routed to
+// that agent group. client addresses are taken from x-forwarded-for or the
+// proxy protocol only when the peer is a trusted proxy.
+type AccessConfig struct {
+	IPFilterConfig `yaml:",inline"`
+	Groups         map[string]IPFilterConfig `yaml:"groups"`
+	TrustedProxies []string                  `yaml:"trusted_proxies"`
+	ForwardedFor   bool                      `yaml:"forwarded_for"`
+	ProxyProtocol  bool                      `yaml:"proxy_protocol"`
+}
+
+// IPFilterConfig lists cidrs or addresses. deny always wins; a non-empty
+// allow list admits only the addresses it covers.
+type IPFilterConfig struct {
+	Allow []string `yaml:"allow"`
+	Deny  []string `yaml:"deny"`
+}
+
+// ForwardAuthConfig asks an external service whether to proxy a request.
+// a 2xx answer allows it; anything else is returned to the client.
+type ForwardAuthConfig struct {
+	URL             string        `yaml:"url"`
+	Timeout         time.Duration `yaml:"timeout"`
+	ResponseHeaders []string      `yaml:"response_headers"`
+	CacheTTL        time.Duration `yaml:"cache_ttl"`
+}
+
+// ClientAuthConfig requires public clients to authenticate before a route
+// is proxied. any configured method may succeed. the verified identity is
+// forwarded to the agent in headers, which are stripped from client requests.
+type ClientAuthConfig struct {
+	Realm        string              `yaml:"realm"`
+	HtpasswdFile string              `yaml:"htpasswd_file"`
+	BearerTokens []BearerTokenConfig `yaml:"bearer_tokens"`
+	JWT          *JWTConfig          `yaml:"jwt"`
+	UserHeader   string              `yaml:"user_header"`
+	ClaimHeaders map[string]string   `yaml:"claim_headers"`
+}
+
+// BearerTokenConfig is a static bearer token and the user it identifies.
+type BearerTokenConfig struct {
+	User  string `yaml:"user"`
+	Token string `yaml:"token" secret:"true"`
+}
+
+// JWTConfig validates bearer jwts. claims lists required claim values; a
+// list-valued claim matches if it contains the value.
+type JWTConfig struct {
+	JWKSFile        string            `yaml:"jwks_file"`
+	JWKSURL         string            `yaml:"jwks_url"`
+	RefreshInterval time.Duration     `yaml:"refresh_interval"`
+	Issuer          string            `yaml:"issuer"`
+	Audience        string            `yaml:"audience"`
+	Claims          map[string]string `yaml:"claims"`
+	Leeway          time.Duration     `yaml:"leeway"`
+	UserClaim       string            `yaml:"user_claim"`
 }
 
 // LoadConfig reads and parses a relay configuration file.
@@ -48,17 +280,122 @@ func LoadConfig(path string) (*Config, error) {
 	}
 	cfg := &Config{
 		Listen: ListenConfig{Addr: ":8080"},
+		TLS: TLSConfig{
+			WatchInterval: 30 * time.Second,
+			ACME: ACMEConfig{
+				DirectoryURL: "https://acme-v02.api.letsencrypt.org/directory",
+				RenewBefore:  30 * 24 * time.Hour,
+				HTTPAddr:     ":80",
+			},
+		},
 		Tunnel: TunnelConfig{
-			Path:           "/_tunnel/ws",
-			PingInterval:   15 * time.Second,
-			RequestTimeout: 60 * time.Second,
+			Path:              "/_tunnel/ws",
+			PingInterval:      15 * time.Second,
+			RequestTimeout:    60 * time.Second,
+			DrainTimeout:      30 * time.Second,
+			StreamIdleTimeout: 5 * time.Minute,
 		},
+		Remote: RemoteConfig{GracePeriod: 30 * time.Second},
 	}
 	if err := yaml.Unmarshal(data, cfg); err != nil {
 		return nil, fmt.Errorf("parsing config: %w", err)
 	}
+	cfg.path = path
 	if cfg.Auth.SharedSecret == "" {
 		return nil, fmt.Errorf("auth.shared_secret is required")
 	}
+	if cfg.Admin.Addr != "" && cfg.Admin.Token == "" {
+		return nil, fmt.Errorf("admin.token is required when admin.addr is set")
+	}
+	for name, secret := range cfg.Auth.Agents {
+		if name == "" || secret == "" {
+			return nil, fmt.Errorf("auth.agents entries need a name and a secret")
+		}
+	}
+	// named policies are only as good as the name, so it must be proven
+	for name := range cfg.Remote.Agents {
+		if _, ok := cfg.Auth.Agents[name]; name != "*" && !ok {
+			return nil, fmt.Errorf("remote.agents.%s needs a secret in auth.agents", name)
+		}
+	}
+	for _, p := range cfg.TLS.CertPairs() {
+		if p.CertFile == "" || p.KeyFile == "" {
+			return nil, fmt.Errorf("tls certificates need both cert_file and key_file")
+		}
+	}
+	if cfg.TLS.Enabled && !cfg.TLS.ACME.Enabled && len(cfg.TLS.CertPairs()) == 0 {
+		return nil, fmt.Errorf("tls.enabled requires a certificate or tls.acme")
+	}
+	if cfg.TLS.ACME.Enabled {
+		if !cfg.TLS.Enabled {
+			return nil, fmt.Errorf("tls.acme requires tls.enabled")
+		}
+		if cfg.TLS.ACME.CacheDir == "" {
+			return nil, fmt.Errorf("tls.acme.cache_dir is required")
+		}
+	}
+	for i, r := range cfg.Routes {
+		if a := r.Auth; a != nil && a.HtpasswdFile == "" && len(a.BearerTokens) == 0 && a.JWT == nil {
+			return nil, fmt.Errorf("routes[%d].auth needs htpasswd_file, bearer_tokens or jwt", i)
+		}
+		if fa := r.ForwardAuth; fa != nil {
+			if fa.URL == "" {
+				return nil, fmt.Errorf("routes[%d].forward_auth.url is required", i)
+			}
+			if fa.Timeout == 0 {
+				fa.Timeout = 5 * time.Second
+			}
+		}
+	}
+	for i, f := range cfg.TCP {
+		if f.Listen == "" {
+			return nil, fmt.Errorf("tcp[%d].listen is required", i)
+		}
+		if _, port, err := net.SplitHostPort(f.Target); err != nil || port == "" {
+			return nil, fmt.Errorf("tcp[%d].target must be host:port", i)
+		}
+	}
+	if cfg.SOCKS.Listen != "" {
+		if cfg.SOCKS.HtpasswdFile == "" || len(cfg.SOCKS.Users) == 0 {
+			return nil, fmt.Errorf("socks needs htpasswd_file and users")
+		}
+		for user, group := range cfg.SOCKS.Users {
+			if group == "" {
+				return nil, fmt.Errorf("socks.users.%s needs a group", user)
+			}
+		}
+	}
+	if cfg.HTTPProxy.Listen != "" {
+		if cfg.HTTPProxy.HtpasswdFile == "" || len(cfg.HTTPProxy.Users) == 0 {
+			return nil, fmt.Errorf("http_proxy needs htpasswd_file and users")
+		}
+		for user, groups := range cfg.HTTPProxy.Users {
+			if len(groups) == 0 {
+				return nil, fmt.Errorf("http_proxy.users.%s needs at least one group", user)
+			}
+		}
+	}
+	if cfg.TLSPassthrough.Listen != "" && len(cfg.TLSPassthrough.Routes) == 0 {
+		return nil, fmt.Errorf("tls_passthrough needs routes")
+	}
+	for i := range cfg.TLSPassthrough.Routes {
+		r := &cfg.TLSPassthrough.Routes[i]
+		if r.Host == "" {
+			return nil, fmt.Errorf("tls_passthrough.routes[%d].host is required", i)
+		}
+		r.Host = strings.ToLower(r.Host)
+	}
+	for i := range cfg.UDP {
+		f := &cfg.UDP[i]
+		if f.Listen == "" {
+			return nil, fmt.Errorf("udp[%d].listen is required", i)
+		}
+		if _, port, err := net.SplitHostPort(f.Target); err != nil || port == "" {
+			return nil, fmt.Errorf("udp[%d].target must be host:port", i)
+		}
+		if f.IdleTimeout <= 0 {
+			f.IdleTimeout = _default_udp_idle_timeout
+		}
+	}
 	return cfg, nil
 }
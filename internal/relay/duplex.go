@@ -0,0 +1,80 @@
+package relay
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/reverseproxy/internal/protocol"
+)
+
+// _is_grpc reports whether a request is a grpc call, whose request and
+// response bodies stream at the same time and whose status comes in the
+// trailers.
+func _is_grpc(r *http.Request) bool {
+	return r.ProtoMajor == 2 && strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc")
+}
+
+// _serve_duplex forwards a request whose body streams to the agent while
+// the response streams back. only idleTimeout applies, to the response
+// head as well, since a grpc server may hold its head until the client
+// has finished sending. it returns true without writing anything if the
+// agent refused the stream.
+func _serve_duplex(w http.ResponseWriter, r *http.Request, tunnel *Tunnel, streamID uint32, ch chan *protocol.Frame, idleTimeout time.Duration) (refused bool) {
+	reset := _stream_reset(tunnel, streamID)
+	// http/1 bodies are only readable alongside the response once asked for
+	http.NewResponseController(w).EnableFullDuplex()
+	go func() {
+		err := protocol.CopyToStream(r.Body, streamID, tunnel.SendFrame)
+		if err == nil {
+			err = tunnel.SendFrame(&protocol.Frame{Type: protocol.TypeStreamClose, StreamID: streamID})
+		}
+		if err != nil {
+			reset()
+		}
+	}()
+
+	var idleC <-chan time.Time
+	if idleTimeout > 0 {
+		timer := time.NewTimer(idleTimeout)
+		defer timer.Stop()
+		idleC = timer.C
+	}
+
+	select {
+	case frame, ok := <-ch:
+		if !ok {
+			http.Error(w, "tunnel closed", http.StatusBadGateway)
+			return false
+		}
+		switch frame.Type {
+		case protocol.TypeDrain, protocol.TypeRefuseStream:
+			return true
+		case protocol.TypeStreamHead:
+			var head TunnelledResponse
+			if err := json.Unmarshal(frame.Payload, &head); err != nil {
+				slog.Error("invalid stream response from agent", "err", err)
+				break
+			}
+			_write_streamed_response(w, r, &head, ch, idleTimeout, reset)
+			return false
+		case protocol.TypeStreamReset:
+			http.Error(w, "backend error", http.StatusBadGateway)
+			return false
+		}
+		reset()
+		_abandon(ch)
+		http.Error(w, "invalid response from backend", http.StatusBadGateway)
+	case <-idleC:
+		slog.Warn("stream timed out waiting for backend")
+		reset()
+		_abandon(ch)
+		http.Error(w, "request timed out", http.StatusGatewayTimeout)
+	case <-r.Context().Done():
+		reset()
+		_abandon(ch)
+	}
+	return false
+}
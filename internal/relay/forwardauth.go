@@ -0,0 +1,216 @@
+package relay
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// largest denial body from the auth service relayed to the client.
+const _forward_auth_max_body = 64 * 1024
+
+// entries above which expired cache results are swept on insert.
+const _forward_auth_sweep_size = 1024
+
+// hop-by-hop and body headers not copied onto the auth subrequest.
+var _forward_auth_skip_headers = []string{
+	"Connection", "Keep-Alive", "Proxy-Connection", "Te", "Trailer",
+	"Transfer-Encoding", "Upgrade", "Content-Length",
+}
+
+// ForwardAuth delegates the decision to proxy a request to an external
+// service, in the manner of nginx auth_request.
+type ForwardAuth struct {
+	url             string
+	client          *http.Client
+	responseHeaders []string
+	cacheTTL        time.Duration
+
+	mu    sync.Mutex
+	cache map[string]*_auth_result
+}
+
+// _auth_result is a cached answer from the auth service.
+type _auth_result struct {
+	status  int
+	headers http.Header
+	body    []byte
+	expires time.Time
+}
+
+// NewForwardAuth creates a forward-auth check for a route.
+func NewForwardAuth(cfg *ForwardAuthConfig) (*ForwardAuth, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid forward_auth url %q", cfg.URL)
+	}
+	return &ForwardAuth{
+		url: cfg.URL,
+		client: &http.Client{
+			Timeout: cfg.Timeout,
+			// redirects are answers for the client, not for us to follow
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		responseHeaders: cfg.ResponseHeaders,
+		cacheTTL:        cfg.CacheTTL,
+		cache:           make(map[string]*_auth_result),
+	}, nil
+}
+
+// Check asks the auth service about the request from client, as the
+// access policy resolved it. if allowed, the selected response headers
+// are copied onto the request and true is returned; otherwise the
+// service's answer has been written to w.
+func (f *ForwardAuth) Check(w http.ResponseWriter, r *http.Request, client netip.Addr) bool {
+	// never trust client-supplied copies of headers the service sets
+	for _, header := range f.responseHeaders {
+		r.Header.Del(header)
+	}
+
+	header := _forward_auth_header(r, client)
+	key := _forward_auth_key(r.Method, header)
+	result := f._cached(key)
+	if result == nil {
+		var err error
+		result, err = f._ask(r, header)
+		if err != nil {
+			slog.Error("forward auth request failed", "url", f.url, "err", err)
+			http.Error(w, "authorisation service unavailable", http.StatusBadGateway)
+			return false
+		}
+		f._store(key, result)
+	}
+
+	if result.status >= 200 && result.status < 300 {
+		for _, header := range f.responseHeaders {
+			if values := result.headers.Values(header); len(values) > 0 {
+				r.Header[http.CanonicalHeaderKey(header)] = values
+			}
+		}
+		return true
+	}
+
+	for k, v := range result.headers {
+		if k == "Content-Length" || k == "Transfer-Encoding" || k == "Connection" {
+			continue
+		}
+		w.Header()[k] = v
+	}
+	w.WriteHeader(result.status)
+	w.Write(result.body)
+	return false
+}
+
+// _forward_auth_header returns the headers the subrequest for r carries:
+// the original ones and the method, proto, host, uri and client address.
+func _forward_auth_header(r *http.Request, client netip.Addr) http.Header {
+	header := r.Header.Clone()
+	for _, name := range _forward_auth_skip_headers {
+		header.Del(name)
+	}
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+	header.Set("X-Forwarded-Method", r.Method)
+	header.Set("X-Forwarded-Proto", proto)
+	header.Set("X-Forwarded-Host", r.Host)
+	header.Set("X-Forwarded-Uri", r.URL.RequestURI())
+	if client.IsValid() {
+		header.Set("X-Forwarded-For", client.String())
+	} else {
+		header.Del("X-Forwarded-For")
+	}
+	return header
+}
+
+// _ask sends the subrequest with method and header.
+func (f *ForwardAuth) _ask(r *http.Request, header http.Header) (*_auth_result, error) {
+	req, err := http.NewRequestWithContext(r.Context(), r.Method, f.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header = header
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	result := &_auth_result{status: resp.StatusCode, headers: resp.Header}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		result.body, err = io.ReadAll(io.LimitReader(resp.Body, _forward_auth_max_body))
+		if err != nil {
+			return nil, fmt.Errorf("reading auth response: %w", err)
+		}
+	}
+	if f.cacheTTL > 0 && !strings.Contains(resp.Header.Get("Cache-Control"), "no-store") {
+		result.expires = time.Now().Add(f.cacheTTL)
+	}
+	return result, nil
+}
+
+// _cached returns an unexpired result for key, or nil.
+func (f *ForwardAuth) _cached(key string) *_auth_result {
+	if f.cacheTTL <= 0 {
+		return nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	result, ok := f.cache[key]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(result.expires) {
+		delete(f.cache, key)
+		return nil
+	}
+	return result
+}
+
+// _store caches a result that has an expiry.
+func (f *ForwardAuth) _store(key string, result *_auth_result) {
+	if result.expires.IsZero() {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.cache) >= _forward_auth_sweep_size {
+		now := time.Now()
+		for k, r := range f.cache {
+			if now.After(r.expires) {
+				delete(f.cache, k)
+			}
+		}
+	}
+	f.cache[key] = result
+}
+
+// _forward_auth_key identifies a subrequest by everything the auth service
+// is shown, so a cached answer is only reused for an identical question.
+func _forward_auth_key(method string, header http.Header) string {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	h := sha256.New()
+	io.WriteString(h, method)
+	for _, name := range names {
+		for _, value := range header[name] {
+			fmt.Fprintf(h, "\x00%s\x00%s", name, value)
+		}
+	}
+	return string(h.Sum(nil))
+}
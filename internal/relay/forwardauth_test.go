@@ -0,0 +1,183 @@
+package relay
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// the client address requests are checked for.
+var _auth_client = netip.MustParseAddr("192.0.2.1")
+
+// _start_auth_service allows requests carrying the "good" token and counts
+// the subrequests it receives.
+func _start_auth_service(t *testing.T, calls *atomic.Int32) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if r.Header.Get("X-Forwarded-Uri") != "/private?x=1" || r.Header.Get("X-Forwarded-Method") != http.MethodPost {
+			http.Error(w, "bad forwarded headers", http.StatusBadRequest)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer good" {
+			w.Header().Set("Location", "https://login.example.com/")
+			w.WriteHeader(http.StatusFound)
+			w.Write([]byte("log in first"))
+			return
+		}
+		w.Header().Set("X-Auth-User", "alice")
+		w.Header().Set("X-Internal", "not copied")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func Test_forward_auth_allows_and_copies_headers(t *testing.T) {
+	var calls atomic.Int32
+	srv := _start_auth_service(t, &calls)
+	f, err := NewForwardAuth(&ForwardAuthConfig{
+		URL:             srv.URL,
+		Timeout:         time.Second,
+		ResponseHeaders: []string{"X-Auth-User"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "http://app.example.com/private?x=1", nil)
+	req.Header.Set("Authorization", "Bearer good")
+	req.Header.Set("X-Auth-User", "mallory")
+	w := httptest.NewRecorder()
+	if !f.Check(w, req, _auth_client) {
+		t.Fatalf("expected request to be allowed, got %d %s", w.Code, w.Body.String())
+	}
+	if got := req.Header.Get("X-Auth-User"); got != "alice" {
+		t.Errorf("user header %q, want alice", got)
+	}
+	if req.Header.Get("X-Internal") != "" {
+		t.Error("unselected header should not be copied")
+	}
+}
+
+func Test_forward_auth_returns_denial_as_is(t *testing.T) {
+	var calls atomic.Int32
+	srv := _start_auth_service(t, &calls)
+	f, err := NewForwardAuth(&ForwardAuthConfig{URL: srv.URL, Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "http://app.example.com/private?x=1", nil)
+	w := httptest.NewRecorder()
+	if f.Check(w, req, _auth_client) {
+		t.Fatal("expected request to be denied")
+	}
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "https://login.example.com/" || w.Body.String() != "log in first" {
+		t.Errorf("denial not relayed: %d %v %q", w.Code, w.Header(), w.Body.String())
+	}
+}
+
+func Test_forward_auth_caches_results(t *testing.T) {
+	var calls atomic.Int32
+	srv := _start_auth_service(t, &calls)
+	f, err := NewForwardAuth(&ForwardAuthConfig{
+		URL:      srv.URL,
+		Timeout:  time.Second,
+		CacheTTL: 100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(token string) bool {
+		req := httptest.NewRequest(http.MethodPost, "http://app.example.com/private?x=1", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		return f.Check(httptest.NewRecorder(), req, _auth_client)
+	}
+	for i := 0; i < 3; i++ {
+		if !check("good") {
+			t.Fatal("expected request to be allowed")
+		}
+	}
+	if calls.Load() != 1 {
+		t.Errorf("expected one subrequest while cached, got %d", calls.Load())
+	}
+	if check("bad") {
+		t.Fatal("different credentials must not share a cached result")
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	check("good")
+	if calls.Load() != 3 {
+		t.Errorf("expected cache entry to expire, got %d subrequests", calls.Load())
+	}
+}
+
+func Test_forward_auth_key_covers_forwarded_headers(t *testing.T) {
+	base := func() *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "http://app.example.com/", nil)
+		req.Header.Set("Authorization", "Bearer good")
+		return req
+	}
+	key := func(r *http.Request, client netip.Addr) string {
+		return _forward_auth_key(r.Method, _forward_auth_header(r, client))
+	}
+	want := key(base(), _auth_client)
+
+	if key(base(), _auth_client) != want {
+		t.Fatal("identical requests should share a key")
+	}
+	if key(base(), netip.MustParseAddr("192.0.2.2")) == want {
+		t.Error("requests from different clients must not share a key")
+	}
+	apiKey := base()
+	apiKey.Header.Set("X-Api-Key", "secret")
+	tenant := base()
+	tenant.Header.Add("X-Tenant", "a")
+	tenant.Header.Add("X-Tenant", "b")
+	for name, r := range map[string]*http.Request{"api key": apiKey, "repeated header": tenant} {
+		if key(r, _auth_client) == want {
+			t.Errorf("requests differing in %s must not share a key", name)
+		}
+	}
+	hop := base()
+	hop.Header.Set("Connection", "close")
+	if key(hop, _auth_client) != want {
+		t.Error("headers not sent to the auth service should not change the key")
+	}
+}
+
+func Test_forward_auth_sends_the_resolved_client(t *testing.T) {
+	// behind a trusted proxy the peer is the proxy, not the client
+	req := httptest.NewRequest(http.MethodGet, "http://app.example.com/", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("X-Forwarded-For", "198.51.100.9")
+	if got := _forward_auth_header(req, _auth_client).Get("X-Forwarded-For"); got != _auth_client.String() {
+		t.Errorf("X-Forwarded-For %q, want %s", got, _auth_client)
+	}
+	if got := _forward_auth_header(req, netip.Addr{}).Get("X-Forwarded-For"); got != "" {
+		t.Errorf("X-Forwarded-For %q without a client address, want none", got)
+	}
+}
+
+func Test_forward_auth_service_down(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	url := srv.URL
+	srv.Close()
+
+	f, err := NewForwardAuth(&ForwardAuthConfig{URL: url, Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	if f.Check(w, httptest.NewRequest(http.MethodGet, "http://app.example.com/", nil), _auth_client) {
+		t.Fatal("expected request to be denied when the service is down")
+	}
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("status %d, want 502", w.Code)
+	}
+}
@@ -0,0 +1,161 @@
+package relay_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/reverseproxy/internal/agent"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// _raw_codec passes messages through as bytes, so the echo service needs
+// no generated types.
+type _raw_codec struct{}
+
+func (_raw_codec) Marshal(v any) ([]byte, error)      { return *v.(*[]byte), nil }
+func (_raw_codec) Unmarshal(data []byte, v any) error { *v.(*[]byte) = append([]byte(nil), data...); return nil }
+func (_raw_codec) Name() string                       { return "raw" }
+
+func init() {
+	encoding.RegisterCodec(_raw_codec{})
+}
+
+// _echo_service echoes every message of a bidirectional stream and
+// reports the count in a trailer.
+var _echo_service = grpc.ServiceDesc{
+	ServiceName: "test.Echo",
+	HandlerType: (*any)(nil),
+	Streams: []grpc.StreamDesc{{
+		StreamName:    "Chat",
+		ServerStreams: true,
+		ClientStreams: true,
+		Handler: func(_ any, stream grpc.ServerStream) error {
+			for n := 0; ; n++ {
+				var msg []byte
+				err := stream.RecvMsg(&msg)
+				if err == io.EOF {
+					stream.SetTrailer(metadata.Pairs("x-echoed", strconv.Itoa(n)))
+					return nil
+				}
+				if err != nil {
+					return err
+				}
+				if err := stream.SendMsg(&msg); err != nil {
+					return err
+				}
+			}
+		},
+	}},
+}
+
+// _start_grpc_backend serves the health and echo services over h2c.
+func _start_grpc_backend(t *testing.T) (string, *health.Server) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := grpc.NewServer()
+	hs := health.NewServer()
+	healthpb.RegisterHealthServer(srv, hs)
+	srv.RegisterService(&_echo_service, struct{}{})
+	go srv.Serve(ln)
+	t.Cleanup(srv.Stop)
+	return fmt.Sprintf("http://%s", ln.Addr()), hs
+}
+
+func Test_integration_grpc(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test in short mode")
+	}
+
+	secret := "integration-test-secret"
+
+	backendURL, hs := _start_grpc_backend(t)
+	relayAddr, stopRelay := _start_relay(t, secret)
+	defer stopRelay()
+
+	a, err := agent.New(_agent_config(relayAddr, backendURL, secret))
+	if err != nil {
+		t.Fatalf("failed to create agent: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go a.Run(ctx)
+	time.Sleep(500 * time.Millisecond)
+
+	conn, err := grpc.NewClient(relayAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := healthpb.NewHealthClient(conn)
+	callCtx, callCancel := context.WithTimeout(ctx, 5*time.Second)
+	defer callCancel()
+
+	t.Run("unary", func(t *testing.T) {
+		resp, err := client.Check(callCtx, &healthpb.HealthCheckRequest{})
+		if err != nil || resp.Status != healthpb.HealthCheckResponse_SERVING {
+			t.Fatalf("check: %v, %v", resp, err)
+		}
+		// an error status arrives in the trailers of an otherwise empty answer
+		_, err = client.Check(callCtx, &healthpb.HealthCheckRequest{Service: "missing"})
+		if status.Code(err) != codes.NotFound {
+			t.Errorf("expected NotFound, got %v", err)
+		}
+	})
+
+	t.Run("server streaming", func(t *testing.T) {
+		hs.SetServingStatus("svc", healthpb.HealthCheckResponse_SERVING)
+		watch, err := client.Watch(callCtx, &healthpb.HealthCheckRequest{Service: "svc"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp, err := watch.Recv(); err != nil || resp.Status != healthpb.HealthCheckResponse_SERVING {
+			t.Fatalf("first update: %v, %v", resp, err)
+		}
+		// the stream stays open and later updates come through as sent
+		hs.SetServingStatus("svc", healthpb.HealthCheckResponse_NOT_SERVING)
+		if resp, err := watch.Recv(); err != nil || resp.Status != healthpb.HealthCheckResponse_NOT_SERVING {
+			t.Fatalf("second update: %v, %v", resp, err)
+		}
+	})
+
+	t.Run("bidirectional streaming", func(t *testing.T) {
+		desc := &grpc.StreamDesc{ServerStreams: true, ClientStreams: true}
+		stream, err := conn.NewStream(callCtx, desc, "/test.Echo/Chat", grpc.CallContentSubtype("raw"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, msg := range []string{"one", "two", "three"} {
+			out := []byte(msg)
+			if err := stream.SendMsg(&out); err != nil {
+				t.Fatalf("send: %v", err)
+			}
+			var in []byte
+			if err := stream.RecvMsg(&in); err != nil || string(in) != msg {
+				t.Fatalf("expected echo %q, got %q, %v", msg, in, err)
+			}
+		}
+		stream.CloseSend()
+		var in []byte
+		if err := stream.RecvMsg(&in); err != io.EOF {
+			t.Fatalf("expected end of stream, got %v", err)
+		}
+		if got := stream.Trailer().Get("x-echoed"); len(got) != 1 || got[0] != "3" {
+			t.Errorf("expected x-echoed trailer 3, got %v", got)
+		}
+	})
+}
@@ -2,10 +2,13 @@ package relay
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/reverseproxy/internal/protocol"
@@ -13,46 +16,145 @@ import (
 
 // TunnelledRequest is the serialised form of an http request sent through the tunnel.
 type TunnelledRequest struct {
-	Method  string            `json:"method"`
-	URL     string            `json:"url"`
-	Headers map[string]string `json:"headers"`
-	Body    []byte            `json:"body,omitempty"`
+	Method  string      `json:"method"`
+	URL     string      `json:"url"`
+	Host    string      `json:"host,omitempty"`
+	Headers http.Header `json:"headers"`
+	Body    []byte      `json:"body,omitempty"`
 }
 
 // TunnelledResponse is the serialised form of an http response received through the tunnel.
 type TunnelledResponse struct {
-	StatusCode int               `json:"status_code"`
-	Headers    map[string]string `json:"headers"`
-	Body       []byte            `json:"body,omitempty"`
+	StatusCode int         `json:"status_code"`
+	Headers    http.Header `json:"headers"`
+	Body       []byte      `json:"body,omitempty"`
 }
 
 // Handler forwards incoming http requests to connected agents via the tunnel.
 type Handler struct {
 	pool    *Pool
-	timeout time.Duration
+	router  atomic.Pointer[Router]
+	access  atomic.Pointer[AccessPolicy]
+	limits  atomic.Pointer[Limits]
+	timeout atomic.Int64
+	// bounds the wait between body frames of a streamed response
+	idleTimeout atomic.Int64
+
+	streamsMu sync.Mutex
+	streams   map[string]*_group_streams
+
+	// endpoints agents asked for, if enabled
+	remote *RemoteForwards
 }
 
 // NewHandler creates a new forwarding handler.
-func NewHandler(pool *Pool, timeout time.Duration) *Handler {
-	return &Handler{pool: pool, timeout: timeout}
+func NewHandler(pool *Pool, router *Router, access *AccessPolicy, limits *Limits, timeout, idleTimeout time.Duration) *Handler {
+	h := &Handler{pool: pool, streams: make(map[string]*_group_streams)}
+	h.Update(router, access, limits, timeout, idleTimeout)
+	return h
+}
+
+// Update swaps the routing table, access policy, limits and timeouts.
+// requests already being forwarded keep the values they started with.
+// rate limit buckets start afresh; group stream counts carry over.
+func (h *Handler) Update(router *Router, access *AccessPolicy, limits *Limits, timeout, idleTimeout time.Duration) {
+	h.router.Store(router)
+	h.access.Store(access)
+	h.limits.Store(limits)
+	h.timeout.Store(int64(timeout))
+	h.idleTimeout.Store(int64(idleTimeout))
+}
+
+// Router returns the routing table in effect.
+func (h *Handler) Router() *Router {
+	return h.router.Load()
 }
 
+// Access returns the access policy in effect.
+func (h *Handler) Access() *AccessPolicy {
+	return h.access.Load()
+}
+
+// maximum number of tunnels a request is offered to before giving up.
+const _max_attempts = 3
+
 // ServeHTTP handles incoming requests by forwarding them through the tunnel.
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	tunnel, err := h.pool.Get()
-	if err != nil {
-		slog.Warn("no agent available", "err", err)
-		http.Error(w, "no backend agents connected", http.StatusBadGateway)
+	access := h.Access()
+	client, _ := access.ClientAddr(r)
+	if !access.Global().Allows(client) {
+		slog.Debug("client address denied", "client", client)
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	// hosts allocated to agents bypass the routing table, unless a route
+	// names the host itself
+	var endpoint *_remote_endpoint
+	if !h.Router().HasHost(_request_host(r)) {
+		endpoint = h.remote._http_endpoint(r.Host)
+	}
+	var route *Route
+	ok := true
+	if endpoint == nil {
+		route, ok = h.Router().Match(r)
+	}
+	if !ok {
+		http.Error(w, "no route for request", http.StatusNotFound)
+		return
+	}
+	var group string
+	pick := func() (*Tunnel, error) { return h.pool.GetBackend(group) }
+	if route != nil {
+		group = route.Group
+	}
+	if endpoint != nil {
+		pick = h.remote._picker(endpoint)
+		if tunnel, err := pick(); err == nil {
+			group = tunnel.Group()
+		}
+	}
+	if (route != nil && !route.Access.Allows(client)) || !access.Group(group).Allows(client) {
+		slog.Debug("client address denied for route", "client", client, "group", group)
+		http.Error(w, "forbidden", http.StatusForbidden)
 		return
 	}
 
-	req, err := _build_tunnelled_request(r)
+	limits := h.limits.Load()
+	for _, l := range _request_limiters(limits, route) {
+		if ok, wait := l.Allow(r, client, route); !ok {
+			slog.Debug("request rate limited", "limit", l.Name(), "client", client)
+			w.Header().Set("Retry-After", _retry_after(wait))
+			http.Error(w, "too many requests", http.StatusTooManyRequests)
+			return
+		}
+	}
+
+	if route != nil {
+		// forward auth sees the original credentials, before built-in auth removes them
+		if route.ForwardAuth != nil && !route.ForwardAuth.Check(w, r, client) {
+			return
+		}
+		if route.Auth != nil {
+			if err := route.Auth.Authenticate(r); err != nil {
+				slog.Debug("client authentication failed", "host", r.Host, "err", err)
+				route.Auth.Challenge(w)
+				return
+			}
+		}
+	}
+
+	// grpc bodies stream both ways, so they are not read up front
+	duplex := _is_grpc(r)
+	req, err := _build_tunnelled_request(r, !duplex)
 	if err != nil {
 		slog.Error("failed to build tunnelled request", "err", err)
 		http.Error(w, "internal error", http.StatusInternalServerError)
 		return
 	}
 
+	// upgrades and duplex streams carry the request in a stream open frame instead
+	upgrade := _is_upgrade(r)
 	payload, err := json.Marshal(req)
 	if err != nil {
 		slog.Error("failed to marshal request", "err", err)
@@ -60,25 +162,135 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	streamID := protocol.NextStreamID()
-	frames := _chunk_payload(streamID, protocol.TypeHTTPRequest, payload)
+	streams := h._group_streams(group)
+	if !streams._acquire(limits.maxStreams[_group_name(group)]) {
+		slog.Debug("group stream limit reached", "group", _group_name(group))
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "too many concurrent requests", http.StatusTooManyRequests)
+		return
+	}
+	defer streams._release()
 
-	// send request frames and register stream
-	var responseCh chan *protocol.Frame
-	for i, f := range frames {
-		if i == 0 {
-			responseCh, err = tunnel.SendRequest(f)
+	// a request the agent did not accept is safe to offer to another tunnel
+	for attempt := 0; attempt < _max_attempts; attempt++ {
+		tunnel, err := pick()
+		if errors.Is(err, ErrTunnelFull) {
+			slog.Warn("all agents at capacity", "group", group)
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "backend agents busy", http.StatusServiceUnavailable)
+			return
+		}
+		if errors.Is(err, ErrNoHealthyBackend) {
+			slog.Warn("no agent with a healthy backend", "group", group)
+			http.Error(w, "no healthy backend", http.StatusServiceUnavailable)
+			return
+		}
+		if err != nil {
+			slog.Warn("no agent available", "err", err)
+			http.Error(w, "no backend agents connected", http.StatusBadGateway)
+			return
+		}
+
+		if duplex {
+			streamID, ch, err := _open_stream(tunnel, &StreamOpen{Kind: StreamKindDuplex, Request: req})
+			if errors.Is(err, ErrTunnelDraining) || errors.Is(err, ErrTunnelFull) {
+				continue
+			}
 			if err != nil {
-				slog.Error("failed to send request", "err", err)
+				slog.Error("failed to open stream", "err", err)
 				http.Error(w, "tunnel error", http.StatusBadGateway)
 				return
 			}
-		} else {
-			if err := tunnel.SendFrame(f); err != nil {
-				slog.Error("failed to send body chunk", "err", err)
+			if _serve_duplex(w, r, tunnel, streamID, ch, time.Duration(h.idleTimeout.Load())) {
+				// part of the body may have gone to the refusing agent, so it cannot be replayed
+				slog.Warn("duplex stream refused by agent", "tunnel", tunnel.ID())
+				w.Header().Set("Retry-After", "1")
+				http.Error(w, "backend agent refused the stream", http.StatusServiceUnavailable)
+			}
+			return
+		}
+
+		if upgrade {
+			streamID, ch, err := _open_stream(tunnel, &StreamOpen{Kind: StreamKindUpgrade, Request: req})
+			if errors.Is(err, ErrTunnelDraining) || errors.Is(err, ErrTunnelFull) {
+				continue
+			}
+			if err != nil {
+				slog.Error("failed to open stream", "err", err)
 				http.Error(w, "tunnel error", http.StatusBadGateway)
 				return
 			}
+			if !_serve_upgrade(w, r, tunnel, streamID, ch, time.Duration(h.timeout.Load()), time.Duration(h.idleTimeout.Load())) {
+				return
+			}
+			slog.Debug("upgrade refused by agent, retrying", "tunnel", tunnel.ID(), "attempt", attempt+1)
+			continue
+		}
+
+		streamID, responseCh, err := _send_request(tunnel, payload)
+		if errors.Is(err, ErrTunnelDraining) || errors.Is(err, ErrTunnelFull) {
+			continue
+		}
+		if err != nil {
+			slog.Error("failed to send request", "err", err)
+			http.Error(w, "tunnel error", http.StatusBadGateway)
+			return
+		}
+
+		// wait for response with timeout
+		reset := _stream_reset(tunnel, streamID)
+		if !_collect_response(w, r, responseCh, time.Duration(h.timeout.Load()), time.Duration(h.idleTimeout.Load()), reset) {
+			return
+		}
+		slog.Debug("stream refused by agent, retrying", "tunnel", tunnel.ID(), "attempt", attempt+1)
+	}
+
+	http.Error(w, "no backend agent accepted the request", http.StatusBadGateway)
+}
+
+// _request_limiters returns the relay-wide then route rate limits.
+func _request_limiters(limits *Limits, route *Route) []*RateLimiter {
+	if route == nil || len(route.RateLimits) == 0 {
+		return limits.rates
+	}
+	return append(append([]*RateLimiter(nil), limits.rates...), route.RateLimits...)
+}
+
+// _group_streams returns the stream counter for a group, creating it.
+func (h *Handler) _group_streams(group string) *_group_streams {
+	group = _group_name(group)
+	h.streamsMu.Lock()
+	defer h.streamsMu.Unlock()
+	g, ok := h.streams[group]
+	if !ok {
+		g = &_group_streams{}
+		h.streams[group] = g
+	}
+	return g
+}
+
+// _group_name names the group of an unrouted request.
+func _group_name(group string) string {
+	if group == "" {
+		return DefaultGroup
+	}
+	return group
+}
+
+// _send_request writes a request payload to the tunnel as a new stream and
+// returns the stream id and the channel its response frames arrive on.
+func _send_request(tunnel *Tunnel, payload []byte) (uint32, chan *protocol.Frame, error) {
+	streamID := protocol.NextStreamID()
+	frames := _chunk_payload(streamID, protocol.TypeHTTPRequest, payload)
+
+	// send request frames and register stream
+	responseCh, err := tunnel.SendRequest(frames[0])
+	if err != nil {
+		return 0, nil, err
+	}
+	for _, f := range frames[1:] {
+		if err := tunnel.SendFrame(f); err != nil {
+			return 0, nil, fmt.Errorf("sending body chunk: %w", err)
 		}
 	}
 
@@ -87,17 +299,23 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		Type:     protocol.TypeStreamClose,
 		StreamID: streamID,
 	}); err != nil {
-		slog.Error("failed to send stream close", "err", err)
+		return 0, nil, fmt.Errorf("sending stream close: %w", err)
 	}
+	return streamID, responseCh, nil
+}
 
-	// wait for response with timeout
-	_collect_response(w, responseCh, h.timeout)
+// _stream_reset returns a func that aborts a stream on the agent.
+func _stream_reset(tunnel *Tunnel, streamID uint32) func() {
+	return func() {
+		tunnel.SendFrame(&protocol.Frame{Type: protocol.TypeStreamReset, StreamID: streamID})
+	}
 }
 
 // _build_tunnelled_request converts an http.Request into a TunnelledRequest.
-func _build_tunnelled_request(r *http.Request) (*TunnelledRequest, error) {
+// the body is left unread unless readBody is set.
+func _build_tunnelled_request(r *http.Request, readBody bool) (*TunnelledRequest, error) {
 	var body []byte
-	if r.Body != nil {
+	if readBody && r.Body != nil {
 		var err error
 		body, err = io.ReadAll(r.Body)
 		if err != nil {
@@ -106,22 +324,26 @@ func _build_tunnelled_request(r *http.Request) (*TunnelledRequest, error) {
 		r.Body.Close()
 	}
 
-	headers := make(map[string]string)
-	for k, v := range r.Header {
-		if len(v) > 0 {
-			headers[k] = v[0]
-		}
-	}
-
 	url := r.URL.String()
 	return &TunnelledRequest{
 		Method:  r.Method,
 		URL:     url,
-		Headers: headers,
+		Host:    r.Host,
+		Headers: r.Header.Clone(),
 		Body:    body,
 	}, nil
 }
 
+// _copy_header adds every value of src to dst, each name prefixed with
+// prefix.
+func _copy_header(dst, src http.Header, prefix string) {
+	for k, vs := range src {
+		for _, v := range vs {
+			dst.Add(prefix+k, v)
+		}
+	}
+}
+
 // _chunk_payload splits a payload into frames respecting the maximum payload size.
 func _chunk_payload(streamID uint32, firstType uint8, payload []byte) []*protocol.Frame {
 	if len(payload) <= protocol.MaxPayloadSize {
@@ -152,7 +374,10 @@ func _chunk_payload(streamID uint32, firstType uint8, payload []byte) []*protoco
 }
 
 // _collect_response reads response frames and writes the http response.
-func _collect_response(w http.ResponseWriter, ch chan *protocol.Frame, timeout time.Duration) {
+// a streamed response is passed on as it arrives, and once its head is in
+// only idleTimeout applies. it returns true without writing anything if
+// the agent refused the stream, because it was draining or at capacity.
+func _collect_response(w http.ResponseWriter, r *http.Request, ch chan *protocol.Frame, timeout, idleTimeout time.Duration, reset func()) (refused bool) {
 	timer := time.NewTimer(timeout)
 	defer timer.Stop()
 
@@ -170,16 +395,34 @@ func _collect_response(w http.ResponseWriter, ch chan *protocol.Frame, timeout t
 				return
 			}
 			switch frame.Type {
+			case protocol.TypeDrain, protocol.TypeRefuseStream:
+				return true
 			case protocol.TypeHTTPResponse:
 				responseData = append(responseData, frame.Payload...)
 			case protocol.TypeBodyChunk:
 				responseData = append(responseData, frame.Payload...)
+			case protocol.TypeStreamHead:
+				var head TunnelledResponse
+				if err := json.Unmarshal(frame.Payload, &head); err != nil {
+					slog.Error("failed to unmarshal response head", "err", err)
+					reset()
+					_abandon(ch)
+					http.Error(w, "invalid response from backend", http.StatusBadGateway)
+					return
+				}
+				_write_streamed_response(w, r, &head, ch, idleTimeout, reset)
+				return
+			case protocol.TypeStreamReset:
+				http.Error(w, "backend error", http.StatusBadGateway)
+				return
 			case protocol.TypeStreamClose:
 				_write_response(w, responseData)
 				return
 			}
 		case <-timer.C:
 			slog.Warn("request timed out waiting for response")
+			reset()
+			_abandon(ch)
 			http.Error(w, "request timed out", http.StatusGatewayTimeout)
 			return
 		}
@@ -200,9 +443,7 @@ func _write_response(w http.ResponseWriter, data []byte) {
 		return
 	}
 
-	for k, v := range resp.Headers {
-		w.Header().Set(k, v)
-	}
+	_copy_header(w.Header(), resp.Headers, "")
 	w.WriteHeader(resp.StatusCode)
 	if len(resp.Body) > 0 {
 		w.Write(resp.Body)
@@ -0,0 +1,231 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"slices"
+	"sync"
+	"time"
+)
+
+// how long a proxy client has to send its request headers.
+const _http_proxy_header_timeout = 10 * time.Second
+
+// _http_proxy is an http forward proxy whose connections exit through
+// agents: CONNECT tunnels and absolute-form requests both become raw tcp
+// streams to the destination.
+type _http_proxy struct {
+	cfg     HTTPProxyConfig
+	users   map[string]string
+	handler *Handler
+	server  *http.Server
+
+	// per group, so pooled connections never cross groups
+	transportMu sync.Mutex
+	transports  map[string]*http.Transport
+}
+
+// _proxy_dial_error is a failed dial through an agent, with the outcome
+// as an http status.
+type _proxy_dial_error struct {
+	status int
+}
+
+func (e *_proxy_dial_error) Error() string {
+	return fmt.Sprintf("dial through agent failed: %s", http.StatusText(e.status))
+}
+
+// _new_http_proxy loads the users for an http proxy listener.
+func _new_http_proxy(cfg *HTTPProxyConfig, handler *Handler) (*_http_proxy, error) {
+	users, err := _load_htpasswd(cfg.HtpasswdFile)
+	if err != nil {
+		return nil, fmt.Errorf("http_proxy: %w", err)
+	}
+	p := &_http_proxy{cfg: *cfg, users: users, handler: handler, transports: make(map[string]*http.Transport)}
+	p.server = &http.Server{Addr: cfg.Listen, Handler: p, ReadHeaderTimeout: _http_proxy_header_timeout}
+	return p, nil
+}
+
+// _start_http_proxy binds the http proxy listener, if configured, and
+// serves it.
+func (s *Server) _start_http_proxy() error {
+	if s.httpProxy == nil {
+		return nil
+	}
+	ln, err := net.Listen("tcp", s.httpProxy.cfg.Listen)
+	if err != nil {
+		return err
+	}
+	slog.Info("http proxy listening", "addr", ln.Addr())
+	go func() {
+		if err := s.httpProxy.server.Serve(ln); err != nil && err != http.ErrServerClosed {
+			slog.Error("http proxy stopped", "err", err)
+		}
+	}()
+	return nil
+}
+
+// _stop_http_proxy stops accepting proxy connections and drops idle
+// pooled ones. tunnels already established are left to finish.
+func (s *Server) _stop_http_proxy() {
+	if s.httpProxy == nil {
+		return
+	}
+	s.httpProxy.server.Close()
+	s.httpProxy.transportMu.Lock()
+	defer s.httpProxy.transportMu.Unlock()
+	for _, t := range s.httpProxy.transports {
+		t.CloseIdleConnections()
+	}
+}
+
+// ServeHTTP authenticates the client, picks its exit group and forwards
+// the request.
+func (p *_http_proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, password, ok := _proxy_credentials(r)
+	if !ok || !_htpasswd_match(p.users, user, password) || len(p.cfg.Users[user]) == 0 {
+		w.Header().Set("Proxy-Authenticate", `Basic realm="relay"`)
+		http.Error(w, "proxy authentication required", http.StatusProxyAuthRequired)
+		return
+	}
+	groups := p.cfg.Users[user]
+	group := groups[0]
+	if p.cfg.GroupHeader != "" {
+		if want := r.Header.Get(p.cfg.GroupHeader); want != "" {
+			if !slices.Contains(groups, want) {
+				http.Error(w, "agent group not allowed", http.StatusForbidden)
+				return
+			}
+			group = want
+		}
+		r.Header.Del(p.cfg.GroupHeader)
+	}
+
+	if r.Method == http.MethodConnect {
+		p._connect(w, r, group)
+		return
+	}
+	if !r.URL.IsAbs() {
+		http.Error(w, "only proxy requests are served", http.StatusBadRequest)
+		return
+	}
+	// pooled connections were dialled for some earlier client, so each
+	// request is checked on its own
+	access := p.handler.Access()
+	if client, _ := _remote_addr(r.RemoteAddr); !access.Global().Allows(client) || !access.Group(group).Allows(client) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	slog.Debug("proxy request", "user", user, "group", _group_name(group), "url", r.URL.Redacted())
+	proxy := &httputil.ReverseProxy{
+		// hop-by-hop headers, Proxy-Authorization among them, are already gone
+		Rewrite:   func(pr *httputil.ProxyRequest) { pr.Out.Host = pr.In.Host },
+		Transport: p._transport(group),
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			status := http.StatusBadGateway
+			var dialErr *_proxy_dial_error
+			if errors.As(err, &dialErr) {
+				status = dialErr.status
+			}
+			slog.Debug("proxy request failed", "url", r.URL.Redacted(), "err", err)
+			http.Error(w, http.StatusText(status), status)
+		},
+	}
+	if addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr); err == nil {
+		r = r.WithContext(context.WithValue(r.Context(), _client_addr_key{}, addr))
+	}
+	proxy.ServeHTTP(w, r)
+}
+
+// _connect takes over the client connection and splices it to the
+// destination once an agent has connected to it.
+func (p *_http_proxy) _connect(w http.ResponseWriter, r *http.Request, group string) {
+	if _, port, err := net.SplitHostPort(r.Host); err != nil || port == "" {
+		http.Error(w, "CONNECT needs host:port", http.StatusBadRequest)
+		return
+	}
+	conn, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		slog.Error("cannot take over proxy connection", "err", err)
+		http.Error(w, "CONNECT not supported", http.StatusInternalServerError)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	client := &_client_conn{Conn: conn, r: brw.Reader}
+	open := &StreamOpen{Kind: StreamKindTCP, Target: r.Host}
+	pick := func() (*Tunnel, error) { return p.handler.pool.Get(group) }
+	p.handler._forward_tcp(client, group, open, pick, func(status int) {
+		fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\n", status, http.StatusText(status))
+		if status != http.StatusOK {
+			fmt.Fprint(conn, "Content-Length: 0\r\nConnection: close\r\n")
+		}
+		fmt.Fprint(conn, "\r\n")
+	})
+}
+
+// _transport returns the transport dialling through agents of group.
+func (p *_http_proxy) _transport(group string) *http.Transport {
+	p.transportMu.Lock()
+	defer p.transportMu.Unlock()
+	if t, ok := p.transports[group]; ok {
+		return t
+	}
+	t := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return p._dial(ctx, group, addr)
+		},
+		MaxIdleConnsPerHost: 4,
+		IdleConnTimeout:     90 * time.Second,
+	}
+	p.transports[group] = t
+	return t
+}
+
+// _dial opens a tcp stream to addr through an agent of group and returns
+// a connection to it.
+func (p *_http_proxy) _dial(ctx context.Context, group, addr string) (net.Conn, error) {
+	local, remote := net.Pipe()
+	outcome := make(chan int, 1)
+	open := &StreamOpen{Kind: StreamKindTCP, Target: addr}
+	pick := func() (*Tunnel, error) { return p.handler.pool.Get(group) }
+	client := &_client_conn{Conn: remote, remote: _client_addr(ctx)}
+	go p.handler._forward_tcp(client, group, open, pick, func(status int) { outcome <- status })
+
+	select {
+	case status := <-outcome:
+		if status != http.StatusOK {
+			local.Close()
+			return nil, &_proxy_dial_error{status: status}
+		}
+		return local, nil
+	case <-ctx.Done():
+		local.Close()
+		return nil, ctx.Err()
+	}
+}
+
+// _client_addr_key carries the proxy client's address to _dial.
+type _client_addr_key struct{}
+
+// _client_addr returns the proxy client's address from a request context.
+func _client_addr(ctx context.Context) net.Addr {
+	addr, _ := ctx.Value(_client_addr_key{}).(net.Addr)
+	return addr
+}
+
+// _proxy_credentials returns the basic credentials in Proxy-Authorization.
+func _proxy_credentials(r *http.Request) (user, password string, ok bool) {
+	auth := r.Header.Get("Proxy-Authorization")
+	if auth == "" {
+		return "", "", false
+	}
+	// BasicAuth parses Authorization only
+	parse := &http.Request{Header: http.Header{"Authorization": {auth}}}
+	return parse.BasicAuth()
+}
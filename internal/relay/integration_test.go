@@ -1,21 +1,56 @@
 package relay_test
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
 	"fmt"
 	"io"
+	"math/big"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/gorilla/websocket"
 	"github.com/reverseproxy/internal/agent"
 	"github.com/reverseproxy/internal/relay"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/net/proxy"
 )
 
 // _start_backend creates a simple http server for testing.
 func _start_backend(t *testing.T) (string, func()) {
 	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to start backend: %v", err)
+	}
+
+	srv := &http.Server{Handler: _backend_mux()}
+	go srv.Serve(listener)
+
+	addr := fmt.Sprintf("http://%s", listener.Addr().String())
+	return addr, func() { srv.Close() }
+}
+
+// _backend_mux serves the test backend's endpoints.
+func _backend_mux() *http.ServeMux {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/hello", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("X-Test", "passed")
@@ -27,28 +62,62 @@ func _start_backend(t *testing.T) (string, func()) {
 		w.WriteHeader(http.StatusOK)
 		w.Write(body)
 	})
-
-	listener, err := net.Listen("tcp", "127.0.0.1:0")
-	if err != nil {
-		t.Fatalf("failed to start backend: %v", err)
-	}
-
-	srv := &http.Server{Handler: mux}
-	go srv.Serve(listener)
-
-	addr := fmt.Sprintf("http://%s", listener.Addr().String())
-	return addr, func() { srv.Close() }
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(500 * time.Millisecond)
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, "slow response")
+	})
+	mux.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := 1; i <= 3; i++ {
+			fmt.Fprintf(w, "data: %d\n\n", i)
+			w.(http.Flusher).Flush()
+			time.Sleep(200 * time.Millisecond)
+		}
+	})
+	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			kind, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if string(msg) == "bye" {
+				conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(4001, "bye"))
+				return
+			}
+			conn.WriteMessage(kind, msg)
+		}
+	})
+	return mux
 }
 
 // _start_relay creates and starts a relay server for testing.
 func _start_relay(t *testing.T, secret string) (string, func()) {
+	t.Helper()
+	return _start_relay_with(t, secret, nil)
+}
+
+// _free_addr returns a local address nothing is listening on.
+func _free_addr(t *testing.T) string {
 	t.Helper()
 	listener, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
-		t.Fatalf("failed to bind relay: %v", err)
+		t.Fatalf("failed to bind: %v", err)
 	}
-	addr := listener.Addr().String()
-	listener.Close()
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+// _start_relay_with starts a relay after configure, if set, adjusts its
+// configuration.
+func _start_relay_with(t *testing.T, secret string, configure func(*relay.Config)) (string, func()) {
+	t.Helper()
+	addr := _free_addr(t)
 
 	cfg := &relay.Config{
 		Listen: relay.ListenConfig{Addr: addr},
@@ -58,15 +127,38 @@ func _start_relay(t *testing.T, secret string) (string, func()) {
 			Path:           "/_tunnel/ws",
 			PingInterval:   5 * time.Second,
 			RequestTimeout: 10 * time.Second,
+			DrainTimeout:   5 * time.Second,
 		},
 	}
+	if configure != nil {
+		configure(cfg)
+	}
 
-	srv := relay.NewServer(cfg)
+	srv, err := relay.NewServer(cfg)
+	if err != nil {
+		t.Fatalf("failed to create relay: %v", err)
+	}
 	go srv.Run()
 
 	// give the server a moment to start
 	time.Sleep(100 * time.Millisecond)
-	return addr, func() { /* server shuts down when test ends */ }
+	return addr, func() { srv.Shutdown(context.Background()) }
+}
+
+// _agent_config returns an agent configuration for local testing without a proxy.
+func _agent_config(relayAddr, backendURL, secret string) *agent.Config {
+	return &agent.Config{
+		Relay:   agent.RelayConfig{URL: fmt.Sprintf("ws://%s/_tunnel/ws", relayAddr)},
+		Backend: agent.BackendConfig{TargetURL: backendURL},
+		Auth:    agent.AuthConfig{SharedSecret: secret},
+		Proxy:   agent.ProxyConfig{VerifyRouting: false, HealthTimeout: 5 * time.Second},
+		Tunnel: agent.TunnelConfig{
+			ReconnectDelay:    1 * time.Second,
+			MaxReconnectDelay: 5 * time.Second,
+			PingInterval:      5 * time.Second,
+			DrainTimeout:      5 * time.Second,
+		},
+	}
 }
 
 func Test_integration_end_to_end(t *testing.T) {
@@ -85,19 +177,7 @@ func Test_integration_end_to_end(t *testing.T) {
 	defer stopRelay()
 
 	// configure and start agent (no proxy for local testing)
-	agentCfg := &agent.Config{
-		Relay:   agent.RelayConfig{URL: fmt.Sprintf("ws://%s/_tunnel/ws", relayAddr)},
-		Backend: agent.BackendConfig{TargetURL: backendURL},
-		Auth:    agent.AuthConfig{SharedSecret: secret},
-		Proxy:   agent.ProxyConfig{VerifyRouting: false, HealthTimeout: 5 * time.Second},
-		Tunnel: agent.TunnelConfig{
-			ReconnectDelay:    1 * time.Second,
-			MaxReconnectDelay: 5 * time.Second,
-			PingInterval:      5 * time.Second,
-		},
-	}
-
-	a, err := agent.New(agentCfg)
+	a, err := agent.New(_agent_config(relayAddr, backendURL, secret))
 	if err != nil {
 		t.Fatalf("failed to create agent: %v", err)
 	}
@@ -135,3 +215,1448 @@ func Test_integration_end_to_end(t *testing.T) {
 		t.Errorf("expected X-Test header 'passed', got %q", resp.Header.Get("X-Test"))
 	}
 }
+
+func Test_integration_repeated_headers_pass_through(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test in short mode")
+	}
+
+	secret := "integration-test-secret"
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Set-Cookie", "a=1")
+		w.Header().Add("Set-Cookie", "b=2")
+		fmt.Fprint(w, strings.Join(r.Header.Values("X-Forwarded-Tag"), ","))
+	}))
+	defer backend.Close()
+
+	relayAddr, stopRelay := _start_relay(t, secret)
+	defer stopRelay()
+
+	a, err := agent.New(_agent_config(relayAddr, backend.URL, secret))
+	if err != nil {
+		t.Fatalf("failed to create agent: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go a.Run(ctx)
+	time.Sleep(500 * time.Millisecond)
+
+	req, _ := http.NewRequest("GET", "http://"+relayAddr+"/", nil)
+	req.Header.Add("X-Forwarded-Tag", "one")
+	req.Header.Add("X-Forwarded-Tag", "two")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "one,two" {
+		t.Errorf("expected both request header values at the backend, got %q", body)
+	}
+	if cookies := resp.Header.Values("Set-Cookie"); len(cookies) != 2 {
+		t.Errorf("expected both cookies at the client, got %q", cookies)
+	}
+}
+
+func Test_integration_agent_drains_inflight_requests(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test in short mode")
+	}
+
+	secret := "integration-test-secret"
+
+	backendURL, stopBackend := _start_backend(t)
+	defer stopBackend()
+
+	relayAddr, stopRelay := _start_relay(t, secret)
+	defer stopRelay()
+
+	a, err := agent.New(_agent_config(relayAddr, backendURL, secret))
+	if err != nil {
+		t.Fatalf("failed to create agent: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		a.Run(ctx)
+		close(stopped)
+	}()
+	time.Sleep(500 * time.Millisecond)
+
+	// start a slow request, then stop the agent while it is in flight
+	type result struct {
+		status int
+		body   string
+		err    error
+	}
+	results := make(chan result, 1)
+	go func() {
+		resp, err := http.Get(fmt.Sprintf("http://%s/slow", relayAddr))
+		if err != nil {
+			results <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		results <- result{status: resp.StatusCode, body: string(body), err: err}
+	}()
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+
+	// while the slow request is still in flight, the draining agent is
+	// given no new ones
+	refused := 0
+	for deadline := time.Now().Add(300 * time.Millisecond); refused == 0 && time.Now().Before(deadline); {
+		resp, err := http.Get(fmt.Sprintf("http://%s/hello", relayAddr))
+		if err != nil {
+			t.Fatalf("request during drain failed: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			refused = resp.StatusCode
+		}
+	}
+	select {
+	case <-results:
+		t.Fatal("the in-flight request finished before the agent stopped taking new ones")
+	case <-stopped:
+		t.Fatal("agent stopped before its in-flight request finished")
+	default:
+	}
+	if refused != http.StatusBadGateway {
+		t.Errorf("expected a new request during the drain to be refused with 502, got %d", refused)
+	}
+
+	res := <-results
+	if res.err != nil {
+		t.Fatalf("in-flight request failed: %v", res.err)
+	}
+	if res.status != http.StatusOK || res.body != "slow response" {
+		t.Errorf("expected 200 %q, got %d %q", "slow response", res.status, res.body)
+	}
+
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("agent did not stop after draining")
+	}
+}
+
+func Test_integration_relay_drain_completes_inflight_requests(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test in short mode")
+	}
+
+	secret := "integration-test-secret"
+
+	backendURL, stopBackend := _start_backend(t)
+	defer stopBackend()
+
+	relayAddr, stopRelay := _start_relay(t, secret)
+
+	a, err := agent.New(_agent_config(relayAddr, backendURL, secret))
+	if err != nil {
+		t.Fatalf("failed to create agent: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go a.Run(ctx)
+	time.Sleep(500 * time.Millisecond)
+
+	results := make(chan error, 1)
+	go func() {
+		resp, err := http.Get(fmt.Sprintf("http://%s/slow", relayAddr))
+		if err != nil {
+			results <- err
+			return
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK || string(body) != "slow response" {
+			results <- fmt.Errorf("unexpected response %d %q", resp.StatusCode, body)
+			return
+		}
+		results <- nil
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	// drain the relay while the request is in flight
+	stopRelay()
+
+	if err := <-results; err != nil {
+		t.Fatalf("in-flight request failed during relay drain: %v", err)
+	}
+}
+
+func Test_integration_agent_config_reload(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test in short mode")
+	}
+
+	secret := "integration-test-secret"
+
+	firstURL, stopFirst := _start_backend(t)
+	defer stopFirst()
+
+	// second backend answers /hello differently so the switch is visible
+	mux := http.NewServeMux()
+	mux.HandleFunc("/hello", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "hello from second backend")
+	})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to start second backend: %v", err)
+	}
+	second := &http.Server{Handler: mux}
+	go second.Serve(listener)
+	defer second.Close()
+	secondURL := "http://" + listener.Addr().String()
+
+	relayAddr, stopRelay := _start_relay(t, secret)
+	defer stopRelay()
+
+	configPath := filepath.Join(t.TempDir(), "agent.yaml")
+	writeConfig := func(backendURL, group string) {
+		t.Helper()
+		data := fmt.Sprintf(`
+relay:
+  url: "ws://%s/_tunnel/ws"
+  group: %q
+backend:
+  target_url: %q
+auth:
+  shared_secret: %q
+proxy:
+  verify_routing: false
+tunnel:
+  reconnect_delay: 1s
+  drain_timeout: 5s
+reload:
+  watch_interval: 0s
+`, relayAddr, group, backendURL, secret)
+		if err := os.WriteFile(configPath, []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeConfig(firstURL, "default")
+
+	cfg, err := agent.LoadConfig(configPath)
+	if err != nil {
+		t.Fatalf("loading agent config: %v", err)
+	}
+	a, err := agent.New(cfg)
+	if err != nil {
+		t.Fatalf("failed to create agent: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go a.Run(ctx)
+	time.Sleep(500 * time.Millisecond)
+
+	get := func() string {
+		t.Helper()
+		resp, err := http.Get(fmt.Sprintf("http://%s/hello", relayAddr))
+		if err != nil {
+			t.Fatalf("request through relay failed: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return string(body)
+	}
+	if got := get(); got != "hello from backend" {
+		t.Fatalf("unexpected body before reload: %q", got)
+	}
+
+	// backend change applies in place
+	writeConfig(secondURL, "default")
+	if err := a.Reload(ctx); err != nil {
+		t.Fatalf("reload failed: %v", err)
+	}
+	if got := get(); got != "hello from second backend" {
+		t.Errorf("backend change not applied: %q", got)
+	}
+
+	// relay settings change reconnects, requests keep flowing throughout
+	writeConfig(secondURL, "blue")
+	if err := a.Reload(ctx); err != nil {
+		t.Fatalf("reload failed: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		if got := get(); got != "hello from second backend" {
+			t.Fatalf("request %d during reconnect: %q", i, got)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// invalid config is refused
+	os.WriteFile(configPath, []byte("relay: {}\n"), 0o600)
+	if err := a.Reload(ctx); err == nil {
+		t.Error("expected invalid config to be refused")
+	}
+}
+
+func Test_integration_agent_stream_limit(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test in short mode")
+	}
+
+	secret := "integration-test-secret"
+
+	backendURL, stopBackend := _start_backend(t)
+	defer stopBackend()
+
+	relayAddr, stopRelay := _start_relay(t, secret)
+	defer stopRelay()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for i := 0; i < 2; i++ {
+		cfg := _agent_config(relayAddr, backendURL, secret)
+		cfg.Tunnel.MaxStreams = 1
+		a, err := agent.New(cfg)
+		if err != nil {
+			t.Fatalf("failed to create agent: %v", err)
+		}
+		go a.Run(ctx)
+	}
+	time.Sleep(500 * time.Millisecond)
+
+	// two agents with one stream each: the third concurrent request is turned away
+	statuses := make(chan *http.Response, 3)
+	for i := 0; i < 3; i++ {
+		go func() {
+			resp, err := http.Get(fmt.Sprintf("http://%s/slow", relayAddr))
+			if err != nil {
+				t.Errorf("request failed: %v", err)
+				statuses <- nil
+				return
+			}
+			resp.Body.Close()
+			statuses <- resp
+		}()
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	counts := make(map[int]int)
+	for i := 0; i < 3; i++ {
+		resp := <-statuses
+		if resp == nil {
+			continue
+		}
+		counts[resp.StatusCode]++
+		if resp.StatusCode == http.StatusServiceUnavailable && resp.Header.Get("Retry-After") == "" {
+			t.Error("expected Retry-After on 503")
+		}
+	}
+	if counts[http.StatusOK] != 2 || counts[http.StatusServiceUnavailable] != 1 {
+		t.Errorf("expected two 200s and one 503, got %v", counts)
+	}
+}
+
+func Test_integration_websocket_passthrough(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test in short mode")
+	}
+
+	secret := "integration-test-secret"
+
+	backendURL, stopBackend := _start_backend(t)
+	defer stopBackend()
+
+	relayAddr, stopRelay := _start_relay(t, secret)
+	defer stopRelay()
+
+	a, err := agent.New(_agent_config(relayAddr, backendURL, secret))
+	if err != nil {
+		t.Fatalf("failed to create agent: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go a.Run(ctx)
+	time.Sleep(500 * time.Millisecond)
+
+	conn, resp, err := websocket.DefaultDialer.Dial(fmt.Sprintf("ws://%s/ws", relayAddr), nil)
+	if err != nil {
+		t.Fatalf("websocket dial through relay failed: %v", err)
+	}
+	defer conn.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected 101, got %d", resp.StatusCode)
+	}
+
+	for _, msg := range []string{"one", "two"} {
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		_, got, err := conn.ReadMessage()
+		if err != nil || string(got) != msg {
+			t.Fatalf("expected echo %q, got %q, %v", msg, got, err)
+		}
+	}
+
+	// the backend's close code reaches the client unchanged
+	conn.WriteMessage(websocket.TextMessage, []byte("bye"))
+	_, _, err = conn.ReadMessage()
+	if !websocket.IsCloseError(err, 4001) {
+		t.Errorf("expected close code 4001, got %v", err)
+	}
+
+	// a backend that declines the upgrade answers as usual
+	_, resp, err = websocket.DefaultDialer.Dial(fmt.Sprintf("ws://%s/hello", relayAddr), nil)
+	if err != websocket.ErrBadHandshake || resp == nil {
+		t.Fatalf("expected bad handshake, got %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "hello from backend" {
+		t.Errorf("declined upgrade: status %d body %q", resp.StatusCode, body)
+	}
+
+	// a plain request to a websocket endpoint is answered normally
+	plain, err := http.Get(fmt.Sprintf("http://%s/ws", relayAddr))
+	if err != nil {
+		t.Fatalf("plain request failed: %v", err)
+	}
+	plain.Body.Close()
+	if plain.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected 400 for non-upgrade request, got %d", plain.StatusCode)
+	}
+}
+
+func Test_integration_event_stream_is_flushed(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test in short mode")
+	}
+
+	secret := "integration-test-secret"
+
+	backendURL, stopBackend := _start_backend(t)
+	defer stopBackend()
+
+	relayAddr, stopRelay := _start_relay(t, secret)
+	defer stopRelay()
+
+	a, err := agent.New(_agent_config(relayAddr, backendURL, secret))
+	if err != nil {
+		t.Fatalf("failed to create agent: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go a.Run(ctx)
+	time.Sleep(500 * time.Millisecond)
+
+	start := time.Now()
+	resp, err := http.Get(fmt.Sprintf("http://%s/events", relayAddr))
+	if err != nil {
+		t.Fatalf("request through relay failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("expected event stream content type, got %q", ct)
+	}
+
+	// each event arrives as the backend sends it, not once the stream ends
+	r := bufio.NewReader(resp.Body)
+	for i := 1; i <= 3; i++ {
+		line, err := r.ReadString('\n')
+		if err != nil || line != fmt.Sprintf("data: %d\n", i) {
+			t.Fatalf("event %d: %q, %v", i, line, err)
+		}
+		r.ReadString('\n')
+		if i == 1 && time.Since(start) > 300*time.Millisecond {
+			t.Errorf("first event took %s, response was buffered", time.Since(start))
+		}
+	}
+	if rest, err := io.ReadAll(r); err != nil || len(rest) != 0 {
+		t.Errorf("expected clean end of stream, got %q, %v", rest, err)
+	}
+}
+
+// _start_tcp_echo starts a tcp server that echoes each connection and
+// closes its side once the client half-closes.
+func _start_tcp_echo(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to bind echo server: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func Test_integration_tcp_forward(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test in short mode")
+	}
+
+	secret := "integration-test-secret"
+	echoAddr := _start_tcp_echo(t)
+	backendURL, stopBackend := _start_backend(t)
+	defer stopBackend()
+
+	forwardAddr, deniedAddr := _free_addr(t), _free_addr(t)
+	relayAddr, stopRelay := _start_relay_with(t, secret, func(cfg *relay.Config) {
+		cfg.TCP = []relay.TCPForwardConfig{
+			{Listen: forwardAddr, Target: echoAddr},
+			{Listen: deniedAddr, Target: "127.0.0.1:1"},
+		}
+	})
+	defer stopRelay()
+
+	cfg := _agent_config(relayAddr, backendURL, secret)
+	cfg.TCP.Allow = []string{echoAddr}
+	a, err := agent.New(cfg)
+	if err != nil {
+		t.Fatalf("failed to create agent: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go a.Run(ctx)
+	time.Sleep(500 * time.Millisecond)
+
+	conn, err := net.Dial("tcp", forwardAddr)
+	if err != nil {
+		t.Fatalf("dial tcp forward: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("expected echo, got %q, %v", buf, err)
+	}
+	// the half-close reaches the echo server, which then closes its side
+	if _, err := conn.Write([]byte("last")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	conn.(*net.TCPConn).CloseWrite()
+	rest, err := io.ReadAll(conn)
+	if err != nil || string(rest) != "last" {
+		t.Fatalf("expected remaining echo then eof, got %q, %v", rest, err)
+	}
+
+	denied, err := net.Dial("tcp", deniedAddr)
+	if err != nil {
+		t.Fatalf("dial denied forward: %v", err)
+	}
+	defer denied.Close()
+	denied.SetDeadline(time.Now().Add(5 * time.Second))
+	if n, err := denied.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expected target off the allow list to be closed, got %d bytes, %v", n, err)
+	}
+}
+
+func Test_integration_stalled_stream_does_not_block_tunnel(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test in short mode")
+	}
+
+	secret := "integration-test-secret"
+	echoAddr := _start_tcp_echo(t)
+	backendURL, stopBackend := _start_backend(t)
+	defer stopBackend()
+
+	forwardAddr := _free_addr(t)
+	relayAddr, stopRelay := _start_relay_with(t, secret, func(cfg *relay.Config) {
+		cfg.TCP = []relay.TCPForwardConfig{{Listen: forwardAddr, Target: echoAddr}}
+	})
+	defer stopRelay()
+
+	cfg := _agent_config(relayAddr, backendURL, secret)
+	cfg.TCP.Allow = []string{echoAddr}
+	a, err := agent.New(cfg)
+	if err != nil {
+		t.Fatalf("failed to create agent: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go a.Run(ctx)
+	time.Sleep(500 * time.Millisecond)
+
+	// far more than a window's worth, echoed back to a client not reading yet
+	bulk, err := net.Dial("tcp", forwardAddr)
+	if err != nil {
+		t.Fatalf("dial tcp forward: %v", err)
+	}
+	defer bulk.Close()
+	bulk.SetDeadline(time.Now().Add(20 * time.Second))
+	data := bytes.Repeat([]byte("0123456789abcdef"), 1<<20)
+	written := make(chan error, 1)
+	go func() {
+		_, err := bulk.Write(data)
+		written <- err
+	}()
+	time.Sleep(300 * time.Millisecond)
+
+	other, err := net.Dial("tcp", forwardAddr)
+	if err != nil {
+		t.Fatalf("dial tcp forward: %v", err)
+	}
+	defer other.Close()
+	other.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := other.Write([]byte("ping")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(other, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("a stalled stream held up another: %q, %v", buf, err)
+	}
+
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(bulk, got); err != nil {
+		t.Fatalf("reading bulk echo: %v", err)
+	}
+	if err := <-written; err != nil {
+		t.Fatalf("writing bulk data: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("bulk echo corrupted")
+	}
+}
+
+func Test_integration_remote_endpoints(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test in short mode")
+	}
+
+	secret := "integration-test-secret"
+	echoAddr := _start_tcp_echo(t)
+	backendURL, stopBackend := _start_backend(t)
+	defer stopBackend()
+
+	_, portStr, _ := net.SplitHostPort(_free_addr(t))
+	relayAddr, stopRelay := _start_relay_with(t, secret, func(cfg *relay.Config) {
+		cfg.Remote = relay.RemoteConfig{
+			PortRange:   portStr,
+			BindHost:    "127.0.0.1",
+			Domain:      "tunnel.example.com",
+			GracePeriod: time.Second,
+			Agents: map[string]relay.RemoteAgentPolicy{
+				"laptop": {Ports: []string{portStr}, Subdomains: []string{"app"}},
+			},
+		}
+		cfg.Auth.Agents = map[string]string{"laptop": "laptop-secret"}
+	})
+	defer stopRelay()
+
+	cfg := _agent_config(relayAddr, backendURL, "laptop-secret")
+	cfg.Relay.Name = "laptop"
+	cfg.RemoteForwards = []agent.RemoteForwardConfig{
+		{Type: "tcp", Port: 0, Target: echoAddr},
+		{Type: "http", Subdomain: "app"},
+	}
+	a, err := agent.New(cfg)
+	if err != nil {
+		t.Fatalf("failed to create agent: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go a.Run(ctx)
+	time.Sleep(500 * time.Millisecond)
+
+	endpoints := a.RemoteEndpoints()
+	if len(endpoints) != 2 || endpoints[0].Error != "" || endpoints[1].Error != "" {
+		t.Fatalf("expected both endpoints allocated, got %+v", endpoints)
+	}
+	if strconv.Itoa(endpoints[0].Port) != portStr || endpoints[1].Host != "app.tunnel.example.com" {
+		t.Fatalf("unexpected endpoints %+v", endpoints)
+	}
+
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", portStr))
+	if err != nil {
+		t.Fatalf("dial remote endpoint: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("expected echo through remote endpoint, got %q, %v", buf, err)
+	}
+
+	req, _ := http.NewRequest("GET", fmt.Sprintf("http://%s/hello", relayAddr), nil)
+	req.Host = "app.tunnel.example.com"
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request to remote host: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "hello from backend" {
+		t.Errorf("expected backend answer for remote host, got %d %q", resp.StatusCode, body)
+	}
+}
+
+// _start_udp_echo starts a udp server that echoes every datagram.
+func _start_udp_echo(t *testing.T) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to bind udp echo server: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 65536)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteTo(buf[:n], addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func Test_integration_udp_forward(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test in short mode")
+	}
+
+	secret := "integration-test-secret"
+	echoAddr := _start_udp_echo(t)
+	backendURL, stopBackend := _start_backend(t)
+	defer stopBackend()
+
+	probe, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	forwardAddr := probe.LocalAddr().String()
+	probe.Close()
+	relayAddr, stopRelay := _start_relay_with(t, secret, func(cfg *relay.Config) {
+		cfg.UDP = []relay.UDPForwardConfig{{Listen: forwardAddr, Target: echoAddr, IdleTimeout: 300 * time.Millisecond}}
+	})
+	defer stopRelay()
+
+	cfg := _agent_config(relayAddr, backendURL, secret)
+	cfg.UDP = agent.UDPConfig{Allow: []string{echoAddr}, IdleTimeout: time.Minute}
+	a, err := agent.New(cfg)
+	if err != nil {
+		t.Fatalf("failed to create agent: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go a.Run(ctx)
+	time.Sleep(500 * time.Millisecond)
+
+	clients := make([]net.Conn, 2)
+	for i := range clients {
+		conn, err := net.Dial("udp", forwardAddr)
+		if err != nil {
+			t.Fatalf("dial udp forward: %v", err)
+		}
+		defer conn.Close()
+		clients[i] = conn
+	}
+	exchange := func(conn net.Conn, msg string) {
+		t.Helper()
+		conn.SetDeadline(time.Now().Add(3 * time.Second))
+		if _, err := conn.Write([]byte(msg)); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		buf := make([]byte, 64)
+		n, err := conn.Read(buf)
+		if err != nil || string(buf[:n]) != msg {
+			t.Fatalf("expected echo %q, got %q, %v", msg, buf[:n], err)
+		}
+	}
+
+	// each client address is a flow of its own
+	exchange(clients[0], "one")
+	exchange(clients[1], "two")
+	exchange(clients[0], "three")
+
+	// once the flow idles out the next datagram opens a new one
+	time.Sleep(600 * time.Millisecond)
+	exchange(clients[0], "four")
+}
+
+func Test_integration_socks_exit_through_agent(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test in short mode")
+	}
+
+	secret := "integration-test-secret"
+	echoAddr := _start_tcp_echo(t)
+	backendURL, stopBackend := _start_backend(t)
+	defer stopBackend()
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("s3cret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	htpasswd := filepath.Join(t.TempDir(), "socks.htpasswd")
+	if err := os.WriteFile(htpasswd, []byte("ops:"+string(hash)+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	socksAddr := _free_addr(t)
+	relayAddr, stopRelay := _start_relay_with(t, secret, func(cfg *relay.Config) {
+		cfg.SOCKS = relay.SOCKSConfig{Listen: socksAddr, HtpasswdFile: htpasswd, Users: map[string]string{"ops": ""}}
+	})
+	defer stopRelay()
+
+	cfg := _agent_config(relayAddr, backendURL, secret)
+	cfg.TCP.Allow = []string{echoAddr}
+	a, err := agent.New(cfg)
+	if err != nil {
+		t.Fatalf("failed to create agent: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go a.Run(ctx)
+	time.Sleep(500 * time.Millisecond)
+
+	dialer, err := proxy.SOCKS5("tcp", socksAddr, &proxy.Auth{User: "ops", Password: "s3cret"}, proxy.Direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dialer.Dial("tcp", echoAddr)
+	if err != nil {
+		t.Fatalf("socks connect through agent: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("expected echo through socks, got %q, %v", buf, err)
+	}
+
+	if _, err := dialer.Dial("tcp", "127.0.0.1:1"); err == nil || !strings.Contains(err.Error(), "not allowed") {
+		t.Errorf("expected target off the agent's allow list to be refused, got %v", err)
+	}
+	wrong, _ := proxy.SOCKS5("tcp", socksAddr, &proxy.Auth{User: "ops", Password: "wrong"}, proxy.Direct)
+	if _, err := wrong.Dial("tcp", echoAddr); err == nil {
+		t.Error("expected wrong password to be rejected")
+	}
+}
+
+func Test_integration_http_proxy_through_agent(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test in short mode")
+	}
+
+	secret := "integration-test-secret"
+	echoAddr := _start_tcp_echo(t)
+	backendURL, stopBackend := _start_backend(t)
+	defer stopBackend()
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("s3cret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	htpasswd := filepath.Join(t.TempDir(), "proxy.htpasswd")
+	if err := os.WriteFile(htpasswd, []byte("ops:"+string(hash)+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	proxyAddr := _free_addr(t)
+	relayAddr, stopRelay := _start_relay_with(t, secret, func(cfg *relay.Config) {
+		cfg.HTTPProxy = relay.HTTPProxyConfig{Listen: proxyAddr, HtpasswdFile: htpasswd, Users: map[string][]string{"ops": {""}}}
+	})
+	defer stopRelay()
+
+	cfg := _agent_config(relayAddr, backendURL, secret)
+	cfg.TCP.Allow = []string{echoAddr, strings.TrimPrefix(backendURL, "http://")}
+	a, err := agent.New(cfg)
+	if err != nil {
+		t.Fatalf("failed to create agent: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go a.Run(ctx)
+	time.Sleep(500 * time.Millisecond)
+
+	connect := func(target, auth string) (net.Conn, *bufio.Reader, *http.Response) {
+		t.Helper()
+		conn, err := net.Dial("tcp", proxyAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n", target, target)
+		if auth != "" {
+			fmt.Fprintf(conn, "Proxy-Authorization: %s\r\n", auth)
+		}
+		fmt.Fprint(conn, "\r\n")
+		br := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+		if err != nil {
+			t.Fatalf("reading CONNECT response: %v", err)
+		}
+		return conn, br, resp
+	}
+	auth := "Basic " + base64.StdEncoding.EncodeToString([]byte("ops:s3cret"))
+
+	conn, br, resp := connect(echoAddr, auth)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected CONNECT to succeed, got %d", resp.StatusCode)
+	}
+	conn.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(br, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("expected echo through CONNECT, got %q, %v", buf, err)
+	}
+	conn.Close()
+
+	if conn, _, resp := connect(echoAddr, ""); resp.StatusCode != http.StatusProxyAuthRequired {
+		t.Errorf("expected 407 without credentials, got %d", resp.StatusCode)
+	} else {
+		conn.Close()
+	}
+	if conn, _, resp := connect("127.0.0.1:1", auth); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected 403 for a target off the agent's allow list, got %d", resp.StatusCode)
+	} else {
+		conn.Close()
+	}
+
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(&url.URL{
+		Scheme: "http", Host: proxyAddr, User: url.UserPassword("ops", "s3cret"),
+	})}}
+	get, err := client.Get(backendURL + "/hello")
+	if err != nil {
+		t.Fatalf("proxied GET: %v", err)
+	}
+	body, _ := io.ReadAll(get.Body)
+	get.Body.Close()
+	if get.StatusCode != http.StatusOK || string(body) != "hello from backend" {
+		t.Errorf("expected backend response through proxy, got %d %q", get.StatusCode, body)
+	}
+}
+
+// _write_self_signed writes a self-signed certificate for name and
+// returns its cert and key files.
+func _write_self_signed(t *testing.T, name string) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+	return certFile, keyFile
+}
+
+func Test_integration_tls_passthrough(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test in short mode")
+	}
+
+	secret := "integration-test-secret"
+	backendURL, stopBackend := _start_backend(t)
+	defer stopBackend()
+	tlsBackend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "hello from tls backend")
+	}))
+	defer tlsBackend.Close()
+
+	passthroughAddr := _free_addr(t)
+	relayAddr, stopRelay := _start_relay_with(t, secret, func(cfg *relay.Config) {
+		cfg.TLSPassthrough = relay.TLSPassthroughConfig{
+			Listen: passthroughAddr,
+			Routes: []relay.PassthroughRouteConfig{{Host: "*.example.test"}},
+		}
+	})
+	defer stopRelay()
+
+	certFile, keyFile := _write_self_signed(t, "term.example.test")
+	cfg := _agent_config(relayAddr, backendURL, secret)
+	cfg.TLSPassthrough = []agent.TLSPassthroughConfig{
+		{Host: "raw.example.test", Target: tlsBackend.Listener.Addr().String()},
+		{Host: "term.example.test", Target: strings.TrimPrefix(backendURL, "http://"), CertFile: certFile, KeyFile: keyFile},
+	}
+	a, err := agent.New(cfg)
+	if err != nil {
+		t.Fatalf("failed to create agent: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go a.Run(ctx)
+	time.Sleep(500 * time.Millisecond)
+
+	get := func(host, path string) (*http.Response, string, error) {
+		t.Helper()
+		client := &http.Client{Timeout: 5 * time.Second, Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "tcp", passthroughAddr)
+			},
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+			DisableKeepAlives: true,
+		}}
+		resp, err := client.Get("https://" + host + path)
+		if err != nil {
+			return nil, "", err
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp, string(body), nil
+	}
+
+	resp, body, err := get("raw.example.test", "/")
+	if err != nil {
+		t.Fatalf("request through passthrough: %v", err)
+	}
+	if body != "hello from tls backend" {
+		t.Errorf("expected tls backend response, got %q", body)
+	}
+	if !resp.TLS.PeerCertificates[0].Equal(tlsBackend.Certificate()) {
+		t.Error("expected the tls backend's own certificate end to end")
+	}
+
+	resp, body, err = get("term.example.test", "/hello")
+	if err != nil {
+		t.Fatalf("request terminated on agent: %v", err)
+	}
+	if body != "hello from backend" {
+		t.Errorf("expected plaintext backend response, got %q", body)
+	}
+	if name := resp.TLS.PeerCertificates[0].Subject.CommonName; name != "term.example.test" {
+		t.Errorf("expected the agent's certificate, got %q", name)
+	}
+
+	if _, _, err := get("other.example.test", "/"); err == nil {
+		t.Error("expected a server name the agent does not serve to be refused")
+	}
+	if _, _, err := get("elsewhere.test", "/"); err == nil {
+		t.Error("expected a server name without a route to be refused")
+	}
+}
+
+func Test_integration_agent_backend_routes(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test in short mode")
+	}
+
+	secret := "integration-test-secret"
+	backendURL, stopBackend := _start_backend(t)
+	defer stopBackend()
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "api %s %s env=%s cookie=%q", r.Method, r.URL.RequestURI(), r.Header.Get("X-Env"), r.Header.Get("Cookie"))
+	}))
+	defer api.Close()
+
+	relayAddr, stopRelay := _start_relay(t, secret)
+	defer stopRelay()
+
+	cfg := _agent_config(relayAddr, backendURL, secret)
+	cfg.Backend.Routes = []agent.BackendRouteConfig{
+		{
+			Host:          "api.example.test",
+			PathPrefix:    "/v1",
+			Methods:       []string{"GET", "POST"},
+			TargetURL:     api.URL,
+			RewritePrefix: "/",
+			SetHeaders:    map[string]string{"X-Env": "prod"},
+			RemoveHeaders: []string{"Cookie"},
+		},
+		{Host: "www.example.test", TargetURL: backendURL},
+	}
+	a, err := agent.New(cfg)
+	if err != nil {
+		t.Fatalf("failed to create agent: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go a.Run(ctx)
+	time.Sleep(500 * time.Millisecond)
+
+	do := func(method, host, path string) (int, string) {
+		t.Helper()
+		req, _ := http.NewRequest(method, "http://"+relayAddr+path, nil)
+		req.Host = host
+		req.Header.Set("Cookie", "session=1")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s%s: %v", method, host, path, err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	if status, body := do("GET", "api.example.test", "/v1/users?page=2"); status != http.StatusOK || body != `api GET /users?page=2 env=prod cookie=""` {
+		t.Errorf("expected rewritten api request, got %d %q", status, body)
+	}
+	if status, body := do("GET", "www.example.test:8080", "/hello"); status != http.StatusOK || body != "hello from backend" {
+		t.Errorf("expected second route by host, got %d %q", status, body)
+	}
+	if status, _ := do("DELETE", "api.example.test", "/v1/users"); status != http.StatusNotFound {
+		t.Errorf("expected method off the route to be 404, got %d", status)
+	}
+	if status, body := do("GET", "other.example.test", "/hello"); status != http.StatusNotFound || !strings.Contains(body, "no backend route matches") {
+		t.Errorf("expected unmatched request to be 404, got %d %q", status, body)
+	}
+}
+
+func Test_integration_agent_backend_replicas(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test in short mode")
+	}
+
+	secret := "integration-test-secret"
+	var healthy [2]atomic.Bool
+	var urls []string
+	for i := range healthy {
+		healthy[i].Store(true)
+		replica := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/healthz" && !healthy[i].Load() {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			fmt.Fprintf(w, "replica %d", i)
+		}))
+		defer replica.Close()
+		urls = append(urls, replica.URL)
+	}
+
+	relayAddr, stopRelay := _start_relay(t, secret)
+	defer stopRelay()
+
+	cfg := _agent_config(relayAddr, urls[0], secret)
+	cfg.Backend.Targets = urls
+	cfg.Backend.HealthCheck = agent.HealthCheckConfig{
+		Path:               "/healthz",
+		Interval:           50 * time.Millisecond,
+		HealthyThreshold:   1,
+		UnhealthyThreshold: 1,
+	}
+	a, err := agent.New(cfg)
+	if err != nil {
+		t.Fatalf("failed to create agent: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go a.Run(ctx)
+	time.Sleep(500 * time.Millisecond)
+
+	get := func() (int, string) {
+		t.Helper()
+		resp, err := http.Get("http://" + relayAddr + "/")
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	seen := map[string]int{}
+	for range 4 {
+		status, body := get()
+		if status != http.StatusOK {
+			t.Fatalf("expected 200, got %d %q", status, body)
+		}
+		seen[body]++
+	}
+	if seen["replica 0"] != 2 || seen["replica 1"] != 2 {
+		t.Errorf("expected requests spread across replicas, got %v", seen)
+	}
+
+	healthy[0].Store(false)
+	time.Sleep(300 * time.Millisecond)
+	for range 4 {
+		if status, body := get(); status != http.StatusOK || body != "replica 1" {
+			t.Errorf("expected failing replica out of rotation, got %d %q", status, body)
+		}
+	}
+
+	// with no replica left the agent tells the relay, which stops sending
+	healthy[1].Store(false)
+	time.Sleep(300 * time.Millisecond)
+	if status, body := get(); status != http.StatusServiceUnavailable || !strings.Contains(body, "no healthy backend") {
+		t.Errorf("expected 503 with every replica down, got %d %q", status, body)
+	}
+
+	healthy[0].Store(true)
+	time.Sleep(300 * time.Millisecond)
+	if status, body := get(); status != http.StatusOK || body != "replica 0" {
+		t.Errorf("expected recovered replica back in rotation, got %d %q", status, body)
+	}
+}
+
+func Test_integration_agent_ejects_unreachable_target(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test in short mode")
+	}
+
+	secret := "integration-test-secret"
+	backendURL, stopBackend := _start_backend(t)
+	defer stopBackend()
+	relayAddr, stopRelay := _start_relay(t, secret)
+	defer stopRelay()
+
+	cfg := _agent_config(relayAddr, backendURL, secret)
+	cfg.Backend.Targets = []string{"http://" + _free_addr(t), backendURL}
+	cfg.Backend.HealthCheck = agent.HealthCheckConfig{EjectAfter: 1, EjectFor: time.Minute}
+	a, err := agent.New(cfg)
+	if err != nil {
+		t.Fatalf("failed to create agent: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go a.Run(ctx)
+	time.Sleep(500 * time.Millisecond)
+
+	failed := 0
+	for range 6 {
+		resp, err := http.Get("http://" + relayAddr + "/hello")
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		resp.Body.Close()
+		switch resp.StatusCode {
+		case http.StatusOK:
+		case http.StatusBadGateway:
+			failed++
+		default:
+			t.Errorf("unexpected status %d", resp.StatusCode)
+		}
+	}
+	if failed != 1 {
+		t.Errorf("expected the unreachable target to fail once before ejection, failed %d times", failed)
+	}
+}
+
+func Test_integration_agent_unix_and_in_process_backends(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test in short mode")
+	}
+
+	secret := "integration-test-secret"
+	socket := filepath.Join(t.TempDir(), "app.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("failed to listen on unix socket: %v", err)
+	}
+	srv := &http.Server{Handler: _backend_mux()}
+	go srv.Serve(listener)
+	defer srv.Close()
+
+	relayAddr, stopRelay := _start_relay(t, secret)
+	defer stopRelay()
+
+	unixCfg := _agent_config(relayAddr, "unix://"+socket, secret)
+	handlerCfg := _agent_config(relayAddr, "", secret)
+	handlerCfg.Backend.Handler = _backend_mux()
+
+	for name, cfg := range map[string]*agent.Config{"unix": unixCfg, "in-process": handlerCfg} {
+		a, err := agent.New(cfg)
+		if err != nil {
+			t.Fatalf("%s: failed to create agent: %v", name, err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			a.Run(ctx)
+			close(done)
+		}()
+		time.Sleep(500 * time.Millisecond)
+
+		resp, err := http.Get(fmt.Sprintf("http://%s/hello", relayAddr))
+		if err != nil {
+			t.Fatalf("%s: request failed: %v", name, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || string(body) != "hello from backend" || resp.Header.Get("X-Test") != "passed" {
+			t.Errorf("%s: unexpected response %d %q", name, resp.StatusCode, body)
+		}
+
+		conn, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf("ws://%s/ws", relayAddr), nil)
+		if err != nil {
+			t.Fatalf("%s: websocket dial failed: %v", name, err)
+		}
+		conn.WriteMessage(websocket.TextMessage, []byte("ping"))
+		if _, got, err := conn.ReadMessage(); err != nil || string(got) != "ping" {
+			t.Errorf("%s: expected websocket echo, got %q, %v", name, got, err)
+		}
+		conn.Close()
+
+		cancel()
+		<-done
+	}
+}
+
+func Test_integration_agent_https_backend_tls(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test in short mode")
+	}
+
+	secret := "integration-test-secret"
+	serverCert, serverKey := _write_self_signed(t, "backend.internal")
+	clientCert, clientKey := _write_self_signed(t, "agent")
+	pair, err := tls.LoadX509KeyPair(serverCert, serverKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientPEM, _ := os.ReadFile(clientCert)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AppendCertsFromPEM(clientPEM)
+
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s %s", r.TLS.ServerName, r.Proto, r.TLS.PeerCertificates[0].Subject.CommonName)
+	}))
+	backend.TLS = &tls.Config{
+		Certificates: []tls.Certificate{pair},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	}
+	backend.EnableHTTP2 = true
+	backend.StartTLS()
+	defer backend.Close()
+
+	relayAddr, stopRelay := _start_relay(t, secret)
+	defer stopRelay()
+
+	verified := agent.BackendTLSConfig{CAFile: serverCert, ClientCert: clientCert, ClientKey: clientKey, ServerName: "backend.internal"}
+	cfg := _agent_config(relayAddr, backend.URL, secret)
+	cfg.Backend.Routes = []agent.BackendRouteConfig{
+		{Host: "h1.example.test", TargetURL: backend.URL, TLS: verified, HTTP2: "off"},
+		{Host: "nocert.example.test", TargetURL: backend.URL},
+		{Host: "insecure.example.test", TargetURL: backend.URL, TLS: agent.BackendTLSConfig{ClientCert: clientCert, ClientKey: clientKey, InsecureSkipVerify: true}},
+		{TargetURL: backend.URL, TLS: verified},
+	}
+	a, err := agent.New(cfg)
+	if err != nil {
+		t.Fatalf("failed to create agent: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go a.Run(ctx)
+	time.Sleep(500 * time.Millisecond)
+
+	get := func(host string) (int, string) {
+		t.Helper()
+		req, _ := http.NewRequest("GET", "http://"+relayAddr+"/", nil)
+		req.Host = host
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s: %v", host, err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	if status, body := get("www.example.test"); status != http.StatusOK || body != "backend.internal HTTP/2.0 agent" {
+		t.Errorf("expected verified mtls request over http/2, got %d %q", status, body)
+	}
+	if status, body := get("h1.example.test"); status != http.StatusOK || body != "backend.internal HTTP/1.1 agent" {
+		t.Errorf("expected http/1.1 with http2 off, got %d %q", status, body)
+	}
+	if status, body := get("nocert.example.test"); status != http.StatusBadGateway {
+		t.Errorf("expected unknown authority to fail, got %d %q", status, body)
+	}
+	if status, body := get("insecure.example.test"); status != http.StatusOK || !strings.HasSuffix(body, " agent") {
+		t.Errorf("expected unverified request to succeed, got %d %q", status, body)
+	}
+}
+
+func Test_integration_agent_host_header_and_timeouts(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test in short mode")
+	}
+
+	secret := "integration-test-secret"
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(500 * time.Millisecond)
+		}
+		fmt.Fprint(w, r.Host)
+	}))
+	defer backend.Close()
+	backendHost := strings.TrimPrefix(backend.URL, "http://")
+
+	relayAddr, stopRelay := _start_relay(t, secret)
+	defer stopRelay()
+
+	cfg := _agent_config(relayAddr, backend.URL, secret)
+	cfg.Backend.Routes = []agent.BackendRouteConfig{
+		{Host: "preserve.example.test", TargetURL: backend.URL, HostHeader: "preserve"},
+		{
+			Host:       "fixed.example.test",
+			TargetURL:  backend.URL,
+			HostHeader: "vhost.internal",
+			Transport:  agent.BackendTransportConfig{ResponseHeaderTimeout: 100 * time.Millisecond, MaxConnsPerHost: 2},
+		},
+		{
+			Host:      "deadline.example.test",
+			TargetURL: backend.URL,
+			Transport: agent.BackendTransportConfig{RequestTimeout: 100 * time.Millisecond},
+		},
+		{TargetURL: backend.URL},
+	}
+	a, err := agent.New(cfg)
+	if err != nil {
+		t.Fatalf("failed to create agent: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go a.Run(ctx)
+	time.Sleep(500 * time.Millisecond)
+
+	get := func(host, path string) (int, string) {
+		t.Helper()
+		req, _ := http.NewRequest("GET", "http://"+relayAddr+path, nil)
+		req.Host = host
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s%s: %v", host, path, err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	if status, body := get("preserve.example.test", "/"); status != http.StatusOK || body != "preserve.example.test" {
+		t.Errorf("expected original host, got %d %q", status, body)
+	}
+	if status, body := get("fixed.example.test", "/"); status != http.StatusOK || body != "vhost.internal" {
+		t.Errorf("expected fixed host, got %d %q", status, body)
+	}
+	if status, body := get("www.example.test", "/"); status != http.StatusOK || body != backendHost {
+		t.Errorf("expected backend host by default, got %d %q", status, body)
+	}
+	if status, body := get("fixed.example.test", "/slow"); status != http.StatusBadGateway || !strings.Contains(body, "timeout awaiting response headers") {
+		t.Errorf("expected response header timeout, got %d %q", status, body)
+	}
+	if status, body := get("deadline.example.test", "/slow"); status != http.StatusBadGateway || !strings.Contains(body, "did not respond within 100ms") {
+		t.Errorf("expected the route's request timeout, got %d %q", status, body)
+	}
+	if status, _ := get("www.example.test", "/slow"); status != http.StatusOK {
+		t.Errorf("expected slow response without a timeout, got %d", status)
+	}
+}
@@ -0,0 +1,403 @@
+package relay
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// minimum time between jwks fetches triggered by unknown key ids.
+const _jwks_min_refresh = 30 * time.Second
+
+// JWTVerifier validates signed jwts against keys from a jwks file or url
+// and checks issuer, audience, expiry and required claims.
+type JWTVerifier struct {
+	cfg    JWTConfig
+	client *http.Client
+
+	mu        sync.Mutex
+	keys      map[string]crypto.PublicKey
+	fetchedAt time.Time
+	// closed when the fetch in progress ends, nil if none is
+	fetching chan struct{}
+	fetchErr error
+}
+
+// _jwt_header is the protected header of a jws compact token.
+type _jwt_header struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// _jwk is a single json web key.
+type _jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// NewJWTVerifier creates a verifier. a jwks file is loaded immediately; a
+// jwks url is fetched on first use and refreshed periodically.
+func NewJWTVerifier(cfg JWTConfig) (*JWTVerifier, error) {
+	if cfg.JWKSFile == "" && cfg.JWKSURL == "" {
+		return nil, fmt.Errorf("jwt needs jwks_file or jwks_url")
+	}
+	v := &JWTVerifier{
+		cfg:    cfg,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+	if cfg.JWKSFile != "" {
+		data, err := os.ReadFile(cfg.JWKSFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading jwks file: %w", err)
+		}
+		keys, err := _parse_jwks(data)
+		if err != nil {
+			return nil, fmt.Errorf("parsing jwks file %s: %w", cfg.JWKSFile, err)
+		}
+		v.keys = keys
+	}
+	return v, nil
+}
+
+// Verify checks the token signature and claims and returns the claims.
+func (v *JWTVerifier) Verify(token string) (map[string]any, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed jwt")
+	}
+
+	var header _jwt_header
+	if err := _decode_segment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("decoding jwt header: %w", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("decoding jwt signature: %w", err)
+	}
+
+	key, err := v._key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := _verify_signature(header.Alg, key, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return nil, err
+	}
+
+	var claims map[string]any
+	if err := _decode_segment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("decoding jwt claims: %w", err)
+	}
+	if err := v._check_claims(claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// _check_claims validates time bounds, issuer, audience and required claims.
+func (v *JWTVerifier) _check_claims(claims map[string]any) error {
+	now := time.Now()
+	leeway := v.cfg.Leeway
+	if exp, ok := claims["exp"].(float64); ok {
+		if now.After(time.Unix(int64(exp), 0).Add(leeway)) {
+			return fmt.Errorf("jwt expired")
+		}
+	} else {
+		return fmt.Errorf("jwt has no exp claim")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok {
+		if now.Add(leeway).Before(time.Unix(int64(nbf), 0)) {
+			return fmt.Errorf("jwt not valid yet")
+		}
+	}
+	if v.cfg.Issuer != "" && claims["iss"] != v.cfg.Issuer {
+		return fmt.Errorf("jwt issuer %v not accepted", claims["iss"])
+	}
+	if v.cfg.Audience != "" && !_claim_has(claims["aud"], v.cfg.Audience) {
+		return fmt.Errorf("jwt audience does not include %q", v.cfg.Audience)
+	}
+	for name, want := range v.cfg.Claims {
+		if !_claim_has(claims[name], want) {
+			return fmt.Errorf("jwt claim %q does not match", name)
+		}
+	}
+	return nil
+}
+
+// _key returns the verification key for a key id, refreshing a jwks url
+// when the key is unknown or the keys are stale.
+func (v *JWTVerifier) _key(kid string) (crypto.PublicKey, error) {
+	if v.cfg.JWKSURL != "" {
+		if err := v._refresh(kid); err != nil {
+			return nil, err
+		}
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if key, ok := v.keys[kid]; ok {
+		return key, nil
+	}
+	if kid == "" && len(v.keys) == 1 {
+		for _, key := range v.keys {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("no jwks key for kid %q", kid)
+}
+
+// _refresh fetches the jwks url if kid is unknown or the keys are stale.
+// one fetch runs at a time, without mu held; callers with a known key
+// go on with the keys they have meanwhile, others wait for it. an error
+// is returned only while there are no keys.
+func (v *JWTVerifier) _refresh(kid string) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	_, known := v.keys[kid]
+	if done := v.fetching; done != nil {
+		if known {
+			return nil
+		}
+		v.mu.Unlock()
+		<-done
+		v.mu.Lock()
+	} else {
+		stale := v.keys == nil || (v.cfg.RefreshInterval > 0 && time.Since(v.fetchedAt) > v.cfg.RefreshInterval)
+		if !stale && (known || time.Since(v.fetchedAt) <= _jwks_min_refresh) {
+			return nil
+		}
+		done = make(chan struct{})
+		v.fetching = done
+		v.fetchedAt = time.Now()
+		v.mu.Unlock()
+		keys, err := v._fetch()
+		v.mu.Lock()
+		if err == nil {
+			v.keys = keys
+		}
+		v.fetchErr = err
+		v.fetching = nil
+		close(done)
+	}
+	if v.keys == nil {
+		return v.fetchErr
+	}
+	return nil
+}
+
+// _fetch downloads and parses the jwks url.
+func (v *JWTVerifier) _fetch() (map[string]crypto.PublicKey, error) {
+	resp, err := v.client.Get(v.cfg.JWKSURL)
+	if err != nil {
+		return nil, fmt.Errorf("fetching jwks: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching jwks: status %d", resp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("reading jwks: %w", err)
+	}
+	keys, err := _parse_jwks(data)
+	if err != nil {
+		return nil, fmt.Errorf("parsing jwks from %s: %w", v.cfg.JWKSURL, err)
+	}
+	return keys, nil
+}
+
+// _parse_jwks decodes rsa, ec and ed25519 keys from a jwks document.
+// keys of other types are skipped.
+func _parse_jwks(data []byte) (map[string]crypto.PublicKey, error) {
+	var doc struct {
+		Keys []_jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range doc.Keys {
+		key, err := k._public_key()
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", k.Kid, err)
+		}
+		if key != nil {
+			keys[k.Kid] = key
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no usable keys")
+	}
+	return keys, nil
+}
+
+// _public_key converts a jwk to a public key, or nil for unsupported types.
+func (k *_jwk) _public_key() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := _decode_big(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := _decode_big(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := _decode_big(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := _decode_big(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, nil
+}
+
+// _verify_signature checks a jws signature for the supported algorithms.
+func _verify_signature(alg string, key crypto.PublicKey, signed, sig []byte) error {
+	if alg == "EdDSA" {
+		pub, ok := key.(ed25519.PublicKey)
+		if !ok || !ed25519.Verify(pub, signed, sig) {
+			return fmt.Errorf("invalid jwt signature")
+		}
+		return nil
+	}
+
+	var hash crypto.Hash
+	if len(alg) == 5 {
+		switch alg[2:] {
+		case "256":
+			hash = crypto.SHA256
+		case "384":
+			hash = crypto.SHA384
+		case "512":
+			hash = crypto.SHA512
+		}
+	}
+	if hash == 0 {
+		return fmt.Errorf("unsupported jwt algorithm %q", alg)
+	}
+
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+
+	switch alg[:2] {
+	case "RS", "PS":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("jwt algorithm %s does not match key type", alg)
+		}
+		var err error
+		if alg[:2] == "RS" {
+			err = rsa.VerifyPKCS1v15(pub, hash, digest, sig)
+		} else {
+			err = rsa.VerifyPSS(pub, hash, digest, sig, nil)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid jwt signature")
+		}
+		return nil
+	case "ES":
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("jwt algorithm %s does not match key type", alg)
+		}
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return fmt.Errorf("invalid jwt signature")
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return fmt.Errorf("invalid jwt signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported jwt algorithm %q", alg)
+}
+
+// _claim_has reports whether a claim equals want, or contains it if the
+// claim is a list.
+func _claim_has(claim any, want string) bool {
+	switch c := claim.(type) {
+	case []any:
+		for _, item := range c {
+			if _claim_string(item) == want {
+				return true
+			}
+		}
+		return false
+	case nil:
+		return false
+	}
+	return _claim_string(claim) == want
+}
+
+// _claim_string renders a claim value as a header-friendly string.
+func _claim_string(claim any) string {
+	if s, ok := claim.(string); ok {
+		return s
+	}
+	data, _ := json.Marshal(claim)
+	return string(data)
+}
+
+// _decode_segment base64url-decodes a jwt segment into v.
+func _decode_segment(seg string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// _decode_big decodes a base64url big-endian integer.
+func _decode_big(s string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(data) == 0 {
+		return nil, fmt.Errorf("invalid key parameter")
+	}
+	return new(big.Int).SetBytes(data), nil
+}
@@ -0,0 +1,108 @@
+package relay
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+)
+
+// _metric_family is one metric in the prometheus text format.
+type _metric_family struct {
+	name    string
+	kind    string
+	help    string
+	samples []_sample
+}
+
+// _sample is a labelled metric value.
+type _sample struct {
+	labels [][2]string
+	value  float64
+}
+
+// _handle_metrics serves relay metrics in the prometheus text format.
+func (s *Server) _handle_metrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, f := range append(s.handler._metrics(), s._udp_metrics()...) {
+		_write_family(w, f)
+	}
+}
+
+// _metrics collects tunnel, rate limit and group stream metrics.
+func (h *Handler) _metrics() []*_metric_family {
+	tunnels := &_metric_family{name: "relay_tunnels", kind: "gauge", help: "Connected agent tunnels."}
+	counts := make(map[string]int)
+	for _, t := range h.pool.Tunnels() {
+		counts[t.Group()]++
+	}
+	for _, group := range _sorted_keys(counts) {
+		tunnels.samples = append(tunnels.samples, _sample{[][2]string{{"group", group}}, float64(counts[group])})
+	}
+
+	limited := &_metric_family{name: "relay_rate_limited_total", kind: "counter", help: "Requests rejected by a rate limit."}
+	buckets := &_metric_family{name: "relay_rate_limit_buckets", kind: "gauge", help: "Token buckets tracked by a rate limit."}
+	exhausted := &_metric_family{name: "relay_rate_limit_exhausted_buckets", kind: "gauge", help: "Token buckets with no tokens left."}
+	limiters := append([]*RateLimiter(nil), h.limits.Load().rates...)
+	for _, route := range h.Router().Routes() {
+		limiters = append(limiters, route.RateLimits...)
+	}
+	for _, l := range limiters {
+		n, empty, hits := l.Stats()
+		labels := [][2]string{{"limit", l.Name()}}
+		limited.samples = append(limited.samples, _sample{labels, float64(hits)})
+		buckets.samples = append(buckets.samples, _sample{labels, float64(n)})
+		exhausted.samples = append(exhausted.samples, _sample{labels, float64(empty)})
+	}
+
+	active := &_metric_family{name: "relay_group_streams", kind: "gauge", help: "Requests in flight per agent group."}
+	capped := &_metric_family{name: "relay_group_stream_limited_total", kind: "counter", help: "Requests rejected by a group stream cap."}
+	maxStreams := &_metric_family{name: "relay_group_max_streams", kind: "gauge", help: "Configured stream cap per agent group, 0 for none."}
+	h.streamsMu.Lock()
+	streams := make(map[string]*_group_streams, len(h.streams))
+	for group, g := range h.streams {
+		streams[group] = g
+	}
+	h.streamsMu.Unlock()
+	for _, group := range _sorted_keys(streams) {
+		labels := [][2]string{{"group", group}}
+		active.samples = append(active.samples, _sample{labels, float64(streams[group].active.Load())})
+		capped.samples = append(capped.samples, _sample{labels, float64(streams[group].limited.Load())})
+	}
+	caps := h.limits.Load().maxStreams
+	for _, group := range _sorted_keys(caps) {
+		maxStreams.samples = append(maxStreams.samples, _sample{[][2]string{{"group", group}}, float64(caps[group])})
+	}
+
+	return []*_metric_family{tunnels, limited, buckets, exhausted, active, capped, maxStreams}
+}
+
+// _write_family writes one metric family.
+func _write_family(w io.Writer, f *_metric_family) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.kind)
+	for _, s := range f.samples {
+		fmt.Fprint(w, f.name)
+		if len(s.labels) > 0 {
+			fmt.Fprint(w, "{")
+			for i, l := range s.labels {
+				if i > 0 {
+					fmt.Fprint(w, ",")
+				}
+				fmt.Fprintf(w, "%s=%s", l[0], strconv.Quote(l[1]))
+			}
+			fmt.Fprint(w, "}")
+		}
+		fmt.Fprintf(w, " %s\n", strconv.FormatFloat(s.value, 'g', -1, 64))
+	}
+}
+
+// _sorted_keys returns a map's keys in order, for stable output.
+func _sorted_keys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
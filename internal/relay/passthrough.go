@@ -0,0 +1,139 @@
+package relay
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+)
+
+// time a client has to send its tls client hello.
+const _client_hello_timeout = 10 * time.Second
+
+// errors from peeking at a client hello.
+var (
+	_err_hello_peeked   = errors.New("client hello peeked")
+	_err_no_server_name = errors.New("client hello has no server name")
+)
+
+// _passthrough_server accepts tls connections and, by the server name in
+// the client hello, hands the still encrypted bytes to an agent.
+type _passthrough_server struct {
+	cfg     TLSPassthroughConfig
+	handler *Handler
+	ln      net.Listener
+}
+
+// _start_passthrough binds the tls passthrough listener, if configured,
+// and serves it.
+func (s *Server) _start_passthrough() error {
+	if s.passthrough == nil {
+		return nil
+	}
+	ln, err := net.Listen("tcp", s.passthrough.cfg.Listen)
+	if err != nil {
+		return err
+	}
+	s.tcpMu.Lock()
+	s.passthrough.ln = ln
+	s.tcpMu.Unlock()
+	go s.passthrough._serve(ln)
+	return nil
+}
+
+// _stop_passthrough stops accepting tls connections. open ones are left
+// to finish.
+func (s *Server) _stop_passthrough() {
+	s.tcpMu.Lock()
+	defer s.tcpMu.Unlock()
+	if s.passthrough != nil && s.passthrough.ln != nil {
+		s.passthrough.ln.Close()
+	}
+}
+
+// _serve accepts tls connections until the listener closes.
+func (ps *_passthrough_server) _serve(ln net.Listener) {
+	slog.Info("tls passthrough listening", "addr", ln.Addr())
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				slog.Error("tls passthrough listener stopped", "addr", ln.Addr(), "err", err)
+			}
+			return
+		}
+		go ps._handle(conn)
+	}
+}
+
+// _handle reads the client hello and forwards the connection, hello
+// included, to an agent of the group routed for its server name.
+func (ps *_passthrough_server) _handle(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(_client_hello_timeout))
+	name, hello, err := _peek_server_name(conn)
+	if err != nil {
+		slog.Debug("tls passthrough hello rejected", "remote", conn.RemoteAddr(), "err", err)
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	group, ok := ps._route(name)
+	if !ok {
+		slog.Debug("no tls passthrough route", "remote", conn.RemoteAddr(), "server_name", name)
+		conn.Close()
+		return
+	}
+	slog.Debug("tls passthrough", "server_name", name, "group", _group_name(group))
+	client := &_client_conn{Conn: conn, r: io.MultiReader(bytes.NewReader(hello), conn)}
+	open := &StreamOpen{Kind: StreamKindTLS, Target: name}
+	pick := func() (*Tunnel, error) { return ps.handler.pool.Get(group) }
+	ps.handler._forward_tcp(client, group, open, pick, nil)
+}
+
+// _route returns the group of the first route matching name.
+func (ps *_passthrough_server) _route(name string) (string, bool) {
+	for _, r := range ps.cfg.Routes {
+		if MatchHost(r.Host, name) {
+			return r.Group, true
+		}
+	}
+	return "", false
+}
+
+// _peek_server_name reads a tls client hello from conn and returns its
+// server name along with every byte read, to be replayed to the agent.
+// nothing is written to conn.
+func _peek_server_name(conn net.Conn) (string, []byte, error) {
+	var read bytes.Buffer
+	var name string
+	peek := &_peek_conn{Conn: conn, r: io.TeeReader(conn, &read)}
+	err := tls.Server(peek, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			name = hello.ServerName
+			return nil, _err_hello_peeked
+		},
+	}).Handshake()
+	if !errors.Is(err, _err_hello_peeked) {
+		return "", nil, err
+	}
+	if name == "" {
+		return "", nil, _err_no_server_name
+	}
+	return strings.ToLower(name), read.Bytes(), nil
+}
+
+// _peek_conn records what is read from a connection and drops what is
+// written, so a handshake can be started without answering the client.
+type _peek_conn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *_peek_conn) Read(p []byte) (int, error) { return c.r.Read(p) }
+
+func (c *_peek_conn) Write(p []byte) (int, error) { return 0, io.ErrClosedPipe }
@@ -0,0 +1,71 @@
+package relay
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+func Test_peek_server_name_replays_hello(t *testing.T) {
+	pair := _write_test_cert(t, t.TempDir(), "db", "db.example.test")
+	cert, err := tls.LoadX509KeyPair(pair.CertFile, pair.KeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientSide, serverSide := net.Pipe()
+	defer clientSide.Close()
+	defer serverSide.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		client := tls.Client(clientSide, &tls.Config{ServerName: "DB.example.test", InsecureSkipVerify: true})
+		done <- client.Handshake()
+	}()
+
+	name, hello, err := _peek_server_name(serverSide)
+	if err != nil {
+		t.Fatalf("peeking server name: %v", err)
+	}
+	if name != "db.example.test" {
+		t.Errorf("expected lowercased server name, got %q", name)
+	}
+	// the handshake must complete as if nothing had been read
+	replay := &_client_conn{Conn: serverSide, r: io.MultiReader(bytes.NewReader(hello), serverSide)}
+	server := tls.Server(replay, &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err := server.Handshake(); err != nil {
+		t.Fatalf("handshake after replay: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("client handshake: %v", err)
+	}
+}
+
+func Test_peek_server_name_requires_sni(t *testing.T) {
+	clientSide, serverSide := net.Pipe()
+	defer serverSide.Close()
+	go func() {
+		tls.Client(clientSide, &tls.Config{InsecureSkipVerify: true}).Handshake()
+		clientSide.Close()
+	}()
+	if _, _, err := _peek_server_name(serverSide); !errors.Is(err, _err_no_server_name) {
+		t.Errorf("expected hello without server name to be rejected, got %v", err)
+	}
+}
+
+func Test_passthrough_routes_by_server_name(t *testing.T) {
+	ps := &_passthrough_server{cfg: TLSPassthroughConfig{Routes: []PassthroughRouteConfig{
+		{Host: "db.example.test", Group: "vault"},
+		{Host: "*.example.test", Group: "web"},
+	}}}
+	for name, want := range map[string]string{"db.example.test": "vault", "app.example.test": "web"} {
+		if group, ok := ps._route(name); !ok || group != want {
+			t.Errorf("%s: expected group %q, got %q, %v", name, want, group, ok)
+		}
+	}
+	if _, ok := ps._route("a.b.example.test"); ok {
+		t.Error("expected wildcard to match one label only")
+	}
+}
@@ -1,12 +1,17 @@
 package relay
 
 import (
+	"errors"
 	"fmt"
 	"log/slog"
 	"sync"
 	"sync/atomic"
 )
 
+// ErrNoHealthyBackend is returned by GetBackend when every agent that could
+// take the request reports no healthy backend.
+var ErrNoHealthyBackend = errors.New("no agent has a healthy backend")
+
 // Pool manages a set of agent tunnels with round-robin selection.
 type Pool struct {
 	mu      sync.RWMutex
@@ -24,7 +29,7 @@ func (p *Pool) Add(t *Tunnel) {
 	p.mu.Lock()
 	p.tunnels = append(p.tunnels, t)
 	p.mu.Unlock()
-	slog.Info("agent added to pool", "id", t.ID(), "pool_size", p.Size())
+	slog.Info("agent added to pool", "id", t.ID(), "group", t.Group(), "pool_size", p.Size())
 
 	// remove the tunnel when it closes
 	go func() {
@@ -46,15 +51,64 @@ func (p *Pool) Remove(t *Tunnel) {
 	}
 }
 
-// Get returns the next tunnel using round-robin selection.
-func (p *Pool) Get() (*Tunnel, error) {
+// Get returns the next tunnel in the group using round-robin selection,
+// skipping tunnels whose agents are draining or at capacity. an empty group
+// matches any tunnel. when every member is full the error wraps ErrTunnelFull.
+func (p *Pool) Get(group string) (*Tunnel, error) {
+	return p._get(group, false)
+}
+
+// GetBackend is Get for requests served by an agent's backend: it also
+// skips tunnels whose agents report no healthy backend.
+func (p *Pool) GetBackend(group string) (*Tunnel, error) {
+	return p._get(group, true)
+}
+
+func (p *Pool) _get(group string, backend bool) (*Tunnel, error) {
 	p.mu.RLock()
 	defer p.mu.RUnlock()
 	if len(p.tunnels) == 0 {
 		return nil, fmt.Errorf("no agents connected")
 	}
-	idx := p.counter.Add(1) % uint64(len(p.tunnels))
-	return p.tunnels[idx], nil
+	n := uint64(len(p.tunnels))
+	start := p.counter.Add(1)
+	members, full, unhealthy := 0, 0, 0
+	for i := uint64(0); i < n; i++ {
+		t := p.tunnels[(start+i)%n]
+		if group != "" && t.Group() != group {
+			continue
+		}
+		members++
+		if t.Draining() {
+			continue
+		}
+		if backend && !t.Healthy() {
+			unhealthy++
+			continue
+		}
+		if t.Full() {
+			full++
+			continue
+		}
+		return t, nil
+	}
+	if members == 0 {
+		return nil, fmt.Errorf("no agents connected in group %q", group)
+	}
+	if full > 0 {
+		return nil, fmt.Errorf("all agents in group %q are busy: %w", group, ErrTunnelFull)
+	}
+	if unhealthy > 0 {
+		return nil, fmt.Errorf("group %q: %w", group, ErrNoHealthyBackend)
+	}
+	return nil, fmt.Errorf("all %d agents in group %q are draining", members, group)
+}
+
+// Tunnels returns a snapshot of the connected tunnels.
+func (p *Pool) Tunnels() []*Tunnel {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return append([]*Tunnel(nil), p.tunnels...)
 }
 
 // Size returns the number of connected tunnels.
@@ -0,0 +1,209 @@
+package relay
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// how long a trusted peer has to send its proxy protocol header.
+const _proxy_header_timeout = 5 * time.Second
+
+// signature opening a proxy protocol v2 header.
+var _proxy_v2_signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// _proxy_listener reads proxy protocol headers from trusted peers so the
+// original client address is reported as the connection's remote address.
+type _proxy_listener struct {
+	net.Listener
+	trusted func(netip.Addr) bool
+}
+
+// Accept wraps connections from trusted peers. the header is read lazily
+// so a slow peer does not hold up the accept loop.
+func (l *_proxy_listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	peer, ok := _remote_addr(conn.RemoteAddr().String())
+	if !ok || !l.trusted(peer) {
+		return conn, nil
+	}
+	return &_proxy_conn{Conn: conn}, nil
+}
+
+// _proxy_conn is a connection whose first bytes are a proxy protocol header.
+type _proxy_conn struct {
+	net.Conn
+
+	once   sync.Once
+	reader *bufio.Reader
+	remote net.Addr
+	err    error
+
+	// the read deadline set by the connection's user, and the one bounding
+	// the header while it is read
+	deadlineMu     sync.Mutex
+	readDeadline   time.Time
+	headerDeadline time.Time
+}
+
+// _read_header consumes the header once, within _proxy_header_timeout or
+// the caller's read deadline if sooner, and then puts the caller's
+// deadline back. a malformed header fails every read.
+func (c *_proxy_conn) _read_header() {
+	c.once.Do(func() {
+		c.deadlineMu.Lock()
+		c.headerDeadline = time.Now().Add(_proxy_header_timeout)
+		c.Conn.SetReadDeadline(_earliest(c.readDeadline, c.headerDeadline))
+		c.deadlineMu.Unlock()
+
+		c.reader = bufio.NewReader(c.Conn)
+		c.remote, c.err = _parse_proxy_header(c.reader)
+
+		c.deadlineMu.Lock()
+		c.headerDeadline = time.Time{}
+		c.Conn.SetReadDeadline(c.readDeadline)
+		c.deadlineMu.Unlock()
+	})
+}
+
+// SetReadDeadline remembers the deadline so reading the header keeps it.
+func (c *_proxy_conn) SetReadDeadline(t time.Time) error {
+	c.deadlineMu.Lock()
+	defer c.deadlineMu.Unlock()
+	c.readDeadline = t
+	return c.Conn.SetReadDeadline(_earliest(t, c.headerDeadline))
+}
+
+func (c *_proxy_conn) SetDeadline(t time.Time) error {
+	if err := c.Conn.SetWriteDeadline(t); err != nil {
+		return err
+	}
+	return c.SetReadDeadline(t)
+}
+
+// _earliest returns the sooner of two deadlines, where zero is none.
+func _earliest(a, b time.Time) time.Time {
+	if a.IsZero() || (!b.IsZero() && b.Before(a)) {
+		return b
+	}
+	return a
+}
+
+func (c *_proxy_conn) Read(b []byte) (int, error) {
+	c._read_header()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+// RemoteAddr returns the client address from the header, or the peer
+// address for local or unknown connections.
+func (c *_proxy_conn) RemoteAddr() net.Addr {
+	c._read_header()
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// _parse_proxy_header reads a v1 or v2 header. a nil address means the
+// header carried no client address.
+func _parse_proxy_header(r *bufio.Reader) (net.Addr, error) {
+	sig, err := r.Peek(len(_proxy_v2_signature))
+	if err != nil {
+		return nil, fmt.Errorf("reading proxy protocol header: %w", err)
+	}
+	if bytes.Equal(sig, _proxy_v2_signature) {
+		return _parse_proxy_v2(r)
+	}
+	if bytes.HasPrefix(sig, []byte("PROXY ")) {
+		return _parse_proxy_v1(r)
+	}
+	return nil, fmt.Errorf("missing proxy protocol header")
+}
+
+// _parse_proxy_v1 reads a text header such as
+// "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n".
+func _parse_proxy_v1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("reading proxy protocol header: %w", err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	text, ok := strings.CutSuffix(string(line), "\r\n")
+	if !ok {
+		return nil, fmt.Errorf("proxy protocol v1 header too long")
+	}
+	fields := strings.Fields(text)
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed proxy protocol v1 header")
+	}
+	addr, err := netip.ParseAddr(fields[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed proxy protocol source address: %w", err)
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("malformed proxy protocol source port: %w", err)
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, uint16(port))), nil
+}
+
+// _parse_proxy_v2 reads a binary header. only tcp over ipv4 and ipv6
+// carries an address; other families are accepted without one.
+func _parse_proxy_v2(r *bufio.Reader) (net.Addr, error) {
+	var hdr [16]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, fmt.Errorf("reading proxy protocol header: %w", err)
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported proxy protocol version %d", hdr[12]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, fmt.Errorf("reading proxy protocol addresses: %w", err)
+	}
+	// LOCAL command: health checks from the proxy itself
+	if hdr[12]&0x0f == 0 {
+		return nil, nil
+	}
+
+	switch hdr[13] {
+	case 0x11: // tcp over ipv4
+		if len(body) < 12 {
+			return nil, fmt.Errorf("short proxy protocol ipv4 addresses")
+		}
+		addr := netip.AddrFrom4([4]byte(body[0:4]))
+		port := binary.BigEndian.Uint16(body[8:10])
+		return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, port)), nil
+	case 0x21: // tcp over ipv6
+		if len(body) < 36 {
+			return nil, fmt.Errorf("short proxy protocol ipv6 addresses")
+		}
+		addr := netip.AddrFrom16([16]byte(body[0:16])).Unmap()
+		port := binary.BigEndian.Uint16(body[32:34])
+		return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, port)), nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,133 @@
+package relay
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_parse_proxy_v1_header(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\nGET / HTTP/1.1\r\n"))
+	addr, err := _parse_proxy_header(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr.String() != "192.0.2.1:56324" {
+		t.Errorf("address %v, want 192.0.2.1:56324", addr)
+	}
+	rest, _ := io.ReadAll(r)
+	if string(rest) != "GET / HTTP/1.1\r\n" {
+		t.Errorf("header not fully consumed, remaining %q", rest)
+	}
+
+	r = bufio.NewReader(strings.NewReader("PROXY UNKNOWN\r\nGET / HTTP/1.1\r\n"))
+	if addr, err := _parse_proxy_header(r); err != nil || addr != nil {
+		t.Errorf("unknown: addr %v err %v", addr, err)
+	}
+}
+
+func Test_parse_proxy_v2_header(t *testing.T) {
+	var buf bytes.Buffer
+	buf.Write(_proxy_v2_signature)
+	buf.Write([]byte{0x21, 0x21})
+	binary.Write(&buf, binary.BigEndian, uint16(36))
+	src := netip.MustParseAddr("2001:db8::7").As16()
+	dst := netip.MustParseAddr("2001:db8::1").As16()
+	buf.Write(src[:])
+	buf.Write(dst[:])
+	binary.Write(&buf, binary.BigEndian, uint16(40000))
+	binary.Write(&buf, binary.BigEndian, uint16(443))
+	buf.WriteString("hello")
+
+	r := bufio.NewReader(&buf)
+	addr, err := _parse_proxy_header(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr.String() != "[2001:db8::7]:40000" {
+		t.Errorf("address %v", addr)
+	}
+	rest, _ := io.ReadAll(r)
+	if string(rest) != "hello" {
+		t.Errorf("remaining %q, want hello", rest)
+	}
+}
+
+func Test_parse_proxy_header_rejects_missing_header(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("GET / HTTP/1.1\r\nHost: x\r\n\r\n"))
+	if _, err := _parse_proxy_header(r); err == nil {
+		t.Fatal("expected missing header to be rejected")
+	}
+}
+
+func Test_proxy_listener_only_trusts_configured_peers(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inner.Close()
+
+	for _, trusted := range []bool{true, false} {
+		ln := &_proxy_listener{Listener: inner, trusted: func(netip.Addr) bool { return trusted }}
+		go func() {
+			c, err := net.Dial("tcp", inner.Addr().String())
+			if err != nil {
+				return
+			}
+			defer c.Close()
+			c.Write([]byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\nping"))
+			io.Copy(io.Discard, c)
+		}()
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		remote := conn.RemoteAddr().String()
+		data := make([]byte, 4)
+		io.ReadFull(conn, data)
+		conn.Close()
+
+		if trusted && (remote != "192.0.2.1:56324" || string(data) != "ping") {
+			t.Errorf("trusted peer: remote %s data %q", remote, data)
+		}
+		if !trusted && strings.HasPrefix(remote, "192.0.2.1") {
+			t.Error("untrusted peer must not set its address")
+		}
+	}
+}
+
+func Test_proxy_header_keeps_the_read_deadline(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	conn := &_proxy_conn{Conn: server}
+	defer conn.Close()
+
+	// as the http server does before reading a request
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	go client.Write([]byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"))
+	if remote := conn.RemoteAddr().String(); remote != "192.0.2.1:56324" {
+		t.Fatalf("unexpected remote address %s", remote)
+	}
+
+	read := make(chan error, 1)
+	go func() {
+		_, err := conn.Read(make([]byte, 1))
+		read <- err
+	}()
+	select {
+	case err := <-read:
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Errorf("expected the read deadline to expire, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("reading the header cleared the read deadline")
+	}
+}
@@ -0,0 +1,204 @@
+package relay
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// how often idle buckets are swept from a limiter.
+const _bucket_sweep_interval = time.Minute
+
+// RateLimiter is a set of token buckets, one per key.
+type RateLimiter struct {
+	name   string
+	key    string
+	header string
+	rate   float64
+	burst  float64
+
+	mu        sync.Mutex
+	buckets   map[string]*_bucket
+	lastSweep time.Time
+
+	limited atomic.Uint64
+}
+
+// _bucket holds the tokens for one key as of last.
+type _bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter creates a limiter. name identifies it in metrics and
+// defaults to fallback.
+func NewRateLimiter(cfg *RateLimitConfig, fallback string) (*RateLimiter, error) {
+	l := &RateLimiter{
+		name:      cfg.Name,
+		key:       cfg.Key,
+		rate:      cfg.Rate,
+		burst:     float64(cfg.Burst),
+		buckets:   make(map[string]*_bucket),
+		lastSweep: time.Now(),
+	}
+	if l.name == "" {
+		l.name = fallback
+	}
+	if l.key == "" {
+		l.key = "client_ip"
+	}
+	if header, ok := strings.CutPrefix(l.key, "header:"); ok && header != "" {
+		l.header = header
+	} else if l.key != "client_ip" && l.key != "route" {
+		return nil, fmt.Errorf("unknown rate limit key %q", l.key)
+	}
+	if l.rate <= 0 {
+		return nil, fmt.Errorf("rate must be positive")
+	}
+	if l.burst < 1 {
+		l.burst = math.Max(1, math.Ceil(l.rate))
+	}
+	return l, nil
+}
+
+// _new_rate_limiters builds limiters, naming unnamed ones after scope.
+func _new_rate_limiters(cfgs []RateLimitConfig, scope string) ([]*RateLimiter, error) {
+	var limiters []*RateLimiter
+	for i := range cfgs {
+		name := fmt.Sprintf("%s[%d]", scope, i)
+		l, err := NewRateLimiter(&cfgs[i], name)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		limiters = append(limiters, l)
+	}
+	return limiters, nil
+}
+
+// Name returns the limiter's metrics name.
+func (l *RateLimiter) Name() string {
+	return l.name
+}
+
+// Allow takes a token from the request's bucket. when none is left it
+// returns false and how long until one is.
+func (l *RateLimiter) Allow(r *http.Request, client netip.Addr, route *Route) (bool, time.Duration) {
+	var key string
+	switch {
+	case l.header != "":
+		key = r.Header.Get(l.header)
+		if key == "" {
+			return true, 0
+		}
+	case l.key == "route":
+		if route != nil {
+			key = route.Host + route.PathPrefix
+		}
+	default:
+		key = client.String()
+	}
+	return l._take(key, time.Now())
+}
+
+// _take refills and takes a token from the bucket for key.
+func (l *RateLimiter) _take(key string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastSweep) > _bucket_sweep_interval {
+		l._sweep(now)
+	}
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &_bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	l.limited.Add(1)
+	wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	return false, wait
+}
+
+// _sweep drops buckets that have refilled, which behave like new ones.
+// called with mu held.
+func (l *RateLimiter) _sweep(now time.Time) {
+	l.lastSweep = now
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// Stats returns the number of tracked buckets, how many are empty, and the
+// number of requests rejected so far.
+func (l *RateLimiter) Stats() (buckets, exhausted int, limited uint64) {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate < 1 {
+			exhausted++
+		}
+	}
+	return len(l.buckets), exhausted, l.limited.Load()
+}
+
+// Limits holds the relay-wide rate limits and group stream caps.
+type Limits struct {
+	rates      []*RateLimiter
+	maxStreams map[string]int
+}
+
+// NewLimits builds limits from configuration.
+func NewLimits(cfg *Config) (*Limits, error) {
+	rates, err := _new_rate_limiters(cfg.RateLimits, "rate_limits")
+	if err != nil {
+		return nil, err
+	}
+	l := &Limits{rates: rates, maxStreams: make(map[string]int)}
+	for group, gc := range cfg.Groups {
+		if gc.MaxStreams < 0 {
+			return nil, fmt.Errorf("groups.%s.max_streams must not be negative", group)
+		}
+		l.maxStreams[group] = gc.MaxStreams
+	}
+	return l, nil
+}
+
+// _group_streams counts concurrent streams for one agent group. counters
+// live on the handler so they survive reloads.
+type _group_streams struct {
+	active  atomic.Int64
+	limited atomic.Uint64
+}
+
+// _acquire takes a stream slot unless limit (when positive) is reached.
+func (g *_group_streams) _acquire(limit int) bool {
+	if g.active.Add(1) > int64(limit) && limit > 0 {
+		g.active.Add(-1)
+		g.limited.Add(1)
+		return false
+	}
+	return true
+}
+
+// _release returns a stream slot.
+func (g *_group_streams) _release() {
+	g.active.Add(-1)
+}
+
+// _retry_after formats a wait as whole seconds, at least one.
+func _retry_after(wait time.Duration) string {
+	return fmt.Sprint(max(1, int(math.Ceil(wait.Seconds()))))
+}
@@ -0,0 +1,125 @@
+package relay
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_rate_limiter_token_bucket(t *testing.T) {
+	l, err := NewRateLimiter(&RateLimitConfig{Rate: 2, Burst: 3}, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		if ok, _ := l._take("a", now); !ok {
+			t.Fatalf("request %d within burst was limited", i)
+		}
+	}
+	ok, wait := l._take("a", now)
+	if ok || wait != 500*time.Millisecond {
+		t.Fatalf("expected limit with 500ms wait, got ok=%v wait=%v", ok, wait)
+	}
+	if ok, _ := l._take("b", now); !ok {
+		t.Error("keys must have separate buckets")
+	}
+	if ok, _ := l._take("a", now.Add(500*time.Millisecond)); !ok {
+		t.Error("bucket should refill at the configured rate")
+	}
+
+	buckets, exhausted, limited := l.Stats()
+	if buckets != 2 || limited != 1 || exhausted > 1 {
+		t.Errorf("stats buckets=%d exhausted=%d limited=%d", buckets, exhausted, limited)
+	}
+
+	l._sweep(now.Add(time.Hour))
+	if buckets, _, _ := l.Stats(); buckets != 0 {
+		t.Errorf("refilled buckets should be swept, %d left", buckets)
+	}
+}
+
+func Test_rate_limiter_rejects_bad_config(t *testing.T) {
+	for _, cfg := range []RateLimitConfig{
+		{Rate: 0},
+		{Rate: 1, Key: "cookie"},
+		{Rate: 1, Key: "header:"},
+	} {
+		if _, err := NewRateLimiter(&cfg, "test"); err == nil {
+			t.Errorf("expected %+v to be rejected", cfg)
+		}
+	}
+}
+
+func Test_handler_rate_limits_by_header(t *testing.T) {
+	router, err := NewRouter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	access, err := NewAccessPolicy(&AccessConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	limits, err := NewLimits(&Config{RateLimits: []RateLimitConfig{
+		{Name: "api-key", Key: "header:X-API-Key", Rate: 0.5, Burst: 1},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewHandler(NewPool(), router, access, limits, time.Second, 0)
+
+	send := func(key string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "http://app.example.com/", nil)
+		if key != "" {
+			r.Header.Set("X-API-Key", key)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	// no agents connected, so an allowed request ends in 502
+	if w := send("k1"); w.Code != http.StatusBadGateway {
+		t.Fatalf("first request: status %d", w.Code)
+	}
+	w := send("k1")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "2" {
+		t.Fatalf("second request: status %d retry-after %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	if w := send("k2"); w.Code != http.StatusBadGateway {
+		t.Errorf("other key: status %d", w.Code)
+	}
+	if w := send(""); w.Code != http.StatusBadGateway {
+		t.Errorf("request without key should not be limited: status %d", w.Code)
+	}
+
+	var out strings.Builder
+	for _, f := range h._metrics() {
+		_write_family(&out, f)
+	}
+	if !strings.Contains(out.String(), `relay_rate_limited_total{limit="api-key"} 1`) {
+		t.Errorf("limit hit missing from metrics:\n%s", out.String())
+	}
+}
+
+func Test_group_streams_cap(t *testing.T) {
+	var g _group_streams
+	if !g._acquire(2) || !g._acquire(2) {
+		t.Fatal("expected two slots")
+	}
+	if g._acquire(2) {
+		t.Fatal("expected third stream to be capped")
+	}
+	g._release()
+	if !g._acquire(2) {
+		t.Fatal("released slot should be reusable")
+	}
+	if !g._acquire(0) {
+		t.Error("zero means no cap")
+	}
+	if g.limited.Load() != 1 {
+		t.Errorf("limited count %d, want 1", g.limited.Load())
+	}
+}
@@ -0,0 +1,247 @@
+package relay
+
+import (
+	"fmt"
+	"log/slog"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// settings that only take effect on restart. changes to them are reported
+// but the running values are kept.
+var _restart_only = []string{
+	"listen",
+	"tls.enabled",
+	"tls.watch_interval",
+	"tls.acme.enabled",
+	"tls.acme.directory_url",
+	"tls.acme.email",
+	"tls.acme.cache_dir",
+	"tls.acme.renew_before",
+	"tls.acme.http_addr",
+	"tls.acme.ca_file",
+	"tunnel.path",
+	"admin",
+	"access.proxy_protocol",
+	"tcp",
+	"udp",
+	"socks",
+	"http_proxy",
+	"remote",
+	"tls_passthrough",
+}
+
+// shown in place of secret values in reload results and logs.
+const _redacted = "<redacted>"
+
+// ReloadResult lists the settings a configuration reload changed, and
+// how.
+type ReloadResult struct {
+	Applied         []string       `json:"applied"`
+	RestartRequired []string       `json:"restart_required"`
+	Changes         []ConfigChange `json:"changes"`
+}
+
+// ConfigChange is a setting's value before and after a reload. fields
+// tagged secret are redacted.
+type ConfigChange struct {
+	Path string `json:"path"`
+	Old  any    `json:"old"`
+	New  any    `json:"new"`
+}
+
+// Reload re-reads the configuration file and applies every change that
+// does not need a restart. existing tunnels stay up. if the new file fails
+// validation nothing is applied.
+func (s *Server) Reload() (*ReloadResult, error) {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	current := s._config()
+	if current.path == "" {
+		return nil, fmt.Errorf("configuration was not loaded from a file")
+	}
+	next, err := LoadConfig(current.path)
+	if err != nil {
+		return nil, fmt.Errorf("reload refused: %w", err)
+	}
+	return s._apply_config(current, next)
+}
+
+// _apply_config swaps in next, keeping the running values of restart-only
+// settings. everything that can fail is prepared before anything is swapped.
+func (s *Server) _apply_config(current, next *Config) (*ReloadResult, error) {
+	result := &ReloadResult{Changes: _config_diff(current, next)}
+	for _, change := range result.Changes {
+		path := change.Path
+		if _is_restart_only(path) || (s.certs == nil && _is_cert_setting(path)) {
+			result.RestartRequired = append(result.RestartRequired, path)
+		} else {
+			result.Applied = append(result.Applied, path)
+		}
+	}
+	_keep_restart_settings(current, next)
+
+	router, err := NewRouter(next.Routes)
+	if err != nil {
+		return nil, fmt.Errorf("reload refused: %w", err)
+	}
+	access, err := NewAccessPolicy(&next.Access)
+	if err != nil {
+		return nil, fmt.Errorf("reload refused: %w", err)
+	}
+	limits, err := NewLimits(next)
+	if err != nil {
+		return nil, fmt.Errorf("reload refused: %w", err)
+	}
+	if s.certs != nil {
+		// also picks up rotated files when the pairs themselves are unchanged
+		if err := s.certs.SetPairs(next.TLS.CertPairs()); err != nil {
+			return nil, fmt.Errorf("reload refused: %w", err)
+		}
+	}
+
+	s.cfg.Store(next)
+	s.handler.Update(router, access, limits, next.Tunnel.RequestTimeout, next.Tunnel.StreamIdleTimeout)
+
+	slog.Info("relay configuration reloaded", "applied", result.Applied, "changes", result.Changes)
+	if len(result.RestartRequired) > 0 {
+		slog.Warn("some configuration changes need a restart to take effect", "settings", result.RestartRequired)
+	}
+	return result, nil
+}
+
+// _keep_restart_settings copies restart-only settings from the running
+// configuration into the next one.
+func _keep_restart_settings(current, next *Config) {
+	next.Listen = current.Listen
+	next.TLS.Enabled = current.TLS.Enabled
+	next.TLS.WatchInterval = current.TLS.WatchInterval
+	hosts := next.TLS.ACME.Hosts
+	next.TLS.ACME = current.TLS.ACME
+	next.TLS.ACME.Hosts = hosts
+	next.Tunnel.Path = current.Tunnel.Path
+	next.Admin = current.Admin
+	next.Access.ProxyProtocol = current.Access.ProxyProtocol
+	next.TCP = current.TCP
+	next.UDP = current.UDP
+	next.SOCKS = current.SOCKS
+	next.HTTPProxy = current.HTTPProxy
+	next.Remote = current.Remote
+	next.TLSPassthrough = current.TLSPassthrough
+}
+
+// _is_restart_only reports whether a setting path needs a restart.
+func _is_restart_only(path string) bool {
+	for _, prefix := range _restart_only {
+		if path == prefix || strings.HasPrefix(path, prefix+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// _is_cert_setting reports whether a setting path names static certificates.
+func _is_cert_setting(path string) bool {
+	return path == "tls.cert_file" || path == "tls.key_file" || path == "tls.certificates"
+}
+
+// _config_diff returns the settings that differ between two
+// configurations. lists are compared as a whole.
+func _config_diff(a, b *Config) []ConfigChange {
+	var changed []ConfigChange
+	_diff_value("", reflect.ValueOf(a).Elem(), reflect.ValueOf(b).Elem(), false, &changed)
+	return changed
+}
+
+// _diff_value walks struct fields by yaml tag, recording differing leaves.
+func _diff_value(path string, a, b reflect.Value, secret bool, changed *[]ConfigChange) {
+	if a.Kind() != reflect.Struct {
+		if !reflect.DeepEqual(a.Interface(), b.Interface()) {
+			*changed = append(*changed, ConfigChange{
+				Path: path,
+				Old:  _display_value(a, secret),
+				New:  _display_value(b, secret),
+			})
+		}
+		return
+	}
+	for i := 0; i < a.NumField(); i++ {
+		field := a.Type().Field(i)
+		name, opts, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+		if opts == "inline" {
+			_diff_value(path, a.Field(i), b.Field(i), secret, changed)
+			continue
+		}
+		if name == "" || name == "-" {
+			continue
+		}
+		if path != "" {
+			name = path + "." + name
+		}
+		_diff_value(name, a.Field(i), b.Field(i), field.Tag.Get("secret") == "true", changed)
+	}
+}
+
+// _display_value renders a setting for a reload diff, keyed by yaml tag,
+// with secret values redacted. map keys are kept so it is clear which
+// entry changed.
+func _display_value(v reflect.Value, secret bool) any {
+	if v.Type() == reflect.TypeOf(time.Duration(0)) {
+		return time.Duration(v.Int()).String()
+	}
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return _display_value(v.Elem(), secret)
+	case reflect.Struct:
+		out := map[string]any{}
+		_display_fields(v, out)
+		return out
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			return nil
+		}
+		out := make([]any, v.Len())
+		for i := range out {
+			out[i] = _display_value(v.Index(i), secret)
+		}
+		return out
+	case reflect.Map:
+		if v.IsNil() {
+			return nil
+		}
+		out := make(map[string]any, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			out[fmt.Sprint(iter.Key().Interface())] = _display_value(iter.Value(), secret)
+		}
+		return out
+	}
+	if secret {
+		if v.IsZero() {
+			return v.Interface()
+		}
+		return _redacted
+	}
+	return v.Interface()
+}
+
+// _display_fields adds a struct's fields to out by yaml tag.
+func _display_fields(v reflect.Value, out map[string]any) {
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		name, opts, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+		if opts == "inline" {
+			_display_fields(v.Field(i), out)
+			continue
+		}
+		if name == "" || name == "-" {
+			continue
+		}
+		out[name] = _display_value(v.Field(i), field.Tag.Get("secret") == "true")
+	}
+}
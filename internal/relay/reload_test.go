@@ -0,0 +1,184 @@
+package relay
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+const _reload_base_config = `
+listen:
+  addr: "127.0.0.1:0"
+auth:
+  shared_secret: "first"
+tunnel:
+  request_timeout: 10s
+routes:
+  - host: "a.example.com"
+`
+
+func _write_config(t *testing.T, path, data string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_reload_applies_live_settings(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "relay.yaml")
+	_write_config(t, path, _reload_base_config)
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("loading config: %v", err)
+	}
+	s, err := NewServer(cfg)
+	if err != nil {
+		t.Fatalf("creating server: %v", err)
+	}
+
+	_write_config(t, path, `
+listen:
+  addr: "127.0.0.1:1"
+auth:
+  shared_secret: "second"
+tunnel:
+  request_timeout: 20s
+routes:
+  - host: "b.example.com"
+`)
+	result, err := s.Reload()
+	if err != nil {
+		t.Fatalf("reload failed: %v", err)
+	}
+
+	for _, want := range []string{"auth.shared_secret", "tunnel.request_timeout", "routes"} {
+		if !slices.Contains(result.Applied, want) {
+			t.Errorf("expected %q to be applied, got %v", want, result.Applied)
+		}
+	}
+	if !slices.Equal(result.RestartRequired, []string{"listen.addr"}) {
+		t.Errorf("expected listen.addr to need a restart, got %v", result.RestartRequired)
+	}
+
+	live := s._config()
+	if live.Auth.SharedSecret != "second" {
+		t.Errorf("shared secret not applied: %q", live.Auth.SharedSecret)
+	}
+	if live.Listen.Addr != "127.0.0.1:0" {
+		t.Errorf("listen address should keep running value, got %q", live.Listen.Addr)
+	}
+	if time.Duration(s.handler.timeout.Load()) != 20*time.Second {
+		t.Errorf("request timeout not applied to handler")
+	}
+	if !s.handler.Router().HasHost("b.example.com") || s.handler.Router().HasHost("a.example.com") {
+		t.Errorf("routes not swapped")
+	}
+}
+
+func Test_reload_refuses_invalid_config(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "relay.yaml")
+	_write_config(t, path, _reload_base_config)
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("loading config: %v", err)
+	}
+	s, err := NewServer(cfg)
+	if err != nil {
+		t.Fatalf("creating server: %v", err)
+	}
+
+	// missing shared secret fails validation
+	_write_config(t, path, `
+tunnel:
+  request_timeout: 20s
+`)
+	if _, err := s.Reload(); err == nil {
+		t.Fatal("expected invalid config to be refused")
+	}
+	if s._config() != cfg {
+		t.Error("configuration changed despite refused reload")
+	}
+	if time.Duration(s.handler.timeout.Load()) != 10*time.Second {
+		t.Error("handler changed despite refused reload")
+	}
+}
+
+func Test_reload_reports_changes_with_secrets_redacted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "relay.yaml")
+	_write_config(t, path, _reload_base_config)
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("loading config: %v", err)
+	}
+	s, err := NewServer(cfg)
+	if err != nil {
+		t.Fatalf("creating server: %v", err)
+	}
+
+	_write_config(t, path, `
+listen:
+  addr: "127.0.0.1:0"
+auth:
+  shared_secret: "second"
+tunnel:
+  request_timeout: 20s
+routes:
+  - host: "a.example.com"
+    auth:
+      bearer_tokens:
+        - user: "ci"
+          token: "hunter2"
+`)
+	result, err := s.Reload()
+	if err != nil {
+		t.Fatalf("reload failed: %v", err)
+	}
+	changes := map[string]ConfigChange{}
+	for _, c := range result.Changes {
+		changes[c.Path] = c
+	}
+
+	if c := changes["tunnel.request_timeout"]; c.Old != "10s" || c.New != "20s" {
+		t.Errorf("request timeout change %+v, want 10s -> 20s", c)
+	}
+	if c := changes["auth.shared_secret"]; c.Old != _redacted || c.New != _redacted {
+		t.Errorf("shared secret should be redacted, got %+v", c)
+	}
+	data, err := json.Marshal(result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"first", "second", "hunter2"} {
+		if strings.Contains(string(data), secret) {
+			t.Errorf("reload result leaks %q: %s", secret, data)
+		}
+	}
+	if !strings.Contains(string(data), `"user":"ci"`) {
+		t.Errorf("non-secret values of changed routes should be shown: %s", data)
+	}
+}
+
+func Test_admin_token_required_with_addr(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "relay.yaml")
+	_write_config(t, path, _reload_base_config+`
+admin:
+  addr: "127.0.0.1:0"
+`)
+	if _, err := LoadConfig(path); err == nil {
+		t.Fatal("expected an admin listener without a token to be refused")
+	}
+
+	s := &Server{}
+	s.cfg.Store(&Config{Admin: AdminConfig{Addr: "127.0.0.1:0"}})
+	w := httptest.NewRecorder()
+	s._admin_handler().ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/reload", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("admin api without a token should refuse requests, got %d", w.Code)
+	}
+}
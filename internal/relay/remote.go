@@ -0,0 +1,431 @@
+package relay
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RemoteEndpointsHeader carries the endpoints allocated to an agent, as a
+// json list of RemoteEndpoint, on the tunnel's upgrade response.
+const RemoteEndpointsHeader = "X-Remote-Endpoints"
+
+// RemoteEndpoint answers one endpoint request from an agent. requests are
+// "tcp:<port>" or "http:<subdomain>"; port 0 or an empty subdomain lets
+// the relay choose.
+type RemoteEndpoint struct {
+	Request string `json:"request"`
+	Port    int    `json:"port,omitempty"`
+	Host    string `json:"host,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// errEndpointInUse is reported for endpoints another agent holds.
+var errEndpointInUse = errors.New("endpoint in use")
+
+// RemoteForwards allocates agent-requested endpoints and tracks the
+// tunnel serving each. an endpoint outlives its tunnel by the grace period
+// so a reconnecting agent gets it back.
+type RemoteForwards struct {
+	cfg       RemoteConfig
+	low, high int
+	policies  map[string]*_remote_policy
+	handler   *Handler
+
+	mu        sync.Mutex
+	endpoints map[string]*_remote_endpoint
+	ports     map[int]*_remote_endpoint
+	hosts     map[string]*_remote_endpoint
+	closed    bool
+}
+
+// _remote_policy is a parsed RemoteAgentPolicy.
+type _remote_policy struct {
+	ports      [][2]int
+	subdomains []string
+}
+
+// _remote_endpoint is an allocated endpoint. tunnel is nil while the
+// endpoint waits for its agent to come back.
+type _remote_endpoint struct {
+	owner string
+	// agent process holding the endpoint; only it may take the endpoint
+	// over while its tunnel is still up
+	instance string
+	request  string
+	port     int
+	host     string
+	listener net.Listener
+	tunnel   *Tunnel
+	expiry   *time.Timer
+	// bumped when the endpoint is taken back, so a stale expiry is ignored
+	gen int
+}
+
+// NewRemoteForwards validates cfg and returns an empty allocator whose
+// tcp connections are served by handler.
+func NewRemoteForwards(cfg *RemoteConfig, handler *Handler) (*RemoteForwards, error) {
+	r := &RemoteForwards{
+		cfg:       *cfg,
+		policies:  make(map[string]*_remote_policy),
+		handler:   handler,
+		endpoints: make(map[string]*_remote_endpoint),
+		ports:     make(map[int]*_remote_endpoint),
+		hosts:     make(map[string]*_remote_endpoint),
+	}
+	if cfg.PortRange != "" {
+		low, high, err := _parse_port_range(cfg.PortRange)
+		if err != nil {
+			return nil, fmt.Errorf("remote.port_range: %w", err)
+		}
+		r.low, r.high = low, high
+	}
+	r.cfg.Domain = strings.ToLower(strings.Trim(cfg.Domain, "."))
+	for name, p := range cfg.Agents {
+		policy := &_remote_policy{subdomains: p.Subdomains}
+		for _, entry := range p.Ports {
+			low, high, err := _parse_port_range(entry)
+			if err != nil {
+				return nil, fmt.Errorf("remote.agents.%s.ports: %w", name, err)
+			}
+			if low < r.low || high > r.high {
+				return nil, fmt.Errorf("remote.agents.%s.ports: %s is outside remote.port_range", name, entry)
+			}
+			policy.ports = append(policy.ports, [2]int{low, high})
+		}
+		for _, pattern := range p.Subdomains {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("remote.agents.%s.subdomains: %w", name, err)
+			}
+		}
+		if len(p.Subdomains) > 0 && r.cfg.Domain == "" {
+			return nil, fmt.Errorf("remote.agents.%s.subdomains needs remote.domain", name)
+		}
+		r.policies[name] = policy
+	}
+	return r, nil
+}
+
+// _parse_port_range parses "port" or "low-high".
+func _parse_port_range(s string) (int, int, error) {
+	lowStr, highStr, found := strings.Cut(s, "-")
+	if !found {
+		highStr = lowStr
+	}
+	low, err := strconv.Atoi(strings.TrimSpace(lowStr))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port %q", lowStr)
+	}
+	high, err := strconv.Atoi(strings.TrimSpace(highStr))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port %q", highStr)
+	}
+	if low < 1 || high > 65535 || low > high {
+		return 0, 0, fmt.Errorf("invalid port range %q", s)
+	}
+	return low, high, nil
+}
+
+// Reserve allocates or takes back the endpoints owner asks for. instance
+// identifies the agent process, which may move its endpoints to a new
+// tunnel before the old one closes. the returned attach function hands
+// them to the owner's new tunnel; it must be called, with nil if the
+// tunnel never came up.
+func (r *RemoteForwards) Reserve(owner, instance string, requests []string) ([]RemoteEndpoint, func(*Tunnel)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var results []RemoteEndpoint
+	var reserved []*_remote_endpoint
+	for _, request := range requests {
+		result := RemoteEndpoint{Request: request}
+		e, err := r._reserve(owner, instance, request)
+		if err != nil {
+			slog.Warn("remote endpoint refused", "agent", owner, "request", request, "err", err)
+			result.Error = err.Error()
+		} else {
+			result.Port, result.Host = e.port, e.host
+			reserved = append(reserved, e)
+		}
+		results = append(results, result)
+	}
+	return results, func(t *Tunnel) { r._attach(reserved, t) }
+}
+
+// _reserve returns owner's endpoint for request, allocating it if needed.
+// an endpoint whose tunnel is up stays with the instance holding it. the
+// caller holds mu.
+func (r *RemoteForwards) _reserve(owner, instance, request string) (*_remote_endpoint, error) {
+	if r.closed {
+		return nil, errors.New("relay shutting down")
+	}
+	if owner == "" {
+		return nil, errors.New("agent name required")
+	}
+	key := owner + "\x00" + request
+	if e, ok := r.endpoints[key]; ok {
+		if e.tunnel != nil && !_closed(e.tunnel) && e.instance != instance {
+			return nil, errEndpointInUse
+		}
+		e.instance = instance
+		if e.expiry != nil {
+			e.expiry.Stop()
+			e.expiry = nil
+		}
+		e.gen++
+		return e, nil
+	}
+
+	policy := r.policies[owner]
+	if policy == nil {
+		policy = r.policies["*"]
+	}
+	if policy == nil {
+		return nil, errors.New("no remote endpoint policy for agent")
+	}
+	kind, value, _ := strings.Cut(request, ":")
+	e := &_remote_endpoint{owner: owner, instance: instance, request: request}
+	switch kind {
+	case "tcp":
+		port, err := strconv.Atoi(value)
+		if err != nil || port < 0 {
+			return nil, fmt.Errorf("invalid port %q", value)
+		}
+		if e.listener, e.port, err = r._listen(policy, port); err != nil {
+			return nil, err
+		}
+		r.ports[e.port] = e
+		go r._serve(e)
+	case "http":
+		host, err := r._pick_host(policy, strings.ToLower(value))
+		if err != nil {
+			return nil, err
+		}
+		e.host = host
+		r.hosts[host] = e
+	default:
+		return nil, fmt.Errorf("unknown endpoint type %q", kind)
+	}
+	r.endpoints[key] = e
+	slog.Info("remote endpoint allocated", "agent", owner, "request", request, "port", e.port, "host", e.host)
+	return e, nil
+}
+
+// _listen binds port, or the first free port the policy allows if port is
+// 0. the caller holds mu.
+func (r *RemoteForwards) _listen(policy *_remote_policy, port int) (net.Listener, int, error) {
+	if port != 0 {
+		if !policy._allows_port(port) {
+			return nil, 0, fmt.Errorf("port %d not allowed", port)
+		}
+		if r.ports[port] != nil {
+			return nil, 0, errEndpointInUse
+		}
+		ln, err := net.Listen("tcp", net.JoinHostPort(r.cfg.BindHost, strconv.Itoa(port)))
+		return ln, port, err
+	}
+	for _, span := range policy.ports {
+		for p := span[0]; p <= span[1]; p++ {
+			if r.ports[p] != nil {
+				continue
+			}
+			if ln, err := net.Listen("tcp", net.JoinHostPort(r.cfg.BindHost, strconv.Itoa(p))); err == nil {
+				return ln, p, nil
+			}
+		}
+	}
+	return nil, 0, errors.New("no free port")
+}
+
+// _allows_port reports whether port is in one of the policy's ranges.
+func (p *_remote_policy) _allows_port(port int) bool {
+	for _, span := range p.ports {
+		if port >= span[0] && port <= span[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// _pick_host returns the hostname for label, or for a generated label if
+// it is empty. the caller holds mu.
+func (r *RemoteForwards) _pick_host(policy *_remote_policy, label string) (string, error) {
+	generated := label == ""
+	for attempt := 0; attempt < 8; attempt++ {
+		if generated {
+			label = _random_label()
+		}
+		if strings.ContainsAny(label, ".:") || !policy._allows_subdomain(label) {
+			return "", fmt.Errorf("subdomain %q not allowed", label)
+		}
+		host := label + "." + r.cfg.Domain
+		// a route's own host keeps its auth and access rules
+		if r.handler != nil && r.handler.Router().HasHost(host) {
+			if !generated {
+				return "", fmt.Errorf("subdomain %q is served by a route", label)
+			}
+			continue
+		}
+		if r.hosts[host] == nil {
+			return host, nil
+		}
+		if !generated {
+			return "", errEndpointInUse
+		}
+	}
+	return "", errors.New("no free subdomain")
+}
+
+// _allows_subdomain reports whether label matches a policy pattern.
+func (p *_remote_policy) _allows_subdomain(label string) bool {
+	for _, pattern := range p.subdomains {
+		if ok, _ := path.Match(pattern, label); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// _closed reports whether t has closed.
+func _closed(t *Tunnel) bool {
+	select {
+	case <-t.Done():
+		return true
+	default:
+		return false
+	}
+}
+
+// _random_label returns a short random dns label.
+func _random_label() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// _attach points reserved endpoints at t and arranges for them to be
+// released once it closes.
+func (r *RemoteForwards) _attach(reserved []*_remote_endpoint, t *Tunnel) {
+	if t == nil {
+		r._release(reserved, nil)
+		return
+	}
+	r.mu.Lock()
+	for _, e := range reserved {
+		e.tunnel = t
+	}
+	r.mu.Unlock()
+	go func() {
+		<-t.Done()
+		r._release(reserved, t)
+	}()
+}
+
+// _release starts the grace period for endpoints still served by t. an
+// endpoint a newer tunnel has taken over is left alone.
+func (r *RemoteForwards) _release(reserved []*_remote_endpoint, t *Tunnel) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, e := range reserved {
+		if e.tunnel != t || e.expiry != nil || r.endpoints[e.owner+"\x00"+e.request] != e {
+			continue
+		}
+		e.tunnel = nil
+		gen := e.gen
+		e.expiry = time.AfterFunc(r.cfg.GracePeriod, func() { r._expire(e, gen) })
+	}
+}
+
+// _expire frees an endpoint whose agent did not come back in time.
+func (r *RemoteForwards) _expire(e *_remote_endpoint, gen int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if e.gen != gen || r.endpoints[e.owner+"\x00"+e.request] != e {
+		return
+	}
+	slog.Info("remote endpoint released", "agent", e.owner, "request", e.request, "port", e.port, "host", e.host)
+	r._free(e)
+}
+
+// _free removes an endpoint and closes its listener. the caller holds mu.
+func (r *RemoteForwards) _free(e *_remote_endpoint) {
+	delete(r.endpoints, e.owner+"\x00"+e.request)
+	if e.listener != nil {
+		delete(r.ports, e.port)
+		e.listener.Close()
+	}
+	if e.host != "" {
+		delete(r.hosts, e.host)
+	}
+}
+
+// Close frees every endpoint. connections already forwarded are left to
+// finish.
+func (r *RemoteForwards) Close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	for _, e := range r.endpoints {
+		if e.expiry != nil {
+			e.expiry.Stop()
+		}
+		r._free(e)
+	}
+}
+
+// _tunnel returns the tunnel currently serving e, or nil.
+func (r *RemoteForwards) _tunnel(e *_remote_endpoint) *Tunnel {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return e.tunnel
+}
+
+// _picker returns a tunnel chooser for e. a reconnecting agent's new
+// tunnel takes over from the old one as soon as it is up.
+func (r *RemoteForwards) _picker(e *_remote_endpoint) func() (*Tunnel, error) {
+	return func() (*Tunnel, error) {
+		if t := r._tunnel(e); t != nil {
+			return t, nil
+		}
+		return nil, fmt.Errorf("agent for %s is not connected", e.request)
+	}
+}
+
+// _http_endpoint returns the endpoint allocated for a request host.
+func (r *RemoteForwards) _http_endpoint(host string) *_remote_endpoint {
+	if r == nil || r.cfg.Domain == "" {
+		return nil
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.hosts[strings.ToLower(host)]
+}
+
+// _serve accepts connections on a tcp endpoint until its listener closes.
+// connections arriving while the agent is away are closed.
+func (r *RemoteForwards) _serve(e *_remote_endpoint) {
+	for {
+		conn, err := e.listener.Accept()
+		if err != nil {
+			return
+		}
+		tunnel := r._tunnel(e)
+		if tunnel == nil {
+			conn.Close()
+			continue
+		}
+		open := &StreamOpen{Kind: StreamKindRemote, Target: e.request}
+		go r.handler._forward_tcp(conn, tunnel.Group(), open, r._picker(e), nil)
+	}
+}
@@ -0,0 +1,179 @@
+package relay
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/reverseproxy/internal/protocol"
+)
+
+// _free_port returns a local port nothing is listening on.
+func _free_port(t *testing.T) int {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+func _new_remote(t *testing.T, port int, grace time.Duration) *RemoteForwards {
+	t.Helper()
+	ports := strconv.Itoa(port)
+	r, err := NewRemoteForwards(&RemoteConfig{
+		PortRange:   ports,
+		BindHost:    "127.0.0.1",
+		Domain:      "tunnel.example.com",
+		GracePeriod: grace,
+		Agents: map[string]RemoteAgentPolicy{
+			"laptop": {Ports: []string{ports}, Subdomains: []string{"app", "ci-*"}},
+			"*":      {Subdomains: []string{"*"}},
+		},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(r.Close)
+	return r
+}
+
+func Test_remote_endpoint_policy(t *testing.T) {
+	port := _free_port(t)
+	r := _new_remote(t, port, time.Minute)
+
+	got, attach := r.Reserve("laptop", "a", []string{"tcp:0", "http:app", "http:other", "tcp:1"})
+	defer attach(nil)
+	if got[0].Port != port || got[0].Error != "" {
+		t.Errorf("tcp:0 should get %d, got %+v", port, got[0])
+	}
+	if got[1].Host != "app.tunnel.example.com" {
+		t.Errorf("http:app should get its subdomain, got %+v", got[1])
+	}
+	if got[2].Error == "" || got[3].Error == "" {
+		t.Errorf("endpoints outside the policy should be refused, got %+v %+v", got[2], got[3])
+	}
+
+	// other agents fall back to the "*" policy, which allows no ports
+	got, attach2 := r.Reserve("desktop", "b", []string{"http:app", "http:", "tcp:0"})
+	defer attach2(nil)
+	if got[0].Error == "" {
+		t.Errorf("a subdomain another agent holds should be refused, got %+v", got[0])
+	}
+	if got[1].Error != "" || got[1].Host == "" {
+		t.Errorf("an empty subdomain should get a generated one, got %+v", got[1])
+	}
+	if got[2].Error == "" {
+		t.Errorf("tcp should be refused without allowed ports, got %+v", got[2])
+	}
+
+	if got, _ := r.Reserve("", "", []string{"http:"}); got[0].Error == "" {
+		t.Error("agents without a name should be refused")
+	}
+}
+
+func Test_remote_endpoint_kept_across_reconnect(t *testing.T) {
+	port := _free_port(t)
+	r := _new_remote(t, port, 300*time.Millisecond)
+	serve := func(*protocol.Codec, uint32) {}
+
+	got, attach := r.Reserve("laptop", "a", []string{"tcp:0"})
+	first := _fake_agent(t, 0, serve)
+	attach(first)
+	if got[0].Port != port {
+		t.Fatalf("expected port %d, got %+v", port, got[0])
+	}
+	first.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	// back within the grace period: same endpoint
+	got, attach = r.Reserve("laptop", "a", []string{"tcp:0"})
+	second := _fake_agent(t, 0, serve)
+	attach(second)
+	if got[0].Port != port {
+		t.Fatalf("reconnect should keep port %d, got %+v", port, got[0])
+	}
+	time.Sleep(400 * time.Millisecond)
+	r.mu.Lock()
+	kept := r.ports[port] != nil && r.ports[port].tunnel == second
+	r.mu.Unlock()
+	if !kept {
+		t.Fatal("endpoint with a live tunnel should be kept")
+	}
+
+	second.Close()
+	time.Sleep(400 * time.Millisecond)
+	r.mu.Lock()
+	freed := r.ports[port] == nil
+	r.mu.Unlock()
+	if !freed {
+		t.Error("endpoint should be released after the grace period")
+	}
+	if ln, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port))); err != nil {
+		t.Errorf("released port still bound: %v", err)
+	} else {
+		ln.Close()
+	}
+}
+
+func Test_remote_endpoint_not_taken_from_live_tunnel(t *testing.T) {
+	port := _free_port(t)
+	r := _new_remote(t, port, time.Minute)
+	serve := func(*protocol.Codec, uint32) {}
+
+	_, attach := r.Reserve("laptop", "a", []string{"tcp:0", "http:app"})
+	first := _fake_agent(t, 0, serve)
+	attach(first)
+
+	// another process with the same name must not take over
+	got, attach2 := r.Reserve("laptop", "b", []string{"tcp:0", "http:app"})
+	attach2(nil)
+	if got[0].Error == "" || got[1].Error == "" {
+		t.Errorf("endpoints with a live tunnel should be refused, got %+v", got)
+	}
+
+	// the same process reconnecting before it drains keeps them
+	got, attach = r.Reserve("laptop", "a", []string{"tcp:0", "http:app"})
+	second := _fake_agent(t, 0, serve)
+	attach(second)
+	if got[0].Port != port || got[1].Error != "" {
+		t.Errorf("the same instance should keep its endpoints, got %+v", got)
+	}
+
+	// once the tunnel is gone another instance may claim them
+	first.Close()
+	second.Close()
+	time.Sleep(50 * time.Millisecond)
+	got, attach = r.Reserve("laptop", "b", []string{"tcp:0"})
+	defer attach(nil)
+	if got[0].Port != port {
+		t.Errorf("an endpoint without a live tunnel should be handed over, got %+v", got[0])
+	}
+}
+
+func Test_remote_subdomain_served_by_route_refused(t *testing.T) {
+	router, err := NewRouter([]RouteConfig{{Host: "admin.tunnel.example.com", Group: "internal"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewHandler(NewPool(), router, nil, &Limits{}, time.Second, 0)
+	r, err := NewRemoteForwards(&RemoteConfig{
+		Domain: "tunnel.example.com",
+		Agents: map[string]RemoteAgentPolicy{"*": {Subdomains: []string{"*"}}},
+	}, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(r.Close)
+
+	got, attach := r.Reserve("laptop", "a", []string{"http:admin", "http:app"})
+	defer attach(nil)
+	if got[0].Error == "" {
+		t.Errorf("a subdomain a route serves should be refused, got %+v", got[0])
+	}
+	if got[1].Error != "" {
+		t.Errorf("other subdomains should be allowed, got %+v", got[1])
+	}
+}
@@ -0,0 +1,138 @@
+package relay
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// DefaultGroup is the group agents join when they do not name one.
+const DefaultGroup = "default"
+
+// Route maps public requests by host and path prefix to an agent group.
+type Route struct {
+	Host       string
+	PathPrefix string
+	Group      string
+	// Auth, ForwardAuth and Access are nil when not configured
+	Auth        *ClientAuth
+	ForwardAuth *ForwardAuth
+	Access      *IPFilter
+	RateLimits  []*RateLimiter
+}
+
+// Router matches requests against the configured routes in order.
+type Router struct {
+	routes []*Route
+}
+
+// NewRouter builds a router from route configuration. with no routes
+// every request goes to any connected agent. fails if a route's auth
+// files, access lists or rate limits are invalid.
+func NewRouter(cfgs []RouteConfig) (*Router, error) {
+	r := &Router{}
+	for i, c := range cfgs {
+		group := c.Group
+		if group == "" {
+			group = DefaultGroup
+		}
+		route := &Route{
+			Host:       strings.ToLower(c.Host),
+			PathPrefix: c.PathPrefix,
+			Group:      group,
+		}
+		if c.Auth != nil {
+			auth, err := NewClientAuth(c.Auth)
+			if err != nil {
+				return nil, fmt.Errorf("routes[%d].auth: %w", i, err)
+			}
+			route.Auth = auth
+		}
+		if c.ForwardAuth != nil {
+			fa, err := NewForwardAuth(c.ForwardAuth)
+			if err != nil {
+				return nil, fmt.Errorf("routes[%d].forward_auth: %w", i, err)
+			}
+			route.ForwardAuth = fa
+		}
+		if c.Access != nil {
+			access, err := NewIPFilter(c.Access)
+			if err != nil {
+				return nil, fmt.Errorf("routes[%d].access: %w", i, err)
+			}
+			route.Access = access
+		}
+		limiters, err := _new_rate_limiters(c.RateLimits, fmt.Sprintf("routes[%d].rate_limits", i))
+		if err != nil {
+			return nil, err
+		}
+		route.RateLimits = limiters
+		r.routes = append(r.routes, route)
+	}
+	return r, nil
+}
+
+// Match returns the first route matching the request. ok is false when
+// routes are configured and none match. a nil route with ok set means
+// routing is not configured.
+func (r *Router) Match(req *http.Request) (route *Route, ok bool) {
+	if len(r.routes) == 0 {
+		return nil, true
+	}
+	host := _request_host(req)
+	for _, rt := range r.routes {
+		if rt.Host != "" && !MatchHost(rt.Host, host) {
+			continue
+		}
+		if rt.PathPrefix != "" && !HasPathPrefix(req.URL.Path, rt.PathPrefix) {
+			continue
+		}
+		return rt, true
+	}
+	return nil, false
+}
+
+// Routes returns the configured routes.
+func (r *Router) Routes() []*Route {
+	return r.routes
+}
+
+// HasHost reports whether any route serves the given hostname.
+func (r *Router) HasHost(host string) bool {
+	host = strings.ToLower(host)
+	for _, rt := range r.routes {
+		if rt.Host != "" && MatchHost(rt.Host, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// _request_host returns the lowercased request host without a port.
+func _request_host(req *http.Request) string {
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(host)
+}
+
+// MatchHost compares a host against a pattern. a leading "*." matches
+// exactly one extra label.
+func MatchHost(pattern, host string) bool {
+	if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+		label, rest, found := strings.Cut(host, ".")
+		return found && label != "" && rest == suffix
+	}
+	return pattern == host
+}
+
+// HasPathPrefix reports whether path starts with prefix on a segment
+// boundary: /api matches /api and /api/users but not /apis.
+func HasPathPrefix(path, prefix string) bool {
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	return len(path) == len(prefix) || strings.HasSuffix(prefix, "/") || path[len(prefix)] == '/'
+}
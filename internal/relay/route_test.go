@@ -0,0 +1,77 @@
+package relay
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_router_without_routes_matches_anything(t *testing.T) {
+	r, err := NewRouter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	route, ok := r.Match(httptest.NewRequest("GET", "http://any.example.com/x", nil))
+	if !ok || route != nil {
+		t.Fatalf("expected unrouted match, got route=%v ok=%v", route, ok)
+	}
+}
+
+func Test_router_matches_in_order(t *testing.T) {
+	r, err := NewRouter([]RouteConfig{
+		{Host: "app.example.com", PathPrefix: "/api/", Group: "api"},
+		{Host: "app.example.com", Group: "web"},
+		{Host: "*.tools.example.com"},
+		{Host: "docs.example.com", PathPrefix: "/v1", Group: "docs"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		url   string
+		group string
+		ok    bool
+	}{
+		{"http://app.example.com/api/users", "api", true},
+		{"http://APP.example.com:8443/index.html", "web", true},
+		{"http://grafana.tools.example.com/", DefaultGroup, true},
+		{"http://tools.example.com/", "", false},
+		{"http://a.b.tools.example.com/", "", false},
+		{"http://other.example.com/", "", false},
+		{"http://docs.example.com/v1", "docs", true},
+		{"http://docs.example.com/v1/intro", "docs", true},
+		{"http://docs.example.com/v10", "", false},
+	}
+	for _, c := range cases {
+		route, ok := r.Match(httptest.NewRequest("GET", c.url, nil))
+		if ok != c.ok {
+			t.Errorf("%s: ok=%v, want %v", c.url, ok, c.ok)
+			continue
+		}
+		if ok && route.Group != c.group {
+			t.Errorf("%s: group %q, want %q", c.url, route.Group, c.group)
+		}
+	}
+}
+
+func Test_router_has_host(t *testing.T) {
+	r, err := NewRouter([]RouteConfig{
+		{Host: "app.example.com"},
+		{Host: "*.tools.example.com"},
+		{PathPrefix: "/static/"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for host, want := range map[string]bool{
+		"app.example.com":       true,
+		"ci.tools.example.com":  true,
+		"tools.example.com":     false,
+		"unrelated.example.com": false,
+		"":                      false,
+	} {
+		if got := r.HasHost(host); got != want {
+			t.Errorf("HasHost(%q) = %v, want %v", host, got, want)
+		}
+	}
+}
@@ -1,53 +1,284 @@
 package relay
 
 import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
 	"fmt"
 	"log/slog"
+	"net"
 	"net/http"
+	"net/netip"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/websocket"
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 // Server is the main relay server that accepts public http traffic
 // and agent websocket connections.
 type Server struct {
-	cfg      *Config
+	cfg      atomic.Pointer[Config]
+	reloadMu sync.Mutex
 	pool     *Pool
 	handler  *Handler
 	upgrader websocket.Upgrader
+	http     *http.Server
+
+	// static certificates by sni, reloaded when the files change
+	certs     *CertStore
+	stopWatch func()
+
+	// automatic certificates, with a plain http listener for http-01 challenges
+	acme     *autocert.Manager
+	acmeHTTP *http.Server
+
+	// optional admin api, e.g. for config reloads
+	admin *http.Server
+
+	// raw tcp and udp forwards, bound by Run
+	tcpMu        sync.Mutex
+	tcpListeners []net.Listener
+	udp          []*_udp_forward
+	socks        *_socks_server
+	httpProxy    *_http_proxy
+	passthrough  *_passthrough_server
+
+	// endpoints allocated to agents as they connect
+	remote *RemoteForwards
 }
 
 // NewServer creates a configured relay server.
-func NewServer(cfg *Config) *Server {
+func NewServer(cfg *Config) (*Server, error) {
+	router, err := NewRouter(cfg.Routes)
+	if err != nil {
+		return nil, err
+	}
+	access, err := NewAccessPolicy(&cfg.Access)
+	if err != nil {
+		return nil, err
+	}
+	limits, err := NewLimits(cfg)
+	if err != nil {
+		return nil, err
+	}
 	pool := NewPool()
-	handler := NewHandler(pool, cfg.Tunnel.RequestTimeout)
-	return &Server{
-		cfg:     cfg,
+	handler := NewHandler(pool, router, access, limits, cfg.Tunnel.RequestTimeout, cfg.Tunnel.StreamIdleTimeout)
+	remote, err := NewRemoteForwards(&cfg.Remote, handler)
+	if err != nil {
+		return nil, err
+	}
+	handler.remote = remote
+	s := &Server{
 		pool:    pool,
 		handler: handler,
+		remote:  remote,
 		upgrader: websocket.Upgrader{
 			CheckOrigin: func(r *http.Request) bool { return true },
 		},
 	}
+	s.cfg.Store(cfg)
+	if cfg.SOCKS.Listen != "" {
+		if s.socks, err = _new_socks_server(&cfg.SOCKS, handler); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.HTTPProxy.Listen != "" {
+		if s.httpProxy, err = _new_http_proxy(&cfg.HTTPProxy, handler); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.TLSPassthrough.Listen != "" {
+		s.passthrough = &_passthrough_server{cfg: cfg.TLSPassthrough, handler: handler}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(cfg.Tunnel.Path, s._handle_tunnel)
+	mux.Handle("/", handler)
+	s.http = &http.Server{Addr: cfg.Listen.Addr, Handler: mux}
+	if !cfg.TLS.Enabled {
+		// http/2 without tls, for grpc clients; tls listeners negotiate it
+		s.http.Handler = h2c.NewHandler(mux, &http2.Server{})
+	}
+	if cfg.Admin.Addr != "" {
+		s.admin = &http.Server{Addr: cfg.Admin.Addr, Handler: s._admin_handler()}
+	}
+
+	if cfg.TLS.Enabled {
+		if err := s._setup_tls(); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
 }
 
-// Run starts the relay server and blocks until it exits.
+// _setup_tls loads static certificates and the acme manager and installs
+// a GetCertificate callback that chooses between them per handshake.
+func (s *Server) _setup_tls() error {
+	cfg := s._config()
+	tlsCfg := &tls.Config{}
+	if pairs := cfg.TLS.CertPairs(); len(pairs) > 0 {
+		certs, err := NewCertStore(pairs)
+		if err != nil {
+			return err
+		}
+		s.certs = certs
+	}
+	if cfg.TLS.ACME.Enabled {
+		m, err := _new_acme_manager(&cfg.TLS.ACME, s._acme_host_allowed)
+		if err != nil {
+			return err
+		}
+		s.acme = m
+		s.acmeHTTP = &http.Server{Addr: cfg.TLS.ACME.HTTPAddr, Handler: m.HTTPHandler(nil)}
+		tlsCfg = m.TLSConfig()
+	}
+	tlsCfg.GetCertificate = s._get_certificate
+	s.http.TLSConfig = tlsCfg
+
+	if s.certs != nil && cfg.TLS.WatchInterval > 0 {
+		s.stopWatch = s.certs.Watch(cfg.TLS.WatchInterval)
+	}
+	return nil
+}
+
+// Run starts the relay server and blocks until it exits. after Shutdown
+// it returns http.ErrServerClosed.
 func (s *Server) Run() error {
-	mux := http.NewServeMux()
-	mux.HandleFunc(s.cfg.Tunnel.Path, s._handle_tunnel)
-	mux.Handle("/", s.handler)
+	cfg := s._config()
+	slog.Info("relay server starting", "addr", cfg.Listen.Addr, "tls", cfg.TLS.Enabled)
 
-	slog.Info("relay server starting", "addr", s.cfg.Listen.Addr, "tls", s.cfg.TLS.Enabled)
+	if s.admin != nil {
+		go s._serve_admin()
+	}
+	ln, err := net.Listen("tcp", cfg.Listen.Addr)
+	if err != nil {
+		return err
+	}
+	if err := s._start_tcp(cfg.TCP); err != nil {
+		ln.Close()
+		return err
+	}
+	if err := s._start_udp(cfg.UDP); err != nil {
+		ln.Close()
+		s._stop_tcp()
+		return err
+	}
+	if err := s._start_socks(); err != nil {
+		ln.Close()
+		s._stop_tcp()
+		s._stop_udp()
+		return err
+	}
+	if err := s._start_http_proxy(); err != nil {
+		ln.Close()
+		s._stop_tcp()
+		s._stop_udp()
+		s._stop_socks()
+		return err
+	}
+	if err := s._start_passthrough(); err != nil {
+		ln.Close()
+		s._stop_tcp()
+		s._stop_udp()
+		s._stop_socks()
+		s._stop_http_proxy()
+		return err
+	}
+	if cfg.Access.ProxyProtocol {
+		ln = &_proxy_listener{Listener: ln, trusted: func(addr netip.Addr) bool {
+			return s.handler.Access().Trusted(addr)
+		}}
+	}
+	if cfg.TLS.Enabled {
+		if s.acmeHTTP != nil {
+			go s._serve_acme_http()
+		}
+		return s.http.ServeTLS(ln, "", "")
+	}
+	return s.http.Serve(ln)
+}
+
+// _serve_acme_http answers http-01 challenges and redirects other plain
+// http requests to https.
+func (s *Server) _serve_acme_http() {
+	slog.Info("acme http-01 listener starting", "addr", s.acmeHTTP.Addr)
+	if err := s.acmeHTTP.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		slog.Error("acme http-01 listener failed", "err", err)
+	}
+}
+
+// Shutdown drains the relay: agents are told to stop using their tunnels
+// so they can connect elsewhere, in-flight requests are given until the
+// drain timeout to finish, then every tunnel is closed.
+func (s *Server) Shutdown(ctx context.Context) error {
+	drainTimeout := s._config().Tunnel.DrainTimeout
+	ctx, cancel := context.WithTimeout(ctx, drainTimeout)
+	defer cancel()
+
+	tunnels := s.pool.Tunnels()
+	slog.Info("relay draining", "tunnels", len(tunnels), "timeout", drainTimeout)
+	for _, t := range tunnels {
+		if err := t.Drain("relay shutting down"); err != nil {
+			slog.Warn("failed to send drain to agent", "id", t.ID(), "err", err)
+		}
+	}
 
-	if s.cfg.TLS.Enabled {
-		return http.ListenAndServeTLS(
-			s.cfg.Listen.Addr,
-			s.cfg.TLS.CertFile,
-			s.cfg.TLS.KeyFile,
-			mux,
-		)
+	// stop accepting public requests and wait for active ones to finish
+	if s.acmeHTTP != nil {
+		s.acmeHTTP.Close()
 	}
-	return http.ListenAndServe(s.cfg.Listen.Addr, mux)
+	if s.admin != nil {
+		s.admin.Close()
+	}
+	if s.stopWatch != nil {
+		s.stopWatch()
+	}
+	s._stop_tcp()
+	s._stop_udp()
+	s._stop_socks()
+	s._stop_http_proxy()
+	s._stop_passthrough()
+	s.remote.Close()
+	err := s.http.Shutdown(ctx)
+	_wait_streams(ctx, tunnels)
+
+	for _, t := range tunnels {
+		t.Close()
+	}
+	return err
+}
+
+// _wait_streams waits until no tunnel has streams awaiting a response, or
+// the context ends.
+func _wait_streams(ctx context.Context, tunnels []*Tunnel) {
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		active := 0
+		for _, t := range tunnels {
+			active += t.Active()
+		}
+		if active == 0 {
+			return
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			slog.Warn("drain timeout reached with streams in flight", "streams", active)
+			return
+		}
+	}
+}
+
+// _config returns the configuration currently in effect.
+func (s *Server) _config() *Config {
+	return s.cfg.Load()
 }
 
 // _handle_tunnel handles websocket upgrade requests from agents.
@@ -57,21 +288,48 @@ func (s *Server) _handle_tunnel(w http.ResponseWriter, r *http.Request) {
 	if token == "" {
 		token = r.Header.Get("X-Auth-Token")
 	}
-	if err := ValidateToken(s.cfg.Auth.SharedSecret, token); err != nil {
-		slog.Warn("agent auth failed", "err", err, "remote", r.RemoteAddr)
+	// the token is bound to the name, signed with the agent's own secret if it has one
+	name := r.URL.Query().Get("name")
+	if err := ValidateAgentToken(s._config().Auth.AgentSecret(name), name, token); err != nil {
+		slog.Warn("agent auth failed", "err", err, "name", name, "remote", r.RemoteAddr)
 		http.Error(w, "unauthorised", http.StatusUnauthorized)
 		return
 	}
 
-	conn, err := s.upgrader.Upgrade(w, r, nil)
+	// endpoints the agent asks for are reported back on the upgrade response
+	header := http.Header{}
+	flowControl := r.URL.Query().Get("flow_control") == "1"
+	if flowControl {
+		header.Set(FlowControlHeader, "1")
+	}
+	attach := func(*Tunnel) {}
+	if requests := r.URL.Query()["forward"]; len(requests) > 0 {
+		var endpoints []RemoteEndpoint
+		endpoints, attach = s.remote.Reserve(name, r.URL.Query().Get("instance"), requests)
+		data, _ := json.Marshal(endpoints)
+		header.Set(RemoteEndpointsHeader, string(data))
+	}
+
+	conn, err := s.upgrader.Upgrade(w, r, header)
 	if err != nil {
 		slog.Error("websocket upgrade failed", "err", err)
+		attach(nil)
 		return
 	}
 
+	group := r.URL.Query().Get("group")
+	if group == "" {
+		group = DefaultGroup
+	}
+
+	// agents that do not advertise a limit are not capped
+	maxStreams, _ := strconv.Atoi(r.URL.Query().Get("max_streams"))
+	maxStreams = max(maxStreams, 0)
+
 	tunnelID := fmt.Sprintf("agent-%s", r.RemoteAddr)
-	slog.Info("agent connected", "id", tunnelID, "remote", r.RemoteAddr)
+	slog.Info("agent connected", "id", tunnelID, "name", name, "group", group, "max_streams", maxStreams, "flow_control", flowControl, "remote", r.RemoteAddr)
 
-	tunnel := NewTunnel(tunnelID, conn, s.cfg.Tunnel.PingInterval)
+	tunnel := NewTunnel(tunnelID, group, maxStreams, flowControl, conn, s._config().Tunnel.PingInterval)
+	attach(tunnel)
 	s.pool.Add(tunnel)
 }
@@ -0,0 +1,272 @@
+package relay
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// time a socks client has to authenticate and send its request.
+const _socks_handshake_timeout = 10 * time.Second
+
+// socks5 protocol values, rfc 1928 and rfc 1929.
+const (
+	_socks_version        = 5
+	_socks_auth_version   = 1
+	_socks_method_userpwd = 2
+	_socks_method_none    = 0xff
+	_socks_cmd_connect    = 1
+	_socks_atyp_ipv4      = 1
+	_socks_atyp_domain    = 3
+	_socks_atyp_ipv6      = 4
+)
+
+// socks5 reply codes.
+const (
+	_socks_succeeded           = 0
+	_socks_general_failure     = 1
+	_socks_not_allowed         = 2
+	_socks_network_unreachable = 3
+	_socks_host_unreachable    = 4
+	_socks_refused             = 5
+	_socks_cmd_unsupported     = 7
+	_socks_atyp_unsupported    = 8
+)
+
+// _socks_server accepts socks5 connect requests and forwards each through
+// an agent in the authenticated user's group.
+type _socks_server struct {
+	addr    string
+	users   map[string]string
+	groups  map[string]string
+	handler *Handler
+	ln      net.Listener
+}
+
+// _new_socks_server loads the users for a socks listener.
+func _new_socks_server(cfg *SOCKSConfig, handler *Handler) (*_socks_server, error) {
+	users, err := _load_htpasswd(cfg.HtpasswdFile)
+	if err != nil {
+		return nil, fmt.Errorf("socks: %w", err)
+	}
+	return &_socks_server{addr: cfg.Listen, users: users, groups: cfg.Users, handler: handler}, nil
+}
+
+// _start_socks binds the socks listener, if configured, and serves it.
+func (s *Server) _start_socks() error {
+	if s.socks == nil {
+		return nil
+	}
+	ln, err := net.Listen("tcp", s.socks.addr)
+	if err != nil {
+		return err
+	}
+	s.tcpMu.Lock()
+	s.socks.ln = ln
+	s.tcpMu.Unlock()
+	go s.socks._serve(ln)
+	return nil
+}
+
+// _stop_socks stops accepting socks connections. open ones are left to
+// finish.
+func (s *Server) _stop_socks() {
+	s.tcpMu.Lock()
+	defer s.tcpMu.Unlock()
+	if s.socks != nil && s.socks.ln != nil {
+		s.socks.ln.Close()
+	}
+}
+
+// _serve accepts socks connections until the listener closes.
+func (ss *_socks_server) _serve(ln net.Listener) {
+	slog.Info("socks listening", "addr", ln.Addr())
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				slog.Error("socks listener stopped", "addr", ln.Addr(), "err", err)
+			}
+			return
+		}
+		go ss._handle(conn)
+	}
+}
+
+// _handle authenticates a client, reads its connect request and hands the
+// connection to an agent.
+func (ss *_socks_server) _handle(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(_socks_handshake_timeout))
+	// reads are unbuffered so nothing the client sends after its request is lost
+	user, err := ss._authenticate(conn)
+	if err != nil {
+		slog.Debug("socks authentication failed", "remote", conn.RemoteAddr(), "err", err)
+		conn.Close()
+		return
+	}
+	target, err := _read_socks_request(conn)
+	if err != nil {
+		slog.Debug("socks request rejected", "remote", conn.RemoteAddr(), "user", user, "err", err)
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	group := ss.groups[user]
+	slog.Debug("socks connect", "user", user, "group", _group_name(group), "target", target)
+	open := &StreamOpen{Kind: StreamKindTCP, Target: target}
+	pick := func() (*Tunnel, error) { return ss.handler.pool.Get(group) }
+	ss.handler._forward_tcp(conn, group, open, pick, func(status int) {
+		_write_socks_reply(conn, _socks_reply_code(status))
+	})
+}
+
+// _authenticate negotiates username/password authentication and returns
+// the user. users without a group mapping are refused.
+func (ss *_socks_server) _authenticate(conn net.Conn) (string, error) {
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(conn, head); err != nil {
+		return "", err
+	}
+	if head[0] != _socks_version {
+		return "", fmt.Errorf("unsupported socks version %d", head[0])
+	}
+	methods := make([]byte, head[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", err
+	}
+	offered := false
+	for _, m := range methods {
+		offered = offered || m == _socks_method_userpwd
+	}
+	if !offered {
+		conn.Write([]byte{_socks_version, _socks_method_none})
+		return "", errors.New("client does not offer username/password authentication")
+	}
+	if _, err := conn.Write([]byte{_socks_version, _socks_method_userpwd}); err != nil {
+		return "", err
+	}
+
+	user, password, err := _read_socks_credentials(conn)
+	if err != nil {
+		return "", err
+	}
+	_, mapped := ss.groups[user]
+	if !mapped || !_htpasswd_match(ss.users, user, password) {
+		conn.Write([]byte{_socks_auth_version, 1})
+		return "", fmt.Errorf("invalid credentials for %q", user)
+	}
+	_, err = conn.Write([]byte{_socks_auth_version, 0})
+	return user, err
+}
+
+// _read_socks_credentials reads a username/password subnegotiation.
+func _read_socks_credentials(r io.Reader) (string, string, error) {
+	version, err := _read_byte(r)
+	if err != nil {
+		return "", "", err
+	}
+	if version != _socks_auth_version {
+		return "", "", fmt.Errorf("unsupported auth version %d", version)
+	}
+	user, err := _read_socks_string(r)
+	if err != nil {
+		return "", "", err
+	}
+	password, err := _read_socks_string(r)
+	return user, password, err
+}
+
+// _read_byte reads a single byte.
+func _read_byte(r io.Reader) (byte, error) {
+	var b [1]byte
+	_, err := io.ReadFull(r, b[:])
+	return b[0], err
+}
+
+// _read_socks_string reads a length-prefixed string.
+func _read_socks_string(r io.Reader) (string, error) {
+	n, err := _read_byte(r)
+	if err != nil {
+		return "", err
+	}
+	b := make([]byte, n)
+	_, err = io.ReadFull(r, b)
+	return string(b), err
+}
+
+// _read_socks_request reads a connect request and returns its target as
+// host:port. other commands and address types are answered and refused.
+func _read_socks_request(conn net.Conn) (string, error) {
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(conn, head); err != nil {
+		return "", err
+	}
+	if head[0] != _socks_version {
+		return "", fmt.Errorf("unsupported socks version %d", head[0])
+	}
+	if head[1] != _socks_cmd_connect {
+		_write_socks_reply(conn, _socks_cmd_unsupported)
+		return "", fmt.Errorf("unsupported command %d", head[1])
+	}
+
+	var host string
+	switch head[3] {
+	case _socks_atyp_ipv4, _socks_atyp_ipv6:
+		size := net.IPv4len
+		if head[3] == _socks_atyp_ipv6 {
+			size = net.IPv6len
+		}
+		ip := make(net.IP, size)
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case _socks_atyp_domain:
+		name, err := _read_socks_string(conn)
+		if err != nil {
+			return "", err
+		}
+		host = name
+	default:
+		_write_socks_reply(conn, _socks_atyp_unsupported)
+		return "", fmt.Errorf("unsupported address type %d", head[3])
+	}
+
+	var port [2]byte
+	if _, err := io.ReadFull(conn, port[:]); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+// _socks_reply_code maps a tcp stream outcome to a socks reply.
+func _socks_reply_code(status int) byte {
+	switch status {
+	case http.StatusOK:
+		return _socks_succeeded
+	case http.StatusForbidden:
+		return _socks_not_allowed
+	case http.StatusServiceUnavailable:
+		return _socks_network_unreachable
+	case http.StatusGatewayTimeout:
+		return _socks_host_unreachable
+	case http.StatusBadGateway:
+		return _socks_refused
+	default:
+		return _socks_general_failure
+	}
+}
+
+// _write_socks_reply sends a reply with an unspecified bound address; the
+// agent's local address is not known to the relay.
+func _write_socks_reply(conn net.Conn, code byte) error {
+	_, err := conn.Write([]byte{_socks_version, code, 0, _socks_atyp_ipv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
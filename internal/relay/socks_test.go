@@ -0,0 +1,26 @@
+package relay
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func Test_socks_users_need_a_group(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "relay.yaml")
+	socks := `
+socks:
+  listen: "127.0.0.1:0"
+  htpasswd_file: "/etc/rprt/socks.htpasswd"
+  users:
+    alice: "office"
+`
+	_write_config(t, path, _reload_base_config+socks)
+	if _, err := LoadConfig(path); err != nil {
+		t.Fatalf("loading config: %v", err)
+	}
+	_write_config(t, path, _reload_base_config+socks+`    bob: ""
+`)
+	if _, err := LoadConfig(path); err == nil {
+		t.Error("a user mapped to an empty group should be refused")
+	}
+}
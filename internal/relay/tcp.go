@@ -0,0 +1,213 @@
+package relay
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/reverseproxy/internal/protocol"
+)
+
+// _listen_tcp binds the configured tcp forwards. on error any listeners
+// already bound are closed.
+func _listen_tcp(forwards []TCPForwardConfig) ([]net.Listener, error) {
+	var listeners []net.Listener
+	for _, f := range forwards {
+		ln, err := net.Listen("tcp", f.Listen)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, ln)
+	}
+	return listeners, nil
+}
+
+// _client_conn is a client connection handed to _forward_tcp after some
+// of it was already handled elsewhere: reads may start with bytes already
+// buffered and the client address may be that of an outer connection.
+type _client_conn struct {
+	net.Conn
+	r      io.Reader
+	remote net.Addr
+}
+
+// Read reads from the buffer, then the connection.
+func (c *_client_conn) Read(p []byte) (int, error) {
+	if c.r == nil {
+		return c.Conn.Read(p)
+	}
+	return c.r.Read(p)
+}
+
+// RemoteAddr returns the client's address.
+func (c *_client_conn) RemoteAddr() net.Addr {
+	if c.remote == nil {
+		return c.Conn.RemoteAddr()
+	}
+	return c.remote
+}
+
+// CloseWrite half-closes the connection, or closes it if it cannot.
+func (c *_client_conn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+// _start_tcp binds the tcp forwards and starts accepting on them.
+func (s *Server) _start_tcp(forwards []TCPForwardConfig) error {
+	listeners, err := _listen_tcp(forwards)
+	if err != nil {
+		return err
+	}
+	s.tcpMu.Lock()
+	s.tcpListeners = listeners
+	s.tcpMu.Unlock()
+	for i, ln := range listeners {
+		go s._serve_tcp(ln, forwards[i])
+	}
+	return nil
+}
+
+// _stop_tcp stops accepting tcp connections. open ones are left to finish.
+func (s *Server) _stop_tcp() {
+	s.tcpMu.Lock()
+	defer s.tcpMu.Unlock()
+	for _, ln := range s.tcpListeners {
+		ln.Close()
+	}
+	s.tcpListeners = nil
+}
+
+// _serve_tcp accepts connections on a tcp forward until the listener
+// closes.
+func (s *Server) _serve_tcp(ln net.Listener, f TCPForwardConfig) {
+	slog.Info("tcp forward listening", "addr", ln.Addr(), "group", _group_name(f.Group), "target", f.Target)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				slog.Error("tcp forward stopped", "addr", ln.Addr(), "err", err)
+			}
+			return
+		}
+		go s.handler.ServeTCP(conn, f.Group, f.Target)
+	}
+}
+
+// ServeTCP forwards a client connection through an agent in group to
+// target, splicing bytes until both sides finish. the client's address
+// must pass the access lists and the group's stream cap applies.
+func (h *Handler) ServeTCP(conn net.Conn, group, target string) {
+	open := &StreamOpen{Kind: StreamKindTCP, Target: target}
+	h._forward_tcp(conn, group, open, func() (*Tunnel, error) { return h.pool.Get(group) }, nil)
+}
+
+// _forward_tcp offers conn to tunnels from pick as the stream open
+// describes, until one accepts it. ready, if set, is told the outcome as
+// an http status before any bytes flow: 200 once the agent is connected
+// to the target. closes conn.
+func (h *Handler) _forward_tcp(conn net.Conn, group string, open *StreamOpen, pick func() (*Tunnel, error), ready func(status int)) {
+	defer conn.Close()
+	if ready == nil {
+		ready = func(int) {}
+	}
+	access := h.Access()
+	client, _ := _remote_addr(conn.RemoteAddr().String())
+	if !access.Global().Allows(client) || !access.Group(group).Allows(client) {
+		slog.Debug("tcp client address denied", "client", client, "group", _group_name(group))
+		ready(http.StatusForbidden)
+		return
+	}
+
+	limits := h.limits.Load()
+	streams := h._group_streams(group)
+	if !streams._acquire(limits.maxStreams[_group_name(group)]) {
+		slog.Debug("group stream limit reached", "group", _group_name(group))
+		ready(http.StatusTooManyRequests)
+		return
+	}
+	defer streams._release()
+
+	for attempt := 0; attempt < _max_attempts; attempt++ {
+		tunnel, err := pick()
+		if err != nil {
+			slog.Warn("no agent for tcp stream", "group", _group_name(group), "err", err)
+			ready(http.StatusServiceUnavailable)
+			return
+		}
+		streamID, ch, err := _open_stream(tunnel, open)
+		if errors.Is(err, ErrTunnelDraining) || errors.Is(err, ErrTunnelFull) {
+			continue
+		}
+		if err != nil {
+			slog.Error("failed to open tcp stream", "err", err)
+			ready(http.StatusBadGateway)
+			return
+		}
+		if !_splice_tcp(conn, tunnel, streamID, ch, time.Duration(h.timeout.Load()), ready) {
+			return
+		}
+		slog.Debug("tcp stream refused by agent, retrying", "tunnel", tunnel.ID(), "attempt", attempt+1)
+	}
+	slog.Warn("no agent accepted tcp stream", "group", _group_name(group), "target", open.Target)
+	ready(http.StatusServiceUnavailable)
+}
+
+// _splice_tcp waits for the agent to connect to the target, then splices
+// conn to the stream. nothing is read from conn until the agent answers,
+// so a refused stream can be retried. it returns true if the agent
+// refused the stream.
+func _splice_tcp(conn net.Conn, tunnel *Tunnel, streamID uint32, ch chan *protocol.Frame, timeout time.Duration, ready func(status int)) (refused bool) {
+	reset := _stream_reset(tunnel, streamID)
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case frame, ok := <-ch:
+		if !ok {
+			ready(http.StatusBadGateway)
+			return false
+		}
+		switch frame.Type {
+		case protocol.TypeDrain, protocol.TypeRefuseStream:
+			return true
+		case protocol.TypeStreamHead:
+			var head TunnelledResponse
+			if err := json.Unmarshal(frame.Payload, &head); err != nil || head.StatusCode != http.StatusOK {
+				slog.Warn("agent could not connect tcp stream", "stream", streamID, "status", head.StatusCode, "reason", string(head.Body))
+				reset()
+				_abandon(ch)
+				if head.StatusCode == 0 {
+					head.StatusCode = http.StatusBadGateway
+				}
+				ready(head.StatusCode)
+				return false
+			}
+		default:
+			_abandon(ch)
+			ready(http.StatusBadGateway)
+			return false
+		}
+	case <-timer.C:
+		slog.Warn("tcp stream timed out waiting for agent", "stream", streamID)
+		reset()
+		_abandon(ch)
+		ready(http.StatusGatewayTimeout)
+		return false
+	}
+	ready(http.StatusOK)
+
+	if err := protocol.Splice(conn, conn, streamID, ch, tunnel.SendFrame); err != nil {
+		slog.Debug("tcp stream ended", "stream", streamID, "err", err)
+	}
+	return false
+}
@@ -1,34 +1,73 @@
 package relay
 
 import (
+	"errors"
 	"fmt"
 	"log/slog"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/reverseproxy/internal/protocol"
 )
 
+// ErrTunnelDraining is returned when a stream is offered to a tunnel that
+// no longer accepts new streams. the request can be retried elsewhere.
+var ErrTunnelDraining = errors.New("tunnel is draining")
+
+// ErrTunnelFull is returned when a tunnel already has as many streams as
+// its agent advertised. the request can be retried elsewhere.
+var ErrTunnelFull = errors.New("tunnel is at capacity")
+
+// FlowControlHeader is set on the upgrade response when the relay agrees
+// to the per-stream flow control an agent asked for with flow_control=1.
+const FlowControlHeader = "X-Tunnel-Flow-Control"
+
 // Tunnel represents a single agent websocket connection on the relay side.
 type Tunnel struct {
 	id       string
+	group    string
 	codec    *protocol.Codec
 	conn     *websocket.Conn
-	streams  map[uint32]chan *protocol.Frame
+	streams  map[uint32]*protocol.Inbox
+	// closed for streams still open when the tunnel shuts down, so their
+	// frames are no longer handed over; a stream the agent has finished or
+	// refused keeps its last frames
+	gone     map[uint32]chan struct{}
+	// send credit of streams this side has not finished sending on
+	windows  map[uint32]*protocol.Window
+	// told about datagrams dropped because their flow is behind
+	drops    map[uint32]func()
 	streamMu sync.RWMutex
 	done     chan struct{}
 	closeOnce sync.Once
+	draining  atomic.Bool
+	// set while the agent reports no healthy backend
+	unhealthy atomic.Bool
 	pingInterval time.Duration
+	// concurrent streams the agent accepts, 0 if it did not say
+	maxStreams int
+	// whether both sides return credit with TypeWindowUpdate
+	flowControl bool
 }
 
 // NewTunnel wraps an agent websocket connection for multiplexed communication.
-func NewTunnel(id string, conn *websocket.Conn, pingInterval time.Duration) *Tunnel {
+// maxStreams is the agent's advertised stream limit, 0 for none. flowControl
+// is set if the agent asked for per-stream flow control; without it a slow
+// stream holds up the tunnel's read loop.
+func NewTunnel(id, group string, maxStreams int, flowControl bool, conn *websocket.Conn, pingInterval time.Duration) *Tunnel {
 	t := &Tunnel{
 		id:           id,
+		group:        group,
+		maxStreams:   maxStreams,
+		flowControl:  flowControl,
 		codec:        protocol.NewCodec(conn),
 		conn:         conn,
-		streams:      make(map[uint32]chan *protocol.Frame),
+		streams:      make(map[uint32]*protocol.Inbox),
+		gone:         make(map[uint32]chan struct{}),
+		windows:      make(map[uint32]*protocol.Window),
+		drops:        make(map[uint32]func()),
 		done:         make(chan struct{}),
 		pingInterval: pingInterval,
 	}
@@ -38,22 +77,105 @@ func NewTunnel(id string, conn *websocket.Conn, pingInterval time.Duration) *Tun
 }
 
 // SendRequest sends a frame and registers a response channel for the stream.
+// if the agent later refuses the stream, because it is draining or at
+// capacity, a TypeDrain or TypeRefuseStream frame is delivered on the
+// channel before it closes.
 func (t *Tunnel) SendRequest(f *protocol.Frame) (chan *protocol.Frame, error) {
-	ch := make(chan *protocol.Frame, 64)
+	var ack func(uint32)
+	if t.flowControl {
+		streamID := f.StreamID
+		ack = func(n uint32) {
+			t.codec.WriteFrame(&protocol.Frame{Type: protocol.TypeWindowUpdate, StreamID: streamID, Payload: protocol.MarshalWindowUpdate(n)})
+		}
+	}
 	t.streamMu.Lock()
-	t.streams[f.StreamID] = ch
+	if t.draining.Load() {
+		t.streamMu.Unlock()
+		return nil, ErrTunnelDraining
+	}
+	if t.maxStreams > 0 && len(t.streams) >= t.maxStreams {
+		t.streamMu.Unlock()
+		return nil, ErrTunnelFull
+	}
+	gone := make(chan struct{})
+	inbox := protocol.NewInbox(ack, gone)
+	t.streams[f.StreamID] = inbox
+	t.gone[f.StreamID] = gone
+	if t.flowControl {
+		t.windows[f.StreamID] = protocol.NewWindow()
+	}
 	t.streamMu.Unlock()
 
 	if err := t.codec.WriteFrame(f); err != nil {
 		t._remove_stream(f.StreamID)
+		t._forget_window(f.StreamID)
 		return nil, fmt.Errorf("writing request frame: %w", err)
 	}
-	return ch, nil
+	return inbox.Frames(), nil
+}
+
+// OnDatagramDropped registers fn to be called for each datagram on the
+// stream that is dropped because its reader has fallen behind.
+func (t *Tunnel) OnDatagramDropped(streamID uint32, fn func()) {
+	t.streamMu.Lock()
+	if _, ok := t.streams[streamID]; ok {
+		t.drops[streamID] = fn
+	}
+	t.streamMu.Unlock()
 }
 
-// SendFrame sends a frame without registering a response channel.
+// SendFrame sends a frame without registering a response channel. under
+// flow control, data frames wait for the agent to have room for them, and
+// are dropped once the agent has reset the stream.
 func (t *Tunnel) SendFrame(f *protocol.Frame) error {
-	return t.codec.WriteFrame(f)
+	if protocol.FlowControlled(f.Type) {
+		t.streamMu.RLock()
+		w := t.windows[f.StreamID]
+		t.streamMu.RUnlock()
+		if w != nil {
+			switch err := w.Take(t.done); err {
+			case protocol.ErrStreamReset:
+				return nil
+			case protocol.ErrStreamLost:
+				return err
+			}
+		}
+	}
+	if err := t.codec.WriteFrame(f); err != nil {
+		return err
+	}
+	if f.Type == protocol.TypeStreamClose || f.Type == protocol.TypeStreamReset {
+		// nothing more is sent on the stream
+		t._forget_window(f.StreamID)
+	}
+	return nil
+}
+
+// Drain asks the agent to stop using this tunnel and stops routing new
+// streams to it. streams already in flight still complete.
+func (t *Tunnel) Drain(reason string) error {
+	t.streamMu.Lock()
+	t.draining.Store(true)
+	t.streamMu.Unlock()
+	payload := protocol.MarshalDrain(&protocol.Drain{Reason: reason})
+	return t.codec.WriteFrame(&protocol.Frame{Type: protocol.TypeDrain, Payload: payload})
+}
+
+// Active returns the number of streams awaiting a response.
+func (t *Tunnel) Active() int {
+	t.streamMu.RLock()
+	defer t.streamMu.RUnlock()
+	return len(t.streams)
+}
+
+// Full reports whether the tunnel has as many streams as its agent accepts.
+func (t *Tunnel) Full() bool {
+	return t.maxStreams > 0 && t.Active() >= t.maxStreams
+}
+
+// MaxStreams returns the agent's advertised stream limit, 0 for none.
+func (t *Tunnel) MaxStreams() int {
+	return t.maxStreams
 }
 
 // Close shuts down the tunnel.
@@ -62,9 +184,18 @@ func (t *Tunnel) Close() {
 		close(t.done)
 		t.codec.Close()
 		t.streamMu.Lock()
-		for id, ch := range t.streams {
-			close(ch)
+		for id, inbox := range t.streams {
+			inbox.Close()
 			delete(t.streams, id)
+			delete(t.drops, id)
+		}
+		for id, gone := range t.gone {
+			close(gone)
+			delete(t.gone, id)
+		}
+		for id, w := range t.windows {
+			w.Close()
+			delete(t.windows, id)
 		}
 		t.streamMu.Unlock()
 		slog.Info("tunnel closed", "id", t.id)
@@ -76,11 +207,26 @@ func (t *Tunnel) Done() <-chan struct{} {
 	return t.done
 }
 
+// Healthy reports whether the agent last said it has a healthy backend.
+func (t *Tunnel) Healthy() bool {
+	return !t.unhealthy.Load()
+}
+
+// Draining reports whether the agent has asked to stop receiving new streams.
+func (t *Tunnel) Draining() bool {
+	return t.draining.Load()
+}
+
 // ID returns the tunnel identifier.
 func (t *Tunnel) ID() string {
 	return t.id
 }
 
+// Group returns the agent group the tunnel serves.
+func (t *Tunnel) Group() string {
+	return t.group
+}
+
 // _read_loop continuously reads frames and dispatches them to stream channels.
 func (t *Tunnel) _read_loop() {
 	defer t.Close()
@@ -99,19 +245,64 @@ func (t *Tunnel) _read_loop() {
 		switch frame.Type {
 		case protocol.TypePong:
 			// keepalive response, nothing to do
-		case protocol.TypeHTTPResponse, protocol.TypeBodyChunk, protocol.TypeStreamClose:
+		case protocol.TypeDrain:
+			t._handle_drain(frame)
+		case protocol.TypeHealth:
+			healthy := len(frame.Payload) > 0 && frame.Payload[0] == 1
+			if t.unhealthy.Swap(!healthy) == healthy {
+				slog.Info("agent backend health changed", "id", t.id, "healthy", healthy)
+			}
+		case protocol.TypeRefuseStream:
+			t.streamMu.RLock()
+			inbox, ok := t.streams[frame.StreamID]
+			t.streamMu.RUnlock()
+			if ok {
+				// the agent sends nothing else on a refused stream
+				inbox.CloseWith(frame)
+				t._remove_stream(frame.StreamID)
+				t._forget_window(frame.StreamID)
+			}
+		case protocol.TypeWindowUpdate:
+			n, err := protocol.UnmarshalWindowUpdate(frame.Payload)
+			if err != nil {
+				slog.Warn("invalid window update from agent", "id", t.id, "err", err)
+				continue
+			}
+			t.streamMu.RLock()
+			w := t.windows[frame.StreamID]
+			t.streamMu.RUnlock()
+			if w != nil {
+				w.Add(int(n))
+			}
+		case protocol.TypeDatagram:
+			t.streamMu.RLock()
+			inbox, ok := t.streams[frame.StreamID]
+			dropped := t.drops[frame.StreamID]
+			t.streamMu.RUnlock()
+			// best effort: never wait for a flow that is behind
+			if ok && !inbox.Offer(frame) && dropped != nil {
+				dropped()
+			}
+		case protocol.TypeHTTPResponse, protocol.TypeBodyChunk, protocol.TypeStreamClose,
+			protocol.TypeStreamHead, protocol.TypeStreamData, protocol.TypeStreamTrailers, protocol.TypeStreamReset:
 			t.streamMu.RLock()
-			ch, ok := t.streams[frame.StreamID]
+			inbox, ok := t.streams[frame.StreamID]
 			t.streamMu.RUnlock()
 			if ok {
-				select {
-				case ch <- frame:
-				case <-t.done:
-					return
+				if !inbox.Deliver(frame, t.done) {
+					// the agent overran the stream's window
+					slog.Warn("stream receive buffer full, resetting", "id", t.id, "stream", frame.StreamID)
+					t.codec.WriteFrame(&protocol.Frame{Type: protocol.TypeStreamReset, StreamID: frame.StreamID})
+					t._remove_stream(frame.StreamID)
+					t._forget_window(frame.StreamID)
+					continue
 				}
-				if frame.Type == protocol.TypeStreamClose {
+				if frame.Type == protocol.TypeStreamClose || frame.Type == protocol.TypeStreamReset {
 					t._remove_stream(frame.StreamID)
 				}
+				if frame.Type == protocol.TypeStreamReset {
+					t._forget_window(frame.StreamID)
+				}
 			}
 		default:
 			slog.Warn("unexpected frame type from agent", "type", frame.Type, "stream", frame.StreamID)
@@ -119,6 +310,38 @@ func (t *Tunnel) _read_loop() {
 	}
 }
 
+// _handle_drain stops routing new streams to the tunnel and hands back any
+// streams the agent did not accept so their requests can be retried.
+func (t *Tunnel) _handle_drain(frame *protocol.Frame) {
+	d, err := protocol.UnmarshalDrain(frame.Payload)
+	if err != nil {
+		slog.Warn("invalid drain frame from agent", "id", t.id, "err", err)
+		return
+	}
+
+	t.streamMu.Lock()
+	t.draining.Store(true)
+	refused := 0
+	for id, inbox := range t.streams {
+		if id <= d.LastStreamID {
+			continue
+		}
+		inbox.CloseWith(&protocol.Frame{Type: protocol.TypeDrain, StreamID: id})
+		delete(t.streams, id)
+		delete(t.drops, id)
+		delete(t.gone, id)
+		if w, ok := t.windows[id]; ok {
+			w.Close()
+			delete(t.windows, id)
+		}
+		refused++
+	}
+	t.streamMu.Unlock()
+
+	slog.Info("agent draining, no longer routing new streams",
+		"id", t.id, "reason", d.Reason, "last_stream", d.LastStreamID, "refused", refused)
+}
+
 // _ping_loop sends periodic pings to keep the connection alive.
 func (t *Tunnel) _ping_loop() {
 	ticker := time.NewTicker(t.pingInterval)
@@ -138,12 +361,25 @@ func (t *Tunnel) _ping_loop() {
 	}
 }
 
-// _remove_stream removes a stream channel from the map and closes it.
+// _remove_stream removes a stream's inbox from the map and closes it.
 func (t *Tunnel) _remove_stream(streamID uint32) {
 	t.streamMu.Lock()
-	if ch, ok := t.streams[streamID]; ok {
-		close(ch)
+	if inbox, ok := t.streams[streamID]; ok {
+		inbox.Close()
 		delete(t.streams, streamID)
+		delete(t.drops, streamID)
+		delete(t.gone, streamID)
+	}
+	t.streamMu.Unlock()
+}
+
+// _forget_window drops a stream's send credit, failing senders waiting
+// on it.
+func (t *Tunnel) _forget_window(streamID uint32) {
+	t.streamMu.Lock()
+	if w, ok := t.windows[streamID]; ok {
+		w.Close()
+		delete(t.windows, streamID)
 	}
 	t.streamMu.Unlock()
 }
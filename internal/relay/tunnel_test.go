@@ -0,0 +1,375 @@
+package relay
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/reverseproxy/internal/protocol"
+)
+
+// _tunnel_pair returns a relay-side tunnel and the codec of the agent end
+// of its connection.
+func _tunnel_pair(t *testing.T, maxStreams int, flowControl bool) (*Tunnel, *protocol.Codec) {
+	t.Helper()
+	tunnels := make(chan *Tunnel, 1)
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("upgrade: %v", err)
+			return
+		}
+		tunnels <- NewTunnel("fake", DefaultGroup, maxStreams, flowControl, conn, time.Minute)
+	}))
+	t.Cleanup(srv.Close)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	codec := protocol.NewCodec(conn)
+	t.Cleanup(func() { codec.Close() })
+	tunnel := <-tunnels
+	t.Cleanup(tunnel.Close)
+	return tunnel, codec
+}
+
+// _fake_agent connects a scripted agent to a relay-side tunnel. serve is
+// called with each complete request stream id.
+func _fake_agent(t *testing.T, maxStreams int, serve func(codec *protocol.Codec, streamID uint32)) *Tunnel {
+	t.Helper()
+	tunnel, codec := _tunnel_pair(t, maxStreams, false)
+	go func() {
+		for {
+			frame, err := codec.ReadFrame()
+			if err != nil {
+				return
+			}
+			if frame.Type == protocol.TypeStreamClose {
+				serve(codec, frame.StreamID)
+			}
+		}
+	}()
+	return tunnel
+}
+
+func Test_refused_stream_is_retried(t *testing.T) {
+	refused := 0
+	tunnel := _fake_agent(t, 0, func(codec *protocol.Codec, streamID uint32) {
+		if refused == 0 {
+			refused++
+			codec.WriteFrame(&protocol.Frame{Type: protocol.TypeRefuseStream, StreamID: streamID})
+			return
+		}
+		payload, _ := json.Marshal(&TunnelledResponse{StatusCode: http.StatusOK, Body: []byte("ok")})
+		codec.WriteFrame(&protocol.Frame{Type: protocol.TypeHTTPResponse, StreamID: streamID, Payload: payload})
+		codec.WriteFrame(&protocol.Frame{Type: protocol.TypeStreamClose, StreamID: streamID})
+	})
+
+	pool := NewPool()
+	pool.Add(tunnel)
+	router, _ := NewRouter(nil)
+	access, _ := NewAccessPolicy(&AccessConfig{})
+	h := NewHandler(pool, router, access, &Limits{}, 5*time.Second, 0)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "http://app.example.com/", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "ok" {
+		t.Fatalf("expected retried request to succeed, got %d %q", w.Code, w.Body.String())
+	}
+	if tunnel.Active() != 0 {
+		t.Errorf("refused stream still registered, %d active", tunnel.Active())
+	}
+}
+
+func Test_full_tunnel_rejects_streams(t *testing.T) {
+	tunnel := _fake_agent(t, 1, func(*protocol.Codec, uint32) {})
+
+	if _, err := tunnel.SendRequest(&protocol.Frame{Type: protocol.TypeHTTPRequest, StreamID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if !tunnel.Full() {
+		t.Error("tunnel with one of one streams should be full")
+	}
+	if _, err := tunnel.SendRequest(&protocol.Frame{Type: protocol.TypeHTTPRequest, StreamID: 2}); !errors.Is(err, ErrTunnelFull) {
+		t.Errorf("expected ErrTunnelFull, got %v", err)
+	}
+
+	pool := NewPool()
+	pool.Add(tunnel)
+	if _, err := pool.Get(DefaultGroup); !errors.Is(err, ErrTunnelFull) {
+		t.Errorf("expected pool to skip full tunnel, got %v", err)
+	}
+}
+
+func Test_streamed_response_idle_timeout(t *testing.T) {
+	tunnel := _fake_agent(t, 0, func(codec *protocol.Codec, streamID uint32) {
+		head, _ := json.Marshal(&TunnelledResponse{StatusCode: http.StatusOK, Headers: http.Header{"Content-Type": {"text/event-stream"}}})
+		codec.WriteFrame(&protocol.Frame{Type: protocol.TypeStreamHead, StreamID: streamID, Payload: head})
+		codec.WriteFrame(&protocol.Frame{Type: protocol.TypeStreamData, StreamID: streamID, Payload: []byte("data: one\n\n")})
+		// then nothing more
+	})
+
+	pool := NewPool()
+	pool.Add(tunnel)
+	router, _ := NewRouter(nil)
+	access, _ := NewAccessPolicy(&AccessConfig{})
+	// the request timeout is shorter than the stream: only idleness counts
+	srv := httptest.NewServer(NewHandler(pool, router, access, &Limits{}, 50*time.Millisecond, 300*time.Millisecond))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	if err != nil || line != "data: one\n" {
+		t.Fatalf("first event: %q, %v", line, err)
+	}
+	start := time.Now()
+	if _, err := io.ReadAll(resp.Body); err == nil {
+		t.Error("idle stream should end with an aborted body")
+	}
+	if waited := time.Since(start); waited < 200*time.Millisecond {
+		t.Errorf("stream aborted after %s, before the idle timeout", waited)
+	}
+}
+
+func Test_slow_stream_does_not_hold_up_others(t *testing.T) {
+	tunnel, codec := _tunnel_pair(t, 0, true)
+	slow, err := tunnel.SendRequest(&protocol.Frame{Type: protocol.TypeStreamOpen, StreamID: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fast, err := tunnel.SendRequest(&protocol.Frame{Type: protocol.TypeStreamOpen, StreamID: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	frames := make(chan *protocol.Frame, 16)
+	go func() {
+		for {
+			f, err := codec.ReadFrame()
+			if err != nil {
+				return
+			}
+			if f.Type == protocol.TypeWindowUpdate || f.Type == protocol.TypeStreamReset {
+				frames <- f
+			}
+		}
+	}()
+
+	// a full window on the slow stream, which nobody reads yet
+	for i := 0; i < protocol.StreamWindow; i++ {
+		codec.WriteFrame(&protocol.Frame{Type: protocol.TypeStreamData, StreamID: 1, Payload: []byte("x")})
+	}
+	codec.WriteFrame(&protocol.Frame{Type: protocol.TypeStreamClose, StreamID: 2})
+	select {
+	case f := <-fast:
+		if f.Type != protocol.TypeStreamClose {
+			t.Fatalf("unexpected frame %d on the fast stream", f.Type)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("a stalled stream held up another")
+	}
+
+	// reading the slow stream returns credit
+	for i := 0; i < protocol.StreamWindow/2; i++ {
+		<-slow
+	}
+	select {
+	case f := <-frames:
+		n, _ := protocol.UnmarshalWindowUpdate(f.Payload)
+		if f.Type != protocol.TypeWindowUpdate || f.StreamID != 1 || n != protocol.StreamWindow/2 {
+			t.Fatalf("expected credit of %d on stream 1, got type %d stream %d credit %d", protocol.StreamWindow/2, f.Type, f.StreamID, n)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no credit returned")
+	}
+
+	// overrunning the window resets the stream instead of blocking
+	for i := 0; i < protocol.StreamBuffer; i++ {
+		codec.WriteFrame(&protocol.Frame{Type: protocol.TypeStreamData, StreamID: 1, Payload: []byte("x")})
+	}
+	select {
+	case f := <-frames:
+		if f.Type != protocol.TypeStreamReset || f.StreamID != 1 {
+			t.Fatalf("expected a reset of stream 1, got type %d stream %d", f.Type, f.StreamID)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("overrun stream was not reset")
+	}
+}
+
+func Test_send_waits_for_agent_credit(t *testing.T) {
+	tunnel, codec := _tunnel_pair(t, 0, true)
+	if _, err := tunnel.SendRequest(&protocol.Frame{Type: protocol.TypeStreamOpen, StreamID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			if _, err := codec.ReadFrame(); err != nil {
+				return
+			}
+		}
+	}()
+	for i := 0; i < protocol.StreamWindow; i++ {
+		if err := tunnel.SendFrame(&protocol.Frame{Type: protocol.TypeStreamData, StreamID: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sent := make(chan error, 1)
+	go func() { sent <- tunnel.SendFrame(&protocol.Frame{Type: protocol.TypeStreamData, StreamID: 1}) }()
+	select {
+	case <-sent:
+		t.Fatal("send past the window should wait for credit")
+	case <-time.After(50 * time.Millisecond):
+	}
+	codec.WriteFrame(&protocol.Frame{Type: protocol.TypeWindowUpdate, StreamID: 1, Payload: protocol.MarshalWindowUpdate(1)})
+	select {
+	case err := <-sent:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("credit did not release the send")
+	}
+}
+
+func Test_datagrams_for_a_stalled_flow_are_dropped(t *testing.T) {
+	// without flow control too, datagrams never hold up the read loop
+	tunnel, codec := _tunnel_pair(t, 0, false)
+	if _, err := tunnel.SendRequest(&protocol.Frame{Type: protocol.TypeStreamOpen, StreamID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	other, err := tunnel.SendRequest(&protocol.Frame{Type: protocol.TypeStreamOpen, StreamID: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dropped atomic.Int32
+	tunnel.OnDatagramDropped(1, func() { dropped.Add(1) })
+
+	for i := 0; i < protocol.StreamBuffer+10; i++ {
+		codec.WriteFrame(&protocol.Frame{Type: protocol.TypeDatagram, StreamID: 1, Payload: []byte("x")})
+	}
+	codec.WriteFrame(&protocol.Frame{Type: protocol.TypeStreamClose, StreamID: 2})
+	select {
+	case <-other:
+	case <-time.After(2 * time.Second):
+		t.Fatal("a stalled udp flow held up another stream")
+	}
+	if dropped.Load() == 0 {
+		t.Error("datagrams beyond the flow's queue should be counted as dropped")
+	}
+}
+
+func Test_drain_marker_reaches_a_backed_up_stream(t *testing.T) {
+	tunnel, codec := _tunnel_pair(t, 0, false)
+	frames, err := tunnel.SendRequest(&protocol.Frame{Type: protocol.TypeStreamOpen, StreamID: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			if _, err := codec.ReadFrame(); err != nil {
+				return
+			}
+		}
+	}()
+
+	// as much as the stream holds, unread, then a drain refusing it
+	sent := protocol.StreamBuffer + 1
+	for i := 0; i < sent; i++ {
+		codec.WriteFrame(&protocol.Frame{Type: protocol.TypeStreamData, StreamID: 1, Payload: []byte("x")})
+	}
+	codec.WriteFrame(&protocol.Frame{Type: protocol.TypeDrain, Payload: protocol.MarshalDrain(&protocol.Drain{Reason: "test"})})
+	for !tunnel.Draining() {
+		time.Sleep(time.Millisecond)
+	}
+
+	for i := 0; i < sent; i++ {
+		if f := <-frames; f == nil || f.Type != protocol.TypeStreamData {
+			t.Fatalf("frame %d: expected stream data, got %v", i, f)
+		}
+	}
+	select {
+	case f, ok := <-frames:
+		if !ok || f.Type != protocol.TypeDrain {
+			t.Fatalf("expected the drain marker after the queued data, got %v", f)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no drain marker")
+	}
+}
+
+func Test_late_response_after_timeout_is_discarded(t *testing.T) {
+	tunnel, codec := _tunnel_pair(t, 1, true)
+	requested := make(chan uint32, 1)
+	var credit atomic.Int64
+	credit.Store(protocol.StreamWindow)
+	go func() {
+		for {
+			frame, err := codec.ReadFrame()
+			if err != nil {
+				return
+			}
+			switch frame.Type {
+			case protocol.TypeStreamClose:
+				requested <- frame.StreamID
+			case protocol.TypeWindowUpdate:
+				n, _ := protocol.UnmarshalWindowUpdate(frame.Payload)
+				credit.Add(int64(n))
+			}
+		}
+	}()
+
+	pool := NewPool()
+	pool.Add(tunnel)
+	router, _ := NewRouter(nil)
+	access, _ := NewAccessPolicy(&AccessConfig{})
+	h := NewHandler(pool, router, access, &Limits{}, 50*time.Millisecond, 0)
+	goroutines := runtime.NumGoroutine()
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "http://app.example.com/", nil))
+	if w.Code != http.StatusGatewayTimeout {
+		t.Fatalf("expected 504, got %d", w.Code)
+	}
+
+	// the agent answers anyway, with more than a window of body
+	streamID := <-requested
+	payload, _ := json.Marshal(&TunnelledResponse{StatusCode: http.StatusOK})
+	codec.WriteFrame(&protocol.Frame{Type: protocol.TypeHTTPResponse, StreamID: streamID, Payload: payload})
+	deadline := time.Now().Add(2 * time.Second)
+	for i := 0; i < 2*protocol.StreamWindow; i++ {
+		for credit.Load() == 0 {
+			if time.Now().After(deadline) {
+				t.Fatalf("no credit returned after %d chunks of the late response", i)
+			}
+			time.Sleep(time.Millisecond)
+		}
+		credit.Add(-1)
+		codec.WriteFrame(&protocol.Frame{Type: protocol.TypeBodyChunk, StreamID: streamID, Payload: []byte("x")})
+	}
+	codec.WriteFrame(&protocol.Frame{Type: protocol.TypeStreamClose, StreamID: streamID})
+
+	for tunnel.Active() != 0 || runtime.NumGoroutine() > goroutines {
+		if time.Now().After(deadline) {
+			t.Fatalf("stream not released: %d active, %d goroutines, %d before", tunnel.Active(), runtime.NumGoroutine(), goroutines)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if tunnel.Full() {
+		t.Error("the timed out stream still holds the tunnel's only slot")
+	}
+}
@@ -0,0 +1,270 @@
+package relay
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/reverseproxy/internal/protocol"
+)
+
+// used when a udp forward sets no idle timeout.
+const _default_udp_idle_timeout = 60 * time.Second
+
+// datagrams queued per flow before more are dropped.
+const _udp_queue_size = 256
+
+// reasons a datagram is dropped, as metric labels.
+const (
+	_udp_drop_denied   = "denied"
+	_udp_drop_limited  = "stream_limit"
+	_udp_drop_no_agent = "no_agent"
+	_udp_drop_queue    = "queue_full"
+	_udp_drop_replies  = "reply_queue_full"
+	_udp_drop_tunnel   = "tunnel_error"
+	_udp_drop_client   = "client_error"
+	_udp_drop_closed   = "flow_closed"
+)
+
+// _udp_forward serves one udp listener. each client address gets a flow
+// of its own through an agent.
+type _udp_forward struct {
+	cfg     UDPForwardConfig
+	conn    net.PacketConn
+	handler *Handler
+	stop    chan struct{}
+
+	mu    sync.Mutex
+	flows map[string]*_udp_flow
+
+	received atomic.Uint64
+	sent     atomic.Uint64
+	dropped  sync.Map // reason -> *atomic.Uint64
+}
+
+// _udp_flow is one client's datagrams to and from an agent stream.
+type _udp_flow struct {
+	client   net.Addr
+	tunnel   *Tunnel
+	streamID uint32
+	ch       chan *protocol.Frame
+	out      chan []byte
+	// the group stream slot the flow holds
+	streams *_group_streams
+}
+
+// _start_udp binds the udp forwards and starts serving them.
+func (s *Server) _start_udp(forwards []UDPForwardConfig) error {
+	var started []*_udp_forward
+	for _, f := range forwards {
+		conn, err := net.ListenPacket("udp", f.Listen)
+		if err != nil {
+			for _, u := range started {
+				u.conn.Close()
+			}
+			return err
+		}
+		started = append(started, &_udp_forward{
+			cfg:     f,
+			conn:    conn,
+			handler: s.handler,
+			stop:    make(chan struct{}),
+			flows:   make(map[string]*_udp_flow),
+		})
+	}
+	s.tcpMu.Lock()
+	s.udp = started
+	s.tcpMu.Unlock()
+	for _, u := range started {
+		go u._serve()
+	}
+	return nil
+}
+
+// _stop_udp closes the udp listeners and ends their flows.
+func (s *Server) _stop_udp() {
+	s.tcpMu.Lock()
+	defer s.tcpMu.Unlock()
+	for _, u := range s.udp {
+		close(u.stop)
+		u.conn.Close()
+	}
+	s.udp = nil
+}
+
+// _serve reads client datagrams until the listener closes and queues each
+// on its client's flow.
+func (u *_udp_forward) _serve() {
+	slog.Info("udp forward listening", "addr", u.conn.LocalAddr(), "group", _group_name(u.cfg.Group), "target", u.cfg.Target)
+	buf := make([]byte, protocol.MaxPayloadSize)
+	for {
+		n, client, err := u.conn.ReadFrom(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				slog.Error("udp forward stopped", "addr", u.conn.LocalAddr(), "err", err)
+			}
+			return
+		}
+		u.received.Add(1)
+		flow, reason := u._flow(client)
+		if flow == nil {
+			u._drop(reason)
+			continue
+		}
+		select {
+		case flow.out <- append([]byte(nil), buf[:n]...):
+		default:
+			u._drop(_udp_drop_queue)
+		}
+	}
+}
+
+// _flow returns the client's flow, opening one through an agent if there
+// is none. on failure it returns the reason to drop the datagram.
+func (u *_udp_forward) _flow(client net.Addr) (*_udp_flow, string) {
+	key := client.String()
+	u.mu.Lock()
+	flow := u.flows[key]
+	u.mu.Unlock()
+	if flow != nil {
+		return flow, ""
+	}
+
+	access := u.handler.Access()
+	addr, _ := _remote_addr(key)
+	if !access.Global().Allows(addr) || !access.Group(u.cfg.Group).Allows(addr) {
+		return nil, _udp_drop_denied
+	}
+	streams := u.handler._group_streams(u.cfg.Group)
+	if !streams._acquire(u.handler.limits.Load().maxStreams[_group_name(u.cfg.Group)]) {
+		return nil, _udp_drop_limited
+	}
+	open := &StreamOpen{Kind: StreamKindUDP, Target: u.cfg.Target}
+	for attempt := 0; attempt < _max_attempts; attempt++ {
+		tunnel, err := u.handler.pool.Get(u.cfg.Group)
+		if err != nil {
+			streams._release()
+			return nil, _udp_drop_no_agent
+		}
+		streamID, ch, err := _open_stream(tunnel, open)
+		if errors.Is(err, ErrTunnelDraining) || errors.Is(err, ErrTunnelFull) {
+			continue
+		}
+		if err != nil {
+			streams._release()
+			return nil, _udp_drop_tunnel
+		}
+		flow = &_udp_flow{client: client, tunnel: tunnel, streamID: streamID, ch: ch, out: make(chan []byte, _udp_queue_size), streams: streams}
+		tunnel.OnDatagramDropped(streamID, func() { u._drop(_udp_drop_replies) })
+		u.mu.Lock()
+		u.flows[key] = flow
+		u.mu.Unlock()
+		slog.Debug("udp flow opened", "client", key, "tunnel", tunnel.ID(), "stream", streamID)
+		go u._run(flow)
+		return flow, ""
+	}
+	streams._release()
+	return nil, _udp_drop_no_agent
+}
+
+// _run passes datagrams between the client and the agent until either
+// side closes the flow, it idles out or the listener stops.
+func (u *_udp_forward) _run(flow *_udp_flow) {
+	defer func() {
+		u.mu.Lock()
+		delete(u.flows, flow.client.String())
+		u.mu.Unlock()
+		flow.streams._release()
+		// datagrams still queued are lost with the flow
+		for range len(flow.out) {
+			<-flow.out
+			u._drop(_udp_drop_closed)
+		}
+	}()
+	idle := time.NewTimer(u.cfg.IdleTimeout)
+	defer idle.Stop()
+	closeFlow := func() {
+		// the agent answers with a close, which ends the channel
+		flow.tunnel.SendFrame(&protocol.Frame{Type: protocol.TypeStreamClose, StreamID: flow.streamID})
+		_abandon(flow.ch)
+	}
+
+	for {
+		select {
+		case payload := <-flow.out:
+			err := flow.tunnel.SendFrame(&protocol.Frame{Type: protocol.TypeDatagram, StreamID: flow.streamID, Payload: payload})
+			if err != nil {
+				u._drop(_udp_drop_tunnel)
+				_abandon(flow.ch)
+				return
+			}
+			idle.Reset(u.cfg.IdleTimeout)
+		case frame, ok := <-flow.ch:
+			if !ok {
+				return
+			}
+			switch frame.Type {
+			case protocol.TypeDatagram:
+				if _, err := u.conn.WriteTo(frame.Payload, flow.client); err != nil {
+					u._drop(_udp_drop_client)
+					continue
+				}
+				u.sent.Add(1)
+				idle.Reset(u.cfg.IdleTimeout)
+			case protocol.TypeStreamClose:
+				flow.tunnel.SendFrame(&protocol.Frame{Type: protocol.TypeStreamClose, StreamID: flow.streamID})
+				_abandon(flow.ch)
+				return
+			default:
+				// refused, reset or drained: the next datagram opens a new flow
+				_abandon(flow.ch)
+				return
+			}
+		case <-idle.C:
+			slog.Debug("udp flow idle, closing", "client", flow.client, "stream", flow.streamID)
+			closeFlow()
+			return
+		case <-u.stop:
+			closeFlow()
+			return
+		}
+	}
+}
+
+// _drop counts a dropped datagram.
+func (u *_udp_forward) _drop(reason string) {
+	counter, _ := u.dropped.LoadOrStore(reason, &atomic.Uint64{})
+	counter.(*atomic.Uint64).Add(1)
+}
+
+// _udp_metrics reports datagram and flow counts per udp forward.
+func (s *Server) _udp_metrics() []*_metric_family {
+	datagrams := &_metric_family{name: "relay_udp_datagrams_total", kind: "counter", help: "Datagrams received from or sent to udp clients."}
+	dropped := &_metric_family{name: "relay_udp_dropped_total", kind: "counter", help: "Datagrams dropped by a udp forward."}
+	flows := &_metric_family{name: "relay_udp_flows", kind: "gauge", help: "Open udp flows."}
+	s.tcpMu.Lock()
+	forwards := append([]*_udp_forward(nil), s.udp...)
+	s.tcpMu.Unlock()
+	for _, u := range forwards {
+		listen := u.cfg.Listen
+		datagrams.samples = append(datagrams.samples,
+			_sample{[][2]string{{"listen", listen}, {"direction", "in"}}, float64(u.received.Load())},
+			_sample{[][2]string{{"listen", listen}, {"direction", "out"}}, float64(u.sent.Load())})
+		reasons := make(map[string]uint64)
+		u.dropped.Range(func(reason, counter any) bool {
+			reasons[reason.(string)] = counter.(*atomic.Uint64).Load()
+			return true
+		})
+		for _, reason := range _sorted_keys(reasons) {
+			dropped.samples = append(dropped.samples, _sample{[][2]string{{"listen", listen}, {"reason", reason}}, float64(reasons[reason])})
+		}
+		u.mu.Lock()
+		open := len(u.flows)
+		u.mu.Unlock()
+		flows.samples = append(flows.samples, _sample{[][2]string{{"listen", listen}}, float64(open)})
+	}
+	return []*_metric_family{datagrams, dropped, flows}
+}
@@ -0,0 +1,121 @@
+package relay
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/reverseproxy/internal/protocol"
+)
+
+func Test_udp_datagrams_without_agent_are_dropped(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	router, _ := NewRouter(nil)
+	access, _ := NewAccessPolicy(&AccessConfig{})
+	u := &_udp_forward{
+		cfg:     UDPForwardConfig{Target: "127.0.0.1:53", IdleTimeout: time.Second},
+		conn:    conn,
+		handler: NewHandler(NewPool(), router, access, &Limits{}, time.Second, 0),
+		stop:    make(chan struct{}),
+		flows:   make(map[string]*_udp_flow),
+	}
+	go u._serve()
+	defer conn.Close()
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	for i := 0; i < 3; i++ {
+		client.Write([]byte("query"))
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if counter, ok := u.dropped.Load(_udp_drop_no_agent); ok && counter.(*atomic.Uint64).Load() == 3 {
+			if u.received.Load() != 3 {
+				t.Errorf("expected 3 datagrams received, got %d", u.received.Load())
+			}
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("datagrams without an agent should be counted as dropped")
+}
+
+func Test_udp_flows_count_against_the_group_stream_cap(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	tunnel, codec := _tunnel_pair(t, 0, false)
+	opened := make(chan uint32, 4)
+	go func() {
+		for {
+			frame, err := codec.ReadFrame()
+			if err != nil {
+				return
+			}
+			if frame.Type == protocol.TypeStreamOpen {
+				opened <- frame.StreamID
+			}
+		}
+	}()
+	pool := NewPool()
+	pool.Add(tunnel)
+	router, _ := NewRouter(nil)
+	access, _ := NewAccessPolicy(&AccessConfig{})
+	limits := &Limits{maxStreams: map[string]int{DefaultGroup: 1}}
+	u := &_udp_forward{
+		cfg:     UDPForwardConfig{Target: "127.0.0.1:53", IdleTimeout: time.Minute},
+		conn:    conn,
+		handler: NewHandler(pool, router, access, limits, time.Second, 0),
+		stop:    make(chan struct{}),
+		flows:   make(map[string]*_udp_flow),
+	}
+	go u._serve()
+	streams := u.handler._group_streams(DefaultGroup)
+
+	first, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	first.Write([]byte("query"))
+	streamID := <-opened
+
+	second, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	second.Write([]byte("query"))
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if counter, ok := u.dropped.Load(_udp_drop_limited); ok && counter.(*atomic.Uint64).Load() == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("a second flow over the group's cap should be dropped")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := streams.active.Load(); n != 1 {
+		t.Fatalf("expected one stream slot held, got %d", n)
+	}
+
+	// the agent ending the flow frees its slot
+	codec.WriteFrame(&protocol.Frame{Type: protocol.TypeStreamClose, StreamID: streamID})
+	for streams.active.Load() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("closed udp flow still holds its stream slot")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
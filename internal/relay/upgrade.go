@@ -0,0 +1,216 @@
+package relay
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/reverseproxy/internal/protocol"
+	"golang.org/x/net/http/httpguts"
+)
+
+// stream kinds carried in a StreamOpen.
+const (
+	// StreamKindUpgrade is an http request that may switch protocols,
+	// such as a websocket handshake.
+	StreamKindUpgrade = "upgrade"
+	// StreamKindDuplex is an http request whose body follows as stream
+	// data while the response streams back, as grpc needs.
+	StreamKindDuplex = "duplex"
+	// StreamKindTCP is a raw byte stream to a host:port the agent dials.
+	StreamKindTCP = "tcp"
+	// StreamKindUDP is a flow of datagrams to a host:port the agent dials.
+	StreamKindUDP = "udp"
+	// StreamKindRemote is a raw byte stream for an endpoint the agent
+	// asked for; the target is the agent's request, e.g. "tcp:0".
+	StreamKindRemote = "remote"
+	// StreamKindTLS is a raw byte stream carrying a tls connection the
+	// relay did not decrypt; the target is the client's server name.
+	StreamKindTLS = "tls"
+)
+
+// StreamOpen is the payload of a TypeStreamOpen frame.
+type StreamOpen struct {
+	Kind    string            `json:"kind"`
+	Request *TunnelledRequest `json:"request,omitempty"`
+	Target  string            `json:"target,omitempty"`
+}
+
+// _is_upgrade reports whether a request asks to switch protocols.
+func _is_upgrade(r *http.Request) bool {
+	return r.Header.Get("Upgrade") != "" && httpguts.HeaderValuesContainsToken(r.Header["Connection"], "upgrade")
+}
+
+// _open_stream offers a bidirectional stream to the tunnel and returns
+// the stream id and the channel its frames arrive on.
+func _open_stream(tunnel *Tunnel, open *StreamOpen) (uint32, chan *protocol.Frame, error) {
+	payload, err := json.Marshal(open)
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(payload) > protocol.MaxPayloadSize {
+		return 0, nil, fmt.Errorf("%s stream open of %d bytes exceeds frame size", open.Kind, len(payload))
+	}
+	streamID := protocol.NextStreamID()
+	ch, err := tunnel.SendRequest(&protocol.Frame{Type: protocol.TypeStreamOpen, StreamID: streamID, Payload: payload})
+	return streamID, ch, err
+}
+
+// _serve_upgrade waits for the backend's answer to an upgrade request. on
+// 101 the client connection is hijacked and spliced to the stream until
+// either side closes; other answers are written as a streamed response.
+// it returns true without writing anything if the agent refused the stream.
+func _serve_upgrade(w http.ResponseWriter, r *http.Request, tunnel *Tunnel, streamID uint32, ch chan *protocol.Frame, timeout, idleTimeout time.Duration) (refused bool) {
+	reset := _stream_reset(tunnel, streamID)
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	var head TunnelledResponse
+	select {
+	case frame, ok := <-ch:
+		if !ok {
+			http.Error(w, "tunnel closed", http.StatusBadGateway)
+			return false
+		}
+		switch frame.Type {
+		case protocol.TypeDrain, protocol.TypeRefuseStream:
+			return true
+		case protocol.TypeStreamHead:
+			if err := json.Unmarshal(frame.Payload, &head); err != nil {
+				slog.Error("invalid upgrade response from agent", "err", err)
+				reset()
+				_abandon(ch)
+				http.Error(w, "invalid response from backend", http.StatusBadGateway)
+				return false
+			}
+		case protocol.TypeStreamReset:
+			http.Error(w, "backend error", http.StatusBadGateway)
+			return false
+		default:
+			reset()
+			_abandon(ch)
+			http.Error(w, "invalid response from backend", http.StatusBadGateway)
+			return false
+		}
+	case <-timer.C:
+		slog.Warn("upgrade timed out waiting for backend")
+		reset()
+		_abandon(ch)
+		http.Error(w, "request timed out", http.StatusGatewayTimeout)
+		return false
+	}
+
+	if head.StatusCode != http.StatusSwitchingProtocols {
+		_write_streamed_response(w, r, &head, ch, idleTimeout, reset)
+		return false
+	}
+
+	conn, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		slog.Error("cannot take over client connection for upgrade", "err", err)
+		reset()
+		_abandon(ch)
+		http.Error(w, "upgrade not supported", http.StatusInternalServerError)
+		return false
+	}
+	// the server's timeouts would cut the upgraded connection short
+	conn.SetDeadline(time.Time{})
+	fmt.Fprintf(brw, "HTTP/1.1 101 %s\r\n", http.StatusText(http.StatusSwitchingProtocols))
+	for k, vs := range head.Headers {
+		for _, v := range vs {
+			fmt.Fprintf(brw, "%s: %s\r\n", k, v)
+		}
+	}
+	brw.WriteString("\r\n")
+	if err := brw.Flush(); err != nil {
+		conn.Close()
+		reset()
+		_abandon(ch)
+		return false
+	}
+
+	slog.Debug("upgraded connection spliced to tunnel", "tunnel", tunnel.ID(), "stream", streamID)
+	if err := protocol.Splice(conn, brw.Reader, streamID, ch, tunnel.SendFrame); err != nil {
+		slog.Debug("upgraded connection ended", "stream", streamID, "err", err)
+	}
+	return false
+}
+
+// _write_streamed_response writes a response whose body follows the head
+// as stream data frames, flushing each one to the client as it arrives,
+// then any trailers.
+// idle bounds the wait for each frame, 0 waits for as long as the stream
+// lasts. a body cut short by either side aborts the client connection so
+// the client cannot mistake it for a complete one.
+func _write_streamed_response(w http.ResponseWriter, r *http.Request, head *TunnelledResponse, ch chan *protocol.Frame, idle time.Duration, reset func()) {
+	_copy_header(w.Header(), head.Headers, "")
+	w.WriteHeader(head.StatusCode)
+	w.Write(head.Body)
+	rc := http.NewResponseController(w)
+	rc.Flush()
+
+	var idleC <-chan time.Time
+	var timer *time.Timer
+	if idle > 0 {
+		timer = time.NewTimer(idle)
+		defer timer.Stop()
+		idleC = timer.C
+	}
+	abort := func(msg string) {
+		slog.Warn(msg, "status", head.StatusCode)
+		reset()
+		_abandon(ch)
+		panic(http.ErrAbortHandler)
+	}
+
+	for {
+		select {
+		case frame, ok := <-ch:
+			if !ok {
+				slog.Warn("tunnel closed during streamed response")
+				panic(http.ErrAbortHandler)
+			}
+			switch frame.Type {
+			case protocol.TypeStreamData:
+				if _, err := w.Write(frame.Payload); err != nil {
+					abort("client went away during streamed response")
+				}
+				if err := rc.Flush(); err != nil {
+					abort("client went away during streamed response")
+				}
+			case protocol.TypeStreamTrailers:
+				var trailers http.Header
+				if err := json.Unmarshal(frame.Payload, &trailers); err != nil {
+					abort("invalid trailers from agent")
+				}
+				_copy_header(w.Header(), trailers, http.TrailerPrefix)
+			case protocol.TypeStreamClose:
+				return
+			case protocol.TypeStreamReset:
+				slog.Warn("backend aborted streamed response")
+				panic(http.ErrAbortHandler)
+			}
+			if timer != nil {
+				if !timer.Stop() {
+					<-timer.C
+				}
+				timer.Reset(idle)
+			}
+		case <-idleC:
+			abort("streamed response idle for too long")
+		case <-r.Context().Done():
+			abort("client went away during streamed response")
+		}
+	}
+}
+
+// _abandon discards a stream's remaining frames so the tunnel read loop
+// never blocks on them. the channel closes when the agent ends the stream.
+func _abandon(ch chan *protocol.Frame) {
+	go func() {
+		for range ch {
+		}
+	}()
+}